@@ -6,10 +6,14 @@ package benchmark
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"testing"
 
+	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 	"golang.org/x/sync/errgroup"
 )
@@ -56,3 +60,58 @@ func BenchmarkGoFuseRead(b *testing.B) {
 
 	b.StopTimer()
 }
+
+func benchmarkLoopbackRead(b *testing.B, passthrough bool) {
+	orig := testutil.TempDir()
+	defer os.RemoveAll(orig)
+
+	blockSize := 64 * 1024
+	content := make([]byte, 16*blockSize)
+	if err := ioutil.WriteFile(filepath.Join(orig, "file"), content, 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	root, err := fs.NewLoopbackRoot(orig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	mnt := testutil.TempDir()
+	defer os.RemoveAll(mnt)
+
+	opts := &fs.Options{}
+	opts.Debug = testutil.VerboseTest()
+	opts.EnablePassthrough = passthrough
+	server, err := fs.Mount(mnt, root, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.Unmount()
+
+	f, err := os.Open(filepath.Join(mnt, "file"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, blockSize)
+	b.SetBytes(int64(blockSize))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(i%16) * int64(blockSize)
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkLoopbackRead(b *testing.B) {
+	benchmarkLoopbackRead(b, false)
+}
+
+// BenchmarkLoopbackReadPassthrough needs Linux 6.9 or newer and
+// CAP_SYS_ADMIN; otherwise it measures the same as
+// BenchmarkLoopbackRead.
+func BenchmarkLoopbackReadPassthrough(b *testing.B) {
+	benchmarkLoopbackRead(b, true)
+}
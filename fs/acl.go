@@ -0,0 +1,121 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// Names of the extended attributes holding POSIX ACLs. The kernel
+// only passes them on if MountOptions.EnableAcl is set.
+const (
+	ACLAccessXAttr  = "system.posix_acl_access"
+	ACLDefaultXAttr = "system.posix_acl_default"
+)
+
+// Tags of ACL entries.
+const (
+	ACL_USER_OBJ  = 0x01
+	ACL_USER      = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP     = 0x08
+	ACL_MASK      = 0x10
+	ACL_OTHER     = 0x20
+)
+
+// ACL_UNDEFINED_ID is the ID of entries that have no qualifier, ie.
+// all but ACL_USER and ACL_GROUP.
+const ACL_UNDEFINED_ID = ^uint32(0)
+
+const (
+	aclXAttrVersion   = 2
+	aclXAttrHeaderLen = 4
+	aclXAttrEntryLen  = 8
+)
+
+// ACLEntry is an entry of a POSIX ACL.
+type ACLEntry struct {
+	// Tag is one of the ACL_* tags.
+	Tag uint16
+
+	// Perm holds the permissions, a combination of 4 (read), 2
+	// (write) and 1 (execute).
+	Perm uint16
+
+	// ID is the UID for ACL_USER, the GID for ACL_GROUP, and
+	// ACL_UNDEFINED_ID otherwise.
+	ID uint32
+}
+
+// ACL is a POSIX access control list, as stored in the
+// system.posix_acl_access and system.posix_acl_default extended
+// attributes.
+type ACL []ACLEntry
+
+// ParseACL decodes the value of an ACL extended attribute, as passed
+// to Setxattr. It returns EINVAL if data is not a valid encoding.
+// The entries are not checked for consistency; the kernel does that
+// before calling Setxattr.
+func ParseACL(data []byte) (ACL, syscall.Errno) {
+	if len(data) < aclXAttrHeaderLen ||
+		(len(data)-aclXAttrHeaderLen)%aclXAttrEntryLen != 0 ||
+		binary.LittleEndian.Uint32(data) != aclXAttrVersion {
+		return nil, syscall.EINVAL
+	}
+	data = data[aclXAttrHeaderLen:]
+	acl := make(ACL, 0, len(data)/aclXAttrEntryLen)
+	for ; len(data) > 0; data = data[aclXAttrEntryLen:] {
+		acl = append(acl, ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(data),
+			Perm: binary.LittleEndian.Uint16(data[2:]),
+			ID:   binary.LittleEndian.Uint32(data[4:]),
+		})
+	}
+	return acl, OK
+}
+
+// Bytes encodes the ACL as the value of an ACL extended attribute,
+// for returning from Getxattr.
+func (a ACL) Bytes() []byte {
+	data := make([]byte, aclXAttrHeaderLen+len(a)*aclXAttrEntryLen)
+	binary.LittleEndian.PutUint32(data, aclXAttrVersion)
+	p := data[aclXAttrHeaderLen:]
+	for _, e := range a {
+		binary.LittleEndian.PutUint16(p, e.Tag)
+		binary.LittleEndian.PutUint16(p[2:], e.Perm)
+		binary.LittleEndian.PutUint32(p[4:], e.ID)
+		p = p[aclXAttrEntryLen:]
+	}
+	return data
+}
+
+// Mode returns the permission bits that correspond to the ACL: the
+// owner bits come from ACL_USER_OBJ, the group bits from ACL_MASK if
+// present and ACL_GROUP_OBJ otherwise, and the other bits from
+// ACL_OTHER. The kernel keeps the file mode in sync this way when an
+// access ACL is set.
+func (a ACL) Mode() uint32 {
+	var user, group, mask, other uint32
+	hasMask := false
+	for _, e := range a {
+		p := uint32(e.Perm & 07)
+		switch e.Tag {
+		case ACL_USER_OBJ:
+			user = p
+		case ACL_GROUP_OBJ:
+			group = p
+		case ACL_MASK:
+			mask = p
+			hasMask = true
+		case ACL_OTHER:
+			other = p
+		}
+	}
+	if hasMask {
+		group = mask
+	}
+	return user<<6 | group<<3 | other
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// testACL is what "setfacl -m u:1000:rw,m::rw file" produces on a
+// file with mode 0640.
+var testACL = ACL{
+	{Tag: ACL_USER_OBJ, Perm: 6, ID: ACL_UNDEFINED_ID},
+	{Tag: ACL_USER, Perm: 6, ID: 1000},
+	{Tag: ACL_GROUP_OBJ, Perm: 4, ID: ACL_UNDEFINED_ID},
+	{Tag: ACL_MASK, Perm: 6, ID: ACL_UNDEFINED_ID},
+	{Tag: ACL_OTHER, Perm: 0, ID: ACL_UNDEFINED_ID},
+}
+
+var testACLBytes = []byte{
+	2, 0, 0, 0,
+	0x01, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+	0x02, 0, 6, 0, 0xe8, 0x03, 0, 0,
+	0x04, 0, 4, 0, 0xff, 0xff, 0xff, 0xff,
+	0x10, 0, 6, 0, 0xff, 0xff, 0xff, 0xff,
+	0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+}
+
+func TestACLEncoding(t *testing.T) {
+	if got := testACL.Bytes(); !bytes.Equal(got, testACLBytes) {
+		t.Errorf("Bytes: got %x, want %x", got, testACLBytes)
+	}
+	got, errno := ParseACL(testACLBytes)
+	if errno != OK {
+		t.Fatalf("ParseACL: %v", errno)
+	}
+	if !reflect.DeepEqual(got, testACL) {
+		t.Errorf("ParseACL: got %v, want %v", got, testACL)
+	}
+	if got, want := testACL.Mode(), uint32(0660); got != want {
+		t.Errorf("Mode: got %o, want %o", got, want)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		{1, 0, 0, 0},
+		testACLBytes[:len(testACLBytes)-1],
+	} {
+		if _, errno := ParseACL(bad); errno != syscall.EINVAL {
+			t.Errorf("ParseACL(%x): got %v, want EINVAL", bad, errno)
+		}
+	}
+}
+
+func TestACLXAttr(t *testing.T) {
+	root := &Inode{}
+	node := &xattrNode{attrs: map[string][]byte{}}
+	node.Attr.Mode = 0640
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	}
+	opts.EnableAcl = true
+	mntDir, srv, clean := testMount(t, root, opts)
+	defer clean()
+	if srv.KernelSettings().Flags&fuse.CAP_POSIX_ACL == 0 {
+		t.Skip("kernel does not support POSIX ACLs")
+	}
+	fn := mntDir + "/file"
+
+	if err := syscall.Setxattr(fn, ACLAccessXAttr, testACL.Bytes(), 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+
+	node.mu.Lock()
+	stored := node.attrs[ACLAccessXAttr]
+	node.mu.Unlock()
+	if got, errno := ParseACL(stored); errno != OK || !reflect.DeepEqual(got, testACL) {
+		t.Errorf("stored ACL: got %v, %v, want %v", got, errno, testACL)
+	}
+
+	buf := make([]byte, 1024)
+	sz, err := syscall.Getxattr(fn, ACLAccessXAttr, buf)
+	if err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	}
+	if got, errno := ParseACL(buf[:sz]); errno != OK || !reflect.DeepEqual(got, testACL) {
+		t.Errorf("Getxattr: got %v, %v, want %v", got, errno, testACL)
+	}
+}
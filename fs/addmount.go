@@ -0,0 +1,176 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// AddMount mounts subRoot, a directory of a tree that is served by
+// Mount, on dir as well, eg. to make part of the tree visible
+// under a second name. Both mounts serve the same nodes, so state
+// in the nodes and their file handles is shared rather than
+// duplicated. If opts is nil, the MountOptions of the tree are used.
+//
+// The kernel needs a connection, and so a fuse.Server, per mount;
+// the returned server serves dir only. Unmounting it leaves the
+// other mounts alone, and unmounting the tree's own mount leaves dir
+// mounted. Nodes that the kernel held for dir when it went away are
+// not forgotten, and stay in memory until their parents are
+// forgotten by the other mounts, or the tree goes away.
+//
+// Each mount is a separate file system to the kernel, with its own
+// device number, so a node has the same inode number in all mounts,
+// but stat(2) reports a different st_dev, and tools such as tar and
+// du do not take the files for the same one. Hard links and renames
+// between the mounts fail with EXDEV. The kernel caches entries,
+// attributes and content per mount, so a change made through one
+// mount is only seen through the others once their caches time out
+// or are invalidated. The notifications of Inode, except
+// NotifyRetrieveCache, are sent to all mounts.
+func AddMount(dir string, subRoot *Inode, opts *fuse.MountOptions) (*fuse.Server, error) {
+	b := subRoot.bridge
+	if b == nil || b.server == nil {
+		return nil, errors.New("fs: AddMount: node is not in a mounted tree")
+	}
+	if !subRoot.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+
+	var mountOpts fuse.MountOptions
+	if opts != nil {
+		mountOpts = *opts
+	} else {
+		mountOpts = b.options.MountOptions
+		if b.options.ReadOnly {
+			mountOpts.Options = append(append([]string{}, mountOpts.Options...), "ro")
+		}
+	}
+	mountOpts.RootNodeId = subRoot.nodeId
+
+	// The mount holds a reference to its root, like the kernel
+	// holds one to the root of the tree.
+	b.addMountRoot(subRoot)
+	server, err := fuse.NewServer(&subMountFS{b}, dir, &mountOpts)
+	if err != nil {
+		b.Forget(subRoot.nodeId, 1)
+		return nil, err
+	}
+	b.mu.Lock()
+	b.mounts = append(b.mounts, server)
+	b.mu.Unlock()
+	go func() {
+		server.Serve()
+		server.WaitForReleases()
+		if b.stopMount(server) {
+			b.releaseOpenFiles()
+		}
+		b.Forget(subRoot.nodeId, 1)
+	}()
+	if err := server.WaitMount(); err != nil {
+		// The serve loop exits, and drops the reference.
+		return nil, err
+	}
+	return server, nil
+}
+
+// subMountFS serves a mount added with AddMount.
+type subMountFS struct {
+	*rawBridge
+}
+
+// Init keeps the server of the tree's mount in the bridge: it
+// negotiated the settings that the bridge checks.
+func (fs *subMountFS) Init(*fuse.Server) {}
+
+// addMountRoot registers n with the kernel as the root of a mount.
+func (b *rawBridge) addMountRoot(n *Inode) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n.lookupCount++
+	n.changeCounter++
+	b.kernelNodeIds[n.nodeId] = n
+	if b.stableAttrs[n.stableAttr] == nil {
+		b.stableAttrs[n.stableAttr] = n
+	}
+}
+
+// stopMount records that the serve loop of a mount exited; server
+// is nil for the tree's own mount. It returns whether no mounts are
+// left, so the file handles that the kernels did not release can be
+// released.
+func (b *rawBridge) stopMount(server *fuse.Server) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if server == nil {
+		b.unmounted = true
+	}
+	for i, s := range b.mounts {
+		if s == server {
+			b.mounts = append(b.mounts[:i:i], b.mounts[i+1:]...)
+			break
+		}
+	}
+	return b.unmounted && len(b.mounts) == 0
+}
+
+// mountsCallbacks sends notifications to all mounts of a tree. The
+// result is that of the tree's own mount: the kernels of the other
+// mounts may not know the node, so their errors are ignored.
+type mountsCallbacks struct {
+	primary ServerCallbacks
+	others  []*fuse.Server
+}
+
+func (m *mountsCallbacks) DeleteNotify(parent uint64, child uint64, name string) fuse.Status {
+	for _, s := range m.others {
+		s.DeleteNotify(parent, child, name)
+	}
+	return m.primary.DeleteNotify(parent, child, name)
+}
+
+func (m *mountsCallbacks) EntryNotify(parent uint64, name string) fuse.Status {
+	for _, s := range m.others {
+		s.EntryNotify(parent, name)
+	}
+	return m.primary.EntryNotify(parent, name)
+}
+
+func (m *mountsCallbacks) InodeNotify(node uint64, off int64, length int64) fuse.Status {
+	for _, s := range m.others {
+		s.InodeNotify(node, off, length)
+	}
+	return m.primary.InodeNotify(node, off, length)
+}
+
+func (m *mountsCallbacks) InodeRetrieveCache(node uint64, offset int64, dest []byte) (int, fuse.Status) {
+	return m.primary.InodeRetrieveCache(node, offset, dest)
+}
+
+func (m *mountsCallbacks) InodeNotifyStoreCache(node uint64, offset int64, data []byte) fuse.Status {
+	for _, s := range m.others {
+		s.InodeNotifyStoreCache(node, offset, data)
+	}
+	return m.primary.InodeNotifyStoreCache(node, offset, data)
+}
+
+// NotifyPoll wakes up polls in all mounts. Poll handles are per
+// kernel connection, so this may cause spurious wakeups, after which
+// the kernel polls again.
+func (m *mountsCallbacks) NotifyPoll(kh uint64) fuse.Status {
+	for _, s := range m.others {
+		s.NotifyPoll(kh)
+	}
+	ps, ok := m.primary.(interface{ NotifyPoll(kh uint64) fuse.Status })
+	if !ok {
+		return fuse.ENOSYS
+	}
+	return ps.NotifyPoll(kh)
+}
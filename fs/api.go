@@ -93,7 +93,8 @@
 // The kernel caches several pieces of information from the FUSE process:
 //
 // 1. File contents: enabled with the fuse.FOPEN_KEEP_CACHE return flag
-// in Open, manipulated with ReadCache and WriteCache, and invalidated
+// in Open, manipulated with Inode.NotifyStoreCache and
+// Inode.NotifyRetrieveCache, and invalidated
 // with Inode.NotifyContent
 //
 // 2. File Attributes (size, mtime, etc.): controlled with the
@@ -129,6 +130,15 @@
 // Getlk, Setlk and Setlkw methods. They alllow locks on regions of
 // regular files.
 //
+// Interrupts
+//
+// When a process is killed while it waits for a FUSE operation, the
+// kernel sends an INTERRUPT for that request. The context.Context
+// passed to the corresponding Node or File method is then canceled.
+// Operations that may block for a long time, eg. for network
+// fetches, should select on ctx.Done() and return EINTR promptly;
+// operations that ignore the context simply run to completion.
+//
 // Parallelism
 //
 // The VFS layer in the kernel is optimized to be highly parallel, and
@@ -169,6 +179,7 @@ package fs
 import (
 	"context"
 	"log"
+	"os"
 	"syscall"
 	"time"
 
@@ -195,13 +206,29 @@ type InodeEmbedder interface {
 }
 
 // Statfs implements statistics for the filesystem that holds this
-// Inode. If not defined, the `out` argument will zeroed with an OK
-// result.  This is because OSX filesystems must Statfs, or the mount
-// will not work.
+// Inode. If not defined, the nearest ancestor implementing Statfs is
+// used. If there is none, `out` is filled with synthetic numbers
+// (4k blocks, 1 TiB free) with an OK result. This is because OSX
+// filesystems must Statfs, or the mount will not work. Loopback
+// style filesystems can use StatfsFromBacking.
 type NodeStatfser interface {
 	Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno
 }
 
+// Syncfs is called for syncfs(2), and should flush all dirty data of
+// the file system, eg. pending writes to a backend. It is called on
+// the root of the mount; like Statfs, the nearest ancestor
+// implementing it is used. If there is none, syncfs succeeds
+// without doing anything.
+//
+// Linux sends SYNCFS (protocol 7.34) only for some connections, eg.
+// virtiofs; for regular FUSE mounts, syncfs(2) writes back the
+// kernel's dirty pages, but does not reach the file system. Data
+// that must be durable can be flushed in Fsync as well.
+type NodeSyncfser interface {
+	Syncfs(ctx context.Context) syscall.Errno
+}
+
 // Access should return if the caller can access the file with the
 // given mode.  This is used for two purposes: to determine if a user
 // may enter a directory, and to answer to implement the access system
@@ -224,11 +251,43 @@ type NodeAccesser interface {
 // returning zeroed permissions, the default behavior is to change the
 // mode of 0755 (directory) or 0644 (files). This can be switched off
 // with the Options.NullPermissions setting. If blksize is unset, 4096
-// is assumed, and the 'blocks' field is set accordingly.
+// is assumed, and the 'blocks' field is set accordingly. A timeout set
+// with out.SetTimeout overrides Options.AttrTimeout for this node; if
+// it is left at zero, Options.AttrTimeout is used. Getattr is not
+// called while attributes stored with Inode.SetCachedAttr are valid.
+//
+// If the kernel names an open handle, eg. for fstat(2) on Linux, and
+// that handle implements FileGetattrer, it is used instead of
+// Getattr, so a file that was unlinked or replaced while open is
+// reported as seen through the handle. Otherwise, f is one of the
+// open handles of the file, if any.
 type NodeGetattrer interface {
 	Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno
 }
 
+// NodeCrtimer supplies the creation (birth) time of a node, which
+// backup tools may want to preserve. The bridge reports it where the
+// platform supports it: on macOS in the attributes from Getattr
+// (see fuse.Attr.SetCrtime), and on Linux as the btime of statx(2),
+// if MountOptions.EnableStatx is set and the node does not implement
+// NodeStatxer. A zero time means the birth time is unknown, and is
+// not reported.
+type NodeCrtimer interface {
+	Crtime(ctx context.Context) time.Time
+}
+
+// Statx returns extended attributes for an Inode, as requested by
+// statx(2). It is only called if MountOptions.EnableStatx is set. The
+// flags carry the AT_STATX_* synchronization mode, and mask the
+// fields the caller is interested in. out.Mask should only contain
+// the STATX_* bits for fields that were actually filled in.
+//
+// If a node does not implement NodeStatxer, the result is
+// synthesized from Getattr, reporting STATX_BASIC_STATS.
+type NodeStatxer interface {
+	Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno
+}
+
 // SetAttr sets attributes for an Inode.
 type NodeSetattrer interface {
 	Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno
@@ -239,6 +298,16 @@ type NodeOnAdder interface {
 	OnAdd(ctx context.Context)
 }
 
+// OnForget is called once the kernel has dropped all its references
+// to the node (after FORGET or BATCH_FORGET), and the node is removed
+// from the tree. It can be used to release resources associated with
+// the node. It is called without locks held; the node's StableAttr
+// may be inspected, but the node should not be added back to the
+// tree, nor should children be added to it.
+type NodeOnForgetter interface {
+	OnForget()
+}
+
 // Getxattr should read data for the given attribute into
 // `dest` and return the number of bytes. If `dest` is too
 // small, it should return ERANGE and the size of the attribute.
@@ -268,13 +337,22 @@ type NodeListxattrer interface {
 	Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno)
 }
 
-// Readlink reads the content of a symlink.
+// Readlink reads the content of a symlink. If
+// MountOptions.EnableSymlinkCaching is set, the kernel caches the
+// result until Inode.NotifySymlink is called.
 type NodeReadlinker interface {
 	Readlink(ctx context.Context) ([]byte, syscall.Errno)
 }
 
 // Open opens an Inode (of regular file type) for reading. It
 // is optional but recommended to return a FileHandle.
+//
+// Unless fuseFlags has fuse.FOPEN_KEEP_CACHE, the kernel drops the
+// cached data of the file when the open completes, for all open
+// handles of the file. With FOPEN_KEEP_CACHE, cached data is kept
+// and reads may see stale content. To decide per open, call
+// Inode.InvalidateContent from Open when the content changed since
+// it was cached; this overrides FOPEN_KEEP_CACHE for that open.
 type NodeOpener interface {
 	Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
@@ -288,13 +366,47 @@ type NodeReader interface {
 	Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno)
 }
 
-// Writes the data into the file handle at given offset. After
-// returning, the data will be reused and may not referenced.
-// The default implementation forwards to the FileHandle.
+// Writes the data into the file handle at given offset. The default
+// implementation forwards to the FileHandle.
+//
+// The data is not copied: it points into the buffer that the request
+// was read into, which is reused for other requests after Write
+// returns. Implementations may pass it on, eg. to a pipe or a network
+// connection, but must not retain it after returning, nor write to
+// it.
+//
+// The kernel splits large writes into requests of at most
+// MountOptions.MaxWrite bytes. Without the writeback cache, the
+// requests for one write(2) call are sent one after the other, so a
+// node can stream sequential writes to a backend as they arrive.
 type NodeWriter interface {
 	Write(ctx context.Context, f FileHandle, data []byte, off int64) (written uint32, errno syscall.Errno)
 }
 
+// NodeAtomicAppender lets the bridge implement O_APPEND for a node
+// that returns true from AtomicAppend. Writes to handles opened with
+// O_APPEND then go to the size of the file as returned by Getattr,
+// rather than the offset supplied by the kernel, which is computed
+// from the size the kernel has cached and goes wrong if the file is
+// also changed by other mounts or behind the kernel's back. Append
+// writes to the node are serialized, so concurrent appenders do not
+// overwrite each other's data. Each request is appended as a whole;
+// a write(2) larger than MountOptions.MaxWrite is split into several
+// requests, which may be interleaved with those of other appenders.
+//
+// The flag is taken from the file handle, so Open must return a
+// non-nil FileHandle. Such handles are opened with FOPEN_DIRECT_IO,
+// as the kernel would otherwise cache the written data at its own
+// offset, and after a write that went elsewhere, the kernel's cached
+// content and attributes of the node are invalidated. The file
+// position of the file descriptor follows the kernel's offset,
+// though. With the writeback cache, the kernel implements O_APPEND
+// itself, and the file system does not see the flag, so it has no
+// effect; the kernel owns the file size then.
+type NodeAtomicAppender interface {
+	AtomicAppend() bool
+}
+
 // Fsync is a signal to ensure writes to the Inode are flushed
 // to stable storage.
 type NodeFsyncer interface {
@@ -315,12 +427,23 @@ type NodeFlusher interface {
 // so any cleanup that requires specific synchronization or
 // could fail with I/O errors should happen in Flush instead.
 // The default implementation forwards to the FileHandle.
+//
+// The kernel sends RELEASE asynchronously, after close(2) has
+// returned, so a new Open on the same node may be served before the
+// Release of a previous handle. Release is called exactly once per
+// FileHandle, after all other operations on the handle have
+// finished, and the bridge drops its reference to the handle when
+// it returns. Handles that are still open when the file system is
+// unmounted are released after the server stops; Mount waits for
+// this before calling Options.OnUnmount.
 type NodeReleaser interface {
 	Release(ctx context.Context, f FileHandle) syscall.Errno
 }
 
 // Allocate preallocates space for future writes, so they will
-// never encounter ESPACE.
+// never encounter ESPACE. The mode is as for fallocate(2), so it
+// can also ask to punch holes (FALLOC_FL_PUNCH_HOLE) or zero
+// ranges (FALLOC_FL_ZERO_RANGE).
 type NodeAllocater interface {
 	Allocate(ctx context.Context, f FileHandle, off uint64, size uint64, mode uint32) syscall.Errno
 }
@@ -340,6 +463,37 @@ type NodeLseeker interface {
 	Lseek(ctx context.Context, f FileHandle, Off uint64, whence uint32) (uint64, syscall.Errno)
 }
 
+// Ioctl implements ioctl(2) on an open file. For the ioctls of
+// regular FUSE mounts, the kernel derives the buffer sizes from the
+// direction and size encoded in cmd: `input` holds the data at `arg`
+// for _IOW and _IOWR commands, and up to `outSize` bytes of
+// `output` are copied back to `arg` for _IOR and _IOWR commands.
+// `result` is the return value of ioctl(2). `flags` holds
+// fuse.FUSE_IOCTL_* flags. If not defined, ioctl returns ENOTTY.
+type NodeIoctler interface {
+	Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, input []byte, outSize uint32, flags uint32) (result int32, output []byte, errno syscall.Errno)
+}
+
+// Poll returns the poll(2) events, out of `events`, for which the
+// open file is ready. It must not block. If a process waits for the
+// file, call Inode.NotifyPoll once it becomes ready, and the kernel
+// calls Poll again. Poll is only called if
+// Options.MountOptions.EnablePoll is set; files that don't
+// implement it are always ready for reading and writing.
+type NodePoller interface {
+	Poll(ctx context.Context, f FileHandle, events uint32) (revents uint32, errno syscall.Errno)
+}
+
+// IoctlSize returns the sizes of the input and output buffers at
+// `arg` for an unrestricted ioctl (fuse.FUSE_IOCTL_UNRESTRICTED,
+// used by CUSE), for which the kernel does not know the sizes. If
+// the request lacks the data, the kernel is asked to retry with
+// these buffers before Ioctl is called. Ioctls that pass data
+// through pointers inside the buffer are not supported.
+type NodeIoctlSizer interface {
+	IoctlSize(ctx context.Context, f FileHandle, cmd uint32, arg uint64) (inSize, outSize uint32, errno syscall.Errno)
+}
+
 // Getlk returns locks that would conflict with the given input
 // lock. If no locks conflict, the output has type L_UNLCK. See
 // fcntl(2) for more information.
@@ -361,6 +515,17 @@ type NodeSetlkwer interface {
 	Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno
 }
 
+// NodeLockOwnerReleaser is implemented by nodes that keep locks
+// themselves, eg. by embedding LockManager. Closing a file drops the
+// POSIX locks of the closing process, but the kernel leaves that to
+// the file system: ReleaseOwner is called with the lock owner of each
+// FLUSH, which the kernel sends on close(2), and of each RELEASE that
+// drops flock(2) locks. Files opened with FOPEN_NOFLUSH are not
+// flushed, so their locks are only dropped by explicit unlocks.
+type NodeLockOwnerReleaser interface {
+	ReleaseOwner(owner uint64)
+}
+
 // DirStream lists directory entries.
 type DirStream interface {
 	// HasNext indicates if there are further entries. HasNext
@@ -369,17 +534,73 @@ type DirStream interface {
 
 	// Next retrieves the next entry. It is only called if HasNext
 	// has previously returned true.  The Errno return may be used to
-	// indicate I/O errors
+	// indicate I/O errors, and ends the listing; the entry is then
+	// ignored.
+	//
+	// Entries returned before the error are not lost: if some of
+	// them are in the current READDIR reply, that reply is sent
+	// without error, and the error is returned for the following
+	// READDIR. To the application, readdir(3) then yields the
+	// partial listing before failing with the error, so for
+	// example `ls` prints the entries it got and reports
+	// "reading directory: Input/output error" for EIO.
 	Next() (fuse.DirEntry, syscall.Errno)
 
 	// Close releases resources related to this directory
-	// stream.
+	// stream. It is called exactly once for each stream returned
+	// by Readdir or ReaddirPlus: when the directory handle is
+	// released, when the directory is listed again from the
+	// start, or, if the kernel never released the handle, when
+	// the file system is unmounted. The listing may be abandoned
+	// at any point, so Close must not assume the stream was
+	// exhausted. It should release all resources, eg. stop
+	// goroutines, before returning; there is no one to report
+	// failures to, so log them if they matter.
+	Close()
+}
+
+// DirSeeker is an optional interface for DirStream and
+// DirPlusStream. Streams implementing it set DirEntry.Off for each
+// entry, and can resume the listing at any offset they returned
+// before, eg. after seekdir(3), or when an NFS server re-exporting
+// the file system continues a listing from a cookie. Other streams
+// are reopened and skipped forward on seeks.
+//
+// Offsets must increase along the stream. Seekdir positions the
+// stream so the next entry is the first one with an offset larger
+// than off. If the entry at off no longer exists, the listing thus
+// continues with the entry after it; it is not an error. If seeking
+// back fails, the stream is reopened, and Seekdir is called on the
+// new one.
+type DirSeeker interface {
+	Seekdir(ctx context.Context, off uint64) syscall.Errno
+}
+
+// DirPlusEntry is a directory entry together with the result of
+// looking it up.
+type DirPlusEntry struct {
+	fuse.DirEntry
+
+	// Child is the Inode for the entry, as NodeLookuper.Lookup
+	// would return it. If nil, the entry is looked up as usual.
+	Child *Inode
+
+	// Out holds the attributes and timeouts for Child.
+	Out fuse.EntryOut
+}
+
+// DirPlusStream lists directory entries along with their Inodes. See
+// NodeReaddirPluser.
+type DirPlusStream interface {
+	// HasNext, Next and Close behave as for DirStream.
+	HasNext() bool
+	Next() (DirPlusEntry, syscall.Errno)
 	Close()
 }
 
 // Lookup should find a direct child of a directory by the child's name.  If
 // the entry does not exist, it should return ENOENT and optionally
-// set a NegativeTimeout in `out`. If it does exist, it should return
+// set a NegativeTimeout in `out`, see below. If it does exist, it should return
 // attribute data in `out` and return the Inode for the child. A new
 // inode can be created using `Inode.NewInode`. The new Inode will be
 // added to the FS tree automatically if the return status is OK.
@@ -400,7 +621,16 @@ type DirStream interface {
 // example, the Symlink, Create, Mknod, Link methods all create new
 // children in directories. Hence, they also return *Inode and must
 // populate their fuse.EntryOut arguments.
-
+//
+// The entry and attribute timeouts set with out.SetEntryTimeout and
+// out.SetAttrTimeout are used as is; each timeout left at zero is
+// replaced by the corresponding Options value.
+//
+// For ENOENT, the entry timeout in out is how long the kernel may
+// cache the negative result. It starts out as Options.NegativeTimeout,
+// so Lookup can set a different timeout for this name, or 0 to not
+// cache it, eg. for a file that is about to appear. On success, the
+// entry timeout counts as left at zero unless Lookup set it.
 //
 type NodeLookuper interface {
 	Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno)
@@ -422,6 +652,17 @@ type NodeOpendirerWithFlags interface {
 	Opendir(ctx context.Context, flags uint32) (openFlags uint32, errno syscall.Errno)
 }
 
+// OpendirHandle opens a directory Inode, and returns a handle for
+// this open. The handle is passed to FileReaddirer, FileReleasedirer
+// and, for FSYNCDIR, to NodeFsyncer or FileFsyncer, so each open of
+// the directory can keep its own state, eg. a cursor into a remote
+// listing, rather than keeping it in the node. If implemented, it is
+// used instead of NodeOpendirer and NodeOpendirerWithFlags. The
+// handle may be nil.
+type NodeOpendirHandler interface {
+	OpendirHandle(ctx context.Context, flags uint32) (fh FileHandle, openFlags uint32, errno syscall.Errno)
+}
+
 // ReadDir opens a stream of directory entries.
 //
 // Readdir essentiallly returns a list of strings, and it is allowed
@@ -433,10 +674,27 @@ type NodeOpendirerWithFlags interface {
 // If a directory does not implement NodeReaddirer, a list of
 // currently known children from the tree is returned. This means that
 // static in-memory file systems need not implement NodeReaddirer.
+//
+// The entries are passed to the kernel as they are: neither the
+// bridge nor the kernel adds "." and "..", and the default listing
+// leaves them out. A stream may include them, with the inode numbers
+// and offsets of its choice, eg. to re-export the file system over
+// NFS. For READDIRPLUS, they are not looked up, and do not become
+// part of the tree.
 type NodeReaddirer interface {
 	Readdir(ctx context.Context) (DirStream, syscall.Errno)
 }
 
+// ReaddirPlus is an optional companion to Readdir. When the kernel
+// asks for a listing with attributes (READDIRPLUS), it is used
+// instead of Readdir, and the Inodes and attributes in the returned
+// entries are used instead of calling Lookup for each entry. This
+// lets file systems fetch attributes for a whole directory at once,
+// eg. with a single batched call to a remote backend.
+type NodeReaddirPluser interface {
+	ReaddirPlus(ctx context.Context) (DirPlusStream, syscall.Errno)
+}
+
 // Mkdir is similar to Lookup, but must create a directory entry and Inode.
 // Default is to return EROFS.
 type NodeMkdirer interface {
@@ -463,12 +721,23 @@ type NodeSymlinker interface {
 
 // Create is similar to Lookup, but should create a new
 // child. It typically also returns a FileHandle as a
-// reference for future reads/writes.
+// reference for future reads/writes. The fuseFlags (eg.
+// FOPEN_DIRECT_IO, FOPEN_KEEP_CACHE) apply to the returned handle as
+// they do for NodeOpener.
 // Default is to return EROFS.
 type NodeCreater interface {
 	Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
 }
 
+// Tmpfile is like Create, but the new file has no name: it is used
+// for open(2) with O_TMPFILE. The returned Inode is not added to
+// this directory; a later NodeLinker.Link (linkat(2) with
+// AT_EMPTY_PATH) can give it a name. Default is to return
+// EOPNOTSUPP.
+type NodeTmpfiler interface {
+	Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (node *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno)
+}
+
 // Unlink should remove a child from this directory.  If the
 // return status is OK, the Inode is removed as child in the
 // FS tree automatically. Default is to return EROFS.
@@ -515,6 +784,25 @@ type FileReleaser interface {
 	Release(ctx context.Context) syscall.Errno
 }
 
+// FileReaddirer is implemented by directory handles returned from
+// NodeOpendirHandler. Readdir is called when the directory is listed
+// from the start, and when a stream that does not implement
+// DirSeeker is reopened for a seek backwards. If the handle
+// implements it, it is used instead of NodeReaddirer and
+// NodeReaddirPluser; for READDIRPLUS, the entries are looked up as
+// usual. See NodeReaddirer.
+type FileReaddirer interface {
+	Readdir(ctx context.Context) (DirStream, syscall.Errno)
+}
+
+// FileReleasedirer is implemented by directory handles returned from
+// NodeOpendirHandler. Releasedir is called once, when the kernel
+// closes the directory, after the stream returned by Readdir was
+// closed.
+type FileReleasedirer interface {
+	Releasedir(ctx context.Context, releaseFlags uint32)
+}
+
 // See NodeGetattrer.
 type FileGetattrer interface {
 	Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno
@@ -550,6 +838,25 @@ type FileLseeker interface {
 	Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno)
 }
 
+// See NodePoller.
+type FilePoller interface {
+	Poll(ctx context.Context, events uint32) (revents uint32, errno syscall.Errno)
+}
+
+// See NodeIoctler.
+type FileIoctler interface {
+	Ioctl(ctx context.Context, cmd uint32, arg uint64, input []byte, outSize uint32, flags uint32) (result int32, output []byte, errno syscall.Errno)
+}
+
+// FilePassthroughFder is implemented by file handles that are backed
+// by a kernel file descriptor. If Options.EnablePassthrough is set,
+// the descriptor is registered with the kernel on open, and reads and
+// writes bypass the FUSE server. The file descriptor must stay open
+// until the file handle is released.
+type FilePassthroughFder interface {
+	PassthroughFd() (int, bool)
+}
+
 // See NodeFlusher.
 type FileFlusher interface {
 	Flush(ctx context.Context) syscall.Errno
@@ -586,17 +893,70 @@ type Options struct {
 
 	// If set to nonnil, this defines the overall entry timeout
 	// for failed lookups (fuse.ENOENT). See fuse.EntryOut for
-	// more information.
+	// more information. NodeLookuper can override it for each
+	// lookup.
 	NegativeTimeout *time.Duration
 
 	// Automatic inode numbers are handed out sequentially
 	// starting from this number. If unset, use 2^63.
 	FirstAutomaticIno uint64
 
+	// InoAllocator, if set, picks the inode numbers of nodes
+	// created with StableAttr.Ino unset, eg. by deriving them
+	// from the IDs that the backend uses for its objects. It is
+	// called once per node, when the node is first added to the
+	// tree under name in parent, either through AddChild or by
+	// the kernel looking it up or creating it; name is empty for
+	// O_TMPFILE files. Until then, StableAttr().Ino of the node
+	// is 0. If it returns 0, an automatic number is used. It
+	// must not take locks that file system operations hold.
+	//
+	// The inode number, with the generation, is what identifies
+	// an object: nodes with the same StableAttr are taken to be
+	// the same node, so returning the number of another object
+	// makes lookups resolve to that object, serving its content
+	// and attributes as if it were a hard link. Nodes of a
+	// different type, or created with O_EXCL, stay distinct but
+	// share the number, which confuses tools such as tar, find
+	// and du that detect hard links by number; the bridge logs a
+	// warning when it sees this. Reusing the number of a deleted
+	// object for a new one is safe once the kernel forgot the
+	// old node, but NFS re-exports identify objects by number
+	// and generation, so a reused number needs a new Gen, or
+	// stale file handles resolve to the new object.
+	InoAllocator func(parent *Inode, name string, mode uint32) uint64
+
 	// OnAdd is an alternative way to specify the OnAdd
 	// functionality of the root node.
 	OnAdd func(ctx context.Context)
 
+	// OnReady is called by Mount once the file system is mounted
+	// and ready to serve requests, before Mount returns.
+	OnReady func(server *fuse.Server)
+
+	// OnUnmount is called by Mount when the serve loop exits
+	// after the file system was unmounted, whether through
+	// Server.Unmount, Server.UnmountLazy or externally, eg. with
+	// fusermount -u. It is called exactly once, after OnReady, and
+	// not at all if mounting fails. It runs on the serve goroutine,
+	// so it may still be running when Server.Unmount returns.
+	OnUnmount func()
+
+	// WrapRawFileSystem, if set, is called by Mount with the
+	// RawFileSystem that serves the node tree, and returns the one
+	// to serve instead. This allows wrapping the tree with
+	// decorators that intercept some operations, as described for
+	// fuse.RawFileSystem. The wrapper must forward Init, so the
+	// tree can send notifications.
+	WrapRawFileSystem func(fuse.RawFileSystem) fuse.RawFileSystem
+
+	// DumpTreeSignal, if set, makes Mount dump the node tree (see
+	// Inode.DumpTree) each time the process receives the signal,
+	// eg. syscall.SIGUSR1, until the file system is unmounted. The
+	// dump goes to the logger, or to standard error if none is
+	// set.
+	DumpTreeSignal os.Signal
+
 	// NullPermissions if set, leaves null file permissions
 	// alone. Otherwise, they are set to 755 (dirs) or 644 (other
 	// files.), which is necessary for doing a chdir into the FUSE
@@ -616,6 +976,80 @@ type Options struct {
 	// Logger is a sink for diagnostic messages. Diagnostic
 	// messages are printed under conditions where we cannot
 	// return error, but want to signal something seems off
-	// anyway. If unset, no messages are printed.
+	// anyway. If set, it replaces MountOptions.Logger for the
+	// messages of this package; those of the fuse.Server still go
+	// to MountOptions.Logger. If neither is set, no messages are
+	// printed.
+	//
+	// Deprecated: set MountOptions.Logger instead, which
+	// supports log levels. As this field shadows it, it has to be
+	// spelled out as Options.MountOptions.Logger.
 	Logger *log.Logger
+
+	// CaseInsensitive makes the child table of each Inode match
+	// names using Unicode case folding (strings.EqualFold),
+	// while preserving the case a child was added with. Names
+	// that only differ in case refer to the same child, so
+	// AddChild without overwrite fails for them.
+	//
+	// The kernel compares names exactly, so a negative entry for
+	// "FOO" would hide a later "foo". NegativeTimeout is
+	// therefore ignored when this is set.
+	CaseInsensitive bool
+
+	// MaxInodes, if positive, is a high watermark for the number
+	// of inodes the kernel holds references to. When the count
+	// rises above it, OnInodeWatermark is called with the
+	// current count, in a separate goroutine, so it can ask the
+	// kernel to drop entries with Inode.NotifyEntry. It is called
+	// again only after the count has dropped back to MaxInodes.
+	MaxInodes        int
+	OnInodeWatermark func(count int)
+
+	// AdaptiveTimeouts makes the kernel forget entries sooner as
+	// the number of inodes it holds approaches MaxInodes, which
+	// must then be positive. Up to half of MaxInodes, entry and
+	// attribute timeouts are reported as they are. Above that,
+	// they shrink linearly, to 1/16 of their value at MaxInodes
+	// and beyond. This applies to the timeouts from Options as
+	// well as those set by the nodes. Timeouts are never scaled
+	// down to zero, so caching is not turned off, and negative
+	// entry timeouts are left alone.
+	AdaptiveTimeouts bool
+
+	// SingleThreadedNodes serializes the operations on each
+	// Inode, while operations on different Inodes still run in
+	// parallel. This is finer grained than
+	// MountOptions.SingleThreaded, and lets nodes that are not
+	// thread-safe do without a mutex of their own. Operations
+	// involving two Inodes (Rename, Link, CopyFileRange) lock
+	// both, in a fixed order.
+	//
+	// An operation that waits for another operation on the same
+	// Inode to complete will deadlock. For this reason, Setlkw
+	// is not serialized.
+	SingleThreadedNodes bool
+
+	// XAttrNamespaceFilter, if set, decides which extended
+	// attributes are visible. Names for which it returns false
+	// are left out of Listxattr results (including the size
+	// reported for an empty buffer), Getxattr and Removexattr
+	// on them return ENOATTR, and Setxattr returns ENOTSUP. The
+	// node methods are not called for such names.
+	XAttrNamespaceFilter func(name string) bool
+
+	// OverlayXAttrs makes the attributes of overlayfs
+	// (trusted.overlay.* and user.overlay.*) visible whatever
+	// XAttrNamespaceFilter says, so the file system can serve as
+	// a layer of an overlayfs mount. Overlayfs also creates
+	// whiteouts, character devices with device number 0, with
+	// Mknod; the bridge passes those on like other devices.
+	OverlayXAttrs bool
+
+	// ReadOnly makes the mount read-only: Mount passes the "ro"
+	// option, and all operations that could modify the file
+	// system, including opening files for writing, fail with
+	// EROFS without reaching the nodes. This holds even for
+	// nodes that implement the mutating interfaces.
+	ReadOnly bool
 }
@@ -5,12 +5,17 @@
 package fs
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"log"
+	"math"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal"
@@ -23,6 +28,9 @@ func errnoToStatus(errno syscall.Errno) fuse.Status {
 type fileEntry struct {
 	file FileHandle
 
+	// openFlags are the flags the file was opened with.
+	openFlags uint32
+
 	// index into Inode.openFiles
 	nodeIndex int
 
@@ -39,6 +47,14 @@ type fileEntry struct {
 	// If `dirOffset` and `fuse.DirEntryList.offset` disagree, then a
 	// directory seek has taken place.
 	dirOffset uint64
+	// dirErrno is an error returned by dirStream after some
+	// entries were already added to a reply. It is returned by
+	// the next READDIR, so the entries reach the kernel first.
+	dirErrno syscall.Errno
+
+	// backingId is the kernel ID of the passthrough backing
+	// file, or 0.
+	backingId int32
 
 	wg sync.WaitGroup
 }
@@ -71,6 +87,11 @@ type rawBridge struct {
 	stableAttrs  map[StableAttr]*Inode
 	automaticIno uint64
 
+	// inoNodes holds the nodes known to the kernel by inode
+	// number and generation, to detect collisions. It is only
+	// used with Options.InoAllocator.
+	inoNodes map[inoGen]*Inode
+
 	// The *Node ID* is an arbitrary uint64 identifier chosen by the FUSE library.
 	// It is used the identify *nodes* (files/directories/symlinks/...) in the
 	// communication between the FUSE library and the Linux kernel.
@@ -89,8 +110,17 @@ type rawBridge struct {
 	// estimate for stableAttrs.
 	nodeCountHigh int
 
+	// overWatermark is set while len(kernelNodeIds) exceeds
+	// Options.MaxInodes.
+	overWatermark bool
+
 	files     []*fileEntry
 	freeFiles []uint32
+
+	// mounts are the servers of the mounts added with AddMount.
+	mounts []*fuse.Server
+	// unmounted is set once the serve loop of Mount exited.
+	unmounted bool
 }
 
 // newInode creates creates new inode pointing to ops.
@@ -113,16 +143,8 @@ func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persisten
 		id.Mode = fuse.S_IFREG
 	}
 
-	if id.Ino == 0 {
-		// Find free inode number.
-		for {
-			id.Ino = b.automaticIno
-			b.automaticIno++
-			_, ok := b.stableAttrs[id]
-			if !ok {
-				break
-			}
-		}
+	if id.Ino == 0 && b.options.InoAllocator == nil {
+		id.Ino = b.nextAutomaticIno(id)
 	}
 
 	initInode(ops.embed(), ops, id, b, persistent, b.nextNodeId)
@@ -130,9 +152,100 @@ func (b *rawBridge) newInodeUnlocked(ops InodeEmbedder, id StableAttr, persisten
 	return ops.embed()
 }
 
+// nextAutomaticIno returns a free inode number for id. Must be called
+// with b.mu held.
+func (b *rawBridge) nextAutomaticIno(id StableAttr) uint64 {
+	for {
+		id.Ino = b.automaticIno
+		b.automaticIno++
+		if _, ok := b.stableAttrs[id]; !ok {
+			return id.Ino
+		}
+	}
+}
+
+// allocIno sets the inode number of ch from Options.InoAllocator, if
+// ch was created without one. It must be called without locks held.
+func (b *rawBridge) allocIno(parent *Inode, name string, ch *Inode) {
+	if b == nil || b.options.InoAllocator == nil {
+		return
+	}
+	b.mu.Lock()
+	id := ch.stableAttr
+	b.mu.Unlock()
+	if id.Ino != 0 {
+		return
+	}
+
+	id.Ino = b.options.InoAllocator(parent, name, id.Mode)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch.stableAttr.Ino != 0 {
+		// Lost a race with another caller.
+		return
+	}
+	if id.Ino == 0 {
+		id.Ino = b.nextAutomaticIno(id)
+	}
+	if id.Reserved() {
+		log.Panicf("InoAllocator returned reserved ID %d for %q", id.Ino, name)
+	}
+	ch.stableAttr.Ino = id.Ino
+}
+
+// inoGen identifies an object for the kernel, and for NFS clients.
+type inoGen struct {
+	ino, gen uint64
+}
+
+// noteIno records that the kernel knows ch by its inode number, and
+// warns if it knows a different node by the same number. Must be
+// called with b.mu held.
+func (b *rawBridge) noteIno(ch *Inode) {
+	if b.inoNodes == nil {
+		return
+	}
+	key := inoGen{ch.stableAttr.Ino, ch.stableAttr.Gen}
+	if prev := b.inoNodes[key]; prev != nil && prev != ch {
+		b.logf("warning: inode number %d (gen %d) is used by both n%d and n%d",
+			key.ino, key.gen, prev.nodeId, ch.nodeId)
+	}
+	b.inoNodes[key] = ch
+}
+
+// lockOps serializes operations on n1 and n2 if
+// Options.SingleThreadedNodes is set. n2 may be nil or equal to n1.
+// The result should be passed to unlockOps.
+func (b *rawBridge) lockOps(n1, n2 *Inode) (*Inode, *Inode) {
+	if !b.options.SingleThreadedNodes {
+		return nil, nil
+	}
+	if n2 == nil || n2 == n1 {
+		n1.opMu.Lock()
+		return n1, nil
+	}
+	if !nodeLess(n1, n2) {
+		n1, n2 = n2, n1
+	}
+	n1.opMu.Lock()
+	n2.opMu.Lock()
+	return n1, n2
+}
+
+// unlockOps releases the locks taken by lockOps.
+func unlockOps(n1, n2 *Inode) {
+	if n2 != nil {
+		n2.opMu.Unlock()
+	}
+	if n1 != nil {
+		n1.opMu.Unlock()
+	}
+}
+
 func (b *rawBridge) logf(format string, args ...interface{}) {
-	if b.options.Logger != nil {
-		b.options.Logger.Printf(format, args...)
+	if l := b.options.MountOptions.Logger; l != nil && l.Enabled(fuse.LogWarning) {
+		l.Log(fuse.LogWarning, fmt.Sprintf(format, args...))
 	}
 }
 
@@ -152,6 +265,9 @@ func (b *rawBridge) newInode(ctx context.Context, ops InodeEmbedder, id StableAt
 // Unless fileFlags has the syscall.O_EXCL bit set, child.stableAttr will be used
 // to find an already-known node. If one is found, `child` is ignored and the
 // already-known one is used. The node that was actually used is returned.
+// addNewChild registers child with the kernel, and links it into
+// parent under name. If name is empty, child is left unlinked, as
+// for O_TMPFILE.
 func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file FileHandle, fileFlags uint32, out *fuse.EntryOut) (selected *Inode, fh uint32) {
 	if name == "." || name == ".." {
 		log.Panicf("BUG: tried to add virtual entry %q to the actual tree", name)
@@ -168,6 +284,7 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 	// dir1.Lookup("file") and dir2.Lookup("file") are executed
 	// simultaneously.  The matching StableAttrs ensure that we return the
 	// same node.
+	b.allocIno(parent, name, child)
 	orig := child
 	id := child.stableAttr
 	if id.Mode & ^(uint32(syscall.S_IFMT)) != 0 {
@@ -211,13 +328,19 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 	if len(b.kernelNodeIds) > b.nodeCountHigh {
 		b.nodeCountHigh = len(b.kernelNodeIds)
 	}
+	b.checkWatermark()
 	// Any node that might be there is overwritten - it is obsolete now
 	b.stableAttrs[id] = child
+	b.noteIno(child)
 	if file != nil {
 		fh = b.registerFile(child, file, fileFlags)
 	}
 
-	parent.setEntry(name, child)
+	if name != "" {
+		parent.setEntry(name, child)
+	} else {
+		child.tmpfile = true
+	}
 
 	out.NodeId = child.nodeId
 	out.Generation = child.stableAttr.Gen
@@ -229,6 +352,32 @@ func (b *rawBridge) addNewChild(parent *Inode, name string, child *Inode, file F
 	return child, fh
 }
 
+// checkWatermark runs Options.OnInodeWatermark if the number of
+// kernel inodes just crossed Options.MaxInodes. Must be called with
+// b.mu held.
+func (b *rawBridge) checkWatermark() {
+	if b.options.MaxInodes <= 0 {
+		return
+	}
+	count := len(b.kernelNodeIds)
+	if count <= b.options.MaxInodes {
+		b.overWatermark = false
+	} else if !b.overWatermark {
+		b.overWatermark = true
+		if cb := b.options.OnInodeWatermark; cb != nil {
+			go cb(count)
+		}
+	}
+}
+
+// InodeCount returns the number of inodes that the kernel holds
+// references to, including the root.
+func (b *rawBridge) InodeCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.kernelNodeIds)
+}
+
 func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
 	b.setAttr(&out.Attr)
 	if b.options.AttrTimeout != nil && out.AttrTimeout() == 0 {
@@ -237,6 +386,10 @@ func (b *rawBridge) setEntryOutTimeout(out *fuse.EntryOut) {
 	if b.options.EntryTimeout != nil && out.EntryTimeout() == 0 {
 		out.SetEntryTimeout(*b.options.EntryTimeout)
 	}
+	if scale := b.timeoutScale(); scale < 1 {
+		out.SetAttrTimeout(scaleTimeout(out.AttrTimeout(), scale))
+		out.SetEntryTimeout(scaleTimeout(out.EntryTimeout(), scale))
+	}
 }
 
 func (b *rawBridge) setAttr(out *fuse.Attr) {
@@ -256,9 +409,54 @@ func (b *rawBridge) setAttr(out *fuse.Attr) {
 }
 
 func (b *rawBridge) setAttrTimeout(out *fuse.AttrOut) {
-	if b.options.AttrTimeout != nil && out.Timeout() == 0 {
-		out.SetTimeout(*b.options.AttrTimeout)
+	out.SetTimeout(b.scaleAttrTimeout(out.Timeout()))
+}
+
+// scaleAttrTimeout returns the attribute timeout to report, given the
+// one set by the node: Options.AttrTimeout if it is zero, scaled
+// under Options.AdaptiveTimeouts.
+func (b *rawBridge) scaleAttrTimeout(timeout time.Duration) time.Duration {
+	if b.options.AttrTimeout != nil && timeout == 0 {
+		timeout = *b.options.AttrTimeout
 	}
+	if scale := b.timeoutScale(); scale < 1 {
+		timeout = scaleTimeout(timeout, scale)
+	}
+	return timeout
+}
+
+// minTimeoutScale is the factor for the timeouts at or above
+// Options.MaxInodes with Options.AdaptiveTimeouts.
+const minTimeoutScale = 1.0 / 16
+
+// timeoutScale returns the factor for the reported timeouts under
+// Options.AdaptiveTimeouts: 1 up to half of MaxInodes, falling
+// linearly to minTimeoutScale at MaxInodes.
+func (b *rawBridge) timeoutScale() float64 {
+	max := b.options.MaxInodes
+	if !b.options.AdaptiveTimeouts || max <= 0 {
+		return 1
+	}
+	low := max / 2
+	count := b.InodeCount()
+	if count <= low {
+		return 1
+	}
+	if count >= max {
+		return minTimeoutScale
+	}
+	frac := float64(count-low) / float64(max-low)
+	return 1 - frac*(1-minTimeoutScale)
+}
+
+// scaleTimeout multiplies t by scale, but does not let a positive
+// timeout drop to zero.
+func scaleTimeout(t time.Duration, scale float64) time.Duration {
+	s := time.Duration(float64(t) * scale)
+	if s <= 0 && t > 0 {
+		return time.Nanosecond
+	}
+	return s
 }
 
 // NewNodeFS creates a node based filesystem based on the
@@ -282,6 +480,17 @@ func NewNodeFS(root InodeEmbedder, opts *Options) fuse.RawFileSystem {
 		bridge.options.EntryTimeout = &oneSec
 		bridge.options.AttrTimeout = &oneSec
 	}
+	if bridge.options.Logger != nil {
+		// The bridge only logs through MountOptions.Logger.
+		bridge.options.MountOptions.Logger = fuse.NewStdLogger(bridge.options.Logger)
+	}
+	if bridge.options.InoAllocator != nil {
+		bridge.inoNodes = map[inoGen]*Inode{}
+	}
+	if bridge.options.CaseInsensitive {
+		// Negative entries in the kernel are not case-folded.
+		bridge.options.NegativeTimeout = nil
+	}
 
 	initInode(root.embed(), root,
 		StableAttr{
@@ -324,16 +533,83 @@ func (b *rawBridge) inode(id uint64, fh uint64) (*Inode, *fileEntry) {
 	return n, f
 }
 
+// The kernel sends directory operations for directories and file
+// operations for other nodes only, but a node may have changed type
+// since the kernel looked it up, and other FUSE clients need not be
+// as careful. checkDir and checkNotDir give the POSIX errors based on
+// StableAttr.Mode, so nodes need not check themselves.
+
+// checkDir returns ENOTDIR if n is not a directory.
+func checkDir(n *Inode) fuse.Status {
+	if !n.IsDir() {
+		return fuse.ENOTDIR
+	}
+	return fuse.OK
+}
+
+// checkNotDir returns EISDIR if n is a directory.
+func checkNotDir(n *Inode) fuse.Status {
+	if n.IsDir() {
+		return fuse.EISDIR
+	}
+	return fuse.OK
+}
+
+// checkAccess returns EBADF if the file handle fh was opened without
+// the access mode (O_RDONLY or O_WRONLY) that an operation needs.
+// Handle 0 is used for files opened without a FileHandle, whose
+// access mode is not known.
+func checkAccess(fh uint64, f *fileEntry, mode uint32) fuse.Status {
+	if fh == 0 {
+		return fuse.OK
+	}
+	acc := f.openFlags & syscall.O_ACCMODE
+	if acc != syscall.O_RDWR && acc != mode {
+		return fuse.EBADF
+	}
+	return fuse.OK
+}
+
+// checkWriteRange returns EFBIG if writing size bytes at off would go
+// past the largest offset the node interfaces can represent.
+func checkWriteRange(off, size uint64) fuse.Status {
+	if off > math.MaxInt64 || size > math.MaxInt64-off {
+		return fuse.Status(syscall.EFBIG)
+	}
+	return fuse.OK
+}
+
 func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
 	ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+
+	// Lookup may replace the default negative timeout, also by 0
+	// to not cache the ENOENT at all.
+	if b.options.NegativeTimeout != nil {
+		presetEntryTimeout(out, *b.options.NegativeTimeout)
+	}
 	child, errno := b.lookup(ctx, parent, name, out)
 
 	if errno != 0 {
-		if b.options.NegativeTimeout != nil && out.EntryTimeout() == 0 {
-			out.SetEntryTimeout(*b.options.NegativeTimeout)
+		timeout := out.EntryTimeout()
+		if errno != syscall.ENOENT || b.options.CaseInsensitive || timeout <= 0 {
+			return errnoToStatus(errno)
 		}
-		return errnoToStatus(errno)
+		// The kernel caches a negative entry from a reply
+		// without node ID.
+		if scale := b.timeoutScale(); scale < 1 {
+			timeout = scaleTimeout(timeout, scale)
+		}
+		*out = fuse.EntryOut{}
+		out.SetEntryTimeout(timeout)
+		return fuse.OK
+	}
+	if entryTimeoutPreset(out) {
+		out.SetEntryTimeout(0)
 	}
 
 	child, _ = b.addNewChild(parent, name, child, nil, 0, out)
@@ -342,6 +618,23 @@ func (b *rawBridge) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name s
 	return fuse.OK
 }
 
+// presetEntryTimeout sets the entry timeout in out to dt, but with a
+// second carried from EntryValid into EntryValidNsec. EntryTimeout
+// still returns dt, as EntryValid wraps around for timeouts below a
+// second, but SetEntryTimeout never stores such a value, so
+// entryTimeoutPreset tells whether Lookup set the timeout.
+func presetEntryTimeout(out *fuse.EntryOut, dt time.Duration) {
+	out.SetEntryTimeout(dt)
+	out.EntryValid--
+	out.EntryValidNsec += 1e9
+}
+
+// entryTimeoutPreset returns true if the timeout stored with
+// presetEntryTimeout is still in place.
+func entryTimeoutPreset(out *fuse.EntryOut) bool {
+	return out.EntryValidNsec >= 1e9
+}
+
 func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	if lu, ok := parent.ops.(NodeLookuper); ok {
 		return lu.Lookup(ctx, name, out)
@@ -352,11 +645,15 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 		return nil, syscall.ENOENT
 	}
 
+	if child.loadCachedAttr(&out.Attr) {
+		return child, OK
+	}
 	if ga, ok := child.ops.(NodeGetattrer); ok {
 		var a fuse.AttrOut
 		errno := ga.Getattr(ctx, nil, &a)
 		if errno == 0 {
 			out.Attr = a.Attr
+			out.SetAttrTimeout(a.Timeout())
 		}
 	}
 
@@ -364,7 +661,14 @@ func (b *rawBridge) lookup(ctx *fuse.Context, parent *Inode, name string, out *f
 }
 
 func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeRmdirer); ok {
 		errno = mops.Rmdir(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
@@ -377,7 +681,14 @@ func (b *rawBridge) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name st
 }
 
 func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeUnlinker); ok {
 		errno = mops.Unlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, name)
@@ -390,12 +701,19 @@ func (b *rawBridge) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name s
 }
 
 func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeMkdirer); ok {
-		child, errno = mops.Mkdir(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, out)
+		child, errno = mops.Mkdir(withUmask(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Umask, true, b.dontMask()), name, input.Mode, out)
 	} else {
 		return fuse.ENOTSUP
 	}
@@ -419,12 +737,20 @@ func (b *rawBridge) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name stri
 }
 
 func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
 
 	var child *Inode
 	var errno syscall.Errno
 	if mops, ok := parent.ops.(NodeMknoder); ok {
-		child, errno = mops.Mknod(&fuse.Context{Caller: input.Caller, Cancel: cancel}, name, input.Mode, input.Rdev, out)
+		umask, ok := mknodUmask(input)
+		child, errno = mops.Mknod(withUmask(&fuse.Context{Caller: input.Caller, Cancel: cancel}, umask, ok, b.dontMask()), name, input.Mode, input.Rdev, out)
 	} else {
 		return fuse.ENOTSUP
 	}
@@ -440,15 +766,45 @@ func (b *rawBridge) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name stri
 }
 
 func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
-	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
+	umask, ok := createUmask(input)
+	ctx := withUmask(&fuse.Context{Caller: input.Caller, Cancel: cancel}, umask, ok, b.dontMask())
 	parent, _ := b.inode(input.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
+
+	if input.Flags&syscall.O_EXCL != 0 {
+		// Serialize exclusive creates in a directory up to
+		// adding the child, so a NodeCreater that checks for
+		// existence before creating cannot let two of them
+		// succeed.
+		if !b.options.SingleThreadedNodes {
+			parent.opMu.Lock()
+			defer parent.opMu.Unlock()
+		}
+		// A child in the tree exists, unless Lookup says it
+		// disappeared behind the bridge's back.
+		if parent.GetChild(name) != nil {
+			lu, ok := parent.ops.(NodeLookuper)
+			if !ok {
+				return fuse.Status(syscall.EEXIST)
+			}
+			if _, errno := lu.Lookup(ctx, name, &fuse.EntryOut{}); errno != syscall.ENOENT {
+				return fuse.Status(syscall.EEXIST)
+			}
+		}
+	}
 
 	var child *Inode
 	var errno syscall.Errno
 	var f FileHandle
 	var flags uint32
 	if mops, ok := parent.ops.(NodeCreater); ok {
-		child, f, flags, errno = mops.Create(ctx, name, input.Flags, input.Mode, &out.EntryOut)
+		child, f, flags, errno = mops.Create(ctx, name, b.openFlags(input.Flags), input.Mode, &out.EntryOut)
 	} else {
 		return fuse.EROFS
 	}
@@ -460,10 +816,64 @@ func (b *rawBridge) Create(cancel <-chan struct{}, input *fuse.CreateIn, name st
 		return errnoToStatus(errno)
 	}
 
+	out.OpenFlags = flags
+	backingId := b.registerBackingFd(f, &out.OpenOut)
 	child, fh := b.addNewChild(parent, name, child, f, input.Flags|syscall.O_CREAT|syscall.O_EXCL, &out.EntryOut)
+	if backingId != 0 {
+		b.mu.Lock()
+		b.files[fh].backingId = backingId
+		b.mu.Unlock()
+	}
+	if atomicAppend(child, input.Flags) {
+		out.OpenFlags |= fuse.FOPEN_DIRECT_IO
+	}
+	if createOpenFlags(input)&fuse.OPEN_KILL_SUIDGID != 0 {
+		// NodeCreater may have opened an existing file.
+		attr := fuse.AttrOut{Attr: out.Attr}
+		b.killSuidgid(ctx, child, f, &attr)
+		out.Attr = attr.Attr
+	}
 
 	out.Fh = uint64(fh)
+
+	child.setEntryOut(&out.EntryOut)
+	b.setEntryOutTimeout(&out.EntryOut)
+	return fuse.OK
+}
+
+func (b *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
+	umask, ok := createUmask(input)
+	ctx := withUmask(&fuse.Context{Caller: input.Caller, Cancel: cancel}, umask, ok, b.dontMask())
+	parent, _ := b.inode(input.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
+
+	mops, ok := parent.ops.(NodeTmpfiler)
+	if !ok {
+		// The kernel translates ENOSYS into EOPNOTSUPP, and
+		// stops asking.
+		return fuse.ENOSYS
+	}
+	child, f, flags, errno := mops.Tmpfile(ctx, b.openFlags(input.Flags), input.Mode, &out.EntryOut)
+	if errno != 0 {
+		return errnoToStatus(errno)
+	}
+
 	out.OpenFlags = flags
+	backingId := b.registerBackingFd(f, &out.OpenOut)
+	child, fh := b.addNewChild(parent, "", child, f, input.Flags|syscall.O_EXCL, &out.EntryOut)
+	if backingId != 0 {
+		b.mu.Lock()
+		b.files[fh].backingId = backingId
+		b.mu.Unlock()
+	}
+
+	out.Fh = uint64(fh)
 
 	child.setEntryOut(&out.EntryOut)
 	b.setEntryOutTimeout(&out.EntryOut)
@@ -519,74 +929,167 @@ func (b *rawBridge) SetDebug(debug bool) {}
 
 func (b *rawBridge) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
 	n, fEntry := b.inode(input.NodeId, input.Fh())
-	f := fEntry.file
-	if f == nil {
-		// The linux kernel doesnt pass along the file
-		// descriptor, so we have to fake it here.
-		// See https://github.com/libfuse/libfuse/issues/62
-		b.mu.Lock()
-		for _, fh := range n.openFiles {
-			f = b.files[fh].file
-			b.files[fh].wg.Add(1)
-			defer b.files[fh].wg.Done()
-			break
-		}
-		b.mu.Unlock()
-	}
 	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
-	return errnoToStatus(b.getattr(ctx, n, f, out))
-}
+	if input.Fh() != 0 {
+		// The kernel names the handle for fstat(2).
+		defer unlockOps(b.lockOps(n, nil))
+		return errnoToStatus(b.getattr(ctx, n, fEntry.file, out, false))
+	}
 
-func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut) syscall.Errno {
-	var errno syscall.Errno
+	// The linux kernel doesnt pass along the file descriptor
+	// for stat(2) of the path, so we have to fake it here. The
+	// attributes are cached per inode, so the handle only goes
+	// to the node. See https://github.com/libfuse/libfuse/issues/62
+	var f FileHandle
+	b.mu.Lock()
+	for _, fh := range n.openFiles {
+		f = b.files[fh].file
+		b.files[fh].wg.Add(1)
+		defer b.files[fh].wg.Done()
+		break
+	}
+	b.mu.Unlock()
+	defer unlockOps(b.lockOps(n, nil))
+	return errnoToStatus(b.nodeGetattr(ctx, n, f, out, false))
+}
 
-	var fg FileGetattrer
-	if f != nil {
-		fg, _ = f.(FileGetattrer)
+// getattr asks f if it implements FileGetattrer, and the node
+// otherwise. f must be the handle the kernel named in the request:
+// it knows the file as it was opened, which may differ from what the
+// node finds, eg. if it was unlinked.
+func (b *rawBridge) getattr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut, noCache bool) syscall.Errno {
+	fg, ok := f.(FileGetattrer)
+	if !ok {
+		return b.nodeGetattr(ctx, n, f, out, noCache)
+	}
+	errno := fg.Getattr(ctx, out)
+	if errno == 0 {
+		b.finishAttr(ctx, n, out)
 	}
+	return errno
+}
 
+// nodeGetattr fills out from the attributes stored with
+// Inode.SetCachedAttr, unless noCache is set, and from the node
+// otherwise.
+func (b *rawBridge) nodeGetattr(ctx context.Context, n *Inode, f FileHandle, out *fuse.AttrOut, noCache bool) syscall.Errno {
+	if !noCache && n.loadCachedAttr(&out.Attr) {
+		b.finishAttr(ctx, n, out)
+		return OK
+	}
+	var errno syscall.Errno
 	if fops, ok := n.ops.(NodeGetattrer); ok {
 		errno = fops.Getattr(ctx, f, out)
-	} else if fg != nil {
-		errno = fg.Getattr(ctx, out)
 	} else {
 		// We set Mode below, which is the minimum for success
 	}
-
 	if errno == 0 {
-		if out.Ino != 0 && n.stableAttr.Ino > 1 && out.Ino != n.stableAttr.Ino {
-			b.logf("warning: rawBridge.getattr: overriding ino %d with %d", out.Ino, n.stableAttr.Ino)
-		}
-		out.Ino = n.stableAttr.Ino
-		out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
-		b.setAttr(&out.Attr)
-		b.setAttrTimeout(out)
+		b.finishAttr(ctx, n, out)
 	}
 	return errno
 }
 
+// finishAttr sets the parts of out that the bridge decides on.
+func (b *rawBridge) finishAttr(ctx context.Context, n *Inode, out *fuse.AttrOut) {
+	if out.Ino != 0 && n.stableAttr.Ino > 1 && out.Ino != n.stableAttr.Ino {
+		b.logf("warning: rawBridge.getattr: overriding ino %d with %d", out.Ino, n.stableAttr.Ino)
+	}
+	out.Ino = n.stableAttr.Ino
+	out.Mode = (out.Attr.Mode & 07777) | n.stableAttr.Mode
+	if c, ok := n.ops.(NodeCrtimer); ok && attrHasCrtime {
+		if t := c.Crtime(ctx); !t.IsZero() {
+			out.Attr.SetCrtime(t)
+		}
+	}
+	b.setAttr(&out.Attr)
+	b.setAttrTimeout(out)
+}
+
+func (b *rawBridge) Statx(cancel <-chan struct{}, input *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	n, fEntry := b.inode(input.NodeId, input.Fh())
+	defer unlockOps(b.lockOps(n, nil))
+	f := fEntry.file
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+
+	if fops, ok := n.ops.(NodeStatxer); ok {
+		errno := fops.Statx(ctx, f, input.SxFlags, input.SxMask, out)
+		if errno == 0 {
+			out.Ino = n.stableAttr.Ino
+			out.Mode = (out.Mode & 07777) | uint16(n.stableAttr.Mode)
+			out.Mask |= fuse.STATX_TYPE | fuse.STATX_INO
+			out.SetTimeout(b.scaleAttrTimeout(out.Timeout()))
+		}
+		return errnoToStatus(errno)
+	}
+
+	// Attributes from Inode.SetCachedAttr satisfy
+	// AT_STATX_DONT_SYNC, but AT_STATX_FORCE_SYNC must reach the
+	// node.
+	attrOut := fuse.AttrOut{}
+	noCache := input.SxFlags&fuse.AT_STATX_FORCE_SYNC != 0
+	if errno := b.getattr(ctx, n, f, &attrOut, noCache); errno != 0 {
+		return errnoToStatus(errno)
+	}
+	out.Statx.FromAttr(&attrOut.Attr)
+	if c, ok := n.ops.(NodeCrtimer); ok && !attrHasCrtime {
+		if t := c.Crtime(ctx); !t.IsZero() {
+			out.Btime = fuse.SxTime{Sec: t.Unix(), Nsec: uint32(t.Nanosecond())}
+			out.Mask |= fuse.STATX_BTIME
+		}
+	}
+	out.AttrValid = attrOut.AttrValid
+	out.AttrValidNsec = attrOut.AttrValidNsec
+	return fuse.OK
+}
+
 func (b *rawBridge) SetAttr(cancel <-chan struct{}, in *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
 
 	fh, _ := in.GetFh()
 
 	n, fEntry := b.inode(in.NodeId, fh)
+	defer unlockOps(b.lockOps(n, nil))
 	f := fEntry.file
+	n.InvalidateCachedAttr()
 
 	var errno = syscall.ENOTSUP
 	if fops, ok := n.ops.(NodeSetattrer); ok {
 		errno = fops.Setattr(ctx, f, in, out)
 	} else if fops, ok := f.(FileSetattrer); ok {
 		errno = fops.Setattr(ctx, in, out)
+	} else if in.Valid&^writebackTimes == 0 && b.writeback() {
+		// The kernel flushes the times of files it wrote
+		// through the cache, eg. on fsync. Ignore them
+		// rather than failing the fsync.
+		errno = b.getattr(ctx, n, f, out, false)
 	}
 
+	if errno == 0 && in.Valid&fuse.FATTR_KILL_SUIDGID != 0 {
+		b.killSuidgid(ctx, n, f, out)
+	}
 	out.Mode = n.stableAttr.Mode | (out.Mode & 07777)
+	if errno == 0 {
+		b.setAttrTimeout(out)
+	}
 	return errnoToStatus(errno)
 }
 
 func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	p1, _ := b.inode(input.NodeId, 0)
 	p2, _ := b.inode(input.Newdir, 0)
+	if st := checkDir(p1); !st.Ok() {
+		return st
+	}
+	if st := checkDir(p2); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(p1, p2))
 
 	if mops, ok := p1.ops.(NodeRenamer); ok {
 		errno := mops.Rename(&fuse.Context{Caller: input.Caller, Cancel: cancel}, oldName, p2.ops, newName, input.Flags)
@@ -604,8 +1107,19 @@ func (b *rawBridge) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName
 }
 
 func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(input.NodeId, 0)
 	target, _ := b.inode(input.Oldnodeid, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	if target.IsDir() {
+		// link(2) gives EPERM for directories.
+		return fuse.EPERM
+	}
+	defer unlockOps(b.lockOps(parent, target))
 
 	if mops, ok := parent.ops.(NodeLinker); ok {
 		child, errno := mops.Link(&fuse.Context{Caller: input.Caller, Cancel: cancel}, target.ops, name, out)
@@ -622,7 +1136,14 @@ func (b *rawBridge) Link(cancel <-chan struct{}, input *fuse.LinkIn, name string
 }
 
 func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, target string, name string, out *fuse.EntryOut) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	parent, _ := b.inode(header.NodeId, 0)
+	if st := checkDir(parent); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(parent, nil))
 
 	if mops, ok := parent.ops.(NodeSymlinker); ok {
 		child, status := mops.Symlink(&fuse.Context{Caller: header.Caller, Cancel: cancel}, target, name, out)
@@ -640,6 +1161,10 @@ func (b *rawBridge) Symlink(cancel <-chan struct{}, header *fuse.InHeader, targe
 
 func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
+	if n.stableAttr.Mode != syscall.S_IFLNK {
+		return nil, fuse.EINVAL
+	}
+	defer unlockOps(b.lockOps(n, nil))
 
 	if linker, ok := n.ops.(NodeReadlinker); ok {
 		result, errno := linker.Readlink(&fuse.Context{Caller: header.Caller, Cancel: cancel})
@@ -656,6 +1181,7 @@ func (b *rawBridge) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out
 
 func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
+	defer unlockOps(b.lockOps(n, nil))
 
 	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
 	if a, ok := n.ops.(NodeAccesser); ok {
@@ -666,7 +1192,7 @@ func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.St
 	caller := input.Caller
 
 	var out fuse.AttrOut
-	if s := b.getattr(ctx, n, nil, &out); s != 0 {
+	if s := b.getattr(ctx, n, nil, &out, false); s != 0 {
 		return errnoToStatus(s)
 	}
 
@@ -680,10 +1206,16 @@ func (b *rawBridge) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.St
 
 func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, data []byte) (uint32, fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
+	defer unlockOps(b.lockOps(n, nil))
 
+	if !b.xattrVisible(attr) {
+		return 0, fuse.ENOATTR
+	}
 	if xops, ok := n.ops.(NodeGetxattrer); ok {
-		nb, errno := xops.Getxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr, data)
-		return nb, errnoToStatus(errno)
+		ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+		return readXAttr(data, func(dest []byte) (uint32, syscall.Errno) {
+			return xops.Getxattr(ctx, attr, dest)
+		})
 	}
 
 	return 0, fuse.ENOATTR
@@ -691,15 +1223,134 @@ func (b *rawBridge) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr
 
 func (b *rawBridge) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, status fuse.Status) {
 	n, _ := b.inode(header.NodeId, 0)
+	defer unlockOps(b.lockOps(n, nil))
 	if xops, ok := n.ops.(NodeListxattrer); ok {
-		sz, errno := xops.Listxattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, dest)
-		return sz, errnoToStatus(errno)
+		ctx := &fuse.Context{Caller: header.Caller, Cancel: cancel}
+		if b.options.XAttrNamespaceFilter != nil {
+			return b.listFilteredXAttr(ctx, xops, dest)
+		}
+		return readXAttr(dest, func(dest []byte) (uint32, syscall.Errno) {
+			return xops.Listxattr(ctx, dest)
+		})
 	}
 	return 0, fuse.OK
 }
 
+// xattrMax bounds the size of attribute values and lists, like
+// XATTR_SIZE_MAX and XATTR_LIST_MAX do in Linux.
+const xattrMax = 64 << 10
+
+// readXAttr calls read, which is a Getxattr or Listxattr, and makes
+// the result follow the two-phase protocol of getxattr(2): for an
+// empty dest, the size of the data is returned; otherwise, if the
+// data does not fit, its size is returned with ERANGE. Nodes that
+// return ERANGE without a usable size are probed with larger buffers,
+// so the kernel never sees a size that does not fit.
+func readXAttr(dest []byte, read func(dest []byte) (uint32, syscall.Errno)) (uint32, fuse.Status) {
+	sz, errno := read(dest)
+	if errno == syscall.ERANGE && (int(sz) <= len(dest) || sz > xattrMax) {
+		data, errno := readAllXAttr(read)
+		if errno != 0 {
+			return 0, errnoToStatus(errno)
+		}
+		if len(data) <= len(dest) {
+			// The data shrunk in the meantime.
+			return uint32(copy(dest, data)), fuse.OK
+		}
+		sz = uint32(len(data))
+	} else if errno != 0 && errno != syscall.ERANGE {
+		return 0, errnoToStatus(errno)
+	}
+
+	if int(sz) > len(dest) && len(dest) > 0 {
+		// Also catches nodes that return a truncated value
+		// without an error.
+		return sz, fuse.ERANGE
+	}
+	return sz, fuse.OK
+}
+
+// readAllXAttr returns all the data of read, growing the buffer until
+// it fits.
+func readAllXAttr(read func(dest []byte) (uint32, syscall.Errno)) ([]byte, syscall.Errno) {
+	buf := make([]byte, 1024)
+	for {
+		sz, errno := read(buf)
+		if errno == 0 && int(sz) <= len(buf) {
+			return buf[:sz], OK
+		}
+		if errno != 0 && errno != syscall.ERANGE {
+			return nil, errno
+		}
+		if len(buf) >= xattrMax {
+			return nil, syscall.E2BIG
+		}
+		n := 2 * len(buf)
+		if int(sz) > n && sz <= xattrMax {
+			n = int(sz)
+		}
+		if n > xattrMax {
+			n = xattrMax
+		}
+		buf = make([]byte, n)
+	}
+}
+
+// listFilteredXAttr lists the attributes of xops into dest, leaving
+// out those rejected by Options.XAttrNamespaceFilter.
+func (b *rawBridge) listFilteredXAttr(ctx context.Context, xops NodeListxattrer, dest []byte) (uint32, fuse.Status) {
+	// The node reports the size of the unfiltered list, so always
+	// fetch all of it.
+	buf, errno := readAllXAttr(func(dest []byte) (uint32, syscall.Errno) {
+		return xops.Listxattr(ctx, dest)
+	})
+	if errno != 0 {
+		return 0, errnoToStatus(errno)
+	}
+
+	var filtered []byte
+	for _, name := range bytes.SplitAfter(buf, []byte{0}) {
+		if len(name) > 1 && b.xattrVisible(string(name[:len(name)-1])) {
+			filtered = append(filtered, name...)
+		}
+	}
+	sz := uint32(len(filtered))
+	if len(dest) == 0 {
+		return sz, fuse.OK
+	}
+	if len(filtered) > len(dest) {
+		return sz, fuse.ERANGE
+	}
+	copy(dest, filtered)
+	return sz, fuse.OK
+}
+
+// xattrVisible returns whether the attribute passes
+// Options.XAttrNamespaceFilter, or is let through by
+// Options.OverlayXAttrs.
+func (b *rawBridge) xattrVisible(attr string) bool {
+	if b.options.XAttrNamespaceFilter == nil || b.options.XAttrNamespaceFilter(attr) {
+		return true
+	}
+	return b.options.OverlayXAttrs && isOverlayXAttr(attr)
+}
+
+// isOverlayXAttr returns whether attr is one that overlayfs stores in
+// its layers, eg. trusted.overlay.opaque, or user.overlay.opaque with
+// the userxattr mount option.
+func isOverlayXAttr(attr string) bool {
+	return strings.HasPrefix(attr, "trusted.overlay.") || strings.HasPrefix(attr, "user.overlay.")
+}
+
 func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	n, _ := b.inode(input.NodeId, 0)
+	defer unlockOps(b.lockOps(n, nil))
+	if !b.xattrVisible(attr) {
+		return fuse.ENOTSUP
+	}
 	if xops, ok := n.ops.(NodeSetxattrer); ok {
 		return errnoToStatus(xops.Setxattr(&fuse.Context{Caller: input.Caller, Cancel: cancel}, attr, data, input.Flags))
 	}
@@ -707,7 +1358,14 @@ func (b *rawBridge) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, att
 }
 
 func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	n, _ := b.inode(header.NodeId, 0)
+	defer unlockOps(b.lockOps(n, nil))
+	if !b.xattrVisible(attr) {
+		return fuse.ENOATTR
+	}
 	if xops, ok := n.ops.(NodeRemovexattrer); ok {
 		return errnoToStatus(xops.Removexattr(&fuse.Context{Caller: header.Caller, Cancel: cancel}, attr))
 	}
@@ -715,26 +1373,122 @@ func (b *rawBridge) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, a
 }
 
 func (b *rawBridge) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if b.options.ReadOnly && (input.Flags&syscall.O_ACCMODE != syscall.O_RDONLY || input.Flags&syscall.O_TRUNC != 0) {
+		return fuse.EROFS
+	}
 	n, _ := b.inode(input.NodeId, 0)
+	if input.Flags&syscall.O_DIRECTORY != 0 {
+		if st := checkDir(n); !st.Ok() {
+			return st
+		}
+	} else if input.Flags&syscall.O_ACCMODE != syscall.O_RDONLY || input.Flags&syscall.O_TRUNC != 0 {
+		// Directories may be opened for reading only.
+		if st := checkNotDir(n); !st.Ok() {
+			return st
+		}
+	}
+	defer unlockOps(b.lockOps(n, nil))
+	if input.Flags&syscall.O_TRUNC != 0 {
+		n.InvalidateCachedAttr()
+	}
 
 	if op, ok := n.ops.(NodeOpener); ok {
-		f, flags, errno := op.Open(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
+		n.mu.Lock()
+		n.opening++
+		n.mu.Unlock()
+
+		ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+		f, flags, errno := op.Open(ctx, b.openFlags(input.Flags))
+
+		n.mu.Lock()
+		n.opening--
+		if n.invalidateOnOpen {
+			// The kernel drops the cached data if the
+			// reply lacks FOPEN_KEEP_CACHE.
+			flags &^= fuse.FOPEN_KEEP_CACHE
+			if n.opening == 0 {
+				n.invalidateOnOpen = false
+			}
+		}
+		n.mu.Unlock()
+
 		if errno != 0 {
 			return errnoToStatus(errno)
 		}
+		if input.Mode&fuse.OPEN_KILL_SUIDGID != 0 {
+			var attr fuse.AttrOut
+			if b.getattr(ctx, n, f, &attr, false) == 0 {
+				b.killSuidgid(ctx, n, f, &attr)
+			}
+		}
 
+		if atomicAppend(n, input.Flags) {
+			// Writes through the page cache would land
+			// at the kernel's offset.
+			flags |= fuse.FOPEN_DIRECT_IO
+		}
+		out.OpenFlags = flags
 		if f != nil {
+			backingId := b.registerBackingFd(f, out)
 			b.mu.Lock()
 			defer b.mu.Unlock()
 			out.Fh = uint64(b.registerFile(n, f, input.Flags))
+			b.files[out.Fh].backingId = backingId
 		}
-		out.OpenFlags = flags
 		return fuse.OK
 	}
 
 	return fuse.ENOTSUP
 }
 
+// backingFdRegistrar is implemented by *fuse.Server.
+type backingFdRegistrar interface {
+	RegisterBackingFd(m *fuse.BackingMap) (int32, syscall.Errno)
+	UnregisterBackingFd(id int32) syscall.Errno
+}
+
+// registerBackingFd sets up passthrough for f if enabled and
+// possible, updating out accordingly. It returns the backing ID, or
+// 0 if the file is served through the FUSE server.
+func (b *rawBridge) registerBackingFd(f FileHandle, out *fuse.OpenOut) int32 {
+	if !b.options.EnablePassthrough {
+		return 0
+	}
+	pf, ok := f.(FilePassthroughFder)
+	if !ok {
+		return 0
+	}
+	reg, ok := b.server.(backingFdRegistrar)
+	if !ok {
+		return 0
+	}
+	fd, ok := pf.PassthroughFd()
+	if !ok {
+		return 0
+	}
+	id, errno := reg.RegisterBackingFd(&fuse.BackingMap{Fd: int32(fd)})
+	if errno != 0 {
+		if errno != syscall.ENOSYS {
+			b.logf("warning: RegisterBackingFd: %v", errno)
+		}
+		return 0
+	}
+	out.OpenFlags |= fuse.FOPEN_PASSTHROUGH
+	out.BackingId = id
+	return id
+}
+
+func (b *rawBridge) unregisterBackingFd(id int32) {
+	if id == 0 {
+		return
+	}
+	if reg, ok := b.server.(backingFdRegistrar); ok {
+		if errno := reg.UnregisterBackingFd(id); errno != 0 {
+			b.logf("warning: UnregisterBackingFd(%d): %v", id, errno)
+		}
+	}
+}
+
 // registerFile hands out a file handle. Must have bridge.mu
 func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 	var fh uint32
@@ -750,6 +1504,9 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 	fileEntry := b.files[fh]
 	fileEntry.nodeIndex = len(n.openFiles)
 	fileEntry.file = f
+	// With the writeback cache, write-only files are also read.
+	fileEntry.openFlags = b.openFlags(flags)
+	fileEntry.backingId = 0
 
 	n.openFiles = append(n.openFiles, fh)
 	return fh
@@ -757,6 +1514,16 @@ func (b *rawBridge) registerFile(n *Inode, f FileHandle, flags uint32) uint32 {
 
 func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
 	n, f := b.inode(input.NodeId, input.Fh)
+	if st := checkNotDir(n); !st.Ok() {
+		return nil, st
+	}
+	if st := checkAccess(input.Fh, f, syscall.O_RDONLY); !st.Ok() {
+		return nil, st
+	}
+	if input.Offset > math.MaxInt64 {
+		return nil, fuse.EINVAL
+	}
+	defer unlockOps(b.lockOps(n, nil))
 
 	if fops, ok := n.ops.(NodeReader); ok {
 		res, errno := fops.Read(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, buf, int64(input.Offset))
@@ -772,6 +1539,7 @@ func (b *rawBridge) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte)
 
 func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	defer unlockOps(b.lockOps(n, nil))
 
 	if lops, ok := n.ops.(NodeGetlker); ok {
 		return errnoToStatus(lops.Getlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags, &out.Lk))
@@ -784,10 +1552,11 @@ func (b *rawBridge) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.Lk
 
 func (b *rawBridge) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	defer unlockOps(b.lockOps(n, nil))
 	if lops, ok := n.ops.(NodeSetlker); ok {
 		return errnoToStatus(lops.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
 	}
-	if sl, ok := n.ops.(FileSetlker); ok {
+	if sl, ok := f.file.(FileSetlker); ok {
 		return errnoToStatus(sl.Setlk(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
 	}
 	return fuse.ENOTSUP
@@ -797,7 +1566,7 @@ func (b *rawBridge) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status
 	if lops, ok := n.ops.(NodeSetlkwer); ok {
 		return errnoToStatus(lops.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Owner, &input.Lk, input.LkFlags))
 	}
-	if sl, ok := n.ops.(FileSetlkwer); ok {
+	if sl, ok := f.file.(FileSetlkwer); ok {
 		return errnoToStatus(sl.Setlkw(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Owner, &input.Lk, input.LkFlags))
 	}
 	return fuse.ENOTSUP
@@ -810,6 +1579,22 @@ func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 	}
 
 	f.wg.Wait()
+	defer unlockOps(b.lockOps(n, nil))
+
+	b.unregisterBackingFd(f.backingId)
+	f.backingId = 0
+
+	n.mu.Lock()
+	for kh, fh := range n.pollHandles {
+		if fh == input.Fh {
+			delete(n.pollHandles, kh)
+		}
+	}
+	n.mu.Unlock()
+
+	if lr, ok := n.ops.(NodeLockOwnerReleaser); ok && input.ReleaseFlags&fuse.RELEASE_FLOCK_UNLOCK != 0 {
+		lr.ReleaseOwner(input.LockOwner)
+	}
 
 	if r, ok := n.ops.(NodeReleaser); ok {
 		r.Release(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file)
@@ -819,6 +1604,8 @@ func (b *rawBridge) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
 
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	// Don't keep the handle alive until the slot is reused.
+	f.file = nil
 	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
 }
 
@@ -831,13 +1618,47 @@ func (b *rawBridge) ReleaseDir(input *fuse.ReleaseIn) {
 		f.dirStream.Close()
 		f.dirStream = nil
 	}
+	f.hasOverflow = false
+	f.overflow = fuse.DirEntry{}
 	f.mu.Unlock()
 
+	if r, ok := f.file.(FileReleasedirer); ok {
+		r.Releasedir(&fuse.Context{Caller: input.Caller}, input.ReleaseFlags)
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	f.file = nil
 	b.freeFiles = append(b.freeFiles, uint32(input.Fh))
 }
 
+// releaseOpenFiles releases the file handles that the kernel did not
+// release, because the connection went away while they were open.
+// It must only be called after the server stopped.
+func (b *rawBridge) releaseOpenFiles() {
+	b.mu.Lock()
+	var ins []*fuse.ReleaseIn
+	var dirs []bool
+	for nodeId, n := range b.kernelNodeIds {
+		for _, fh := range n.openFiles {
+			ins = append(ins, &fuse.ReleaseIn{
+				InHeader: fuse.InHeader{NodeId: nodeId},
+				Fh:       uint64(fh),
+			})
+			dirs = append(dirs, n.IsDir())
+		}
+	}
+	b.mu.Unlock()
+
+	for i, in := range ins {
+		if dirs[i] {
+			b.ReleaseDir(in)
+		} else {
+			b.Release(nil, in)
+		}
+	}
+}
+
 func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -858,22 +1679,107 @@ func (b *rawBridge) releaseFileEntry(nid uint64, fh uint64) (*Inode, *fileEntry)
 }
 
 func (b *rawBridge) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, status fuse.Status) {
+	if b.options.ReadOnly {
+		return 0, fuse.EROFS
+	}
 	n, f := b.inode(input.NodeId, input.Fh)
+	if st := checkNotDir(n); !st.Ok() {
+		return 0, st
+	}
+	if st := checkAccess(input.Fh, f, syscall.O_WRONLY); !st.Ok() {
+		return 0, st
+	}
+	defer unlockOps(b.lockOps(n, nil))
+	n.InvalidateCachedAttr()
 
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	off := input.Offset
+	if atomicAppend(n, f.openFlags) {
+		n.appendMu.Lock()
+		defer n.appendMu.Unlock()
+		var attr fuse.AttrOut
+		if errno := b.getattr(ctx, n, f.file, &attr, false); errno != 0 {
+			return 0, errnoToStatus(errno)
+		}
+		off = attr.Size
+	}
+	if st := checkWriteRange(off, uint64(len(data))); !st.Ok() {
+		return 0, st
+	}
+
+	var w uint32
+	var errno syscall.Errno
 	if wr, ok := n.ops.(NodeWriter); ok {
-		w, errno := wr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+		w, errno = wr.Write(ctx, f.file, data, int64(off))
+	} else if fr, ok := f.file.(FileWriter); ok {
+		w, errno = fr.Write(ctx, data, int64(off))
+	} else {
+		return 0, fuse.ENOTSUP
+	}
+	if errno == 0 && off != input.Offset {
+		// The kernel cached the file as if the data went to
+		// input.Offset.
+		n.NotifyContent(int64(off), int64(w))
+	}
+	if errno == 0 && input.WriteFlags&fuse.WRITE_KILL_SUIDGID != 0 {
+		var attr fuse.AttrOut
+		if b.getattr(ctx, n, f.file, &attr, false) == 0 {
+			b.killSuidgid(ctx, n, f.file, &attr)
+		}
 	}
-	if fr, ok := f.file.(FileWriter); ok {
-		w, errno := fr.Write(&fuse.Context{Caller: input.Caller, Cancel: cancel}, data, int64(input.Offset))
-		return w, errnoToStatus(errno)
+	return w, errnoToStatus(errno)
+}
+
+// atomicAppend returns whether writes to a handle of n opened with
+// openFlags go to the end of the file; see NodeAtomicAppender.
+func atomicAppend(n *Inode, openFlags uint32) bool {
+	ap, ok := n.ops.(NodeAtomicAppender)
+	return ok && openFlags&syscall.O_APPEND != 0 && ap.AtomicAppend()
+}
+
+// killSuidgid clears the setuid bit of n, and the setgid bit if the
+// file is group executable, as POSIX requires after a write or
+// truncate by a process that may not set them. attr holds the
+// current attributes, and is updated on success. The kernel only
+// asks for this with the KILL_SUIDGID flags if
+// MountOptions.HandleKillPriv was negotiated.
+func (b *rawBridge) killSuidgid(ctx context.Context, n *Inode, f FileHandle, attr *fuse.AttrOut) {
+	mode := attr.Mode & 07777
+	kill := mode & syscall.S_ISUID
+	if mode&(syscall.S_ISGID|syscall.S_IXGRP) == syscall.S_ISGID|syscall.S_IXGRP {
+		kill |= syscall.S_ISGID
+	}
+	if kill == 0 {
+		return
 	}
 
-	return 0, fuse.ENOTSUP
+	in := &fuse.SetAttrIn{}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		in.Caller = *caller
+	}
+	in.Valid = fuse.FATTR_MODE
+	in.Mode = mode &^ kill
+	var out fuse.AttrOut
+	var errno syscall.Errno
+	if fops, ok := n.ops.(NodeSetattrer); ok {
+		errno = fops.Setattr(ctx, f, in, &out)
+	} else if fops, ok := f.(FileSetattrer); ok {
+		errno = fops.Setattr(ctx, in, &out)
+	}
+	n.InvalidateCachedAttr()
+	if errno != 0 {
+		b.logf("warning: clearing setuid/setgid of %v: %v", n, errno)
+		return
+	}
+	*attr = out
 }
 
 func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	defer unlockOps(b.lockOps(n, nil))
+	if lr, ok := n.ops.(NodeLockOwnerReleaser); ok {
+		lr.ReleaseOwner(input.LockOwner)
+	}
 	if fl, ok := n.ops.(NodeFlusher); ok {
 		return errnoToStatus(fl.Flush(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file))
 	}
@@ -885,6 +1791,7 @@ func (b *rawBridge) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Stat
 
 func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	defer unlockOps(b.lockOps(n, nil))
 	if fs, ok := n.ops.(NodeFsyncer); ok {
 		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.FsyncFlags))
 	}
@@ -895,7 +1802,21 @@ func (b *rawBridge) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Stat
 }
 
 func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if b.options.ReadOnly {
+		return fuse.EROFS
+	}
 	n, f := b.inode(input.NodeId, input.Fh)
+	if st := checkNotDir(n); !st.Ok() {
+		return st
+	}
+	if st := checkAccess(input.Fh, f, syscall.O_WRONLY); !st.Ok() {
+		return st
+	}
+	if st := checkWriteRange(input.Offset, input.Length); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(n, nil))
+	n.InvalidateCachedAttr()
 	if a, ok := n.ops.(NodeAllocater); ok {
 		return errnoToStatus(a.Allocate(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.Offset, input.Length, input.Mode))
 	}
@@ -907,10 +1828,17 @@ func (b *rawBridge) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) f
 
 func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
+	if st := checkDir(n); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(n, nil))
 
 	var errno syscall.Errno
+	var fh FileHandle
 
 	switch od := n.ops.(type) {
+	case NodeOpendirHandler:
+		fh, out.OpenFlags, errno = od.OpendirHandle(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
 	case NodeOpendirerWithFlags:
 		out.OpenFlags, errno = od.Opendir(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.Flags)
 	case NodeOpendirer:
@@ -921,7 +1849,7 @@ func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fus
 	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	out.Fh = uint64(b.registerFile(n, nil, 0))
+	out.Fh = uint64(b.registerFile(n, fh, 0))
 	return fuse.OK
 }
 
@@ -929,25 +1857,41 @@ func (b *rawBridge) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fus
 // seeks to offset requested in `input`. Caller must hold `f.mu`.
 // The `eof` return value shows if `f.dirStream` ended before the requested
 // offset was reached.
-func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode *Inode, f *fileEntry) (errno syscall.Errno, eof bool) {
+func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode *Inode, f *fileEntry, plus bool) (errno syscall.Errno, eof bool) {
 	// Get a new directory stream in the following cases:
 	// 1) f.dirStream == nil ............ First READDIR[PLUS] on this file handle.
 	// 2) input.Offset == 0 ............. Start reading the directory again from
 	//                                    the beginning (user called rewinddir(3) or lseek(2)).
 	// 3) input.Offset < f.nextOffset ... Seek back (user called seekdir(3) or lseek(2)).
+	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	if f.dirStream != nil && input.Offset != 0 && input.Offset != f.dirOffset {
+		if sk, ok := dirSeeker(f.dirStream); ok {
+			errno := b.seekStream(ctx, sk, input.Offset, f)
+			if errno == 0 || input.Offset > f.dirOffset {
+				return errno, false
+			}
+			// The stream may only keep recent entries;
+			// seek back from a new one.
+		}
+	}
 	if f.dirStream == nil || input.Offset == 0 || input.Offset < f.dirOffset {
 		if f.dirStream != nil {
 			f.dirStream.Close()
 			f.dirStream = nil
 		}
-		str, errno := b.getStream(&fuse.Context{Caller: input.Caller, Cancel: cancel}, inode)
+		str, errno := b.getStream(ctx, inode, f.file, plus)
 		if errno != 0 {
 			return errno, false
 		}
 
 		f.dirOffset = 0
 		f.hasOverflow = false
+		f.dirErrno = 0
 		f.dirStream = str
+
+		if sk, ok := dirSeeker(str); ok && input.Offset != 0 {
+			return b.seekStream(ctx, sk, input.Offset, f), false
+		}
 	}
 
 	// Seek forward?
@@ -958,54 +1902,110 @@ func (b *rawBridge) setStream(cancel <-chan struct{}, input *fuse.ReadIn, inode
 			// user will get an empty directory listing.
 			return 0, true
 		}
-		_, errno := f.dirStream.Next()
+		e, errno := f.dirStream.Next()
 		if errno != 0 {
 			return errno, true
 		}
-		f.dirOffset++
+		f.dirOffset = nextDirOffset(f.dirOffset, e)
 	}
 
 	return 0, false
 }
 
-func (b *rawBridge) getStream(ctx context.Context, inode *Inode) (DirStream, syscall.Errno) {
-	if rd, ok := inode.ops.(NodeReaddirer); ok {
+// seekStream positions a DirSeeker stream at off. Caller must hold
+// `f.mu`.
+func (b *rawBridge) seekStream(ctx context.Context, sk DirSeeker, off uint64, f *fileEntry) syscall.Errno {
+	f.hasOverflow = false
+	f.dirErrno = 0
+	if errno := sk.Seekdir(ctx, off); errno != 0 {
+		return errno
+	}
+	f.dirOffset = off
+	return 0
+}
+
+// dirSeeker returns the DirSeeker implementation of str, if any.
+func dirSeeker(str DirStream) (DirSeeker, bool) {
+	if pa, ok := str.(*dirPlusAdapter); ok {
+		sk, ok := pa.DirPlusStream.(DirSeeker)
+		return sk, ok
+	}
+	sk, ok := str.(DirSeeker)
+	return sk, ok
+}
+
+// nextDirOffset returns the directory offset after e, which is
+// preceded by offset off.
+func nextDirOffset(off uint64, e fuse.DirEntry) uint64 {
+	if e.Off != 0 {
+		return e.Off
+	}
+	return off + 1
+}
+
+func (b *rawBridge) getStream(ctx context.Context, inode *Inode, fh FileHandle, plus bool) (DirStream, syscall.Errno) {
+	if rd, ok := fh.(FileReaddirer); ok {
+		return rd.Readdir(ctx)
+	}
+	rdp, hasPlus := inode.ops.(NodeReaddirPluser)
+	rd, hasReaddir := inode.ops.(NodeReaddirer)
+	if hasPlus && (plus || !hasReaddir) {
+		str, errno := rdp.ReaddirPlus(ctx)
+		if errno != 0 {
+			return nil, errno
+		}
+		return &dirPlusAdapter{DirPlusStream: str}, 0
+	}
+	if hasReaddir {
 		return rd.Readdir(ctx)
 	}
 
 	r := []fuse.DirEntry{}
-	for k, ch := range inode.Children() {
-		r = append(r, fuse.DirEntry{Mode: ch.Mode(),
-			Name: k,
-			Ino:  ch.StableAttr().Ino})
+	for _, e := range inode.ChildrenSorted() {
+		r = append(r, fuse.DirEntry{Mode: e.Child.Mode(),
+			Name: e.Name,
+			Ino:  e.Child.StableAttr().Ino})
 	}
 	return NewListDirStream(r), 0
 }
 
 func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	if st := checkDir(n); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(n, nil))
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	errno, eof := b.setStream(cancel, input, n, f)
+	errno, eof := b.setStream(cancel, input, n, f, false)
 	if errno != 0 {
 		return errnoToStatus(errno)
+	} else if f.dirErrno != 0 {
+		errno, f.dirErrno = f.dirErrno, 0
+		return errnoToStatus(errno)
 	} else if eof {
 		return fuse.OK
 	}
 
+	added := false
 	if f.hasOverflow {
 		// always succeeds.
 		out.AddDirEntry(f.overflow)
 		f.hasOverflow = false
-		f.dirOffset++
+		f.dirOffset = nextDirOffset(f.dirOffset, f.overflow)
+		added = true
 	}
 
 	for f.dirStream.HasNext() {
 		e, errno := f.dirStream.Next()
 
 		if errno != 0 {
+			if added {
+				f.dirErrno = errno
+				return fuse.OK
+			}
 			return errnoToStatus(errno)
 		}
 		if !out.AddDirEntry(e) {
@@ -1013,7 +2013,8 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 			f.hasOverflow = true
 			return errnoToStatus(errno)
 		}
-		f.dirOffset++
+		f.dirOffset = nextDirOffset(f.dirOffset, e)
+		added = true
 	}
 
 	return fuse.OK
@@ -1021,18 +2022,26 @@ func (b *rawBridge) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fus
 
 func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
 	n, f := b.inode(input.NodeId, input.Fh)
+	if st := checkDir(n); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(n, nil))
 
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	errno, eof := b.setStream(cancel, input, n, f)
+	errno, eof := b.setStream(cancel, input, n, f, true)
 	if errno != 0 {
 		return errnoToStatus(errno)
+	} else if f.dirErrno != 0 {
+		errno, f.dirErrno = f.dirErrno, 0
+		return errnoToStatus(errno)
 	} else if eof {
 		return fuse.OK
 	}
 
 	ctx := &fuse.Context{Caller: input.Caller, Cancel: cancel}
+	added := false
 	for f.dirStream.HasNext() || f.hasOverflow {
 		var e fuse.DirEntry
 		var errno syscall.Errno
@@ -1045,6 +2054,10 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 		}
 
 		if errno != 0 {
+			if added {
+				f.dirErrno = errno
+				return fuse.OK
+			}
 			return errnoToStatus(errno)
 		}
 
@@ -1054,7 +2067,8 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 			f.hasOverflow = true
 			return fuse.OK
 		}
-		f.dirOffset++
+		f.dirOffset = nextDirOffset(f.dirOffset, e)
+		added = true
 
 		// Virtual entries "." and ".." should be part of the
 		// directory listing, but not part of the filesystem tree.
@@ -1065,7 +2079,16 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 			continue
 		}
 
-		child, errno := b.lookup(ctx, n, e.Name, entryOut)
+		var child *Inode
+		if pa, ok := f.dirStream.(*dirPlusAdapter); ok && pa.last.Child != nil {
+			// pa.last is the entry for e, also if e was
+			// the overflow: Next was not called since.
+			child = pa.last.Child
+			*entryOut = pa.last.Out
+			errno = 0
+		} else {
+			child, errno = b.lookup(ctx, n, e.Name, entryOut)
+		}
 		if errno != 0 {
 			if b.options.NegativeTimeout != nil {
 				entryOut.SetEntryTimeout(*b.options.NegativeTimeout)
@@ -1086,9 +2109,16 @@ func (b *rawBridge) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out
 }
 
 func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
-	n, _ := b.inode(input.NodeId, input.Fh)
+	n, f := b.inode(input.NodeId, input.Fh)
+	if st := checkDir(n); !st.Ok() {
+		return st
+	}
+	defer unlockOps(b.lockOps(n, nil))
 	if fs, ok := n.ops.(NodeFsyncer); ok {
-		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, nil, input.FsyncFlags))
+		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, f.file, input.FsyncFlags))
+	}
+	if fs, ok := f.file.(FileFsyncer); ok {
+		return errnoToStatus(fs.Fsync(&fuse.Context{Caller: input.Caller, Cancel: cancel}, input.FsyncFlags))
 	}
 
 	return fuse.ENOTSUP
@@ -1096,34 +2126,217 @@ func (b *rawBridge) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.S
 
 func (b *rawBridge) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
 	n, _ := b.inode(input.NodeId, 0)
-	if sf, ok := n.ops.(NodeStatfser); ok {
-		return errnoToStatus(sf.Statfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}, out))
+	for p := n; p != nil; _, p = p.Parent() {
+		if sf, ok := p.ops.(NodeStatfser); ok {
+			defer unlockOps(b.lockOps(p, nil))
+			return errnoToStatus(sf.Statfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}, out))
+		}
 	}
 
-	// leave zeroed out
+	b.defaultStatfs(out)
+	return fuse.OK
+}
+
+func (b *rawBridge) SyncFs(cancel <-chan struct{}, input *fuse.SyncFsIn) fuse.Status {
+	n, _ := b.inode(input.NodeId, 0)
+	for p := n; p != nil; _, p = p.Parent() {
+		if sf, ok := p.ops.(NodeSyncfser); ok {
+			defer unlockOps(b.lockOps(p, nil))
+			return errnoToStatus(sf.Syncfs(&fuse.Context{Caller: input.Caller, Cancel: cancel}))
+		}
+	}
 	return fuse.OK
 }
 
+// defaultStatfs fills in plausible numbers for file systems that
+// don't implement Statfs, so df(1) doesn't report them as full.
+func (b *rawBridge) defaultStatfs(out *fuse.StatfsOut) {
+	const (
+		blockSize = 4096
+		blocks    = 1 << 40 / blockSize
+		files     = 1 << 32
+	)
+	*out = fuse.StatfsOut{
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		NameLen: 255,
+		Blocks:  blocks,
+		Bfree:   blocks,
+		Bavail:  blocks,
+		Files:   files,
+		Ffree:   files - uint64(b.InodeCount()),
+	}
+}
+
+// writebackTimes are the SETATTR fields that the kernel sends to
+// flush the times it keeps with the writeback cache.
+const writebackTimes = fuse.FATTR_MTIME | fuse.FATTR_CTIME | fuse.FATTR_FH | fuse.FATTR_LOCKOWNER
+
+// writeback returns whether the writeback cache was negotiated.
+func (b *rawBridge) writeback() bool {
+	if !b.options.EnableWritebackCache {
+		return false
+	}
+	s, ok := b.server.(interface{ NegotiatedSettings() *fuse.InitOut })
+	return ok && s.NegotiatedSettings().Flags&fuse.CAP_WRITEBACK_CACHE != 0
+}
+
+// dontMask returns whether the kernel passes modes without applying
+// the umask, see MountOptions.DontMask.
+func (b *rawBridge) dontMask() bool {
+	if !b.options.DontMask {
+		return false
+	}
+	s, ok := b.server.(interface{ NegotiatedSettings() *fuse.InitOut })
+	return ok && s.NegotiatedSettings().Flags&fuse.CAP_DONT_MASK != 0
+}
+
+// openFlags returns the flags to pass to a node for opening a file.
+// With the writeback cache, the kernel reads from files opened only
+// for writing, to fill partial pages, and implements O_APPEND itself.
+func (b *rawBridge) openFlags(flags uint32) uint32 {
+	if !b.writeback() {
+		return flags
+	}
+	if flags&syscall.O_ACCMODE == syscall.O_WRONLY {
+		flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+	}
+	return flags &^ syscall.O_APPEND
+}
+
 func (b *rawBridge) Init(s *fuse.Server) {
 	b.server = s
 }
 
 func (b *rawBridge) CopyFileRange(cancel <-chan struct{}, in *fuse.CopyFileRangeIn) (size uint32, status fuse.Status) {
+	if b.options.ReadOnly {
+		return 0, fuse.EROFS
+	}
 	n1, f1 := b.inode(in.NodeId, in.FhIn)
+	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
+	if st := checkNotDir(n1); !st.Ok() {
+		return 0, st
+	}
+	if st := checkNotDir(n2); !st.Ok() {
+		return 0, st
+	}
+	if st := checkAccess(in.FhIn, f1, syscall.O_RDONLY); !st.Ok() {
+		return 0, st
+	}
+	if st := checkAccess(in.FhOut, f2, syscall.O_WRONLY); !st.Ok() {
+		return 0, st
+	}
+	if st := checkWriteRange(in.OffOut, in.Len); !st.Ok() {
+		return 0, st
+	}
 	cfr, ok := n1.ops.(NodeCopyFileRanger)
 	if !ok {
 		return 0, fuse.ENOTSUP
 	}
 
-	n2, f2 := b.inode(in.NodeIdOut, in.FhOut)
+	defer unlockOps(b.lockOps(n1, n2))
+	n2.InvalidateCachedAttr()
 
 	sz, errno := cfr.CopyFileRange(&fuse.Context{Caller: in.Caller, Cancel: cancel},
 		f1.file, in.OffIn, n2, f2.file, in.OffOut, in.Len, in.Flags)
 	return sz, errnoToStatus(errno)
 }
 
+func (b *rawBridge) Poll(cancel <-chan struct{}, in *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	n, f := b.inode(in.NodeId, in.Fh)
+	defer unlockOps(b.lockOps(n, nil))
+
+	if in.Flags&fuse.FUSE_POLL_SCHEDULE_NOTIFY != 0 {
+		n.mu.Lock()
+		if n.pollHandles == nil {
+			n.pollHandles = map[uint64]uint64{}
+		}
+		n.pollHandles[in.Kh] = in.Fh
+		n.mu.Unlock()
+	}
+
+	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	var errno syscall.Errno
+	if p, ok := n.ops.(NodePoller); ok {
+		out.Revents, errno = p.Poll(ctx, f.file, in.Events)
+	} else if p, ok := f.file.(FilePoller); ok {
+		out.Revents, errno = p.Poll(ctx, in.Events)
+	} else {
+		// ENOSYS would make the kernel stop polling any file.
+		out.Revents = fuse.DEFAULT_POLLMASK
+	}
+	return errnoToStatus(errno)
+}
+
+func (b *rawBridge) Ioctl(cancel <-chan struct{}, in *fuse.IoctlIn, inbuf []byte, out *fuse.IoctlOut) ([]byte, fuse.Status) {
+	n, f := b.inode(in.NodeId, in.Fh)
+	defer unlockOps(b.lockOps(n, nil))
+
+	ctx := &fuse.Context{Caller: in.Caller, Cancel: cancel}
+	if sz, ok := n.ops.(NodeIoctlSizer); ok && in.Flags&fuse.FUSE_IOCTL_UNRESTRICTED != 0 {
+		inSize, outSize, errno := sz.IoctlSize(ctx, f.file, in.Cmd, in.Arg)
+		if errno != 0 {
+			return nil, errnoToStatus(errno)
+		}
+		if in.InSize < inSize || in.OutSize < outSize {
+			return ioctlRetry(in.Arg, inSize, outSize, out), fuse.OK
+		}
+	}
+
+	var result int32
+	var data []byte
+	var errno syscall.Errno
+	if ic, ok := n.ops.(NodeIoctler); ok {
+		result, data, errno = ic.Ioctl(ctx, f.file, in.Cmd, in.Arg, inbuf, in.OutSize, in.Flags)
+	} else if ic, ok := f.file.(FileIoctler); ok {
+		result, data, errno = ic.Ioctl(ctx, in.Cmd, in.Arg, inbuf, in.OutSize, in.Flags)
+	} else {
+		return nil, fuse.ENOTTY
+	}
+	if errno != 0 {
+		return nil, errnoToStatus(errno)
+	}
+	if len(data) > int(in.OutSize) {
+		data = data[:in.OutSize]
+	}
+	out.Result = result
+	return data, fuse.OK
+}
+
+// ioctlRetry fills out to ask the kernel to retry the ioctl with the
+// given buffers at arg, and returns the iovecs for the reply.
+func ioctlRetry(arg uint64, inSize, outSize uint32, out *fuse.IoctlOut) []byte {
+	var iovs []fuse.IoctlIovec
+	if inSize > 0 {
+		iovs = append(iovs, fuse.IoctlIovec{Base: arg, Len: uint64(inSize)})
+		out.InIovs = 1
+	}
+	if outSize > 0 {
+		iovs = append(iovs, fuse.IoctlIovec{Base: arg, Len: uint64(outSize)})
+		out.OutIovs = 1
+	}
+	out.Flags = fuse.FUSE_IOCTL_RETRY
+
+	sz := int(unsafe.Sizeof(fuse.IoctlIovec{}))
+	data := make([]byte, len(iovs)*sz)
+	for i := range iovs {
+		*(*fuse.IoctlIovec)(unsafe.Pointer(&data[i*sz])) = iovs[i]
+	}
+	return data
+}
+
 func (b *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	n, f := b.inode(in.NodeId, in.Fh)
+	if n.IsDir() {
+		// READDIR carries the offset, and seeks the directory
+		// stream as needed. Directories have no data or holes.
+		if in.Whence == _SEEK_SET {
+			out.Offset = in.Offset
+			return fuse.OK
+		}
+		return fuse.EINVAL
+	}
+	defer unlockOps(b.lockOps(n, nil))
 
 	ls, ok := n.ops.(NodeLseeker)
 	if ok {
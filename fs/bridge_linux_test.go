@@ -0,0 +1,79 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// unlinkedNode reports ENOENT from Getattr, as if it were unlinked,
+// and hands out handles that still know the size.
+type unlinkedNode struct {
+	Inode
+}
+
+var _ = (NodeGetattrer)((*unlinkedNode)(nil))
+var _ = (NodeOpener)((*unlinkedNode)(nil))
+
+func (n *unlinkedNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return syscall.ENOENT
+}
+
+func (n *unlinkedNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &sizeHandle{size: 5}, 0, OK
+}
+
+type sizeHandle struct {
+	size uint64
+}
+
+var _ = (FileGetattrer)((*sizeHandle)(nil))
+
+func (h *sizeHandle) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Size = h.size
+	return OK
+}
+
+func TestGetattrPrefersHandle(t *testing.T) {
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &unlinkedNode{}, StableAttr{}), false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	in := fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}
+	var out fuse.AttrOut
+	if st := rb.GetAttr(nil, &in, &out); st != fuse.ENOENT {
+		t.Errorf("GetAttr without handle: got %v, want ENOENT", st)
+	}
+
+	var openOut fuse.OpenOut
+	if st := rb.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	// stat(2) of the path, while the file is open, goes to the
+	// node.
+	out = fuse.AttrOut{}
+	if st := rb.GetAttr(nil, &in, &out); st != fuse.ENOENT {
+		t.Errorf("GetAttr of open file without handle: got %v, want ENOENT", st)
+	}
+
+	// The kernel names the handle for fstat(2).
+	in.Flags_ = fuse.FUSE_GETATTR_FH
+	in.Fh_ = openOut.Fh
+	out = fuse.AttrOut{}
+	if st := rb.GetAttr(nil, &in, &out); !st.Ok() || out.Size != 5 {
+		t.Errorf("GetAttr with handle: got %v, size %d, want OK, 5", st, out.Size)
+	}
+}
@@ -5,13 +5,17 @@
 package fs
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -238,3 +242,1066 @@ func (fn *testIno1) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 	child := fn.NewInode(ctx, &testIno1{}, stable)
 	return child, 0
 }
+
+type timeoutNode struct {
+	Inode
+	timeout time.Duration
+}
+
+func (n *timeoutNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.SetTimeout(n.timeout)
+	return 0
+}
+
+type timeoutLookupNode struct {
+	Inode
+}
+
+func (n *timeoutLookupNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if name == "custom" {
+		out.SetEntryTimeout(time.Hour)
+		out.SetAttrTimeout(2 * time.Hour)
+	}
+	return n.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG}), 0
+}
+
+func TestPerNodeTimeout(t *testing.T) {
+	sec := time.Second
+	opts := &Options{EntryTimeout: &sec, AttrTimeout: &sec}
+
+	root := &Inode{}
+	rawFS := NewNodeFS(root, opts)
+	ctx := context.Background()
+	root.AddChild("immutable", root.NewPersistentInode(ctx, &timeoutNode{timeout: time.Hour}, StableAttr{}), false)
+	root.AddChild("default", root.NewPersistentInode(ctx, &timeoutNode{}, StableAttr{}), false)
+
+	for name, want := range map[string]time.Duration{"immutable": time.Hour, "default": time.Second} {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup %q: %v", name, st)
+		}
+		if got := out.AttrTimeout(); got != want {
+			t.Errorf("%s: Lookup attr timeout %v, want %v", name, got, want)
+		}
+
+		var attrOut fuse.AttrOut
+		in := &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: out.NodeId}}
+		if st := rawFS.GetAttr(nil, in, &attrOut); !st.Ok() {
+			t.Fatalf("GetAttr %q: %v", name, st)
+		}
+		if got := attrOut.Timeout(); got != want {
+			t.Errorf("%s: GetAttr timeout %v, want %v", name, got, want)
+		}
+	}
+
+	rawFS = NewNodeFS(&timeoutLookupNode{}, opts)
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "custom", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if out.EntryTimeout() != time.Hour || out.AttrTimeout() != 2*time.Hour {
+		t.Errorf("got entry %v attr %v, want 1h, 2h", out.EntryTimeout(), out.AttrTimeout())
+	}
+	out = fuse.EntryOut{}
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "other", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	if out.EntryTimeout() != sec || out.AttrTimeout() != sec {
+		t.Errorf("got entry %v attr %v, want 1s, 1s", out.EntryTimeout(), out.AttrTimeout())
+	}
+}
+
+// appearingDir has files that appear behind the kernel's back. It
+// asks not to cache negative lookups for names starting with
+// "uncached".
+type appearingDir struct {
+	Inode
+
+	mu      sync.Mutex
+	names   map[string]bool
+	lookups map[string]int
+}
+
+var _ = (NodeLookuper)((*appearingDir)(nil))
+
+func (d *appearingDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lookups[name]++
+	if !d.names[name] {
+		if strings.HasPrefix(name, "uncached") {
+			out.SetEntryTimeout(0)
+		}
+		return nil, syscall.ENOENT
+	}
+	return d.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG}), OK
+}
+
+func (d *appearingDir) add(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.names[name] = true
+}
+
+func TestNegativeTimeout(t *testing.T) {
+	hour := time.Hour
+	root := &appearingDir{names: map[string]bool{}, lookups: map[string]int{}}
+	mntDir, _, clean := testMount(t, root, &Options{NegativeTimeout: &hour})
+	defer clean()
+
+	for _, name := range []string{"cached", "uncached"} {
+		if _, err := os.Stat(mntDir + "/" + name); !os.IsNotExist(err) {
+			t.Fatalf("Stat %q: got %v, want ENOENT", name, err)
+		}
+		root.add(name)
+	}
+
+	// The negative entry hides the new file.
+	if _, err := os.Stat(mntDir + "/cached"); !os.IsNotExist(err) {
+		t.Errorf("Stat cached: got %v, want cached ENOENT", err)
+	}
+	// Without a negative entry, the new file is visible.
+	if _, err := os.Stat(mntDir + "/uncached"); err != nil {
+		t.Errorf("Stat uncached: %v", err)
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if got := root.lookups["cached"]; got != 1 {
+		t.Errorf("got %d lookups for cached, want 1", got)
+	}
+	if got := root.lookups["uncached"]; got != 2 {
+		t.Errorf("got %d lookups for uncached, want 2", got)
+	}
+}
+
+// timeoutDir finds any name, setting the entry timeouts from its map.
+type timeoutDir struct {
+	Inode
+
+	timeouts map[string]time.Duration
+}
+
+var _ = (NodeLookuper)((*timeoutDir)(nil))
+
+func (d *timeoutDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if dt, ok := d.timeouts[name]; ok {
+		out.SetEntryTimeout(dt)
+	}
+	return d.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG}), OK
+}
+
+func TestLookupEntryTimeoutWithNegativeTimeout(t *testing.T) {
+	entry, negative := time.Hour, time.Minute
+	root := &timeoutDir{timeouts: map[string]time.Duration{
+		"negative": negative,
+		"short":    time.Second,
+	}}
+	rb := NewNodeFS(root, &Options{
+		EntryTimeout:    &entry,
+		NegativeTimeout: &negative,
+	}).(*rawBridge)
+
+	for name, want := range map[string]time.Duration{
+		"unset":    entry,
+		"negative": negative,
+		"short":    time.Second,
+	} {
+		var out fuse.EntryOut
+		if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup %q: %v", name, st)
+		}
+		if got := out.EntryTimeout(); got != want {
+			t.Errorf("Lookup %q: got entry timeout %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestPresetEntryTimeout(t *testing.T) {
+	for _, dt := range []time.Duration{0, time.Millisecond, time.Second, 90 * time.Second} {
+		var out fuse.EntryOut
+		presetEntryTimeout(&out, dt)
+		if got := out.EntryTimeout(); got != dt {
+			t.Errorf("got %v, want %v", got, dt)
+		}
+		if !entryTimeoutPreset(&out) {
+			t.Errorf("%v: preset timeout not recognized", dt)
+		}
+		out.SetEntryTimeout(dt)
+		if entryTimeoutPreset(&out) {
+			t.Errorf("%v: timeout set by SetEntryTimeout taken as preset", dt)
+		}
+	}
+}
+
+// readdirPlusRoot lists a fixed set of files, counting how they are
+// discovered.
+type readdirPlusRoot struct {
+	Inode
+
+	lookups, readdirs, readdirPluses int
+}
+
+var _ = (NodeLookuper)((*readdirPlusRoot)(nil))
+var _ = (NodeReaddirer)((*readdirPlusRoot)(nil))
+var _ = (NodeReaddirPluser)((*readdirPlusRoot)(nil))
+
+var readdirPlusNames = []string{"a", "b", "c"}
+
+func (r *readdirPlusRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	r.lookups++
+	return r.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG}), 0
+}
+
+func (r *readdirPlusRoot) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	r.readdirs++
+	var list []fuse.DirEntry
+	for _, nm := range readdirPlusNames {
+		list = append(list, fuse.DirEntry{Name: nm, Mode: syscall.S_IFREG})
+	}
+	return NewListDirStream(list), 0
+}
+
+func (r *readdirPlusRoot) ReaddirPlus(ctx context.Context) (DirPlusStream, syscall.Errno) {
+	r.readdirPluses++
+	var list []DirPlusEntry
+	for _, nm := range readdirPlusNames {
+		list = append(list, DirPlusEntry{
+			DirEntry: fuse.DirEntry{Name: nm, Mode: syscall.S_IFREG},
+			Child:    r.NewInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFREG}),
+		})
+	}
+	return NewListDirPlusStream(list), 0
+}
+
+func TestReaddirPlusBatch(t *testing.T) {
+	root := &readdirPlusRoot{}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	openIn := fuse.OpenIn{}
+	openIn.NodeId = 1
+	openOut := fuse.OpenOut{}
+	if status := rb.OpenDir(nil, &openIn, &openOut); !status.Ok() {
+		t.Fatal(status)
+	}
+	readIn := fuse.ReadIn{}
+	readIn.NodeId = 1
+	readIn.Fh = openOut.Fh
+
+	// Each buffer fits a single entry, so every call but the first
+	// starts with the overflow of the previous one.
+	entrySize := int(unsafe.Sizeof(fuse.EntryOut{})) + 24 + 8
+	for i := range readdirPlusNames {
+		readIn.Offset = uint64(i)
+		dirents := fuse.NewDirEntryList(make([]byte, entrySize), readIn.Offset)
+		if status := rb.ReadDirPlus(nil, &readIn, dirents); !status.Ok() {
+			t.Fatal(status)
+		}
+	}
+	if root.readdirPluses != 1 || root.readdirs != 0 || root.lookups != 0 {
+		t.Errorf("READDIRPLUS: got %d ReaddirPlus, %d Readdir, %d Lookup calls, want 1, 0, 0",
+			root.readdirPluses, root.readdirs, root.lookups)
+	}
+	for _, nm := range readdirPlusNames {
+		if root.GetChild(nm) == nil {
+			t.Errorf("child %q not added", nm)
+		}
+	}
+
+	readIn.Offset = 0
+	if status := rb.ReadDir(nil, &readIn, fuse.NewDirEntryList(make([]byte, 400), 0)); !status.Ok() {
+		t.Fatal(status)
+	}
+	if root.readdirs != 1 {
+		t.Errorf("READDIR: got %d Readdir calls, want 1", root.readdirs)
+	}
+}
+
+// naiveCreateDir checks for existence and creates in separate steps,
+// so concurrent creates race unless the bridge serializes them.
+type naiveCreateDir struct {
+	Inode
+
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+var _ = (NodeLookuper)((*naiveCreateDir)(nil))
+var _ = (NodeCreater)((*naiveCreateDir)(nil))
+
+func (d *naiveCreateDir) exists(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.names[name]
+}
+
+func (d *naiveCreateDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	if !d.exists(name) {
+		return nil, syscall.ENOENT
+	}
+	return d.NewInode(ctx, &Inode{}, StableAttr{}), OK
+}
+
+func (d *naiveCreateDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	if d.exists(name) {
+		return nil, nil, 0, syscall.EEXIST
+	}
+	time.Sleep(time.Millisecond)
+	d.mu.Lock()
+	d.names[name] = true
+	d.mu.Unlock()
+	return d.NewInode(ctx, &Inode{}, StableAttr{}), nil, 0, OK
+}
+
+func TestCreateExclusive(t *testing.T) {
+	root := &naiveCreateDir{names: map[string]bool{}}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	const n = 20
+	var successes, exists int32
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			in := fuse.CreateIn{
+				Flags: syscall.O_CREAT | syscall.O_EXCL | syscall.O_RDWR,
+				Mode:  0644,
+			}
+			in.NodeId = 1
+			var out fuse.CreateOut
+			switch st := rb.Create(nil, &in, "file", &out); st {
+			case fuse.OK:
+				atomic.AddInt32(&successes, 1)
+			case fuse.Status(syscall.EEXIST):
+				atomic.AddInt32(&exists, 1)
+			default:
+				t.Errorf("Create: %v", st)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if successes != 1 || exists != n-1 {
+		t.Errorf("got %d successes and %d EEXIST, want 1 and %d", successes, exists, n-1)
+	}
+}
+
+// blindCreateDir creates without checking for existence.
+type blindCreateDir struct {
+	naiveCreateDir
+}
+
+func (d *blindCreateDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	d.mu.Lock()
+	d.names[name] = true
+	d.mu.Unlock()
+	return d.NewInode(ctx, &Inode{}, StableAttr{}), nil, 0, OK
+}
+
+func TestCreateExclusiveKnownChild(t *testing.T) {
+	root := &blindCreateDir{naiveCreateDir{names: map[string]bool{"known": true}}}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+	ctx := context.Background()
+	for _, name := range []string{"known", "stale"} {
+		root.AddChild(name, root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+	}
+
+	for _, c := range []struct {
+		name string
+		want fuse.Status
+	}{
+		{"known", fuse.Status(syscall.EEXIST)},
+		// Gone from the directory, but not from the tree.
+		{"stale", fuse.OK},
+	} {
+		in := fuse.CreateIn{Flags: syscall.O_CREAT | syscall.O_EXCL | syscall.O_RDWR, Mode: 0644}
+		in.NodeId = 1
+		if st := rb.Create(nil, &in, c.name, &fuse.CreateOut{}); st != c.want {
+			t.Errorf("Create(%q): got %v, want %v", c.name, st, c.want)
+		}
+	}
+}
+
+func TestBridgeTypeChecks(t *testing.T) {
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("dir", root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFDIR}), false)
+			root.AddChild("file", root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFREG}), false)
+			root.AddChild("link", root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFLNK}), false)
+		},
+	}).(*rawBridge)
+
+	ids := map[string]uint64{}
+	for _, name := range []string{"dir", "file", "link"} {
+		var out fuse.EntryOut
+		if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		ids[name] = out.NodeId
+	}
+
+	hdr := func(id uint64) fuse.InHeader { return fuse.InHeader{NodeId: id} }
+	open := func(flags uint32) func(id uint64) fuse.Status {
+		return func(id uint64) fuse.Status {
+			return rb.Open(nil, &fuse.OpenIn{InHeader: hdr(id), Flags: flags}, &fuse.OpenOut{})
+		}
+	}
+	cases := []struct {
+		name string
+		op   func(id uint64) fuse.Status
+		// want is returned for the node named bad.
+		bad  string
+		want fuse.Status
+		// badOnly skips the op for other nodes, as it needs
+		// an open handle.
+		badOnly bool
+	}{
+		{name: "lookup", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Lookup(nil, &fuse.InHeader{NodeId: id}, "x", &fuse.EntryOut{})
+		}},
+		{name: "mkdir", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Mkdir(nil, &fuse.MkdirIn{InHeader: hdr(id)}, "x", &fuse.EntryOut{})
+		}},
+		{name: "mknod", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Mknod(nil, &fuse.MknodIn{InHeader: hdr(id)}, "x", &fuse.EntryOut{})
+		}},
+		{name: "create", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Create(nil, &fuse.CreateIn{InHeader: hdr(id)}, "x", &fuse.CreateOut{})
+		}},
+		{name: "symlink", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Symlink(nil, &fuse.InHeader{NodeId: id}, "target", "x", &fuse.EntryOut{})
+		}},
+		{name: "unlink", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Unlink(nil, &fuse.InHeader{NodeId: id}, "x")
+		}},
+		{name: "rmdir", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Rmdir(nil, &fuse.InHeader{NodeId: id}, "x")
+		}},
+		{name: "rename", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.Rename(nil, &fuse.RenameIn{InHeader: hdr(1), Newdir: id}, "x", "y")
+		}},
+		{name: "link", bad: "dir", want: fuse.EPERM, op: func(id uint64) fuse.Status {
+			return rb.Link(nil, &fuse.LinkIn{InHeader: hdr(1), Oldnodeid: id}, "x", &fuse.EntryOut{})
+		}},
+		{name: "opendir", bad: "file", want: fuse.ENOTDIR, badOnly: true, op: func(id uint64) fuse.Status {
+			return rb.OpenDir(nil, &fuse.OpenIn{InHeader: hdr(id)}, &fuse.OpenOut{})
+		}},
+		{name: "readdir", bad: "file", want: fuse.ENOTDIR, badOnly: true, op: func(id uint64) fuse.Status {
+			return rb.ReadDir(nil, &fuse.ReadIn{InHeader: hdr(id)}, fuse.NewDirEntryList(make([]byte, 100), 0))
+		}},
+		{name: "readdirplus", bad: "file", want: fuse.ENOTDIR, badOnly: true, op: func(id uint64) fuse.Status {
+			return rb.ReadDirPlus(nil, &fuse.ReadIn{InHeader: hdr(id)}, fuse.NewDirEntryList(make([]byte, 100), 0))
+		}},
+		{name: "fsyncdir", bad: "file", want: fuse.ENOTDIR, op: func(id uint64) fuse.Status {
+			return rb.FsyncDir(nil, &fuse.FsyncIn{InHeader: hdr(id)})
+		}},
+		{name: "open O_DIRECTORY", bad: "file", want: fuse.ENOTDIR, op: open(syscall.O_RDONLY | syscall.O_DIRECTORY)},
+		{name: "open O_WRONLY", bad: "dir", want: fuse.EISDIR, op: open(syscall.O_WRONLY)},
+		{name: "open O_TRUNC", bad: "dir", want: fuse.EISDIR, op: open(syscall.O_RDONLY | syscall.O_TRUNC)},
+		{name: "read", bad: "dir", want: fuse.EISDIR, op: func(id uint64) fuse.Status {
+			_, st := rb.Read(nil, &fuse.ReadIn{InHeader: hdr(id)}, make([]byte, 10))
+			return st
+		}},
+		{name: "write", bad: "dir", want: fuse.EISDIR, op: func(id uint64) fuse.Status {
+			_, st := rb.Write(nil, &fuse.WriteIn{InHeader: hdr(id)}, []byte("x"))
+			return st
+		}},
+		{name: "fallocate", bad: "dir", want: fuse.EISDIR, op: func(id uint64) fuse.Status {
+			return rb.Fallocate(nil, &fuse.FallocateIn{InHeader: hdr(id)})
+		}},
+		{name: "copy_file_range", bad: "dir", want: fuse.EISDIR, op: func(id uint64) fuse.Status {
+			_, st := rb.CopyFileRange(nil, &fuse.CopyFileRangeIn{InHeader: hdr(id), NodeIdOut: ids["file"]})
+			return st
+		}},
+		{name: "lseek SEEK_DATA", bad: "dir", want: fuse.EINVAL, op: func(id uint64) fuse.Status {
+			return rb.Lseek(nil, &fuse.LseekIn{InHeader: hdr(id), Whence: _SEEK_DATA}, &fuse.LseekOut{})
+		}},
+	}
+	for _, c := range cases {
+		for name, id := range ids {
+			if name == "link" || (c.badOnly && name != c.bad) {
+				continue
+			}
+			st := c.op(id)
+			if name == c.bad && st != c.want {
+				t.Errorf("%s on %s: got %v, want %v", c.name, name, st, c.want)
+			} else if name != c.bad && st == c.want {
+				t.Errorf("%s on %s: got %v", c.name, name, st)
+			}
+		}
+	}
+
+	// Only symlinks can be read as links.
+	for name, id := range ids {
+		_, st := rb.Readlink(nil, &fuse.InHeader{NodeId: id})
+		if want := fuse.EINVAL; (name == "link") == (st == want) {
+			t.Errorf("readlink on %s: got %v", name, st)
+		}
+	}
+
+	// Directories can be opened for reading, and support SEEK_SET.
+	if st := open(syscall.O_RDONLY)(ids["dir"]); st == fuse.EISDIR {
+		t.Errorf("open O_RDONLY on dir: got %v", st)
+	}
+	var out fuse.LseekOut
+	if st := rb.Lseek(nil, &fuse.LseekIn{InHeader: hdr(ids["dir"]), Offset: 5, Whence: _SEEK_SET}, &out); !st.Ok() || out.Offset != 5 {
+		t.Errorf("lseek SEEK_SET on dir: got %v, offset %d, want 5", st, out.Offset)
+	}
+}
+
+func TestWriteKillSuidgid(t *testing.T) {
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for name, mode := range map[string]uint32{
+				"suid":     04755,
+				"sgid":     02775,
+				"sgid-nox": 02664,
+			} {
+				f := &MemRegularFile{Attr: fuse.Attr{Mode: mode}}
+				root.AddChild(name, root.NewPersistentInode(ctx, f, StableAttr{}), false)
+			}
+		},
+	}).(*rawBridge)
+
+	cases := []struct {
+		name  string
+		flags uint32
+		want  uint32
+	}{
+		{"suid", 0, 04755},
+		{"suid", fuse.WRITE_KILL_SUIDGID, 0755},
+		{"sgid", fuse.WRITE_KILL_SUIDGID, 0775},
+		// Without group execute, setgid marks mandatory locking,
+		// which writes leave alone.
+		{"sgid-nox", fuse.WRITE_KILL_SUIDGID, 02664},
+	}
+	for _, c := range cases {
+		var entry fuse.EntryOut
+		if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, c.name, &entry); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", c.name, st)
+		}
+		openIn := fuse.OpenIn{Flags: syscall.O_WRONLY}
+		openIn.NodeId = entry.NodeId
+		var openOut fuse.OpenOut
+		if st := rb.Open(nil, &openIn, &openOut); !st.Ok() {
+			t.Fatalf("Open(%q): %v", c.name, st)
+		}
+		writeIn := fuse.WriteIn{Fh: openOut.Fh, WriteFlags: c.flags}
+		writeIn.NodeId = entry.NodeId
+		if _, st := rb.Write(nil, &writeIn, []byte("data")); !st.Ok() {
+			t.Fatalf("Write(%q): %v", c.name, st)
+		}
+
+		getIn := fuse.GetAttrIn{}
+		getIn.NodeId = entry.NodeId
+		var out fuse.AttrOut
+		if st := rb.GetAttr(nil, &getIn, &out); !st.Ok() {
+			t.Fatalf("GetAttr(%q): %v", c.name, st)
+		}
+		if got := out.Mode & 07777; got != c.want {
+			t.Errorf("%s with flags %x: got mode %o, want %o", c.name, c.flags, got, c.want)
+		}
+	}
+}
+
+func TestKillSuidgidTruncate(t *testing.T) {
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for _, name := range []string{"setattr", "open"} {
+				f := &MemRegularFile{Data: []byte("data"), Attr: fuse.Attr{Mode: 06775}}
+				root.AddChild(name, root.NewPersistentInode(ctx, f, StableAttr{}), false)
+			}
+		},
+	}).(*rawBridge)
+
+	lookup := func(name string) uint64 {
+		var entry fuse.EntryOut
+		if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &entry); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		return entry.NodeId
+	}
+	getMode := func(id uint64) uint32 {
+		in := fuse.GetAttrIn{}
+		in.NodeId = id
+		var out fuse.AttrOut
+		if st := rb.GetAttr(nil, &in, &out); !st.Ok() {
+			t.Fatalf("GetAttr: %v", st)
+		}
+		return out.Mode & 07777
+	}
+
+	id := lookup("setattr")
+	setIn := fuse.SetAttrIn{}
+	setIn.NodeId = id
+	setIn.Valid = fuse.FATTR_SIZE | fuse.FATTR_KILL_SUIDGID
+	var setOut fuse.AttrOut
+	if st := rb.SetAttr(nil, &setIn, &setOut); !st.Ok() {
+		t.Fatalf("SetAttr: %v", st)
+	}
+	if got := setOut.Mode & 07777; got != 0775 {
+		t.Errorf("SetAttr reply: got mode %o, want 775", got)
+	}
+	if got := getMode(id); got != 0775 {
+		t.Errorf("after SetAttr: got mode %o, want 775", got)
+	}
+
+	id = lookup("open")
+	openIn := fuse.OpenIn{Flags: syscall.O_WRONLY | syscall.O_TRUNC, Mode: fuse.OPEN_KILL_SUIDGID}
+	openIn.NodeId = id
+	if st := rb.Open(nil, &openIn, &fuse.OpenOut{}); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	if got := getMode(id); got != 0775 {
+		t.Errorf("after Open: got mode %o, want 775", got)
+	}
+}
+
+// sloppyXAttrNode has a single attribute, whose value it returns
+// without following the size protocol of getxattr(2): if truncate is
+// set, it returns as much as fits without an error, and otherwise it
+// returns ERANGE without the size.
+type sloppyXAttrNode struct {
+	Inode
+	value    []byte
+	truncate bool
+}
+
+var _ = (NodeGetxattrer)((*sloppyXAttrNode)(nil))
+var _ = (NodeListxattrer)((*sloppyXAttrNode)(nil))
+
+func (n *sloppyXAttrNode) read(data, dest []byte) (uint32, syscall.Errno) {
+	if n.truncate {
+		copy(dest, data)
+		return uint32(len(data)), OK
+	}
+	if len(dest) < len(data) {
+		return 0, syscall.ERANGE
+	}
+	return uint32(copy(dest, data)), OK
+}
+
+func (n *sloppyXAttrNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if attr != "user.big" {
+		return 0, ENOATTR
+	}
+	return n.read(n.value, dest)
+}
+
+func (n *sloppyXAttrNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	return n.read([]byte("user.big\x00"), dest)
+}
+
+func TestXAttrSizeProbe(t *testing.T) {
+	value := []byte(strings.Repeat("x", 5000))
+	for _, truncate := range []bool{false, true} {
+		root := &sloppyXAttrNode{value: value, truncate: truncate}
+		rb := NewNodeFS(root, &Options{}).(*rawBridge)
+		hdr := &fuse.InHeader{NodeId: 1}
+
+		get := func(sz int) (uint32, fuse.Status, []byte) {
+			buf := make([]byte, sz)
+			n, st := rb.GetXAttr(nil, hdr, "user.big", buf)
+			if st.Ok() && sz > 0 {
+				return n, st, buf[:n]
+			}
+			return n, st, nil
+		}
+		if n, st, _ := get(0); !st.Ok() || n != uint32(len(value)) {
+			t.Errorf("truncate %v: probe: got %d, %v, want %d, OK", truncate, n, st, len(value))
+		}
+		if n, st, _ := get(100); st != fuse.ERANGE || n != uint32(len(value)) {
+			t.Errorf("truncate %v: small buffer: got %d, %v, want %d, ERANGE", truncate, n, st, len(value))
+		}
+		if _, st, got := get(len(value)); !st.Ok() || string(got) != string(value) {
+			t.Errorf("truncate %v: exact buffer: got %v, %q", truncate, st, got)
+		}
+
+		names := "user.big\x00"
+		if n, st := rb.ListXAttr(nil, hdr, nil); !st.Ok() || n != uint32(len(names)) {
+			t.Errorf("truncate %v: list probe: got %d, %v, want %d, OK", truncate, n, st, len(names))
+		}
+		if n, st := rb.ListXAttr(nil, hdr, make([]byte, 4)); st != fuse.ERANGE || n != uint32(len(names)) {
+			t.Errorf("truncate %v: list small buffer: got %d, %v, want %d, ERANGE", truncate, n, st, len(names))
+		}
+	}
+}
+
+// inoLookupDir creates a node of the type given by the name on each
+// lookup, without an inode number.
+type inoLookupDir struct {
+	Inode
+}
+
+func (d *inoLookupDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	mode := uint32(syscall.S_IFREG)
+	if strings.HasPrefix(name, "dir") {
+		mode = syscall.S_IFDIR
+	}
+	return d.NewInode(ctx, &Inode{}, StableAttr{Mode: mode}), 0
+}
+
+func TestInoAllocator(t *testing.T) {
+	inos := map[string]uint64{
+		"static": 100,
+		"a":      200,
+		"b":      200,
+		"dir":    200,
+
+		"getoradd": 300,
+		"replaced": 400,
+	}
+	var static *Inode
+	root := &inoLookupDir{}
+	var logBuf bytes.Buffer
+	rb := NewNodeFS(root, &Options{
+		Logger: log.New(&logBuf, "", 0),
+		InoAllocator: func(parent *Inode, name string, mode uint32) uint64 {
+			if parent != &root.Inode {
+				t.Errorf("%q: got parent %v", name, parent)
+			}
+			return inos[name]
+		},
+		OnAdd: func(ctx context.Context) {
+			static = root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+			if ino := static.StableAttr().Ino; ino != 0 {
+				t.Errorf("got ino %d before AddChild, want 0", ino)
+			}
+			root.AddChild("static", static, false)
+		},
+	}).(*rawBridge)
+
+	if got := static.StableAttr().Ino; got != 100 {
+		t.Errorf("AddChild: got ino %d, want 100", got)
+	}
+
+	lookup := func(name string) fuse.EntryOut {
+		t.Helper()
+		var out fuse.EntryOut
+		if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, name, &out); !st.Ok() {
+			t.Fatalf("Lookup(%q): %v", name, st)
+		}
+		return out
+	}
+
+	a := lookup("a")
+	if a.Ino != 200 {
+		t.Errorf("a: got ino %d, want 200", a.Ino)
+	}
+	// Nodes with the same StableAttr are the same node.
+	if b := lookup("b"); b.NodeId != a.NodeId {
+		t.Errorf("b: got node %d, want %d", b.NodeId, a.NodeId)
+	}
+	if logBuf.Len() > 0 {
+		t.Errorf("unexpected warning: %s", logBuf.String())
+	}
+
+	// A directory with the same number is a different node.
+	if dir := lookup("dir"); dir.NodeId == a.NodeId || dir.Ino != 200 {
+		t.Errorf("dir: got node %d, ino %d", dir.NodeId, dir.Ino)
+	}
+	if !strings.Contains(logBuf.String(), "inode number 200") {
+		t.Errorf("got log %q, want collision warning", logBuf.String())
+	}
+
+	// 0 selects an automatic number.
+	if auto := lookup("auto"); auto.Ino < 1<<63 {
+		t.Errorf("auto: got ino %d, want automatic", auto.Ino)
+	}
+
+	ctx := context.Background()
+	ch, _ := root.GetOrAddChild("getoradd", root.NewPersistentInode(ctx, &Inode{}, StableAttr{}))
+	if got := ch.StableAttr().Ino; got != 300 {
+		t.Errorf("GetOrAddChild: got ino %d, want 300", got)
+	}
+	ch = root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	root.ReplaceChildren(map[string]*Inode{"replaced": ch})
+	if got := ch.StableAttr().Ino; got != 400 {
+		t.Errorf("ReplaceChildren: got ino %d, want 400", got)
+	}
+}
+
+// handleFile is a MemRegularFile that hands out file handles.
+type handleFile struct {
+	MemRegularFile
+}
+
+func (f *handleFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &struct{ flags uint32 }{flags}, 0, OK
+}
+
+func TestBridgeEdgeErrnos(t *testing.T) {
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			f := &handleFile{MemRegularFile{Data: []byte("hello")}}
+			root.AddChild("file", root.NewPersistentInode(ctx, f, StableAttr{}), false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	open := func(flags uint32) uint64 {
+		t.Helper()
+		in := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: flags}
+		var out fuse.OpenOut
+		if st := rb.Open(nil, &in, &out); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+		return out.Fh
+	}
+	read := func(fh, off uint64) fuse.Status {
+		in := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Fh: fh, Offset: off, Size: 10}
+		_, st := rb.Read(nil, &in, make([]byte, 10))
+		return st
+	}
+	write := func(fh, off uint64) fuse.Status {
+		in := fuse.WriteIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Fh: fh, Offset: off}
+		_, st := rb.Write(nil, &in, []byte("abc"))
+		return st
+	}
+	fallocate := func(node, fh, off uint64) fuse.Status {
+		in := fuse.FallocateIn{InHeader: fuse.InHeader{NodeId: node}, Fh: fh, Offset: off, Length: 10}
+		return rb.Fallocate(nil, &in)
+	}
+
+	rdonly, wronly, rdwr := open(syscall.O_RDONLY), open(syscall.O_WRONLY), open(syscall.O_RDWR)
+	for _, c := range []struct {
+		name string
+		got  fuse.Status
+		want fuse.Status
+	}{
+		{"read rdonly", read(rdonly, 0), fuse.OK},
+		{"read wronly", read(wronly, 0), fuse.EBADF},
+		{"read rdwr", read(rdwr, 0), fuse.OK},
+		{"read negative offset", read(rdonly, 1<<63), fuse.EINVAL},
+		{"write rdonly", write(rdonly, 0), fuse.EBADF},
+		{"write wronly", write(wronly, 0), fuse.OK},
+		{"write past max size", write(rdwr, 1<<63-2), fuse.Status(syscall.EFBIG)},
+		{"fallocate rdonly", fallocate(entry.NodeId, rdonly, 0), fuse.EBADF},
+		{"fallocate past max size", fallocate(entry.NodeId, wronly, 1<<63-5), fuse.Status(syscall.EFBIG)},
+		{"fallocate dir", fallocate(1, 0, 0), fuse.EISDIR},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+// syncfsRoot counts Syncfs calls.
+type syncfsRoot struct {
+	Inode
+	calls int
+	errno syscall.Errno
+}
+
+var _ = (NodeSyncfser)((*syncfsRoot)(nil))
+
+func (n *syncfsRoot) Syncfs(ctx context.Context) syscall.Errno {
+	n.calls++
+	return n.errno
+}
+
+func TestSyncFs(t *testing.T) {
+	root := &syncfsRoot{}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+	in := &fuse.SyncFsIn{InHeader: fuse.InHeader{NodeId: 1}}
+	if st := rb.SyncFs(nil, in); !st.Ok() || root.calls != 1 {
+		t.Errorf("SyncFs: got %v, %d calls, want OK, 1 call", st, root.calls)
+	}
+	root.errno = syscall.EIO
+	if st := rb.SyncFs(nil, in); st != fuse.EIO {
+		t.Errorf("SyncFs: got %v, want EIO", st)
+	}
+
+	// Without NodeSyncfser, syncfs is a no-op.
+	rb = NewNodeFS(&Inode{}, &Options{}).(*rawBridge)
+	if st := rb.SyncFs(nil, in); !st.Ok() {
+		t.Errorf("SyncFs without NodeSyncfser: got %v, want OK", st)
+	}
+}
+
+// appendFile is a handleFile that lets the bridge implement O_APPEND.
+type appendFile struct {
+	handleFile
+}
+
+var _ = (NodeAtomicAppender)((*appendFile)(nil))
+
+func (f *appendFile) AtomicAppend() bool { return true }
+
+func TestAtomicAppend(t *testing.T) {
+	root := &Inode{}
+	f := &appendFile{handleFile{MemRegularFile{}}}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, f, StableAttr{}), false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	open := func(flags uint32) uint64 {
+		in := fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Flags: flags}
+		var out fuse.OpenOut
+		if st := rb.Open(nil, &in, &out); !st.Ok() {
+			t.Fatalf("Open: %v", st)
+		}
+		if got, want := out.OpenFlags&fuse.FOPEN_DIRECT_IO != 0, flags&syscall.O_APPEND != 0; got != want {
+			t.Errorf("flags %x: got DIRECT_IO %v, want %v", flags, got, want)
+		}
+		return out.Fh
+	}
+
+	const writers, records = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		fh := open(syscall.O_WRONLY | syscall.O_APPEND)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := bytes.Repeat([]byte{byte('a' + i)}, 16)
+			for j := 0; j < records; j++ {
+				// The kernel's idea of the offset is stale.
+				in := fuse.WriteIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Fh: fh, Offset: 0}
+				if _, st := rb.Write(nil, &in, rec); !st.Ok() {
+					t.Errorf("Write: %v", st)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(f.Data) != writers*records*16 {
+		t.Fatalf("got %d bytes, want %d", len(f.Data), writers*records*16)
+	}
+	counts := map[byte]int{}
+	for off := 0; off < len(f.Data); off += 16 {
+		rec := f.Data[off : off+16]
+		if !bytes.Equal(rec, bytes.Repeat(rec[:1], 16)) {
+			t.Fatalf("torn record at %d: %q", off, rec)
+		}
+		counts[rec[0]]++
+	}
+	for i := 0; i < writers; i++ {
+		if c := counts[byte('a'+i)]; c != records {
+			t.Errorf("writer %d: got %d records, want %d", i, c, records)
+		}
+	}
+
+	// Without O_APPEND, the offset is honored.
+	fh := open(syscall.O_WRONLY)
+	in := fuse.WriteIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Fh: fh, Offset: 0}
+	if _, st := rb.Write(nil, &in, []byte("x")); !st.Ok() || f.Data[0] != 'x' {
+		t.Errorf("Write at 0: got %v, data starts with %q", st, f.Data[:1])
+	}
+}
+
+type crtimeNode struct {
+	Inode
+	crtime time.Time
+}
+
+var _ = (NodeCrtimer)((*crtimeNode)(nil))
+
+func (n *crtimeNode) Crtime(ctx context.Context) time.Time {
+	return n.crtime
+}
+
+func TestCrtimeStatx(t *testing.T) {
+	crtime := time.Unix(1234567890, 42)
+	root := &crtimeNode{crtime: crtime}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	in := &fuse.StatxIn{InHeader: fuse.InHeader{NodeId: 1}, SxMask: fuse.STATX_BTIME}
+	var out fuse.StatxOut
+	if st := rb.Statx(nil, in, &out); !st.Ok() {
+		t.Fatalf("Statx: %v", st)
+	}
+	if out.Mask&fuse.STATX_BTIME == 0 {
+		t.Errorf("got mask %x, want STATX_BTIME", out.Mask)
+	}
+	if out.Btime.Sec != crtime.Unix() || out.Btime.Nsec != 42 {
+		t.Errorf("got btime %+v, want %v", out.Btime, crtime)
+	}
+}
+
+// statxRoot implements NodeStatxer, leaving the timeout unset.
+type statxRoot struct {
+	Inode
+}
+
+var _ = (NodeStatxer)((*statxRoot)(nil))
+
+func (r *statxRoot) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	return OK
+}
+
+func TestAdaptiveTimeouts(t *testing.T) {
+	entry, attr, negative := 16*time.Second, 32*time.Second, 48*time.Second
+	root := &statxRoot{}
+	rawFS := NewNodeFS(root, &Options{
+		EntryTimeout:     &entry,
+		AttrTimeout:      &attr,
+		NegativeTimeout:  &negative,
+		MaxInodes:        8,
+		AdaptiveTimeouts: true,
+	})
+	ctx := context.Background()
+	for i := 0; i < 9; i++ {
+		root.AddChild(fmt.Sprintf("f%d", i), root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+	}
+
+	// The root counts as well, so the n-th lookup makes for n+1
+	// inodes. Scaling starts above 4, and bottoms out at 8.
+	for i, want := range []time.Duration{16000, 16000, 16000, 12250, 8500, 4750, 1000, 1000, 1000} {
+		want *= time.Millisecond
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, fmt.Sprintf("f%d", i), &out); !st.Ok() {
+			t.Fatalf("Lookup: %v", st)
+		}
+		if got := out.EntryTimeout(); got != want {
+			t.Errorf("lookup %d: got entry timeout %v, want %v", i+1, got, want)
+		}
+		if got := out.AttrTimeout(); got != 2*want {
+			t.Errorf("lookup %d: got attr timeout %v, want %v", i+1, got, 2*want)
+		}
+	}
+
+	var out fuse.AttrOut
+	if st := rawFS.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if got := out.Timeout(); got != 2*time.Second {
+		t.Errorf("got GetAttr timeout %v, want 2s", got)
+	}
+
+	var sxOut fuse.StatxOut
+	if st := rawFS.Statx(nil, &fuse.StatxIn{InHeader: fuse.InHeader{NodeId: 1}}, &sxOut); !st.Ok() {
+		t.Fatalf("Statx: %v", st)
+	}
+	if got := sxOut.Timeout(); got != 2*time.Second {
+		t.Errorf("got Statx timeout %v, want 2s", got)
+	}
+
+	var negOut fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "missing", &negOut); !st.Ok() || negOut.NodeId != 0 {
+		t.Fatalf("Lookup missing: got %v, node %d, want a negative entry", st, negOut.NodeId)
+	}
+	if got := negOut.EntryTimeout(); got != 3*time.Second {
+		t.Errorf("got negative entry timeout %v, want 3s", got)
+	}
+
+	if got := scaleTimeout(time.Nanosecond, minTimeoutScale); got != time.Nanosecond {
+		t.Errorf("scaleTimeout(1ns): got %v, want 1ns", got)
+	}
+}
@@ -9,9 +9,12 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -134,3 +137,493 @@ func TestKeepCache(t *testing.T) {
 		t.Errorf("nokeep read 2 got %q want read 1 %q", c2, c1)
 	}
 }
+
+// staleFile keeps its cache, unless its content was changed with
+// stale set.
+type staleFile struct {
+	Inode
+
+	mu      sync.Mutex
+	content []byte
+	stale   bool
+}
+
+var _ = (NodeReader)((*staleFile)(nil))
+var _ = (NodeOpener)((*staleFile)(nil))
+var _ = (NodeGetattrer)((*staleFile)(nil))
+
+func (f *staleFile) setContent(content string, stale bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.content = []byte(content)
+	f.stale = stale
+}
+
+func (f *staleFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	f.mu.Lock()
+	stale := f.stale
+	f.stale = false
+	f.mu.Unlock()
+	if stale {
+		if errno := f.InvalidateContent(); errno != 0 {
+			return nil, 0, errno
+		}
+	}
+	return nil, fuse.FOPEN_KEEP_CACHE, OK
+}
+
+func (f *staleFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Size = uint64(len(f.content))
+	return OK
+}
+
+func (f *staleFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fuse.ReadResultData(append([]byte{}, f.content[off:]...)), OK
+}
+
+func TestInvalidateContentOnOpen(t *testing.T) {
+	file := &staleFile{}
+	file.setContent("aaaa", false)
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	read := func(want string) {
+		t.Helper()
+		if c, err := ioutil.ReadFile(mntDir + "/file"); err != nil {
+			t.Fatal(err)
+		} else if string(c) != want {
+			t.Errorf("got %q, want %q", c, want)
+		}
+	}
+	read("aaaa")
+
+	// Same size and mtime, so the kernel keeps its cache.
+	file.setContent("bbbb", false)
+	read("aaaa")
+
+	file.setContent("cccc", true)
+	read("cccc")
+}
+
+func TestNotifyPath(t *testing.T) {
+	root := &Inode{}
+	var dir *Inode
+	keep := &keepCacheFile{keepCache: true}
+	hour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout: &hour,
+		AttrTimeout:  &hour,
+		OnAdd: func(ctx context.Context) {
+			dir = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir", dir, false)
+			keep.setContent(0)
+			dir.AddChild("keep", dir.NewPersistentInode(ctx, keep, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	c1, err := ioutil.ReadFile(mntDir + "/dir/keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2, err := ioutil.ReadFile(mntDir + "/dir/keep"); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(c1, c2) {
+		t.Fatalf("read 2 got %q, want cached %q", c2, c1)
+	}
+	if errno := root.NotifyPathContent("dir/keep"); errno != 0 {
+		t.Fatalf("NotifyPathContent: %v", errno)
+	}
+	if c3, err := ioutil.ReadFile(mntDir + "/dir/keep"); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(c1, c3) {
+		t.Errorf("read 3 got %q, want different", c3)
+	}
+
+	// The entry stays cached after it is removed from the tree.
+	dir.RmChild("keep")
+	if _, err := os.Stat(mntDir + "/dir/keep"); err != nil {
+		t.Fatalf("cached entry: %v", err)
+	}
+	if errno := root.NotifyPathEntry("dir", "keep"); errno != 0 {
+		t.Fatalf("NotifyPathEntry: %v", errno)
+	}
+	if _, err := os.Stat(mntDir + "/dir/keep"); !os.IsNotExist(err) {
+		t.Errorf("after NotifyPathEntry: got %v, want ENOENT", err)
+	}
+
+	if errno := root.NotifyPathContent("dir/nonexistent"); errno != syscall.ENOENT {
+		t.Errorf("NotifyPathContent unknown path: got %v, want ENOENT", errno)
+	}
+	if errno := root.NotifyPathEntry("nonexistent", "x"); errno != syscall.ENOENT {
+		t.Errorf("NotifyPathEntry unknown parent: got %v, want ENOENT", errno)
+	}
+}
+
+func TestNotifyStoreRetrieveCache(t *testing.T) {
+	root := &keepCacheRoot{}
+	if errno := root.NotifyStoreCache(0, []byte("x")); errno != syscall.ENOTCONN {
+		t.Errorf("NotifyStoreCache before mount: got %v, want ENOTCONN", errno)
+	}
+	if _, errno := root.NotifyRetrieveCache(0, make([]byte, 1)); errno != syscall.ENOTCONN {
+		t.Errorf("NotifyRetrieveCache before mount: got %v, want ENOTCONN", errno)
+	}
+
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	c1, err := ioutil.ReadFile(mntDir + "/keep")
+	if err != nil {
+		t.Fatalf("read keep 1: %v", err)
+	}
+
+	// Keep the file open, so the kernel holds on to the inode
+	// and its cache.
+	f, err := os.Open(mntDir + "/keep")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	want := bytes.Repeat([]byte("y"), len(c1))
+	if errno := root.keep.NotifyStoreCache(0, want); errno != OK {
+		t.Fatalf("NotifyStoreCache: %v", errno)
+	}
+
+	got := make([]byte, len(want))
+	n, errno := root.keep.NotifyRetrieveCache(0, got)
+	if errno != OK {
+		t.Fatalf("NotifyRetrieveCache: %v", errno)
+	}
+	if !bytes.Equal(got[:n], want) {
+		t.Errorf("NotifyRetrieveCache got %q, want %q", got[:n], want)
+	}
+
+	c2, err := ioutil.ReadFile(mntDir + "/keep")
+	if err != nil {
+		t.Fatalf("read keep 2: %v", err)
+	}
+	if !bytes.Equal(c2, want) {
+		t.Errorf("read after NotifyStoreCache got %q, want %q", c2, want)
+	}
+}
+
+type countingSymlink struct {
+	Inode
+
+	mu     sync.Mutex
+	target []byte
+	count  int
+}
+
+var _ = (NodeReadlinker)((*countingSymlink)(nil))
+
+func (l *countingSymlink) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+	return l.target, OK
+}
+
+func (l *countingSymlink) readlinkCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func mountCountingSymlink(tb testing.TB, cache bool) (string, *countingSymlink, func()) {
+	link := &countingSymlink{target: []byte("target")}
+	root := &Inode{}
+	sec := time.Second
+	opts := &Options{
+		EntryTimeout: &sec,
+		AttrTimeout:  &sec,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("link", root.NewPersistentInode(ctx, link, StableAttr{Mode: fuse.S_IFLNK}), false)
+		},
+	}
+	opts.EnableSymlinkCaching = cache
+
+	mnt, _, clean := testMount(tb, root, opts)
+	return mnt + "/link", link, clean
+}
+
+func TestSymlinkCaching(t *testing.T) {
+	path, link, clean := mountCountingSymlink(t, true)
+	defer clean()
+
+	for i := 0; i < 3; i++ {
+		if got, err := os.Readlink(path); err != nil || got != "target" {
+			t.Fatalf("Readlink: %q, %v", got, err)
+		}
+	}
+	if c := link.readlinkCount(); c != 1 {
+		t.Errorf("got %d Readlink calls, want 1", c)
+	}
+
+	link.mu.Lock()
+	link.target = []byte("other")
+	link.mu.Unlock()
+	if errno := link.NotifySymlink(); errno != OK {
+		t.Fatalf("NotifySymlink: %v", errno)
+	}
+	if got, err := os.Readlink(path); err != nil || got != "other" {
+		t.Fatalf("Readlink after NotifySymlink: %q, %v", got, err)
+	}
+	if c := link.readlinkCount(); c != 2 {
+		t.Errorf("got %d Readlink calls, want 2", c)
+	}
+}
+
+func benchmarkReadlink(b *testing.B, cache bool) {
+	path, link, clean := mountCountingSymlink(b, cache)
+	defer clean()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := os.Readlink(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(link.readlinkCount())/float64(b.N), "readlinks/op")
+}
+
+func BenchmarkReadlinkUncached(b *testing.B) {
+	benchmarkReadlink(b, false)
+}
+
+func BenchmarkReadlinkCached(b *testing.B) {
+	benchmarkReadlink(b, true)
+}
+
+// countingAttrFile counts the calls to Getattr, which report size.
+type countingAttrFile struct {
+	Inode
+
+	size    uint64
+	counter *int64
+}
+
+var _ = (NodeGetattrer)((*countingAttrFile)(nil))
+var _ = (NodeSetattrer)((*countingAttrFile)(nil))
+
+func (f *countingAttrFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	atomic.AddInt64(f.counter, 1)
+	out.Mode = 0644
+	out.Size = f.size
+	return OK
+}
+
+func (f *countingAttrFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	out.Size = f.size
+	return OK
+}
+
+// mountAttrFiles mounts n files whose attributes are cached with
+// SetCachedAttr if cache is set. The kernel does not cache them.
+func mountAttrFiles(tb testing.TB, n int, cache bool) (string, []*countingAttrFile, *int64, func()) {
+	counter := new(int64)
+	var files []*countingAttrFile
+	root := &Inode{}
+	sec := time.Second
+	mnt, _, clean := testMount(tb, root, &Options{
+		EntryTimeout: &sec,
+		OnAdd: func(ctx context.Context) {
+			for i := 0; i < n; i++ {
+				f := &countingAttrFile{size: 10, counter: counter}
+				ch := root.NewPersistentInode(ctx, f, StableAttr{})
+				if cache {
+					ch.SetCachedAttr(&fuse.Attr{Mode: 0444, Size: 5}, 0)
+				}
+				root.AddChild(fmt.Sprintf("file%d", i), ch, false)
+				files = append(files, f)
+			}
+		},
+	})
+	return mnt, files, counter, clean
+}
+
+func TestCachedAttr(t *testing.T) {
+	mnt, files, counter, clean := mountAttrFiles(t, 1, true)
+	defer clean()
+	name := mnt + "/file0"
+
+	stat := func(wantSize int64, wantCalls int64) {
+		t.Helper()
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != wantSize {
+			t.Errorf("got size %d, want %d", fi.Size(), wantSize)
+		}
+		if c := atomic.LoadInt64(counter); c != wantCalls {
+			t.Errorf("got %d Getattr calls, want %d", c, wantCalls)
+		}
+	}
+
+	stat(5, 0)
+	stat(5, 0)
+
+	files[0].InvalidateCachedAttr()
+	stat(10, 1)
+
+	files[0].SetCachedAttr(&fuse.Attr{Size: 5}, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	stat(10, 2)
+
+	// Setattr drops the cached attributes.
+	files[0].SetCachedAttr(&fuse.Attr{Size: 5}, 0)
+	stat(5, 2)
+	if err := os.Chmod(name, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stat(10, 3)
+}
+
+func TestCachedAttrStatxForceSync(t *testing.T) {
+	var counter int64
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &countingAttrFile{size: 10, counter: &counter}, StableAttr{})
+			ch.SetCachedAttr(&fuse.Attr{Size: 5}, 0)
+			root.AddChild("file", ch, false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	for _, tc := range []struct {
+		flags uint32
+		size  uint64
+		calls int64
+	}{
+		{fuse.AT_STATX_SYNC_AS_STAT, 5, 0},
+		{fuse.AT_STATX_DONT_SYNC, 5, 0},
+		{fuse.AT_STATX_FORCE_SYNC, 10, 1},
+	} {
+		in := &fuse.StatxIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, SxFlags: tc.flags}
+		var out fuse.StatxOut
+		if st := rb.Statx(nil, in, &out); !st.Ok() {
+			t.Fatalf("Statx: %v", st)
+		}
+		if out.Size != tc.size {
+			t.Errorf("flags %x: got size %d, want %d", tc.flags, out.Size, tc.size)
+		}
+		if c := atomic.LoadInt64(&counter); c != tc.calls {
+			t.Errorf("flags %x: got %d Getattr calls, want %d", tc.flags, c, tc.calls)
+		}
+	}
+}
+
+// sizeFile reports its size through the handle.
+type sizeFile struct {
+	size uint64
+}
+
+func (f *sizeFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	out.Size = f.size
+	return OK
+}
+
+type sizeFileNode struct {
+	Inode
+}
+
+func (n *sizeFileNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &sizeFile{size: 42}, 0, OK
+}
+
+func TestCachedAttrFileGetattr(t *testing.T) {
+	root := &Inode{}
+	var node *Inode
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			node = root.NewPersistentInode(ctx, &sizeFileNode{}, StableAttr{})
+			node.SetCachedAttr(&fuse.Attr{Size: 5}, 0)
+			root.AddChild("file", node, false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	getSize := func() uint64 {
+		in := fuse.GetAttrIn{}
+		in.NodeId = entry.NodeId
+		var out fuse.AttrOut
+		if st := rb.GetAttr(nil, &in, &out); !st.Ok() {
+			t.Fatalf("GetAttr: %v", st)
+		}
+		return out.Size
+	}
+	if got := getSize(); got != 5 {
+		t.Errorf("closed file: got size %d, want 5", got)
+	}
+
+	openIn := fuse.OpenIn{}
+	openIn.NodeId = entry.NodeId
+	var openOut fuse.OpenOut
+	if st := rb.Open(nil, &openIn, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	// stat(2) of the path, while the file is open, still uses the
+	// cached attributes.
+	if got := getSize(); got != 5 {
+		t.Errorf("open file: got size %d, want 5", got)
+	}
+
+	// The handle takes precedence where the kernel names it.
+	in := &fuse.StatxIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, GetattrFlags: fuse.FUSE_GETATTR_FH, Fh_: openOut.Fh}
+	var out fuse.StatxOut
+	if st := rb.Statx(nil, in, &out); !st.Ok() {
+		t.Fatalf("Statx: %v", st)
+	}
+	if out.Size != 42 {
+		t.Errorf("Statx with handle: got size %d, want 42", out.Size)
+	}
+}
+
+func benchmarkStatFiles(b *testing.B, cache bool) {
+	const n = 10000
+	mnt, _, counter, clean := mountAttrFiles(b, n, cache)
+	defer clean()
+
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s/file%d", mnt, i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, name := range names {
+			if _, err := os.Lstat(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(counter))/float64(b.N), "getattrs/op")
+}
+
+func BenchmarkStatFilesUncached(b *testing.B) {
+	benchmarkStatFiles(b, false)
+}
+
+func BenchmarkStatFilesCached(b *testing.B) {
+	benchmarkStatFiles(b, true)
+}
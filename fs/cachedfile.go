@@ -0,0 +1,198 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// FetchFunc reads the content of a file at off into dest, and returns
+// the number of bytes read. A short count marks the end of the file.
+type FetchFunc func(off int64, dest []byte) (int, syscall.Errno)
+
+// CachedFileOptions configures a CachedFile.
+type CachedFileOptions struct {
+	// BlockSize is the unit in which content is fetched and
+	// cached. The default is 128 KiB.
+	BlockSize int
+
+	// MaxSize bounds the number of bytes held in the cache. Once
+	// it is exceeded, the least recently used blocks are
+	// dropped. The default is 64 MiB.
+	MaxSize int64
+}
+
+// CachedFileStats holds the counters of a CachedFile. Each block a
+// read touches counts as one hit or one miss.
+type CachedFileStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// HitRate returns the fraction of block lookups that were served from
+// the cache, or 0 if there were none.
+func (s CachedFileStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CachedFile is a read-only FileHandle that serves reads from an
+// in-memory cache of the blocks returned by a FetchFunc, so repeated
+// and overlapping reads over a slow backend do not go back to it.
+// Concurrent reads of a missing block share a single fetch.
+//
+// A CachedFile has no Release, so the same one can be returned from
+// every Open of a node to share the cache between opens. The cache
+// assumes the content does not change; call Invalidate if it does.
+type CachedFile struct {
+	fetch     FetchFunc
+	blockSize int64
+	maxSize   int64
+
+	mu sync.Mutex
+	// blocks holds the cached blocks by index.
+	blocks map[int64]*cacheBlock
+	// lru holds the cached blocks, most recently used first.
+	lru   list.List
+	size  int64
+	stats CachedFileStats
+	// gen is bumped by Invalidate, so fetches that started
+	// before it are not cached.
+	gen uint64
+}
+
+type cacheBlock struct {
+	idx  int64
+	elem *list.Element
+	// done is closed once data and errno are set.
+	done  chan struct{}
+	data  []byte
+	errno syscall.Errno
+}
+
+var _ = (FileReader)((*CachedFile)(nil))
+
+// NewCachedFile returns a CachedFile that fetches content with fetch.
+// If opts is nil, the defaults are used.
+func NewCachedFile(fetch FetchFunc, opts *CachedFileOptions) *CachedFile {
+	f := &CachedFile{
+		fetch:     fetch,
+		blockSize: 128 << 10,
+		maxSize:   64 << 20,
+		blocks:    map[int64]*cacheBlock{},
+	}
+	if opts != nil && opts.BlockSize > 0 {
+		f.blockSize = int64(opts.BlockSize)
+	}
+	if opts != nil && opts.MaxSize > 0 {
+		f.maxSize = opts.MaxSize
+	}
+	return f
+}
+
+func (f *CachedFile) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n := 0
+	for n < len(dest) {
+		pos := off + int64(n)
+		data, errno := f.block(pos / f.blockSize)
+		if errno != 0 {
+			if n > 0 {
+				break
+			}
+			return nil, errno
+		}
+		start := pos % f.blockSize
+		if start >= int64(len(data)) {
+			break
+		}
+		n += copy(dest[n:], data[start:])
+		if int64(len(data)) < f.blockSize {
+			// End of file.
+			break
+		}
+	}
+	return fuse.ReadResultData(dest[:n]), OK
+}
+
+// block returns the content of the block with index idx, fetching it
+// if it is not cached.
+func (f *CachedFile) block(idx int64) ([]byte, syscall.Errno) {
+	f.mu.Lock()
+	if b, ok := f.blocks[idx]; ok {
+		f.stats.Hits++
+		if b.elem != nil {
+			f.lru.MoveToFront(b.elem)
+		}
+		f.mu.Unlock()
+		<-b.done
+		return b.data, b.errno
+	}
+	f.stats.Misses++
+	b := &cacheBlock{idx: idx, done: make(chan struct{})}
+	f.blocks[idx] = b
+	gen := f.gen
+	f.mu.Unlock()
+
+	buf := make([]byte, f.blockSize)
+	n, errno := f.fetch(idx*f.blockSize, buf)
+	if errno == 0 {
+		b.data = buf[:n]
+	}
+	b.errno = errno
+	close(b.done)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if errno != 0 || gen != f.gen {
+		// Don't cache errors, so the next read retries.
+		if f.blocks[idx] == b {
+			delete(f.blocks, idx)
+		}
+	} else {
+		b.elem = f.lru.PushFront(b)
+		f.size += int64(len(b.data))
+		f.evict()
+	}
+	return b.data, b.errno
+}
+
+// evict drops the least recently used blocks until the cache fits
+// in maxSize. Must be called with f.mu held.
+func (f *CachedFile) evict() {
+	for f.size > f.maxSize {
+		e := f.lru.Back()
+		if e == nil {
+			return
+		}
+		b := f.lru.Remove(e).(*cacheBlock)
+		delete(f.blocks, b.idx)
+		f.size -= int64(len(b.data))
+	}
+}
+
+// Invalidate drops all cached content, so later reads fetch it
+// again.
+func (f *CachedFile) Invalidate() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocks = map[int64]*cacheBlock{}
+	f.lru.Init()
+	f.size = 0
+	f.gen++
+}
+
+// Stats returns the hit and miss counts of the cache.
+func (f *CachedFile) Stats() CachedFileStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+)
+
+// countingFetcher serves data, and counts the fetches per offset.
+type countingFetcher struct {
+	data    []byte
+	fetches map[int64]int
+	fail    bool
+}
+
+func (c *countingFetcher) fetch(off int64, dest []byte) (int, syscall.Errno) {
+	c.fetches[off]++
+	if c.fail {
+		return 0, syscall.EIO
+	}
+	if off >= int64(len(c.data)) {
+		return 0, OK
+	}
+	return copy(dest, c.data[off:]), OK
+}
+
+func TestCachedFile(t *testing.T) {
+	data := make([]byte, 250)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	c := &countingFetcher{data: data, fetches: map[int64]int{}}
+	f := NewCachedFile(c.fetch, &CachedFileOptions{BlockSize: 100, MaxSize: 200})
+
+	read := func(off int64, sz int) []byte {
+		t.Helper()
+		res, errno := f.Read(context.Background(), make([]byte, sz), off)
+		if errno != 0 {
+			t.Fatalf("Read(%d, %d): %v", off, sz, errno)
+		}
+		got, _ := res.Bytes(nil)
+		return got
+	}
+
+	// Straddles the first two blocks.
+	if got := read(50, 100); !bytes.Equal(got, data[50:150]) {
+		t.Errorf("read 50: got %v", got)
+	}
+	if got := read(120, 10); !bytes.Equal(got, data[120:130]) {
+		t.Errorf("read 120: got %v", got)
+	}
+	// Reads past the end are short.
+	if got := read(240, 100); !bytes.Equal(got, data[240:]) {
+		t.Errorf("read 240: got %v", got)
+	}
+	if got := read(300, 10); len(got) != 0 {
+		t.Errorf("read 300: got %v", got)
+	}
+
+	if c.fetches[0] != 1 || c.fetches[100] != 1 || c.fetches[200] != 1 {
+		t.Errorf("got fetches %v, want one per block", c.fetches)
+	}
+	if st := f.Stats(); st.Hits != 1 || st.Misses != 4 {
+		t.Errorf("got stats %+v, want 1 hit, 4 misses", st)
+	}
+
+	// The blocks hold 250 bytes, so block 0 was evicted when
+	// block 2 came in, and must be fetched again.
+	read(0, 10)
+	if c.fetches[0] != 2 {
+		t.Errorf("got %d fetches of block 0, want 2", c.fetches[0])
+	}
+
+	// Errors are returned, and not cached.
+	f.Invalidate()
+	c.fail = true
+	if _, errno := f.Read(context.Background(), make([]byte, 10), 0); errno != syscall.EIO {
+		t.Errorf("got %v, want EIO", errno)
+	}
+	c.fail = false
+	if got := read(0, 10); !bytes.Equal(got, data[:10]) {
+		t.Errorf("read after error: got %v", got)
+	}
+}
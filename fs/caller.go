@@ -0,0 +1,83 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Caller returns the credentials of the process that issued the
+// request that ctx belongs to. It returns false if ctx does not come
+// from a FUSE request, eg. the context passed to OnAdd.
+//
+// The UID and GID are the effective IDs of the caller, except for
+// Access, where they are the real IDs. On Linux, the Pid is the
+// thread ID of the caller as seen from the PID namespace of the
+// server; it is 0 if the caller is not visible in that namespace.
+//
+// The kernel does not supply caller information for requests that
+// are not made on behalf of a process. For those, the Caller is all
+// zeroes:
+//
+//   - Release and ReleaseDir, which are sent when the last reference
+//     to a file is dropped, possibly asynchronously;
+//   - Forget, which does not reach the node API;
+//   - Write requests flushing dirty pages, if the kernel caches
+//     writes (CAP_WRITEBACK_CACHE).
+func Caller(ctx context.Context) (fuse.Caller, bool) {
+	c, ok := fuse.FromContext(ctx)
+	if !ok {
+		return fuse.Caller{}, false
+	}
+	return *c, true
+}
+
+type umaskKeyType struct{}
+
+var umaskKey umaskKeyType
+
+type umaskValue struct {
+	umask uint32
+	// unmasked is set if the kernel did not apply umask to the
+	// mode.
+	unmasked bool
+}
+
+// Umask returns the umask of the calling process. It is only
+// available in Mkdir, Mknod, Create and Tmpfile, and only on Linux
+// for the latter three. The kernel normally has already applied the
+// umask to the mode passed to these methods; see ModeUnmasked.
+func Umask(ctx context.Context) (uint32, bool) {
+	v, ok := ctx.Value(umaskKey).(umaskValue)
+	return v.umask, ok
+}
+
+// ModeUnmasked reports whether the mode passed to Mkdir, Mknod,
+// Create or Tmpfile is the mode the caller asked for, without its
+// umask applied. This is the case if MountOptions.DontMask is set,
+// and the kernel supports it. The file system should then apply the
+// umask from Umask itself.
+func ModeUnmasked(ctx context.Context) bool {
+	v, _ := ctx.Value(umaskKey).(umaskValue)
+	return v.unmasked
+}
+
+// applyUmask returns mode with the caller's umask applied, unless
+// the kernel did that already.
+func applyUmask(ctx context.Context, mode uint32) uint32 {
+	if v, _ := ctx.Value(umaskKey).(umaskValue); v.unmasked {
+		return mode &^ v.umask
+	}
+	return mode
+}
+
+func withUmask(ctx context.Context, umask uint32, ok bool, unmasked bool) context.Context {
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, umaskKey, umaskValue{umask, unmasked})
+}
@@ -0,0 +1,22 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import "github.com/hanwen/go-fuse/v2/fuse"
+
+// The OSX kernel does not pass the umask for CREATE and MKNOD, nor
+// open flags for CREATE.
+
+func createUmask(in *fuse.CreateIn) (uint32, bool) {
+	return 0, false
+}
+
+func mknodUmask(in *fuse.MknodIn) (uint32, bool) {
+	return 0, false
+}
+
+func createOpenFlags(in *fuse.CreateIn) uint32 {
+	return 0
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type callerNode struct {
+	Inode
+
+	mu       sync.Mutex
+	caller   fuse.Caller
+	callerOK bool
+	umask    uint32
+	umaskOK  bool
+}
+
+var _ = (NodeMkdirer)((*callerNode)(nil))
+var _ = (NodeCreater)((*callerNode)(nil))
+
+func (n *callerNode) record(ctx context.Context) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.caller, n.callerOK = Caller(ctx)
+	n.umask, n.umaskOK = Umask(ctx)
+}
+
+func (n *callerNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n.record(ctx)
+	return n.NewInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFDIR}), OK
+}
+
+func (n *callerNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	n.record(ctx)
+	return n.NewInode(ctx, &MemRegularFile{}, StableAttr{}), nil, 0, OK
+}
+
+func TestCallerUmask(t *testing.T) {
+	root := &callerNode{}
+	mnt, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	if _, ok := Caller(context.Background()); ok {
+		t.Error("Caller succeeded on a background context")
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	oldMask := syscall.Umask(027)
+	defer syscall.Umask(oldMask)
+
+	check := func(op string) {
+		t.Helper()
+		root.mu.Lock()
+		defer root.mu.Unlock()
+		if !root.callerOK {
+			t.Fatalf("%s: no caller", op)
+		}
+		if got, want := root.caller.Pid, uint32(syscall.Gettid()); got != want {
+			t.Errorf("%s: got pid %d, want %d", op, got, want)
+		}
+		if got, want := root.caller.Uid, uint32(os.Geteuid()); got != want {
+			t.Errorf("%s: got uid %d, want %d", op, got, want)
+		}
+		if got, want := root.caller.Gid, uint32(os.Getegid()); got != want {
+			t.Errorf("%s: got gid %d, want %d", op, got, want)
+		}
+		if !root.umaskOK || root.umask != 027 {
+			t.Errorf("%s: got umask %o (%v), want 027", op, root.umask, root.umaskOK)
+		}
+	}
+
+	if err := syscall.Mkdir(mnt+"/dir", 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	check("Mkdir")
+
+	fd, err := syscall.Open(mnt+"/file", syscall.O_CREAT|syscall.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	syscall.Close(fd)
+	check("Create")
+}
+
+type modeNode struct {
+	Inode
+
+	mu       sync.Mutex
+	mode     uint32
+	unmasked bool
+}
+
+var _ = (NodeMkdirer)((*modeNode)(nil))
+
+func (n *modeNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.mode = mode
+	n.unmasked = ModeUnmasked(ctx)
+	return n.NewInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFDIR}), OK
+}
+
+func TestDontMask(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	oldMask := syscall.Umask(027)
+	defer syscall.Umask(oldMask)
+
+	for _, dontMask := range []bool{false, true} {
+		root := &modeNode{}
+		opts := &Options{}
+		opts.DontMask = dontMask
+		mnt, server, clean := testMount(t, root, opts)
+
+		if err := syscall.Mkdir(mnt+"/dir", 0777); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		negotiated := server.NegotiatedSettings().Flags&fuse.CAP_DONT_MASK != 0
+		if negotiated && !dontMask {
+			t.Error("CAP_DONT_MASK negotiated without DontMask")
+		}
+		want := uint32(0750)
+		if negotiated {
+			want = 0777
+		}
+		root.mu.Lock()
+		if got := root.mode & 07777; got != want {
+			t.Errorf("DontMask=%v: got mode %o, want %o", dontMask, got, want)
+		}
+		if root.unmasked != negotiated {
+			t.Errorf("DontMask=%v: got ModeUnmasked %v, want %v", dontMask, root.unmasked, negotiated)
+		}
+		root.mu.Unlock()
+		clean()
+	}
+}
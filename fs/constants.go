@@ -19,11 +19,24 @@ func ToErrno(err error) syscall.Errno {
 	return syscall.Errno(s)
 }
 
+// RENAME_NOREPLACE is a flag argument for renameat2()
+const RENAME_NOREPLACE = 0x1
+
 // RENAME_EXCHANGE is a flag argument for renameat2()
 const RENAME_EXCHANGE = 0x2
 
+// seek to an absolute offset
+const _SEEK_SET = 0
+
 // seek to the next data
 const _SEEK_DATA = 3
 
 // seek to the next hole
 const _SEEK_HOLE = 4
+
+// Mode flags for fallocate(2).
+const (
+	_FALLOC_FL_KEEP_SIZE  = 0x1
+	_FALLOC_FL_PUNCH_HOLE = 0x2
+	_FALLOC_FL_ZERO_RANGE = 0x10
+)
@@ -8,3 +8,6 @@ import "syscall"
 
 // ENOATTR indicates that an extended attribute was not present.
 var ENOATTR = syscall.ENODATA
+
+// attrHasCrtime is set if fuse.Attr carries the creation time.
+const attrHasCrtime = false
@@ -9,6 +9,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync"
 	"syscall"
 	"testing"
 
@@ -94,3 +95,82 @@ func TestFUSEDirectIO(t *testing.T) {
 		t.Errorf("got %q want %q", got, want)
 	}
 }
+
+// dioCreateRoot creates files that are opened with FOPEN_DIRECT_IO.
+type dioCreateRoot struct {
+	Inode
+
+	mu    sync.Mutex
+	reads int
+}
+
+var _ = (NodeCreater)((*dioCreateRoot)(nil))
+
+func (r *dioCreateRoot) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	ch := r.NewInode(ctx, &Inode{}, StableAttr{Mode: fuse.S_IFREG})
+	return ch, &dioCountFH{root: r}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+// dioCountFH stores written data, and counts reads on its root.
+type dioCountFH struct {
+	root *dioCreateRoot
+	data []byte
+}
+
+var _ = (FileReader)((*dioCountFH)(nil))
+var _ = (FileWriter)((*dioCountFH)(nil))
+
+func (fh *dioCountFH) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	fh.root.mu.Lock()
+	defer fh.root.mu.Unlock()
+	if end := int(off) + len(data); end > len(fh.data) {
+		fh.data = append(fh.data, make([]byte, end-len(fh.data))...)
+	}
+	copy(fh.data[off:], data)
+	return uint32(len(data)), OK
+}
+
+func (fh *dioCountFH) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	fh.root.mu.Lock()
+	defer fh.root.mu.Unlock()
+	fh.root.reads++
+	if off >= int64(len(fh.data)) {
+		return fuse.ReadResultData(nil), OK
+	}
+	return fuse.ReadResultData(fh.data[off:]), OK
+}
+
+// TestFUSEDirectIOCreate checks that FOPEN_DIRECT_IO returned from
+// Create bypasses the page cache.
+func TestFUSEDirectIOCreate(t *testing.T) {
+	root := &dioCreateRoot{}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	f, err := os.OpenFile(mntDir+"/file", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f.Close()
+
+	want := []byte("hello world")
+	if _, err := f.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	const N = 3
+	for i := 0; i < N; i++ {
+		buf := make([]byte, len(want))
+		if n, err := f.ReadAt(buf, 0); err != nil {
+			t.Fatalf("ReadAt: %v", err)
+		} else if !bytes.Equal(buf[:n], want) {
+			t.Errorf("got %q, want %q", buf[:n], want)
+		}
+	}
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.reads != N {
+		t.Errorf("got %d reads on the server, want %d", root.reads, N)
+	}
+}
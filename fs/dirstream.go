@@ -5,6 +5,9 @@
 package fs
 
 import (
+	"context"
+	"sort"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -25,10 +28,224 @@ func (a *dirArray) Next() (fuse.DirEntry, syscall.Errno) {
 }
 
 func (a *dirArray) Close() {
+	a.entries = nil
+}
+
+type dirPlusArray struct {
+	entries []DirPlusEntry
+}
+
+func (a *dirPlusArray) HasNext() bool {
+	return len(a.entries) > 0
+}
+
+func (a *dirPlusArray) Next() (DirPlusEntry, syscall.Errno) {
+	e := a.entries[0]
+	a.entries = a.entries[1:]
+	return e, 0
+}
+
+func (a *dirPlusArray) Close() {
+	a.entries = nil
+}
+
+// NewListDirPlusStream wraps a slice of DirPlusEntry as a
+// DirPlusStream.
+func NewListDirPlusStream(list []DirPlusEntry) DirPlusStream {
+	return &dirPlusArray{list}
+}
 
+// dirPlusAdapter makes a DirPlusStream usable as a DirStream. The
+// last entry returned by Next is kept for READDIRPLUS.
+type dirPlusAdapter struct {
+	DirPlusStream
+	last DirPlusEntry
+}
+
+func (a *dirPlusAdapter) Next() (fuse.DirEntry, syscall.Errno) {
+	e, errno := a.DirPlusStream.Next()
+	a.last = e
+	return e.DirEntry, errno
 }
 
 // NewListDirStream wraps a slice of DirEntry as a DirStream.
 func NewListDirStream(list []fuse.DirEntry) DirStream {
 	return &dirArray{list}
 }
+
+type seekableDirArray struct {
+	entries []fuse.DirEntry
+	pos     int
+}
+
+var _ = (DirSeeker)((*seekableDirArray)(nil))
+
+func (a *seekableDirArray) HasNext() bool {
+	return a.pos < len(a.entries)
+}
+
+func (a *seekableDirArray) Next() (fuse.DirEntry, syscall.Errno) {
+	e := a.entries[a.pos]
+	a.pos++
+	return e, 0
+}
+
+func (a *seekableDirArray) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	a.pos = sort.Search(len(a.entries), func(i int) bool {
+		return a.entries[i].Off > off
+	})
+	return 0
+}
+
+func (a *seekableDirArray) Close() {
+	a.entries = nil
+	a.pos = 0
+}
+
+// NewSeekableListDirStream wraps a slice of DirEntry as a DirStream
+// that implements DirSeeker. The entries must have increasing,
+// nonzero Off values. For seeks to work across calls to Readdir,
+// the offset of an entry must not change while the directory is
+// listed, eg. by deriving it from a creation counter.
+func NewSeekableListDirStream(list []fuse.DirEntry) DirStream {
+	return &seekableDirArray{entries: list}
+}
+
+// chanDirWindow is the number of entries a ChanDirStream keeps for
+// seeking back. It is more than a READDIR reply, which is a page,
+// can hold.
+const chanDirWindow = 256
+
+// ChanDirStream is a DirStream that reads entries lazily from a
+// channel, so large directories need not be held in memory.
+//
+// The producer sends entries on the channel and closes it when it is
+// done. To report an I/O error, it calls Fail before closing the
+// channel. If the stream is closed before it is exhausted (for
+// example, because the directory handle was released), the channel
+// returned by Done is closed, and the producer should stop sending.
+//
+// The stream numbers the entries in the order they are received,
+// overwriting DirEntry.Off, and implements DirSeeker. It keeps the
+// last entries it read, so when the kernel seeks back because the
+// reader did not take a whole READDIR reply, they are served from
+// memory. Seeking back further reopens the directory, so each
+// Readdir call should start a new producer.
+type ChanDirStream struct {
+	entries <-chan fuse.DirEntry
+	done    chan struct{}
+	once    sync.Once
+
+	// window holds the entries read last. If pos is less than
+	// its length, window[pos] is the next entry to return.
+	window []fuse.DirEntry
+	pos    int
+
+	// off is the offset of the last entry read from entries.
+	off uint64
+
+	mu    sync.Mutex
+	errno syscall.Errno
+}
+
+var _ = (DirSeeker)((*ChanDirStream)(nil))
+
+// NewChanDirStream returns a ChanDirStream reading from entries.
+func NewChanDirStream(entries <-chan fuse.DirEntry) *ChanDirStream {
+	return &ChanDirStream{
+		entries: entries,
+		done:    make(chan struct{}),
+	}
+}
+
+// Done returns a channel that is closed when the stream is closed.
+func (s *ChanDirStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Fail makes Next return errno once all entries sent so far are
+// consumed. It should be called before closing the entries channel.
+func (s *ChanDirStream) Fail(errno syscall.Errno) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errno = errno
+}
+
+// read appends the next entry from the channel to the window, and
+// reports whether there was one. It must be called with pos at the
+// end of the window.
+func (s *ChanDirStream) read() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case e, ok := <-s.entries:
+		if !ok {
+			return false
+		}
+		s.off++
+		e.Off = s.off
+		if len(s.window) == chanDirWindow {
+			s.window = s.window[1:]
+			s.pos--
+		}
+		s.window = append(s.window, e)
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *ChanDirStream) HasNext() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	if s.pos < len(s.window) || s.read() {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errno != 0
+}
+
+func (s *ChanDirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if s.pos < len(s.window) {
+		e := s.window[s.pos]
+		s.pos++
+		return e, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errno := s.errno
+	s.errno = 0
+	return fuse.DirEntry{}, errno
+}
+
+// Seekdir seeks within the entries kept in memory, or forward. It
+// returns EINVAL for offsets that were dropped from memory already.
+func (s *ChanDirStream) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	if off < s.off-uint64(len(s.window)) {
+		return syscall.EINVAL
+	}
+	s.pos = len(s.window)
+	for s.off < off && s.read() {
+		s.pos = len(s.window)
+	}
+	if off < s.off {
+		s.pos -= int(s.off - off)
+	}
+	return 0
+}
+
+// Close closes the channel returned by Done. It does not wait for
+// the producer to stop.
+func (s *ChanDirStream) Close() {
+	s.once.Do(func() { close(s.done) })
+}
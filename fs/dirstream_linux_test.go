@@ -0,0 +1,491 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// seekDir lists its names with stable offsets.
+type seekDir struct {
+	Inode
+
+	mu      sync.Mutex
+	names   []string
+	offsets map[string]uint64
+}
+
+var _ = (NodeReaddirer)((*seekDir)(nil))
+
+func (d *seekDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var r []fuse.DirEntry
+	for _, n := range d.names {
+		r = append(r, fuse.DirEntry{Name: n, Mode: fuse.S_IFREG, Off: d.offsets[n]})
+	}
+	return NewSeekableListDirStream(r), OK
+}
+
+type direntOff struct {
+	name string
+	off  int64
+}
+
+// getdents reads the remaining entries of the directory fd, with
+// their offsets.
+func getdents(t *testing.T, fd int) []direntOff {
+	t.Helper()
+	var r []direntOff
+	// A small buffer makes the kernel continue from the offset
+	// of the last entry it returned.
+	buf := make([]byte, 64)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			t.Fatalf("Getdents: %v", err)
+		}
+		if n == 0 {
+			return r
+		}
+		for i := 0; i < n; {
+			de := (*unix.Dirent)(unsafe.Pointer(&buf[i]))
+			nm := buf[i+int(unsafe.Offsetof(de.Name)) : i+int(de.Reclen)]
+			for j, c := range nm {
+				if c == 0 {
+					nm = nm[:j]
+					break
+				}
+			}
+			r = append(r, direntOff{string(nm), de.Off})
+			i += int(de.Reclen)
+		}
+	}
+}
+
+func TestDirSeeker(t *testing.T) {
+	dir := &seekDir{
+		names:   []string{"aaaaaaaaaaaa", "bbbbbbbbbbbb", "cccccccccccc", "dddddddddddd"},
+		offsets: map[string]uint64{},
+	}
+	for i, n := range dir.names {
+		dir.offsets[n] = uint64(1000 * (i + 1))
+	}
+	mntDir, _, clean := testMount(t, dir, nil)
+	defer clean()
+
+	fd, err := syscall.Open(mntDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	all := getdents(t, fd)
+	var want []direntOff
+	for _, n := range dir.names {
+		want = append(want, direntOff{n, int64(dir.offsets[n])})
+	}
+	if !reflect.DeepEqual(all, want) {
+		t.Fatalf("got %v, want %v", all, want)
+	}
+
+	// telldir/seekdir on the same handle.
+	if _, err := unix.Seek(fd, all[1].off, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got := getdents(t, fd); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("after seek: got %v, want %v", got, want[2:])
+	}
+
+	// Remove the entry at the offset, and resume from it on a
+	// new handle: the listing continues after it.
+	dir.mu.Lock()
+	dir.names = append(dir.names[:2:2], dir.names[3:]...)
+	dir.mu.Unlock()
+
+	fd2, err := syscall.Open(mntDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd2)
+	if _, err := unix.Seek(fd2, all[2].off, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+	if got := getdents(t, fd2); !reflect.DeepEqual(got, want[3:]) {
+		t.Errorf("stale offset: got %v, want %v", got, want[3:])
+	}
+}
+
+// closeCountStream counts the calls to Close.
+type closeCountStream struct {
+	DirStream
+	closes *int32
+}
+
+func (s *closeCountStream) Close() {
+	atomic.AddInt32(s.closes, 1)
+	s.DirStream.Close()
+}
+
+// closeCountDir lists a backing directory.
+type closeCountDir struct {
+	Inode
+	dir    string
+	closes int32
+}
+
+var _ = (NodeReaddirer)((*closeCountDir)(nil))
+
+func (d *closeCountDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	ds, errno := NewLoopbackDirStream(d.dir)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &closeCountStream{ds, &d.closes}, OK
+}
+
+func TestDirStreamCloseAbandoned(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	for i := 0; i < 100; i++ {
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/file%d", dir, i), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// backingFds counts the open fds for the backing directory.
+	backingFds := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, fd := range fds {
+			if target, err := os.Readlink("/proc/self/fd/" + fd.Name()); err == nil && target == dir {
+				n++
+			}
+		}
+		return n
+	}
+
+	node := &closeCountDir{dir: dir}
+	mntDir, _, clean := testMount(t, node, nil)
+	unmounted := false
+	defer func() {
+		if !unmounted {
+			clean()
+		}
+	}()
+
+	fd, err := syscall.Open(mntDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read a single entry, and abandon the listing.
+	buf := make([]byte, 64)
+	if n, err := unix.Getdents(fd, buf); err != nil || n == 0 {
+		t.Fatalf("Getdents: %d, %v", n, err)
+	}
+	if got := backingFds(); got != 1 {
+		t.Errorf("got %d backing fds while listing, want 1", got)
+	}
+	syscall.Close(fd)
+
+	// The kernel sends RELEASEDIR asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&node.closes) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&node.closes); got != 1 {
+		t.Fatalf("got %d Close calls, want 1", got)
+	}
+	if got := backingFds(); got != 0 {
+		t.Errorf("got %d backing fds after Close, want 0", got)
+	}
+
+	clean()
+	unmounted = true
+	if got := atomic.LoadInt32(&node.closes); got != 1 {
+		t.Errorf("got %d Close calls after unmount, want 1", got)
+	}
+}
+
+// dotDir lists "." and ".." itself, with its own inode numbers.
+type dotDir struct {
+	Inode
+}
+
+var _ = (NodeReaddirer)((*dotDir)(nil))
+
+var dotDirEntries = []fuse.DirEntry{
+	{Name: ".", Mode: fuse.S_IFDIR, Ino: 100, Off: 10},
+	{Name: "..", Mode: fuse.S_IFDIR, Ino: 200, Off: 20},
+	{Name: "file", Mode: fuse.S_IFREG, Ino: 300, Off: 30},
+}
+
+func (d *dotDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	return NewListDirStream(dotDirEntries), OK
+}
+
+type direntIno struct {
+	name string
+	ino  uint64
+	off  int64
+}
+
+func TestDotEntries(t *testing.T) {
+	mntDir, _, clean := testMount(t, &dotDir{}, nil)
+	defer clean()
+
+	fd, err := syscall.Open(mntDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	var got []direntIno
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			t.Fatalf("Getdents: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		for i := 0; i < n; {
+			de := (*unix.Dirent)(unsafe.Pointer(&buf[i]))
+			if de.Reclen == 0 || i+int(de.Reclen) > n {
+				t.Fatalf("malformed dirent at %d: %+v", i, de)
+			}
+			nm := buf[i+int(unsafe.Offsetof(de.Name)) : i+int(de.Reclen)]
+			for j, c := range nm {
+				if c == 0 {
+					nm = nm[:j]
+					break
+				}
+			}
+			got = append(got, direntIno{string(nm), de.Ino, de.Off})
+			i += int(de.Reclen)
+		}
+	}
+
+	var want []direntIno
+	for _, e := range dotDirEntries {
+		want = append(want, direntIno{e.Name, e.Ino, int64(e.Off)})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDotEntriesBridge(t *testing.T) {
+	rb := NewNodeFS(&dotDir{}, &Options{}).(*rawBridge)
+	var openOut fuse.OpenOut
+	if st := rb.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &openOut); !st.Ok() {
+		t.Fatalf("OpenDir: %v", st)
+	}
+
+	buf := make([]byte, 4096)
+	out := fuse.NewDirEntryList(buf, 0)
+	in := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: openOut.Fh, Size: uint32(len(buf))}
+	if st := rb.ReadDir(nil, &in, out); !st.Ok() {
+		t.Fatalf("ReadDir: %v", st)
+	}
+
+	var got []direntIno
+	for _, e := range out.Entries() {
+		got = append(got, direntIno{e.Name, e.Ino, int64(e.Off)})
+	}
+	var want []direntIno
+	for _, e := range dotDirEntries {
+		want = append(want, direntIno{e.Name, e.Ino, int64(e.Off)})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The dot entries do not end up in the tree.
+	in.Offset = 0
+	if st := rb.ReadDirPlus(nil, &in, fuse.NewDirEntryList(buf, 0)); !st.Ok() {
+		t.Fatalf("ReadDirPlus: %v", st)
+	}
+	if ch := rb.root.GetChild(".."); ch != nil {
+		t.Errorf("\"..\" was added to the tree")
+	}
+}
+
+// cursorDir keeps the listing position in its directory handles.
+type cursorDir struct {
+	Inode
+
+	names []string
+
+	mu       sync.Mutex
+	handles  []*cursorHandle
+	released int
+}
+
+var _ = (NodeOpendirHandler)((*cursorDir)(nil))
+
+func (d *cursorDir) OpendirHandle(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := &cursorHandle{dir: d}
+	d.handles = append(d.handles, h)
+	return h, 0, OK
+}
+
+// cursorHandle is its own DirStream.
+type cursorHandle struct {
+	dir *cursorDir
+	pos int
+}
+
+var _ = (FileReaddirer)((*cursorHandle)(nil))
+var _ = (FileReleasedirer)((*cursorHandle)(nil))
+
+func (h *cursorHandle) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	h.pos = 0
+	return h, OK
+}
+
+func (h *cursorHandle) HasNext() bool {
+	return h.pos < len(h.dir.names)
+}
+
+func (h *cursorHandle) Next() (fuse.DirEntry, syscall.Errno) {
+	h.pos++
+	return fuse.DirEntry{Name: h.dir.names[h.pos-1], Mode: fuse.S_IFREG}, OK
+}
+
+func (h *cursorHandle) Close() {}
+
+func (h *cursorHandle) Releasedir(ctx context.Context, releaseFlags uint32) {
+	h.dir.mu.Lock()
+	defer h.dir.mu.Unlock()
+	h.dir.released++
+}
+
+func newCursorDir() *cursorDir {
+	d := &cursorDir{}
+	for i := 0; i < 20; i++ {
+		d.names = append(d.names, fmt.Sprintf("file%02d", i))
+	}
+	return d
+}
+
+func TestOpendirHandleBridge(t *testing.T) {
+	d := newCursorDir()
+	rb := NewNodeFS(d, &Options{}).(*rawBridge)
+
+	var fhs [2]uint64
+	for i := range fhs {
+		var out fuse.OpenOut
+		if st := rb.OpenDir(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &out); !st.Ok() {
+			t.Fatalf("OpenDir: %v", st)
+		}
+		fhs[i] = out.Fh
+	}
+
+	// Interleave small reads on both handles.
+	var got [2][]string
+	var offs [2]uint64
+	buf := make([]byte, 64)
+	for done := false; !done; {
+		done = true
+		for i, fh := range fhs {
+			out := fuse.NewDirEntryList(buf, offs[i])
+			in := fuse.ReadIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: fh, Offset: offs[i], Size: uint32(len(buf))}
+			if st := rb.ReadDir(nil, &in, out); !st.Ok() {
+				t.Fatalf("ReadDir: %v", st)
+			}
+			for _, e := range out.Entries() {
+				got[i] = append(got[i], e.Name)
+				offs[i] = e.Off
+				done = false
+			}
+		}
+	}
+	for i := range got {
+		if !reflect.DeepEqual(got[i], d.names) {
+			t.Errorf("handle %d: got %v, want %v", i, got[i], d.names)
+		}
+	}
+	if len(d.handles) != 2 || d.handles[0] == d.handles[1] {
+		t.Fatalf("got handles %v, want 2 distinct", d.handles)
+	}
+
+	for _, fh := range fhs {
+		rb.ReleaseDir(&fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: 1}, Fh: fh})
+	}
+	if d.released != 2 {
+		t.Errorf("got %d Releasedir calls, want 2", d.released)
+	}
+}
+
+func TestOpendirHandle(t *testing.T) {
+	d := newCursorDir()
+	mntDir, _, clean := testMount(t, d, nil)
+	defer clean()
+
+	var fds [2]int
+	for i := range fds {
+		fd, err := syscall.Open(mntDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds[i] = fd
+	}
+
+	// Read part of the first listing, then all of the second.
+	buf := make([]byte, 64)
+	if n, err := unix.Getdents(fds[0], buf); err != nil || n == 0 {
+		t.Fatalf("Getdents: %d, %v", n, err)
+	}
+	var want []direntOff
+	for i, nm := range d.names {
+		want = append(want, direntOff{nm, int64(i + 1)})
+	}
+	if got := getdents(t, fds[1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("second listing: got %v, want %v", got, want)
+	}
+
+	// The first listing continues where it stopped.
+	rest := getdents(t, fds[0])
+	if len(rest) == 0 || len(rest) >= len(want) || !reflect.DeepEqual(rest, want[len(want)-len(rest):]) {
+		t.Errorf("rest of first listing: got %v, want a tail of %v", rest, want)
+	}
+
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+	// The kernel sends RELEASEDIR asynchronously.
+	released := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for released != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		d.mu.Lock()
+		released = d.released
+		d.mu.Unlock()
+	}
+	if released != 2 {
+		t.Errorf("got %d Releasedir calls, want 2", released)
+	}
+}
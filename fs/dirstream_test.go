@@ -0,0 +1,275 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestChanDirStreamError(t *testing.T) {
+	ch := make(chan fuse.DirEntry)
+	s := NewChanDirStream(ch)
+	go func() {
+		for i := 0; i < 3; i++ {
+			ch <- fuse.DirEntry{Name: fmt.Sprintf("file%d", i), Mode: fuse.S_IFREG}
+		}
+		s.Fail(syscall.EIO)
+		close(ch)
+	}()
+
+	var names []string
+	for s.HasNext() {
+		e, errno := s.Next()
+		if errno != 0 {
+			if errno != syscall.EIO {
+				t.Errorf("got errno %v, want EIO", errno)
+			}
+			break
+		}
+		names = append(names, e.Name)
+	}
+	if len(names) != 3 {
+		t.Errorf("got %v, want 3 entries", names)
+	}
+	if s.HasNext() {
+		t.Errorf("HasNext after error")
+	}
+	s.Close()
+}
+
+func TestChanDirStreamClose(t *testing.T) {
+	ch := make(chan fuse.DirEntry)
+	s := NewChanDirStream(ch)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer close(ch)
+		for i := 0; ; i++ {
+			select {
+			case ch <- fuse.DirEntry{Name: fmt.Sprintf("file%d", i), Mode: fuse.S_IFREG}:
+			case <-s.Done():
+				return
+			}
+		}
+	}()
+
+	if !s.HasNext() {
+		t.Fatal("HasNext: false")
+	}
+	s.Next()
+	s.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer did not stop")
+	}
+	if s.HasNext() {
+		t.Errorf("HasNext after Close")
+	}
+}
+
+type chanDirNode struct {
+	Inode
+	count int
+
+	readdirs int
+}
+
+func (n *chanDirNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	n.readdirs++
+	ch := make(chan fuse.DirEntry)
+	s := NewChanDirStream(ch)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n.count; i++ {
+			select {
+			case ch <- fuse.DirEntry{Name: fmt.Sprintf("file%d", i), Mode: fuse.S_IFREG}:
+			case <-s.Done():
+				return
+			}
+		}
+	}()
+	return s, 0
+}
+
+func TestChanDirStreamMount(t *testing.T) {
+	root := &chanDirNode{count: 2000}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	f, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	entries, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatalf("Readdirnames: %v", err)
+	}
+	if len(entries) != root.count {
+		t.Errorf("got %d entries, want %d", len(entries), root.count)
+	}
+}
+
+type failingDirNode struct {
+	Inode
+}
+
+func (n *failingDirNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	ch := make(chan fuse.DirEntry, 10)
+	s := NewChanDirStream(ch)
+	for i := 0; i < cap(ch); i++ {
+		ch <- fuse.DirEntry{Name: fmt.Sprintf("file%d", i), Mode: fuse.S_IFREG}
+	}
+	s.Fail(syscall.EIO)
+	close(ch)
+	return s, 0
+}
+
+func TestReaddirPartialError(t *testing.T) {
+	mntDir, _, clean := testMount(t, &failingDirNode{}, nil)
+	defer clean()
+
+	f, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if len(names) != 10 {
+		t.Errorf("got %d entries, want 10", len(names))
+	}
+	if !errors.Is(err, syscall.EIO) {
+		t.Errorf("got error %v, want EIO", err)
+	}
+}
+
+func TestSeekableListDirStream(t *testing.T) {
+	var list []fuse.DirEntry
+	for i, n := range []string{"a", "b", "c"} {
+		list = append(list, fuse.DirEntry{Name: n, Mode: fuse.S_IFREG, Off: uint64(10 * (i + 1))})
+	}
+	s := NewSeekableListDirStream(list)
+	sk := s.(DirSeeker)
+
+	names := func() string {
+		var r string
+		for s.HasNext() {
+			e, _ := s.Next()
+			r += e.Name
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		off  uint64
+		want string
+	}{
+		{0, "abc"},
+		{10, "bc"},
+		{15, "bc"}, // entry at 15 is gone: continue after it.
+		{30, ""},
+		{20, "c"},
+	} {
+		if errno := sk.Seekdir(context.Background(), tc.off); errno != 0 {
+			t.Fatalf("Seekdir(%d): %v", tc.off, errno)
+		}
+		if got := names(); got != tc.want {
+			t.Errorf("Seekdir(%d): got %q, want %q", tc.off, got, tc.want)
+		}
+	}
+}
+
+func TestChanDirStreamSeekdir(t *testing.T) {
+	root := &chanDirNode{count: 1000}
+	str, _ := root.Readdir(context.Background())
+	s := str.(*ChanDirStream)
+	defer s.Close()
+
+	next := func() uint64 {
+		if !s.HasNext() {
+			return 0
+		}
+		e, _ := s.Next()
+		return e.Off
+	}
+	for i := 0; i < 300; i++ {
+		next()
+	}
+	for _, tc := range []struct {
+		off  uint64
+		want uint64
+	}{
+		{290, 291},
+		{600, 601},
+		{350, 351},
+		{999, 1000},
+		{1000, 0},
+		{5000, 0},
+	} {
+		if errno := s.Seekdir(context.Background(), tc.off); errno != 0 {
+			t.Fatalf("Seekdir(%d): %v", tc.off, errno)
+		}
+		if got := next(); got != tc.want {
+			t.Errorf("Seekdir(%d): got next offset %d, want %d", tc.off, got, tc.want)
+		}
+	}
+	if errno := s.Seekdir(context.Background(), 10); errno != syscall.EINVAL {
+		t.Errorf("Seekdir to dropped entry: got %v, want EINVAL", errno)
+	}
+}
+
+func TestChanDirStreamSeekBack(t *testing.T) {
+	root := &chanDirNode{count: 1000}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	openIn := fuse.OpenIn{}
+	openIn.NodeId = 1
+	openOut := fuse.OpenOut{}
+	if status := rb.OpenDir(nil, &openIn, &openOut); !status.Ok() {
+		t.Fatal(status)
+	}
+	readIn := fuse.ReadIn{}
+	readIn.NodeId = 1
+	readIn.Fh = openOut.Fh
+
+	// readdir returns the name of the first entry from readIn.Offset.
+	readdir := func(size int) string {
+		buf := make([]byte, size)
+		if status := rb.ReadDir(nil, &readIn, fuse.NewDirEntryList(buf, readIn.Offset)); !status.Ok() {
+			t.Fatal(status)
+		}
+		nameLen := *(*uint32)(unsafe.Pointer(&buf[16]))
+		return string(buf[24 : 24+nameLen])
+	}
+	readdir(1 << 16)
+
+	for _, tc := range []struct {
+		off      uint64
+		want     string
+		readdirs int
+	}{
+		{900, "file900", 1},
+		{10, "file10", 2},
+	} {
+		readIn.Offset = tc.off
+		if got := readdir(100); got != tc.want {
+			t.Errorf("offset %d: got %q, want %q", tc.off, got, tc.want)
+		}
+		if root.readdirs != tc.readdirs {
+			t.Errorf("offset %d: got %d Readdir calls, want %d", tc.off, root.readdirs, tc.readdirs)
+		}
+	}
+}
@@ -7,10 +7,8 @@ package fs
 import (
 	"context"
 	"sync"
-
-	//	"time"
-
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
@@ -42,6 +40,22 @@ var _ = (FileFlusher)((*loopbackFile)(nil))
 var _ = (FileFsyncer)((*loopbackFile)(nil))
 var _ = (FileSetattrer)((*loopbackFile)(nil))
 var _ = (FileAllocater)((*loopbackFile)(nil))
+var _ = (FilePassthroughFder)((*loopbackFile)(nil))
+var _ = (loopbackFder)((*loopbackFile)(nil))
+
+func (f *loopbackFile) withFd(fn func(fd int) syscall.Errno) syscall.Errno {
+	f.mu.Lock()
+	fd := f.fd
+	f.mu.Unlock()
+	return fn(fd)
+}
+
+func (f *loopbackFile) PassthroughFd() (int, bool) {
+	// This Fd is not accessed concurrently, but lock anyway for uniformity.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fd, true
+}
 
 func (f *loopbackFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
 	f.mu.Lock()
@@ -92,9 +106,8 @@ func (f *loopbackFile) Fsync(ctx context.Context, flags uint32) (errno syscall.E
 }
 
 const (
-	_OFD_GETLK  = 36
-	_OFD_SETLK  = 37
-	_OFD_SETLKW = 38
+	_OFD_GETLK = 36
+	_OFD_SETLK = 37
 )
 
 func (f *loopbackFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (errno syscall.Errno) {
@@ -108,14 +121,41 @@ func (f *loopbackFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLoc
 }
 
 func (f *loopbackFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
-	return f.setLock(ctx, owner, lk, flags, false)
+	return f.setLock(ctx, owner, lk, flags)
 }
 
 func (f *loopbackFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
-	return f.setLock(ctx, owner, lk, flags, true)
+	return waitLock(ctx, func() syscall.Errno {
+		return f.setLock(ctx, owner, lk, flags)
+	})
 }
 
-func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, blocking bool) (errno syscall.Errno) {
+// waitLock retries the non-blocking lock attempt try, with increasing
+// delays, until it does not fail with a conflict. It returns EINTR
+// if ctx is cancelled first, ie. the kernel interrupts the request
+// because the waiting process got a signal. A blocking fcntl or
+// flock call cannot be cancelled, so it would leave the process
+// hanging until the lock is free.
+func waitLock(ctx context.Context, try func() syscall.Errno) syscall.Errno {
+	delay := time.Millisecond
+	for {
+		errno := try()
+		if errno != syscall.EAGAIN && errno != syscall.EACCES {
+			return errno
+		}
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-time.After(delay):
+		}
+		if delay < 100*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+// setLock takes or releases a lock without waiting.
+func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) (errno syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if (flags & fuse.FUSE_LK_FLOCK) != 0 {
@@ -130,20 +170,11 @@ func (f *loopbackFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileL
 		default:
 			return syscall.EINVAL
 		}
-		if !blocking {
-			op |= syscall.LOCK_NB
-		}
-		return ToErrno(syscall.Flock(f.fd, op))
+		return ToErrno(syscall.Flock(f.fd, op|syscall.LOCK_NB))
 	} else {
 		flk := syscall.Flock_t{}
 		lk.ToFlockT(&flk)
-		var op int
-		if blocking {
-			op = _OFD_SETLKW
-		} else {
-			op = _OFD_SETLK
-		}
-		return ToErrno(syscall.FcntlFlock(uintptr(f.fd), op, &flk))
+		return ToErrno(syscall.FcntlFlock(uintptr(f.fd), _OFD_SETLK, &flk))
 	}
 }
 
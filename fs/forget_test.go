@@ -118,3 +118,107 @@ func TestForget(t *testing.T) {
 		t.Fatalf("got %d live nodes, want 1", l)
 	}
 }
+
+type forgetCountNode struct {
+	Inode
+	forgets int
+}
+
+var _ = (NodeOnForgetter)((*forgetCountNode)(nil))
+
+func (n *forgetCountNode) OnForget() {
+	n.forgets++
+}
+
+type forgetCountRoot struct {
+	Inode
+	child *forgetCountNode
+}
+
+func (n *forgetCountRoot) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	return n.NewInode(ctx, n.child, StableAttr{Mode: syscall.S_IFREG, Ino: 42}), 0
+}
+
+func TestOnForget(t *testing.T) {
+	root := &forgetCountRoot{child: &forgetCountNode{}}
+	rawFS := NewNodeFS(root, &Options{})
+
+	var out fuse.EntryOut
+	for i := 0; i < 3; i++ {
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !st.Ok() {
+			t.Fatalf("Lookup: %v", st)
+		}
+	}
+
+	// A BATCH_FORGET is split into individual Forget calls.
+	rawFS.Forget(out.NodeId, 2)
+	if root.child.forgets != 0 {
+		t.Fatalf("OnForget called with live kernel references")
+	}
+	rawFS.Forget(out.NodeId, 1)
+	if root.child.forgets != 1 {
+		t.Fatalf("got %d OnForget calls, want 1", root.child.forgets)
+	}
+	if root.GetChild("file") != nil {
+		t.Errorf("child still in tree")
+	}
+
+	// Cleaning up the dead node again should not call OnForget.
+	root.child.removeRef(0, false)
+	if root.child.forgets != 1 {
+		t.Errorf("got %d OnForget calls, want 1", root.child.forgets)
+	}
+}
+
+func TestInodeWatermark(t *testing.T) {
+	counts := make(chan int, 10)
+	root := &allChildrenNode{depth: 1}
+	rawFS := NewNodeFS(root, &Options{
+		MaxInodes:        3,
+		OnInodeWatermark: func(count int) { counts <- count },
+	})
+	bridge := rawFS.(*rawBridge)
+
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		var out fuse.EntryOut
+		if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, fmt.Sprint(i), &out); !st.Ok() {
+			t.Fatalf("Lookup: %v", st)
+		}
+		ids = append(ids, out.NodeId)
+	}
+	if got := bridge.InodeCount(); got != 6 {
+		t.Errorf("got InodeCount %d, want 6", got)
+	}
+	select {
+	case got := <-counts:
+		if got != 4 {
+			t.Errorf("got count %d, want 4", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnInodeWatermark was not called")
+	}
+
+	// Drop below the watermark, and cross it again.
+	for _, id := range ids[:3] {
+		rawFS.Forget(id, 1)
+	}
+	if got := bridge.InodeCount(); got != 3 {
+		t.Errorf("got InodeCount %d, want 3", got)
+	}
+	var out fuse.EntryOut
+	if st := rawFS.Lookup(nil, &fuse.InHeader{NodeId: 1}, "again", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	select {
+	case got := <-counts:
+		if got != 4 {
+			t.Errorf("got count %d, want 4", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnInodeWatermark was not called after dropping below the watermark")
+	}
+	if len(counts) != 0 {
+		t.Errorf("OnInodeWatermark called too often")
+	}
+}
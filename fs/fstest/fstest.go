@@ -0,0 +1,203 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fstest drives file systems built with the fs package
+// without mounting them, for unit tests that must run without access
+// to /dev/fuse.
+//
+// A Conn issues requests to the fs.NodeFS bridge the way the kernel
+// would, bypassing the wire encoding. Like the kernel, the test is
+// responsible for the reference counting: every successful Lookup,
+// Create and Mkdir adds a lookup count to the returned node, which
+// is dropped with Forget.
+//
+//	c := fstest.New(root, nil)
+//	entry, st := c.Lookup(fstest.RootID, "file")
+//	open, st := c.Open(entry.NodeId, syscall.O_RDONLY)
+//	data, st := c.Read(entry.NodeId, open.Fh, 0, 1024)
+//	c.Release(entry.NodeId, open.Fh)
+//	c.Forget(entry.NodeId, 1)
+//
+// Notifications to the kernel, such as Inode.NotifyContent, are not
+// supported, since there is no server.
+package fstest
+
+import (
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// RootID is the node ID of the root.
+const RootID = fuse.FUSE_ROOT_ID
+
+// Conn sends requests to a file system.
+type Conn struct {
+	// FS is the bridge the requests go to. It can be used
+	// directly for requests that Conn has no method for.
+	FS fuse.RawFileSystem
+
+	// Caller is the process that all requests appear to come
+	// from.
+	Caller fuse.Caller
+
+	cancel <-chan struct{}
+}
+
+// New creates the file system for root, and returns a Conn to send
+// requests to it. The options are as for fs.NewNodeFS; nil means
+// the zero Options.
+func New(root fs.InodeEmbedder, opts *fs.Options) *Conn {
+	if opts == nil {
+		opts = &fs.Options{}
+	}
+	return &Conn{FS: fs.NewNodeFS(root, opts)}
+}
+
+// Interruptible returns a Conn that sends its requests with the given
+// cancel channel. Closing the channel simulates the kernel sending
+// INTERRUPT for all requests in flight on the returned Conn, which
+// shows up as the cancellation of their context.Context.
+func (c *Conn) Interruptible(cancel <-chan struct{}) *Conn {
+	r := *c
+	r.cancel = cancel
+	return &r
+}
+
+func (c *Conn) header(node uint64) fuse.InHeader {
+	return fuse.InHeader{NodeId: node, Caller: c.Caller}
+}
+
+// Lookup looks up name in the directory parent.
+func (c *Conn) Lookup(parent uint64, name string) (fuse.EntryOut, fuse.Status) {
+	var out fuse.EntryOut
+	h := c.header(parent)
+	st := c.FS.Lookup(c.cancel, &h, name, &out)
+	return out, st
+}
+
+// Forget drops nlookup references to node.
+func (c *Conn) Forget(node, nlookup uint64) {
+	c.FS.Forget(node, nlookup)
+}
+
+// GetAttr returns the attributes of node.
+func (c *Conn) GetAttr(node uint64) (fuse.AttrOut, fuse.Status) {
+	in := fuse.GetAttrIn{InHeader: c.header(node)}
+	var out fuse.AttrOut
+	st := c.FS.GetAttr(c.cancel, &in, &out)
+	return out, st
+}
+
+// Truncate sets the size of node.
+func (c *Conn) Truncate(node uint64, size uint64) (fuse.AttrOut, fuse.Status) {
+	in := fuse.SetAttrIn{}
+	in.InHeader = c.header(node)
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = size
+	var out fuse.AttrOut
+	st := c.FS.SetAttr(c.cancel, &in, &out)
+	return out, st
+}
+
+// Mkdir creates a directory.
+func (c *Conn) Mkdir(parent uint64, name string, mode uint32) (fuse.EntryOut, fuse.Status) {
+	in := fuse.MkdirIn{InHeader: c.header(parent), Mode: mode}
+	var out fuse.EntryOut
+	st := c.FS.Mkdir(c.cancel, &in, name, &out)
+	return out, st
+}
+
+// Create creates and opens a file.
+func (c *Conn) Create(parent uint64, name string, flags uint32, mode uint32) (fuse.CreateOut, fuse.Status) {
+	in := fuse.CreateIn{InHeader: c.header(parent), Flags: flags, Mode: mode}
+	var out fuse.CreateOut
+	st := c.FS.Create(c.cancel, &in, name, &out)
+	return out, st
+}
+
+// Unlink removes a file.
+func (c *Conn) Unlink(parent uint64, name string) fuse.Status {
+	h := c.header(parent)
+	return c.FS.Unlink(c.cancel, &h, name)
+}
+
+// Rmdir removes a directory.
+func (c *Conn) Rmdir(parent uint64, name string) fuse.Status {
+	h := c.header(parent)
+	return c.FS.Rmdir(c.cancel, &h, name)
+}
+
+// Open opens node.
+func (c *Conn) Open(node uint64, flags uint32) (fuse.OpenOut, fuse.Status) {
+	in := fuse.OpenIn{InHeader: c.header(node), Flags: flags}
+	var out fuse.OpenOut
+	st := c.FS.Open(c.cancel, &in, &out)
+	return out, st
+}
+
+// Read reads up to size bytes at off from an open file.
+func (c *Conn) Read(node, fh uint64, off int64, size int) ([]byte, fuse.Status) {
+	in := fuse.ReadIn{InHeader: c.header(node), Fh: fh, Offset: uint64(off), Size: uint32(size)}
+	buf := make([]byte, size)
+	res, st := c.FS.Read(c.cancel, &in, buf)
+	if !st.Ok() {
+		return nil, st
+	}
+	defer res.Done()
+	data, st := res.Bytes(buf)
+	if len(data) > size {
+		data = data[:size]
+	}
+	// The result may alias buf or data owned by the file
+	// system; return a copy the test can keep.
+	return append([]byte{}, data...), st
+}
+
+// Write writes data at off to an open file.
+func (c *Conn) Write(node, fh uint64, off int64, data []byte) (uint32, fuse.Status) {
+	in := fuse.WriteIn{InHeader: c.header(node), Fh: fh, Offset: uint64(off), Size: uint32(len(data))}
+	return c.FS.Write(c.cancel, &in, data)
+}
+
+// Flush flushes an open file, as happens on close(2).
+func (c *Conn) Flush(node, fh uint64) fuse.Status {
+	in := fuse.FlushIn{InHeader: c.header(node), Fh: fh}
+	return c.FS.Flush(c.cancel, &in)
+}
+
+// Release closes an open file.
+func (c *Conn) Release(node, fh uint64) {
+	in := fuse.ReleaseIn{InHeader: c.header(node), Fh: fh}
+	c.FS.Release(c.cancel, &in)
+}
+
+// ReadDir opens the directory node, lists all its entries, and closes
+// it again. Like the kernel, it reads the directory in chunks of
+// bufSize bytes; if bufSize is 0, 4096 is used.
+func (c *Conn) ReadDir(node uint64, bufSize int) ([]fuse.DirEntry, fuse.Status) {
+	if bufSize == 0 {
+		bufSize = 4096
+	}
+	openIn := fuse.OpenIn{InHeader: c.header(node)}
+	var openOut fuse.OpenOut
+	if st := c.FS.OpenDir(c.cancel, &openIn, &openOut); !st.Ok() {
+		return nil, st
+	}
+	defer c.FS.ReleaseDir(&fuse.ReleaseIn{InHeader: c.header(node), Fh: openOut.Fh})
+
+	var result []fuse.DirEntry
+	in := fuse.ReadIn{InHeader: c.header(node), Fh: openOut.Fh, Size: uint32(bufSize)}
+	for {
+		l := fuse.NewDirEntryList(make([]byte, bufSize), in.Offset)
+		if st := c.FS.ReadDir(c.cancel, &in, l); !st.Ok() {
+			return result, st
+		}
+		es := l.Entries()
+		if len(es) == 0 {
+			return result, fuse.OK
+		}
+		result = append(result, es...)
+		in.Offset = es[len(es)-1].Off
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fstest
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestConn(t *testing.T) {
+	root := &fs.MemDir{}
+	c := New(root, nil)
+
+	created, st := c.Create(RootID, "file", syscall.O_RDWR|syscall.O_CREAT, 0644)
+	if !st.Ok() {
+		t.Fatalf("Create: %v", st)
+	}
+	node, fh := created.NodeId, created.Fh
+	if n, st := c.Write(node, fh, 0, []byte("hello")); !st.Ok() || n != 5 {
+		t.Fatalf("Write: %d, %v", n, st)
+	}
+	if data, st := c.Read(node, fh, 1, 100); !st.Ok() || string(data) != "ello" {
+		t.Errorf("Read: %q, %v", data, st)
+	}
+	c.Release(node, fh)
+
+	if _, st := c.Mkdir(RootID, "dir", 0755); !st.Ok() {
+		t.Fatalf("Mkdir: %v", st)
+	}
+	entry, st := c.Lookup(RootID, "file")
+	if !st.Ok() || entry.NodeId != node {
+		t.Errorf("Lookup: %v, %v, want node %d", entry.NodeId, st, node)
+	}
+	if attr, st := c.GetAttr(node); !st.Ok() || attr.Size != 5 {
+		t.Errorf("GetAttr: size %d, %v", attr.Size, st)
+	}
+	if _, st := c.Lookup(RootID, "missing"); st != fuse.ENOENT {
+		t.Errorf("Lookup(missing): got %v, want ENOENT", st)
+	}
+
+	// A small buffer forces the listing to take several calls.
+	entries, st := c.ReadDir(RootID, 64)
+	if !st.Ok() {
+		t.Fatalf("ReadDir: %v", st)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"dir", "file"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ReadDir: got %v, want %v", names, want)
+	}
+
+	if st := c.Unlink(RootID, "file"); !st.Ok() {
+		t.Fatalf("Unlink: %v", st)
+	}
+	// Create and Lookup each added a reference.
+	c.Forget(node, 2)
+	if got := c.FS.(interface{ InodeCount() int }).InodeCount(); got != 2 {
+		t.Errorf("got %d inodes after Forget, want 2", got)
+	}
+}
+
+type blockingNode struct {
+	fs.Inode
+	started chan struct{}
+}
+
+var _ = (fs.NodeOpener)((*blockingNode)(nil))
+var _ = (fs.NodeReader)((*blockingNode)(nil))
+
+func (n *blockingNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	return nil, 0, fs.OK
+}
+
+func (n *blockingNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	close(n.started)
+	<-ctx.Done()
+	return nil, syscall.EINTR
+}
+
+func TestConnInterrupt(t *testing.T) {
+	root := &fs.Inode{}
+	node := &blockingNode{started: make(chan struct{})}
+	c := New(root, &fs.Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, fs.StableAttr{}), false)
+		},
+	})
+
+	entry, st := c.Lookup(RootID, "file")
+	if !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	open, st := c.Open(entry.NodeId, syscall.O_RDONLY)
+	if !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	interrupt := make(chan struct{})
+	done := make(chan fuse.Status)
+	go func() {
+		_, st := c.Interruptible(interrupt).Read(entry.NodeId, open.Fh, 0, 10)
+		done <- st
+	}()
+	<-node.started
+	close(interrupt)
+	if st := <-done; st != fuse.EINTR {
+		t.Errorf("interrupted Read: got %v, want EINTR", st)
+	}
+}
@@ -7,12 +7,16 @@ package fs
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode"
 	"unsafe"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -69,6 +73,15 @@ type Inode struct {
 	// protected by bridge.mu
 	openFiles []uint32
 
+	// opMu serializes operations if Options.SingleThreadedNodes
+	// is set. Otherwise, it only serializes O_EXCL creates in a
+	// directory.
+	opMu sync.Mutex
+
+	// appendMu serializes O_APPEND writes for nodes implementing
+	// NodeAtomicAppender.
+	appendMu sync.Mutex
+
 	// mu protects the following mutable fields. When locking
 	// multiple Inodes, locks must be acquired using
 	// lockNodes/unlockNodes
@@ -98,9 +111,44 @@ type Inode struct {
 	// When you change this, you MUST increment changeCounter.
 	children map[string]*Inode
 
+	// foldedNames maps the case-folded names of the children to
+	// their keys in children, with Options.CaseInsensitive.
+	// Change it only through setChild and deleteChild.
+	foldedNames map[string]string
+
 	// Parents of this Inode. Can be more than one due to hard links.
 	// When you change this, you MUST increment changeCounter.
 	parents inodeParents
+
+	// tmpfile is set for a node from NodeTmpfiler that has not
+	// been linked into the tree yet.
+	tmpfile bool
+
+	// pollHandles maps the kernel poll handles that wait for a
+	// NotifyPoll to the file handles they were polled through.
+	// Release drops them, except those of opens without a
+	// FileHandle, which are only dropped by NotifyPoll.
+	pollHandles map[uint64]uint64
+
+	// opening counts the Open calls in progress. If
+	// InvalidateContent is called during one of them,
+	// invalidateOnOpen is set.
+	opening          int
+	invalidateOnOpen bool
+
+	// cachedAttr is the *attrCacheEntry stored with
+	// SetCachedAttr, or nil. It is accessed atomically, so
+	// GETATTR does not contend for mu.
+	cachedAttr unsafe.Pointer
+}
+
+// attrCacheEntry holds attributes stored with SetCachedAttr. It is
+// not changed once stored.
+type attrCacheEntry struct {
+	attr fuse.Attr
+
+	// expiry is zero if the entry does not expire.
+	expiry time.Time
 }
 
 func (n *Inode) IsDir() bool {
@@ -143,6 +191,53 @@ func (n *Inode) Mode() uint32 {
 	return n.stableAttr.Mode
 }
 
+// SetCachedAttr stores attr in the Inode, so GETATTR is answered
+// from it without calling the node's Getattr. If timeout is positive,
+// the attributes are used for that long, otherwise until
+// InvalidateCachedAttr is called. The Ino and the file type are taken
+// from the StableAttr, and the birth time from NodeCrtimer, as for
+// Getattr. fstat(2) through a handle implementing FileGetattrer still
+// asks the handle, and statx(2) with AT_STATX_FORCE_SYNC calls the
+// node.
+//
+// This saves the dispatch for nodes whose attributes are known in
+// advance, eg. `ls -l` of a large directory with a short
+// Options.AttrTimeout. The bridge drops the attributes before it
+// calls Setattr, Write, Allocate or CopyFileRange (for the
+// destination), and before an Open with O_TRUNC. Nodes must call
+// SetCachedAttr or InvalidateCachedAttr for other changes, eg. to
+// the link count.
+func (n *Inode) SetCachedAttr(attr *fuse.Attr, timeout time.Duration) {
+	e := &attrCacheEntry{attr: *attr}
+	if timeout > 0 {
+		e.expiry = time.Now().Add(timeout)
+	}
+	atomic.StorePointer(&n.cachedAttr, unsafe.Pointer(e))
+}
+
+// InvalidateCachedAttr drops the attributes stored with
+// SetCachedAttr, so the next GETATTR calls the node again.
+func (n *Inode) InvalidateCachedAttr() {
+	atomic.StorePointer(&n.cachedAttr, nil)
+}
+
+// loadCachedAttr copies the attributes stored with SetCachedAttr to
+// out, and returns false if there are none.
+func (n *Inode) loadCachedAttr(out *fuse.Attr) bool {
+	p := atomic.LoadPointer(&n.cachedAttr)
+	if p == nil {
+		return false
+	}
+	e := (*attrCacheEntry)(p)
+	if !e.expiry.IsZero() && time.Now().After(e.expiry) {
+		// Unless it was replaced in the meantime.
+		atomic.CompareAndSwapPointer(&n.cachedAttr, p, nil)
+		return false
+	}
+	*out = e.attr
+	return true
+}
+
 // Returns the root of the tree
 func (n *Inode) Root() *Inode {
 	return n.bridge.root
@@ -312,6 +407,47 @@ func (n *Inode) Path(root *Inode) string {
 	return path
 }
 
+// Paths returns all paths to the inode relative to `root`, sorted.
+// There is more than one path if the inode, or one of its ancestors,
+// has hard links. If root is nil, the root of the file system is
+// used. Links that would revisit an inode (cycles) are not followed.
+// If the inode is not reachable from root, Paths returns an empty
+// slice.
+func (n *Inode) Paths(root *Inode) []string {
+	if root == nil {
+		root = n.Root()
+	}
+
+	var result []string
+	visiting := map[*Inode]bool{}
+	var walk func(p *Inode, segments []string)
+	walk = func(p *Inode, segments []string) {
+		if p == root {
+			path := make([]string, 0, len(segments))
+			for i := len(segments) - 1; i >= 0; i-- {
+				path = append(path, segments[i])
+			}
+			result = append(result, strings.Join(path, "/"))
+			return
+		}
+		if visiting[p] {
+			return
+		}
+		visiting[p] = true
+		p.mu.Lock()
+		parents := p.parents.all()
+		p.mu.Unlock()
+		for _, pd := range parents {
+			walk(pd.parent, append(segments[:len(segments):len(segments)], pd.name))
+		}
+		delete(visiting, p)
+	}
+	walk(n, nil)
+
+	sort.Strings(result)
+	return result
+}
+
 // setEntry does `iparent[name] = ichild` linking.
 //
 // setEntry must not be called simultaneously for any of iparent or ichild.
@@ -319,6 +455,7 @@ func (n *Inode) Path(root *Inode) string {
 // but it could be also valid if only iparent is locked and ichild was just
 // created and only one goroutine keeps referencing it.
 func (iparent *Inode) setEntry(name string, ichild *Inode) {
+	name = iparent.childKey(name)
 	newParent := parentData{name, iparent}
 	if ichild.stableAttr.Mode == syscall.S_IFDIR {
 		// Directories cannot have more than one parent. Clear the map.
@@ -327,7 +464,8 @@ func (iparent *Inode) setEntry(name string, ichild *Inode) {
 		ichild.parents.clear()
 	}
 	ichild.parents.add(newParent)
-	iparent.children[name] = ichild
+	ichild.tmpfile = false
+	iparent.setChild(name, ichild)
 	ichild.changeCounter++
 	iparent.changeCounter++
 }
@@ -392,8 +530,15 @@ func (n *Inode) removeRef(nlookup uint64, dropPersistence bool) (forgotten bool,
 		forgotten = true
 		// Dropping the node from stableAttrs guarantees that no new references to this node are
 		// handed out to the kernel, hence we can also safely delete it from kernelNodeIds.
-		delete(n.bridge.stableAttrs, n.stableAttr)
+		// A node that was never handed out may share its StableAttr with one that was.
+		if n.bridge.stableAttrs[n.stableAttr] == n {
+			delete(n.bridge.stableAttrs, n.stableAttr)
+		}
+		if key := (inoGen{n.stableAttr.Ino, n.stableAttr.Gen}); n.bridge.inoNodes[key] == n {
+			delete(n.bridge.inoNodes, key)
+		}
 		delete(n.bridge.kernelNodeIds, n.nodeId)
+		n.bridge.checkWatermark()
 	}
 	n.bridge.mu.Unlock()
 
@@ -426,7 +571,7 @@ retry:
 				// another node has replaced us already
 				continue
 			}
-			delete(p.parent.children, p.name)
+			p.parent.deleteChild(p.name)
 			p.parent.changeCounter++
 		}
 		n.parents.clear()
@@ -440,6 +585,15 @@ retry:
 		break
 	}
 
+	// Either this call dropped the last kernel reference, or it
+	// detached the node from the tree. Further calls on the dead
+	// node do neither, so OnForget runs once.
+	if nlookup > 0 || len(parents) > 0 {
+		if of, ok := n.ops.(NodeOnForgetter); ok {
+			of.OnForget()
+		}
+	}
+
 	for _, p := range lockme {
 		if p != n {
 			p.removeRef(0, false)
@@ -448,37 +602,127 @@ retry:
 	return forgotten, false
 }
 
+// childKey returns the key under which name is stored in
+// n.children. On case-insensitive file systems, this is the name of
+// an existing child that equals name under case folding. Must be
+// called with n.mu held.
+func (n *Inode) childKey(name string) string {
+	if !n.caseInsensitive() {
+		return name
+	}
+	if key, ok := n.foldedNames[foldName(name)]; ok {
+		return key
+	}
+	return name
+}
+
+func (n *Inode) caseInsensitive() bool {
+	return n.bridge != nil && n.bridge.options.CaseInsensitive
+}
+
+// setChild stores ch in n.children under key, which must be free
+// under case folding, if that applies. Must be called with n.mu
+// held.
+func (n *Inode) setChild(key string, ch *Inode) {
+	n.children[key] = ch
+	if n.caseInsensitive() {
+		if n.foldedNames == nil {
+			n.foldedNames = map[string]string{}
+		}
+		n.foldedNames[foldName(key)] = key
+	}
+}
+
+// deleteChild removes key from n.children. Must be called with n.mu
+// held.
+func (n *Inode) deleteChild(key string) {
+	delete(n.children, key)
+	if n.caseInsensitive() {
+		delete(n.foldedNames, foldName(key))
+	}
+}
+
+// foldName maps each rune of name to the smallest rune that
+// strings.EqualFold considers equal to it, so names are EqualFold if
+// and only if their folded names are equal.
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return min
+	}, name)
+}
+
+// linkChild adds ch as a child under name, replacing the child that
+// has that name, if any, which is returned. It must be called with
+// the locks of n, ch and the replaced child held.
+func (n *Inode) linkChild(name string, ch *Inode) (prev *Inode) {
+	prev = n.unlinkChild(name)
+	n.setChild(name, ch)
+	ch.parents.add(parentData{name, n})
+	ch.tmpfile = false
+	ch.changeCounter++
+	n.changeCounter++
+	return prev
+}
+
+// unlinkChild removes the child that has the given name, and returns
+// it, or nil if there is none. It must be called with the locks of n
+// and the child held.
+func (n *Inode) unlinkChild(name string) *Inode {
+	key := n.childKey(name)
+	ch := n.children[key]
+	if ch == nil {
+		return nil
+	}
+	n.deleteChild(key)
+	ch.parents.delete(parentData{key, n})
+	ch.changeCounter++
+	n.changeCounter++
+	return ch
+}
+
 // GetChild returns a child node with the given name, or nil if the
 // directory has no child by that name.
 func (n *Inode) GetChild(name string) *Inode {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	return n.children[name]
+	return n.children[n.childKey(name)]
 }
 
 // AddChild adds a child to this node. If overwrite is false, fail if
 // the destination already exists.
 func (n *Inode) AddChild(name string, ch *Inode, overwrite bool) (success bool) {
+	success, _ = n.addChild(name, ch, overwrite)
+	return success
+}
+
+// addChild is AddChild, but also returns the child that was replaced,
+// if any.
+func (n *Inode) addChild(name string, ch *Inode, overwrite bool) (success bool, prev *Inode) {
 	if len(name) == 0 {
 		log.Panic("empty name for inode")
 	}
 
+	n.bridge.allocIno(n, name, ch)
+
 retry:
 	for {
 		lockNode2(n, ch)
-		prev, ok := n.children[name]
+		prev, ok := n.children[n.childKey(name)]
 		parentCounter := n.changeCounter
 		if !ok {
-			n.children[name] = ch
-			ch.parents.add(parentData{name, n})
-			n.changeCounter++
-			ch.changeCounter++
+			n.linkChild(name, ch)
 			unlockNode2(n, ch)
-			return true
+			return true, nil
 		}
 		unlockNode2(n, ch)
 		if !overwrite {
-			return false
+			return false, nil
 		}
 		lockme := [3]*Inode{n, ch, prev}
 
@@ -488,15 +732,92 @@ retry:
 			continue retry
 		}
 
-		prev.parents.delete(parentData{name, n})
-		n.children[name] = ch
-		ch.parents.add(parentData{name, n})
-		n.changeCounter++
-		ch.changeCounter++
-		prev.changeCounter++
+		n.linkChild(name, ch)
 		unlockNodes(lockme[:]...)
 
-		return true
+		return true, prev
+	}
+}
+
+// GetOrAddChild adds ch as a child of this node, unless a child by
+// that name already exists. It returns the child that is in the tree
+// afterwards, and whether that is ch. The check and the insertion
+// happen atomically, so concurrent callers agree on a single child.
+// If ch loses, and it is not linked elsewhere, it is discarded as if
+// by ForgetPersistent.
+func (n *Inode) GetOrAddChild(name string, ch *Inode) (*Inode, bool) {
+	if len(name) == 0 {
+		log.Panic("empty name for inode")
+	}
+
+	n.bridge.allocIno(n, name, ch)
+
+	lockNode2(n, ch)
+	prev, ok := n.children[n.childKey(name)]
+	if !ok {
+		n.linkChild(name, ch)
+	}
+	orphan := ch.parents.count() == 0 && ch.lookupCount == 0
+	unlockNode2(n, ch)
+
+	if !ok {
+		return ch, true
+	}
+	if prev != ch && orphan {
+		ch.ForgetPersistent()
+	}
+	return prev, false
+}
+
+// AddChildren adds all children to this node in a single step, taking
+// the lock of the node once rather than once per child. This is
+// useful when populating large directories. If overwrite is false,
+// and some names already exist, no child is added at all, and the
+// colliding names are returned in sorted order. If overwrite is true,
+// existing children are replaced, as with AddChild.
+func (n *Inode) AddChildren(children map[string]*Inode, overwrite bool) (collisions []string) {
+	for name := range children {
+		if len(name) == 0 {
+			log.Panic("empty name for inode")
+		}
+	}
+	for name, ch := range children {
+		n.bridge.allocIno(n, name, ch)
+	}
+
+	var lockme []*Inode
+retry:
+	for {
+		n.mu.Lock()
+		lockme = append(lockme[:0], n)
+		nChange := n.changeCounter
+		collisions = collisions[:0]
+		for name := range children {
+			if prev, ok := n.children[n.childKey(name)]; ok {
+				collisions = append(collisions, name)
+				lockme = append(lockme, prev)
+			}
+		}
+		n.mu.Unlock()
+		if len(collisions) > 0 && !overwrite {
+			sort.Strings(collisions)
+			return collisions
+		}
+		for _, ch := range children {
+			lockme = append(lockme, ch)
+		}
+
+		lockNodes(lockme...)
+		if n.changeCounter != nChange {
+			unlockNodes(lockme...)
+			continue retry
+		}
+
+		for name, ch := range children {
+			n.linkChild(name, ch)
+		}
+		unlockNodes(lockme...)
+		return nil
 	}
 }
 
@@ -511,6 +832,93 @@ func (n *Inode) Children() map[string]*Inode {
 	return r
 }
 
+// ChildEntry is a named child of a directory Inode.
+type ChildEntry struct {
+	Name  string
+	Child *Inode
+}
+
+// ChildrenSorted returns the children of this directory Inode, sorted
+// by name. Unlike Children, the order is deterministic.
+func (n *Inode) ChildrenSorted() []ChildEntry {
+	n.mu.Lock()
+	r := make([]ChildEntry, 0, len(n.children))
+	for k, v := range n.children {
+		r = append(r, ChildEntry{k, v})
+	}
+	n.mu.Unlock()
+
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// Walk calls fn for n and all its descendants, depth first, in the
+// order of ChildrenSorted. The path is relative to n, so it is ""
+// for n itself. If fn returns false, the walk stops. A node with
+// hard links is visited once for each path; links that would
+// revisit an ancestor (cycles) are not followed.
+//
+// Walk holds no locks while calling fn, and takes the lock of only
+// one node at a time, so fn may call methods of the nodes, and the
+// tree may change during the walk. The walk is live rather than a
+// snapshot: the children of a node are listed just before they are
+// visited, so changes to a part of the tree that has not been
+// reached yet are seen, and those to parts already visited are not.
+func (n *Inode) Walk(fn func(path string, n *Inode) bool) {
+	visiting := map[*Inode]bool{}
+	var walk func(path string, n *Inode) bool
+	walk = func(path string, n *Inode) bool {
+		if !fn(path, n) {
+			return false
+		}
+		visiting[n] = true
+		defer delete(visiting, n)
+		for _, e := range n.ChildrenSorted() {
+			if visiting[e.Child] {
+				continue
+			}
+			p := e.Name
+			if path != "" {
+				p = path + "/" + p
+			}
+			if !walk(p, e.Child) {
+				return false
+			}
+		}
+		return true
+	}
+	walk("", n)
+}
+
+// DumpTree writes a line for n and each of its descendants to w, for
+// debugging: the path, node ID, inode number, type, kernel lookup
+// count, whether the node is persistent, and the number of children.
+// The tree is traversed with Walk, so locks are only held briefly,
+// and each line is written as its node is visited, so a huge tree is
+// not collected in memory. It returns the first error from w.
+func (n *Inode) DumpTree(w io.Writer) error {
+	var err error
+	n.Walk(func(path string, ch *Inode) bool {
+		ch.mu.Lock()
+		lookups, persistent, children := ch.lookupCount, ch.persistent, len(ch.children)
+		ch.mu.Unlock()
+
+		// The bridge assigns node IDs and inode numbers under
+		// its own lock.
+		ch.bridge.mu.Lock()
+		nodeId, ino := ch.nodeId, ch.stableAttr.Ino
+		ch.bridge.mu.Unlock()
+
+		if path == "" {
+			path = "."
+		}
+		_, err = fmt.Fprintf(w, "%s\tn%d i%d %s lookups=%d persistent=%v children=%d\n",
+			path, nodeId, ino, modeStr(ch.stableAttr.Mode), lookups, persistent, children)
+		return err == nil
+	})
+	return err
+}
+
 // Parents returns a parent of this Inode, or nil if this Inode is
 // deleted or is the root
 func (n *Inode) Parent() (string, *Inode) {
@@ -554,7 +962,7 @@ retry:
 		lockme = append(lockme[:0], n)
 		nChange := n.changeCounter
 		for _, nm := range names {
-			ch := n.children[nm]
+			ch := n.children[n.childKey(nm)]
 			if ch == nil {
 				n.mu.Unlock()
 				return false, true
@@ -570,13 +978,8 @@ retry:
 		}
 
 		for _, nm := range names {
-			ch := n.children[nm]
-			delete(n.children, nm)
-			ch.parents.delete(parentData{nm, n})
-
-			ch.changeCounter++
+			n.unlinkChild(nm)
 		}
-		n.changeCounter++
 
 		live = n.lookupCount > 0 || len(n.children) > 0 || n.persistent
 		unlockNodes(lockme...)
@@ -593,6 +996,83 @@ retry:
 	return true, true
 }
 
+// ReplaceChildren replaces all children of this directory with
+// newChildren in a single step: concurrent lookups and directory
+// listings see either the old or the new set of children, never a
+// mix. Children that are left without a parent are dropped as with
+// RmChild. Afterwards, the kernel is told to drop its cached entries
+// for the names that were removed, added or changed.
+func (n *Inode) ReplaceChildren(newChildren map[string]*Inode) {
+	for name := range newChildren {
+		if len(name) == 0 {
+			log.Panic("empty name for inode")
+		}
+	}
+	for name, ch := range newChildren {
+		n.bridge.allocIno(n, name, ch)
+	}
+
+	var lockme []*Inode
+	var old map[string]*Inode
+	var dropped []*Inode
+retry:
+	for {
+		n.mu.Lock()
+		lockme = append(lockme[:0], n)
+		nChange := n.changeCounter
+		for _, ch := range n.children {
+			lockme = append(lockme, ch)
+		}
+		n.mu.Unlock()
+		for _, ch := range newChildren {
+			lockme = append(lockme, ch)
+		}
+
+		lockNodes(lockme...)
+		if n.changeCounter != nChange {
+			unlockNodes(lockme...)
+			continue retry
+		}
+
+		old = make(map[string]*Inode, len(n.children))
+		for name, ch := range n.children {
+			old[name] = ch
+			n.unlinkChild(name)
+		}
+		for name, ch := range newChildren {
+			n.linkChild(name, ch)
+		}
+		for _, ch := range old {
+			if ch.parents.count() == 0 {
+				dropped = append(dropped, ch)
+			}
+		}
+		unlockNodes(lockme...)
+		break
+	}
+
+	for _, ch := range dropped {
+		ch.removeRef(0, false)
+	}
+
+	if n.bridge.server == nil {
+		// Not mounted yet, so the kernel has nothing cached.
+		return
+	}
+	for name, ch := range old {
+		if _, ok := newChildren[name]; !ok {
+			n.NotifyDelete(name, ch)
+		} else if newChildren[name] != ch {
+			n.NotifyEntry(name)
+		}
+	}
+	for name := range newChildren {
+		if _, ok := old[name]; !ok {
+			n.NotifyEntry(name)
+		}
+	}
+}
+
 // MvChild executes a rename. If overwrite is set, a child at the
 // destination will be overwritten, should it exist. It returns false
 // if 'overwrite' is false, and the destination exists.
@@ -607,10 +1087,17 @@ retry:
 		counter1 := n.changeCounter
 		counter2 := newParent.changeCounter
 
+		old = n.childKey(old)
+		destName := newParent.childKey(newName)
 		oldChild := n.children[old]
-		destChild := newParent.children[newName]
+		destChild := newParent.children[destName]
 		unlockNode2(n, newParent)
 
+		if destChild == oldChild && newParent == n {
+			// Renaming to a different case of the same name.
+			destChild = nil
+		}
+
 		if destChild != nil && !overwrite {
 			return false
 		}
@@ -622,7 +1109,7 @@ retry:
 		}
 
 		if oldChild != nil {
-			delete(n.children, old)
+			n.deleteChild(old)
 			oldChild.parents.delete(parentData{old, n})
 			n.changeCounter++
 			oldChild.changeCounter++
@@ -631,14 +1118,14 @@ retry:
 		if destChild != nil {
 			// This can cause the child to be slated for
 			// removal; see below
-			delete(newParent.children, newName)
-			destChild.parents.delete(parentData{newName, newParent})
+			newParent.deleteChild(destName)
+			destChild.parents.delete(parentData{destName, newParent})
 			destChild.changeCounter++
 			newParent.changeCounter++
 		}
 
 		if oldChild != nil {
-			newParent.children[newName] = oldChild
+			newParent.setChild(newName, oldChild)
 			newParent.changeCounter++
 
 			oldChild.parents.add(parentData{newName, newParent})
@@ -664,6 +1151,8 @@ retry:
 		counter1 := oldParent.changeCounter
 		counter2 := newParent.changeCounter
 
+		oldName = oldParent.childKey(oldName)
+		newName = newParent.childKey(newName)
 		oldChild := oldParent.children[oldName]
 		destChild := newParent.children[newName]
 		unlockNode2(oldParent, newParent)
@@ -680,14 +1169,14 @@ retry:
 
 		// Detach
 		if oldChild != nil {
-			delete(oldParent.children, oldName)
+			oldParent.deleteChild(oldName)
 			oldChild.parents.delete(parentData{oldName, oldParent})
 			oldParent.changeCounter++
 			oldChild.changeCounter++
 		}
 
 		if destChild != nil {
-			delete(newParent.children, newName)
+			newParent.deleteChild(newName)
 			destChild.parents.delete(parentData{newName, newParent})
 			destChild.changeCounter++
 			newParent.changeCounter++
@@ -695,7 +1184,7 @@ retry:
 
 		// Attach
 		if oldChild != nil {
-			newParent.children[newName] = oldChild
+			newParent.setChild(newName, oldChild)
 			newParent.changeCounter++
 
 			oldChild.parents.add(parentData{newName, newParent})
@@ -703,7 +1192,7 @@ retry:
 		}
 
 		if destChild != nil {
-			oldParent.children[oldName] = destChild
+			oldParent.setChild(oldName, destChild)
 			oldParent.changeCounter++
 
 			destChild.parents.add(parentData{oldName, oldParent})
@@ -714,37 +1203,353 @@ retry:
 	}
 }
 
+// Rename moves the child oldName to newParent under newName, like
+// MvChild, and invalidates both entries in the kernel if the file
+// system is mounted. It is meant for file systems that reorganize
+// their tree outside of FUSE requests, eg. from a background
+// goroutine. It returns ENOENT if there is no child oldName, EEXIST
+// if the destination exists and overwrite is not set, and EINVAL if a
+// directory would be moved into itself or one of its descendants.
+//
+// The descendant check walks the parents of newParent before the
+// move, so callers that rename directories from several goroutines
+// at once must serialize those calls themselves.
+func (n *Inode) Rename(oldName string, newParent *Inode, newName string, overwrite bool) syscall.Errno {
+	if len(newName) == 0 {
+		return syscall.EINVAL
+	}
+	child := n.GetChild(oldName)
+	if child == nil {
+		return syscall.ENOENT
+	}
+	if child.IsDir() {
+		for p := newParent; p != nil; _, p = p.Parent() {
+			if p == child {
+				return syscall.EINVAL
+			}
+		}
+	}
+
+	dest := newParent.GetChild(newName)
+	if dest == child {
+		// Renaming to a different case of the same name.
+		dest = nil
+	}
+	if !n.MvChild(oldName, newParent, newName, overwrite) {
+		return syscall.EEXIST
+	}
+
+	if _, errno := n.cacheServer(); errno != 0 {
+		return OK
+	}
+	n.NotifyEntry(oldName)
+	if dest != nil {
+		newParent.NotifyDelete(newName, dest)
+	} else {
+		newParent.NotifyEntry(newName)
+	}
+	return OK
+}
+
+// PublishContent creates or replaces the child name with a new
+// persistent MemRegularFile holding data, like writing a temporary
+// file and renaming it over name. The swap is atomic, so readers
+// see either the old or the new content in full, never a mix. If the
+// file system is mounted, the kernel is told that the old entry was
+// deleted, so the next lookup finds the new node. Files that were
+// opened before keep reading the old node, and hence the old
+// content. A replaced child that is not linked elsewhere is released
+// as with ForgetPersistent once the kernel drops it. data must not
+// be changed after the call.
+func (n *Inode) PublishContent(ctx context.Context, name string, data []byte) *Inode {
+	ch := n.NewPersistentInode(ctx, &MemRegularFile{
+		Data: data,
+		Attr: fuse.Attr{Mode: 0644},
+	}, StableAttr{Mode: syscall.S_IFREG})
+
+	_, prev := n.addChild(name, ch, true)
+
+	if _, errno := n.cacheServer(); errno == 0 {
+		if prev != nil {
+			n.NotifyDelete(name, prev)
+		} else {
+			n.NotifyEntry(name)
+		}
+	}
+
+	if prev != nil {
+		prev.mu.Lock()
+		orphan := prev.parents.count() == 0
+		prev.mu.Unlock()
+		if orphan {
+			prev.ForgetPersistent()
+		}
+	}
+	return ch
+}
+
 // NotifyEntry notifies the kernel that data for a (directory, name)
 // tuple should be invalidated. On next access, a LOOKUP operation
 // will be started.
 func (n *Inode) NotifyEntry(name string) syscall.Errno {
-	status := n.bridge.server.EntryNotify(n.nodeId, name)
-	return syscall.Errno(status)
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+	return syscall.Errno(srv.EntryNotify(n.nodeId, name))
 }
 
 // NotifyDelete notifies the kernel that the given inode was removed
 // from this directory as entry under the given name. It is equivalent
-// to NotifyEntry, but also sends an event to inotify watchers.
+// to NotifyEntry, but the kernel also deletes its cached entry, so
+// open files see the child as unlinked, and inotify watchers of the
+// child get IN_DELETE_SELF. Kernels before Linux 5.3 also send
+// IN_DELETE to watchers of the directory; later ones only do so for
+// deletions made through the mount. Call it after removing the child
+// from the tree, eg. with RmChild.
+//
+// If child is nil, or the kernel holds no reference to it, eg.
+// because it was forgotten already, the name is only invalidated as
+// with NotifyEntry, and OK is returned if the kernel did not cache
+// it. Otherwise, the kernel returns ENOENT if it caches another inode
+// under name, and ENOTEMPTY if child is a directory whose entries it
+// still caches. Like NotifyEntry, this must not be called while
+// holding locks that the file system operations take.
 func (n *Inode) NotifyDelete(name string, child *Inode) syscall.Errno {
-	// XXX arg ordering?
-	return syscall.Errno(n.bridge.server.DeleteNotify(n.nodeId, child.nodeId, name))
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+	var childId uint64
+	if child != nil {
+		child.mu.Lock()
+		if child.lookupCount > 0 {
+			childId = child.nodeId
+		}
+		child.mu.Unlock()
+	}
+	errno = syscall.Errno(srv.DeleteNotify(n.nodeId, childId, name))
+	if errno == syscall.ENOENT && childId == 0 {
+		return OK
+	}
+	return errno
+}
 
+// NotifyAddEntry notifies the kernel that name was added to this
+// directory, eg. after AddChild. The kernel forgets that name did not
+// exist, and drops its cached listing of the directory (see
+// FOPEN_CACHE_DIR), so the next readdir shows the new entry. Other
+// entries, and the attributes of the children, stay cached.
+//
+// The kernel cannot patch a cached listing: it caches the readdir
+// output as a stream, so any change makes the next readdir from the
+// start fetch the whole listing again. Listings are only cached on
+// Linux 4.20 and later; older kernels just have the name invalidated.
+// Like NotifyEntry, this must not be called while holding locks that
+// the file system operations take.
+func (n *Inode) NotifyAddEntry(name string) syscall.Errno {
+	return n.notifyDirEntry(name)
+}
+
+// NotifyRemoveEntry notifies the kernel that name was removed from
+// this directory, eg. after RmChild. The kernel forgets the entry,
+// and drops its cached listing of the directory, with the same
+// limitations as NotifyAddEntry. Use NotifyDelete instead to also
+// have the kernel treat open files of the child as unlinked.
+func (n *Inode) NotifyRemoveEntry(name string) syscall.Errno {
+	return n.notifyDirEntry(name)
+}
+
+// notifyDirEntry invalidates name and the cached listing of n. It
+// returns OK if the kernel has neither cached.
+func (n *Inode) notifyDirEntry(name string) syscall.Errno {
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+	errno = syscall.Errno(srv.EntryNotify(n.nodeId, name))
+	if errno != syscall.ENOENT {
+		// If the kernel cached the name, positively or
+		// negatively, it also marked the directory as changed,
+		// which drops the listing.
+		return errno
+	}
+
+	// The listing lives in the page cache of the directory, so
+	// invalidating its content drops it.
+	errno = syscall.Errno(srv.InodeNotify(n.nodeId, 0, 0))
+	if errno == syscall.ENOENT {
+		return OK
+	}
+	return errno
 }
 
 // NotifyContent notifies the kernel that content under the given
 // inode should be flushed from buffers.
 func (n *Inode) NotifyContent(off, sz int64) syscall.Errno {
 	// XXX how does this work for directories?
-	return syscall.Errno(n.bridge.server.InodeNotify(n.nodeId, off, sz))
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+	return syscall.Errno(srv.InodeNotify(n.nodeId, off, sz))
+}
+
+// NotifySymlink notifies the kernel that the target of this symlink
+// changed. This is only needed if MountOptions.EnableSymlinkCaching
+// is set, as the kernel otherwise does not cache symlink targets.
+func (n *Inode) NotifySymlink() syscall.Errno {
+	return n.NotifyContent(0, 0)
+}
+
+// NotifyPathContent invalidates the attributes and cached content of
+// the node at the slash-separated path below n, eg. "a/b/c" relative
+// to the root. It is meant for backends that learn about changes by
+// path. It returns ENOENT if the path is not in the tree, ie. the
+// kernel has not looked it up and so has nothing cached for it. Like
+// all notifications, it is a hint that the kernel may ignore.
+func (n *Inode) NotifyPathContent(path string) syscall.Errno {
+	ch := n.lookupPath(path)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	if _, errno := n.cacheServer(); errno != 0 {
+		return errno
+	}
+	return ch.NotifyContent(0, 0)
+}
+
+// NotifyPathEntry invalidates the entry name in the directory at the
+// slash-separated parentPath below n, so the kernel looks it up again
+// on next access. This also works for entries the kernel remembers
+// as not existing. It returns ENOENT if parentPath is not in the
+// tree.
+func (n *Inode) NotifyPathEntry(parentPath, name string) syscall.Errno {
+	parent := n.lookupPath(parentPath)
+	if parent == nil {
+		return syscall.ENOENT
+	}
+	if _, errno := n.cacheServer(); errno != 0 {
+		return errno
+	}
+	return parent.NotifyEntry(name)
+}
+
+// lookupPath returns the descendant of n at the slash-separated
+// path, or nil if a component is not among the children.
+func (n *Inode) lookupPath(path string) *Inode {
+	for _, c := range strings.Split(path, "/") {
+		if c == "" || c == "." {
+			continue
+		}
+		n = n.GetChild(c)
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// NotifyStoreCache stores data in the kernel page cache of this
+// inode at the given offset, eg. to populate the cache after content
+// changed behind the kernel's back. It returns ENOTCONN if the file
+// system is not mounted yet. The kernel returns ENOENT if it does not
+// currently know the inode.
+func (n *Inode) NotifyStoreCache(off int64, data []byte) syscall.Errno {
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+	return syscall.Errno(srv.InodeNotifyStoreCache(n.nodeId, off, data))
+}
+
+// NotifyRetrieveCache reads data from the kernel page cache of this
+// inode, including dirty data that was not written back yet. It
+// returns the number of consecutive bytes cached at off, which may be
+// fewer than len(dest). The errors are as for NotifyStoreCache.
+func (n *Inode) NotifyRetrieveCache(off int64, dest []byte) (int, syscall.Errno) {
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return 0, errno
+	}
+	c, s := srv.InodeRetrieveCache(n.nodeId, off, dest)
+	return c, syscall.Errno(s)
+}
+
+// InvalidateContent invalidates the attributes and data that the
+// kernel cached for this node. It may be called from NodeOpener.Open,
+// where sending NotifyContent could deadlock with the kernel: then the
+// attributes are invalidated right away, and the data is dropped when
+// the open completes, regardless of FOPEN_KEEP_CACHE.
+func (n *Inode) InvalidateContent() syscall.Errno {
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+
+	n.mu.Lock()
+	opening := n.opening > 0
+	if opening {
+		n.invalidateOnOpen = true
+	}
+	n.mu.Unlock()
+
+	if opening {
+		// A negative offset only invalidates the attributes.
+		return syscall.Errno(srv.InodeNotify(n.nodeId, -1, 0))
+	}
+	return n.NotifyContent(0, 0)
+}
+
+// NotifyPoll wakes up the poll(2) calls that wait for this node to
+// become ready. The kernel then calls Poll again. See NodePoller.
+func (n *Inode) NotifyPoll() syscall.Errno {
+	srv, errno := n.cacheServer()
+	if errno != 0 {
+		return errno
+	}
+	ps, ok := srv.(interface{ NotifyPoll(kh uint64) fuse.Status })
+	if !ok {
+		return syscall.ENOSYS
+	}
+
+	n.mu.Lock()
+	handles := n.pollHandles
+	n.pollHandles = nil
+	n.mu.Unlock()
+
+	for kh := range handles {
+		if st := ps.NotifyPoll(kh); !st.Ok() {
+			return syscall.Errno(st)
+		}
+	}
+	return OK
+}
+
+// cacheServer returns the server to send cache notifications to.
+func (n *Inode) cacheServer() (ServerCallbacks, syscall.Errno) {
+	if n.bridge == nil || n.bridge.server == nil {
+		return nil, syscall.ENOTCONN
+	}
+	n.bridge.mu.Lock()
+	others := n.bridge.mounts
+	n.bridge.mu.Unlock()
+	if len(others) > 0 {
+		return &mountsCallbacks{n.bridge.server, others}, OK
+	}
+	return n.bridge.server, OK
 }
 
 // WriteCache stores data in the kernel cache.
+//
+// Deprecated: use NotifyStoreCache.
 func (n *Inode) WriteCache(offset int64, data []byte) syscall.Errno {
-	return syscall.Errno(n.bridge.server.InodeNotifyStoreCache(n.nodeId, offset, data))
+	return n.NotifyStoreCache(offset, data)
 }
 
 // ReadCache reads data from the kernel cache.
+//
+// Deprecated: use NotifyRetrieveCache.
 func (n *Inode) ReadCache(offset int64, dest []byte) (count int, errno syscall.Errno) {
-	c, s := n.bridge.server.InodeRetrieveCache(n.nodeId, offset, dest)
-	return c, syscall.Errno(s)
+	return n.NotifyRetrieveCache(offset, dest)
 }
@@ -1,8 +1,15 @@
 package fs
 
 import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 )
 
 func TestInodeIsDir(t *testing.T) {
@@ -26,3 +33,456 @@ func TestInodeIsDir(t *testing.T) {
 		}
 	}
 }
+
+func TestInodePaths(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+
+	dir1 := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	dir2 := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	file := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	root.AddChild("dir1", dir1, false)
+	root.AddChild("dir2", dir2, false)
+	dir1.AddChild("a", file, false)
+	dir1.AddChild("b", file, false)
+	dir2.AddChild("c", file, false)
+
+	want := []string{"dir1/a", "dir1/b", "dir2/c"}
+	if got := file.Paths(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := file.Paths(dir1); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("relative to dir1: got %v, want [a b]", got)
+	}
+	if got := root.Paths(nil); !reflect.DeepEqual(got, []string{""}) {
+		t.Errorf("root: got %q, want [\"\"]", got)
+	}
+
+	detached := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	if got := detached.Paths(nil); len(got) != 0 {
+		t.Errorf("detached: got %v, want none", got)
+	}
+
+	// A cycle that does not reach root.
+	loop1 := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	loop2 := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	loop1.AddChild("x", loop2, false)
+	loop2.AddChild("y", loop1, false)
+	if got := loop2.Paths(nil); len(got) != 0 {
+		t.Errorf("cycle: got %v, want none", got)
+	}
+}
+
+func TestInodeWalk(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+
+	dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+	file := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	root.AddChild("b", dir, false)
+	root.AddChild("a", file, false)
+	dir.AddChild("c", file, false)
+	// A cycle back to the root.
+	dir.AddChild("up", root, false)
+
+	var got []string
+	root.Walk(func(path string, n *Inode) bool {
+		got = append(got, path)
+		if path == "b/c" && n != file {
+			t.Errorf("b/c: got node %p, want %p", n, file)
+		}
+		return true
+	})
+	if want := []string{"", "a", "b", "b/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Stop early.
+	got = nil
+	root.Walk(func(path string, n *Inode) bool {
+		got = append(got, path)
+		return path != "a"
+	})
+	if want := []string{"", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stopped walk: got %q, want %q", got, want)
+	}
+
+	// The visitor may change the tree.
+	got = nil
+	root.Walk(func(path string, n *Inode) bool {
+		got = append(got, path)
+		if path == "a" {
+			dir.RmChild("c")
+		}
+		return true
+	})
+	if want := []string{"", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("walk with removal: got %q, want %q", got, want)
+	}
+}
+
+func TestDumpTree(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+	dir := root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR, Ino: 2})
+	root.AddChild("dir", dir, false)
+	dir.AddChild("file", root.NewPersistentInode(ctx, &Inode{}, StableAttr{Ino: 3}), false)
+
+	var buf bytes.Buffer
+	if err := root.DumpTree(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q, want 3 lines", buf.String())
+	}
+	for i, want := range []string{".\tn1 ", "dir\tn", "dir/file\tn"} {
+		if !strings.HasPrefix(lines[i], want) {
+			t.Errorf("line %d: got %q, want prefix %q", i, lines[i], want)
+		}
+	}
+	if !strings.Contains(lines[1], " i2 dir ") || !strings.Contains(lines[1], "persistent=true children=1") {
+		t.Errorf("got %q", lines[1])
+	}
+
+	// Errors from the writer stop the dump.
+	if err := root.DumpTree(errWriter{}); err != syscall.ENOSPC {
+		t.Errorf("got %v, want ENOSPC", err)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, syscall.ENOSPC }
+
+func TestChildrenSorted(t *testing.T) {
+	names := []string{"c", "a", "d", "b"}
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for _, nm := range names {
+				root.AddChild(nm, root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+			}
+		},
+	})
+	defer clean()
+
+	want := []string{"a", "b", "c", "d"}
+	var got []string
+	for _, e := range root.ChildrenSorted() {
+		got = append(got, e.Name)
+		if e.Child != root.GetChild(e.Name) {
+			t.Errorf("child %q: got %p, want %p", e.Name, e.Child, root.GetChild(e.Name))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ChildrenSorted: got %v, want %v", got, want)
+	}
+
+	// The default Readdir lists the children in the same order.
+	f, err := os.Open(mntDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err = f.Readdirnames(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir: got %v, want %v", got, want)
+	}
+}
+
+func TestGetOrAddChild(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+	defer clean()
+
+	id := StableAttr{Ino: 1000}
+	const n = 10
+	var wg sync.WaitGroup
+	winners := make([]*Inode, n)
+	added := make([]bool, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ch := root.NewPersistentInode(ctx, &Inode{}, id)
+			winners[i], added[i] = root.GetOrAddChild("file", ch)
+		}(i)
+	}
+	wg.Wait()
+
+	winner := root.GetChild("file")
+	count := 0
+	for i := 0; i < n; i++ {
+		if winners[i] != winner {
+			t.Errorf("caller %d: got child %p, want %p", i, winners[i], winner)
+		}
+		if added[i] {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("got %d additions, want 1", count)
+	}
+
+	// Register the winner with the kernel.
+	var st syscall.Stat_t
+	if err := syscall.Stat(mntDir+"/file", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Ino != id.Ino {
+		t.Errorf("got ino %d, want %d", st.Ino, id.Ino)
+	}
+
+	loser := root.NewPersistentInode(ctx, &Inode{}, id)
+	if got, ok := root.GetOrAddChild("file", loser); ok || got != winner {
+		t.Errorf("GetOrAddChild: got %p, %v, want %p, false", got, ok, winner)
+	}
+	if loser.persistent {
+		t.Error("losing child was not discarded")
+	}
+	// Discarding the loser must not drop the winner, which has
+	// the same StableAttr.
+	b := root.bridge
+	b.mu.Lock()
+	known := b.stableAttrs[winner.StableAttr()]
+	b.mu.Unlock()
+	if known != winner {
+		t.Errorf("stableAttrs: got %p, want %p", known, winner)
+	}
+}
+
+func TestInodeRename(t *testing.T) {
+	root := &Inode{}
+	var dir1, dir2, sub *Inode
+	hour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout: &hour,
+		AttrTimeout:  &hour,
+		OnAdd: func(ctx context.Context) {
+			dir1 = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			dir2 = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			sub = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("dir1", dir1, false)
+			root.AddChild("dir2", dir2, false)
+			dir1.AddChild("sub", sub, false)
+			dir1.AddChild("file", root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+			dir2.AddChild("other", root.NewPersistentInode(ctx, &Inode{}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	// Get the entries into the kernel cache.
+	for _, p := range []string{"dir1/file", "dir2/other", "dir1/sub"} {
+		if _, err := os.Lstat(mntDir + "/" + p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if errno := dir1.Rename("nonexistent", dir2, "x", false); errno != syscall.ENOENT {
+		t.Errorf("missing child: got %v, want ENOENT", errno)
+	}
+	if errno := dir1.Rename("file", dir2, "other", false); errno != syscall.EEXIST {
+		t.Errorf("no overwrite: got %v, want EEXIST", errno)
+	}
+	if errno := root.Rename("dir1", sub, "loop", false); errno != syscall.EINVAL {
+		t.Errorf("into descendant: got %v, want EINVAL", errno)
+	}
+	if errno := root.Rename("dir1", dir1, "loop", false); errno != syscall.EINVAL {
+		t.Errorf("into itself: got %v, want EINVAL", errno)
+	}
+
+	if errno := dir1.Rename("file", dir2, "other", true); errno != 0 {
+		t.Fatalf("Rename: %v", errno)
+	}
+	if _, err := os.Lstat(mntDir + "/dir1/file"); !os.IsNotExist(err) {
+		t.Errorf("old name: got %v, want ENOENT", err)
+	}
+	if _, err := os.Lstat(mntDir + "/dir2/other"); err != nil {
+		t.Errorf("new name: %v", err)
+	}
+
+	if errno := dir1.Rename("sub", root, "sub", false); errno != 0 {
+		t.Fatalf("Rename dir: %v", errno)
+	}
+	if _, err := os.Lstat(mntDir + "/sub"); err != nil {
+		t.Errorf("moved dir: %v", err)
+	}
+	if name, parent := sub.Parent(); name != "sub" || parent != root {
+		t.Errorf("Parent: got %q, %p, want %q, %p", name, parent, "sub", root)
+	}
+}
+
+func TestAddChildren(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+
+	newFile := func() *Inode {
+		return root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	}
+	a, b := newFile(), newFile()
+	if got := root.AddChildren(map[string]*Inode{"a": a, "b": b}, false); len(got) != 0 {
+		t.Fatalf("AddChildren: got collisions %v", got)
+	}
+
+	// A collision without overwrite adds nothing.
+	c, b2 := newFile(), newFile()
+	got := root.AddChildren(map[string]*Inode{"c": c, "b": b2}, false)
+	if !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("collisions: got %v, want [b]", got)
+	}
+	if root.GetChild("c") != nil || root.GetChild("b") != b {
+		t.Errorf("failed AddChildren changed the tree: %v", root.Children())
+	}
+
+	if got := root.AddChildren(map[string]*Inode{"c": c, "b": b2}, true); len(got) != 0 {
+		t.Errorf("AddChildren overwrite: got collisions %v", got)
+	}
+	want := map[string]*Inode{"a": a, "b": b2, "c": c}
+	if got := root.Children(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if name, parent := b.Parent(); parent != nil {
+		t.Errorf("replaced child still has parent %q", name)
+	}
+	if name, parent := b2.Parent(); name != "b" || parent != root {
+		t.Errorf("Parent: got %q, %p, want %q, %p", name, parent, "b", root)
+	}
+}
+
+func TestReplaceChildrenCaseInsensitive(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		CaseInsensitive: true,
+		OnAdd:           func(c context.Context) { ctx = c },
+	})
+
+	newFile := func() *Inode {
+		return root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	}
+	a, keep := newFile(), newFile()
+	root.AddChild("File", a, false)
+	root.AddChild("keep", keep, false)
+
+	b := newFile()
+	root.ReplaceChildren(map[string]*Inode{"FILE": b, "keep": keep})
+	want := map[string]*Inode{"FILE": b, "keep": keep}
+	if got := root.Children(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := root.GetChild("file"); got != b {
+		t.Errorf("GetChild: got %v, want %v", got, b)
+	}
+	if name, parent := a.Parent(); parent != nil {
+		t.Errorf("replaced child still has parent %q", name)
+	}
+	if name, parent := keep.Parent(); name != "keep" || parent != root {
+		t.Errorf("Parent: got %q, %p, want %q, %p", name, parent, "keep", root)
+	}
+
+	// Names that differ in case only collide.
+	root.ReplaceChildren(map[string]*Inode{"x": newFile(), "X": newFile()})
+	if got := root.Children(); len(got) != 1 {
+		t.Errorf("got %v, want a single child", got)
+	}
+}
+
+func TestCaseInsensitiveRename(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		CaseInsensitive: true,
+		OnAdd:           func(c context.Context) { ctx = c },
+	})
+
+	a := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	b := root.NewPersistentInode(ctx, &Inode{}, StableAttr{})
+	root.AddChild("Foo", a, false)
+	root.AddChild("bar", b, false)
+
+	root.MvChild("FOO", root, "foo", false)
+	root.MvChild("BAR", root, "Baz", true)
+	root.ExchangeChild("FOO", root, "baz")
+	for name, want := range map[string]*Inode{"fOO": b, "BAZ": a, "bar": nil} {
+		if got := root.GetChild(name); got != want {
+			t.Errorf("GetChild(%q): got %v, want %v", name, got, want)
+		}
+	}
+	if len(root.foldedNames) != 2 {
+		t.Errorf("got folded names %v, want 2", root.foldedNames)
+	}
+
+	root.RmChild("foo", "baz")
+	if len(root.foldedNames) != 0 {
+		t.Errorf("got folded names %v after RmChild", root.foldedNames)
+	}
+}
+
+func TestFoldName(t *testing.T) {
+	for _, c := range [][2]string{
+		{"abc", "ABC"},
+		{"k", "\u212a"}, // KELVIN SIGN
+		{"straße", "STRASSE"},
+		{"σ", "ς"},
+	} {
+		if got, want := foldName(c[0]) == foldName(c[1]), strings.EqualFold(c[0], c[1]); got != want {
+			t.Errorf("%q, %q: got equal %v, want %v", c[0], c[1], got, want)
+		}
+	}
+}
+
+func TestPublishContentConcurrent(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+
+	const n = 20
+	published := make([]*Inode, n)
+	var wg sync.WaitGroup
+	for i := range published {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			published[i] = root.PublishContent(ctx, "file", []byte{byte(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	// Every node but the final one was replaced, and released.
+	final := root.GetChild("file")
+	for i, ch := range published {
+		if ch == final {
+			continue
+		}
+		if name, parent := ch.Parent(); parent != nil {
+			t.Errorf("%d: replaced child still has parent %q", i, name)
+		}
+		if ch.persistent {
+			t.Errorf("%d: replaced child is still persistent", i)
+		}
+	}
+	if !final.persistent {
+		t.Error("final child is not persistent")
+	}
+}
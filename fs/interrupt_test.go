@@ -82,3 +82,67 @@ func TestInterrupt(t *testing.T) {
 		t.Errorf("open request was not interrupted")
 	}
 }
+
+// interruptReadNode is a file whose reads block until they are
+// interrupted.
+type interruptReadNode struct {
+	Inode
+	started  chan struct{}
+	canceled chan struct{}
+}
+
+var _ = (NodeOpener)((*interruptReadNode)(nil))
+var _ = (NodeReader)((*interruptReadNode)(nil))
+
+func (n *interruptReadNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	// Direct I/O, so the read is issued on behalf of the reading
+	// process rather than by readahead.
+	return nil, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (n *interruptReadNode) Read(ctx context.Context, f FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	close(n.started)
+	select {
+	case <-time.After(5 * time.Second):
+		return nil, syscall.EIO
+	case <-ctx.Done():
+		close(n.canceled)
+		return nil, syscall.EINTR
+	}
+}
+
+func TestInterruptRead(t *testing.T) {
+	root := &Inode{}
+	node := &interruptReadNode{
+		started:  make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, node, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	cmd := exec.Command("cat", mntDir+"/file")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("run %v: %v", cmd, err)
+	}
+
+	select {
+	case <-node.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("read was not issued")
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Errorf("Kill: %v", err)
+	}
+	cmd.Wait()
+
+	select {
+	case <-node.canceled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("context of the read was not canceled")
+	}
+}
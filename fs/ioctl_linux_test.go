@@ -0,0 +1,156 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ioc encodes an ioctl command like the _IOC macro.
+func ioc(dir, typ, nr, size uint32) uint32 {
+	return dir<<30 | size<<16 | typ<<8 | nr
+}
+
+const (
+	_IOC_WRITE = 1
+	_IOC_READ  = 2
+)
+
+var (
+	// ioctlIncr adds one to the uint64 at arg.
+	ioctlIncr = ioc(_IOC_READ|_IOC_WRITE, 'x', 1, 8)
+	// ioctlVersion stores a uint32 at arg, and returns 7.
+	ioctlVersion = ioc(_IOC_READ, 'x', 2, 4)
+)
+
+type ioctlNode struct {
+	Inode
+}
+
+var _ = (NodeOpener)((*ioctlNode)(nil))
+var _ = (NodeIoctler)((*ioctlNode)(nil))
+var _ = (NodeIoctlSizer)((*ioctlNode)(nil))
+
+func (n *ioctlNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, 0, OK
+}
+
+func (n *ioctlNode) Ioctl(ctx context.Context, f FileHandle, cmd uint32, arg uint64, input []byte, outSize uint32, flags uint32) (int32, []byte, syscall.Errno) {
+	switch cmd {
+	case ioctlIncr:
+		if len(input) != 8 {
+			return 0, nil, syscall.EINVAL
+		}
+		out := make([]byte, 8)
+		binary.LittleEndian.PutUint64(out, binary.LittleEndian.Uint64(input)+1)
+		return 0, out, OK
+	case ioctlVersion:
+		out := make([]byte, 4)
+		binary.LittleEndian.PutUint32(out, 42)
+		return 7, out, OK
+	}
+	return 0, nil, syscall.ENOTTY
+}
+
+func (n *ioctlNode) IoctlSize(ctx context.Context, f FileHandle, cmd uint32, arg uint64) (uint32, uint32, syscall.Errno) {
+	if cmd == ioctlIncr {
+		return 8, 8, OK
+	}
+	return 0, 0, syscall.ENOTTY
+}
+
+func TestIoctl(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, &ioctlNode{}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	f, err := os.Open(mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, 41)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(ioctlIncr), uintptr(unsafe.Pointer(&buf[0]))); errno != 0 {
+		t.Fatalf("ioctl incr: %v", errno)
+	}
+	if got := binary.LittleEndian.Uint64(buf); got != 42 {
+		t.Errorf("incr: got %d, want 42", got)
+	}
+
+	var version uint32
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(ioctlVersion), uintptr(unsafe.Pointer(&version)))
+	if errno != 0 {
+		t.Fatalf("ioctl version: %v", errno)
+	}
+	if r != 7 || version != 42 {
+		t.Errorf("version: got result %d, value %d, want 7, 42", r, version)
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(ioc(_IOC_READ, 'x', 3, 4)), uintptr(unsafe.Pointer(&version))); errno != syscall.ENOTTY {
+		t.Errorf("unknown ioctl: got %v, want ENOTTY", errno)
+	}
+}
+
+func TestIoctlUnrestrictedRetry(t *testing.T) {
+	root := &ioctlNode{}
+	bridge := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	var open fuse.OpenOut
+	if st := bridge.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}}, &open); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	in := &fuse.IoctlIn{
+		InHeader: fuse.InHeader{NodeId: 1},
+		Fh:       open.Fh,
+		Flags:    fuse.FUSE_IOCTL_UNRESTRICTED,
+		Cmd:      ioctlIncr,
+		Arg:      0x1000,
+	}
+	var out fuse.IoctlOut
+	data, st := bridge.Ioctl(nil, in, nil, &out)
+	if !st.Ok() {
+		t.Fatalf("Ioctl: %v", st)
+	}
+	if out.Flags&fuse.FUSE_IOCTL_RETRY == 0 || out.InIovs != 1 || out.OutIovs != 1 {
+		t.Fatalf("got %+v, want a retry with 1 in and 1 out iovec", out)
+	}
+	sz := int(unsafe.Sizeof(fuse.IoctlIovec{}))
+	if len(data) != 2*sz {
+		t.Fatalf("got %d bytes of iovecs, want %d", len(data), 2*sz)
+	}
+	for i := 0; i < 2; i++ {
+		iov := *(*fuse.IoctlIovec)(unsafe.Pointer(&data[i*sz]))
+		if iov.Base != in.Arg || iov.Len != 8 {
+			t.Errorf("iovec %d: got %+v", i, iov)
+		}
+	}
+
+	// The kernel retries with the requested buffers.
+	in.InSize, in.OutSize = 8, 8
+	input := make([]byte, 8)
+	binary.LittleEndian.PutUint64(input, 1)
+	out = fuse.IoctlOut{}
+	data, st = bridge.Ioctl(nil, in, input, &out)
+	if !st.Ok() {
+		t.Fatalf("Ioctl: %v", st)
+	}
+	if out.Flags != 0 || len(data) != 8 || binary.LittleEndian.Uint64(data) != 2 {
+		t.Errorf("got %+v, data %v, want 2", out, data)
+	}
+}
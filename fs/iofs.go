@@ -0,0 +1,212 @@
+// +build go1.16
+
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"io/ioutil"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NewFSRoot returns a read-only file system that serves fsys, eg. an
+// embed.FS, a zip.Reader or an os.DirFS. Directories are listed with
+// fs.ReadDir as they are looked up, and attributes come from
+// fs.Stat. Files are read through io.ReaderAt if the fs.File
+// implements it. Otherwise they are read sequentially, seeking if the
+// file is an io.Seeker, and reopening it to read backwards if not.
+//
+// Everything that is not a directory is served as a regular file.
+// Write permissions are not reported, and opening for writing fails
+// with EROFS.
+func NewFSRoot(fsys iofs.FS) InodeEmbedder {
+	return &ioFSDir{ioFSPath: ioFSPath{fsys, "."}}
+}
+
+// ioFSPath is an entry of an io/fs file system, name being its path
+// in fsys.
+type ioFSPath struct {
+	fsys iofs.FS
+	name string
+}
+
+func (p *ioFSPath) getattr(out *fuse.AttrOut) syscall.Errno {
+	fi, err := iofs.Stat(p.fsys, p.name)
+	if err != nil {
+		return ioFSErrno(err)
+	}
+	ioFSAttr(fi, &out.Attr)
+	return OK
+}
+
+// ioFSAttr fills out from fi.
+func ioFSAttr(fi iofs.FileInfo, out *fuse.Attr) {
+	out.Mode = uint32(fi.Mode().Perm() &^ 0222)
+	if fi.IsDir() {
+		out.Mode |= fuse.S_IFDIR
+	} else {
+		out.Mode |= fuse.S_IFREG
+		out.Size = uint64(fi.Size())
+		out.Blocks = (out.Size + 511) / 512
+	}
+	// There is only the modification time to report.
+	mtime := fi.ModTime()
+	out.SetTimes(&mtime, &mtime, &mtime)
+}
+
+// ioFSErrno converts an error from fsys to an Errno.
+func ioFSErrno(err error) syscall.Errno {
+	switch {
+	case errors.Is(err, iofs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, iofs.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, iofs.ErrInvalid):
+		return syscall.EINVAL
+	}
+	return ioErrno(err)
+}
+
+type ioFSDir struct {
+	Inode
+	ioFSPath
+}
+
+var _ = (NodeGetattrer)((*ioFSDir)(nil))
+var _ = (NodeLookuper)((*ioFSDir)(nil))
+var _ = (NodeReaddirer)((*ioFSDir)(nil))
+
+func (d *ioFSDir) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return d.getattr(out)
+}
+
+func (d *ioFSDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	child := ioFSPath{d.fsys, path.Join(d.name, name)}
+	fi, err := iofs.Stat(d.fsys, child.name)
+	if err != nil {
+		return nil, ioFSErrno(err)
+	}
+	ioFSAttr(fi, &out.Attr)
+	if fi.IsDir() {
+		return d.NewInode(ctx, &ioFSDir{ioFSPath: child}, StableAttr{Mode: fuse.S_IFDIR}), OK
+	}
+	return d.NewInode(ctx, &ioFSFile{ioFSPath: child}, StableAttr{Mode: fuse.S_IFREG}), OK
+}
+
+func (d *ioFSDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	entries, err := iofs.ReadDir(d.fsys, d.name)
+	if err != nil {
+		return nil, ioFSErrno(err)
+	}
+	r := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		mode := uint32(fuse.S_IFREG)
+		if e.IsDir() {
+			mode = fuse.S_IFDIR
+		}
+		r = append(r, fuse.DirEntry{Name: e.Name(), Mode: mode})
+	}
+	return NewListDirStream(r), OK
+}
+
+type ioFSFile struct {
+	Inode
+	ioFSPath
+}
+
+var _ = (NodeGetattrer)((*ioFSFile)(nil))
+var _ = (NodeOpener)((*ioFSFile)(nil))
+
+func (f *ioFSFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return f.getattr(out)
+}
+
+func (f *ioFSFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	file, err := f.fsys.Open(f.name)
+	if err != nil {
+		return nil, 0, ioFSErrno(err)
+	}
+	if ra, ok := file.(io.ReaderAt); ok {
+		return NewReaderAtHandle(ra), 0, OK
+	}
+	return &ioFSStream{fsys: f.fsys, name: f.name, file: file}, 0, OK
+}
+
+// ioFSStream reads a file that does not implement io.ReaderAt.
+type ioFSStream struct {
+	fsys iofs.FS
+	name string
+
+	mu   sync.Mutex
+	file iofs.File
+	pos  int64
+}
+
+var _ = (FileReader)((*ioFSStream)(nil))
+var _ = (FileReleaser)((*ioFSStream)(nil))
+
+func (s *ioFSStream) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if errno := s.seek(off); errno != 0 {
+		return nil, errno
+	}
+	n, err := io.ReadFull(s.file, dest)
+	s.pos += int64(n)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, ioFSErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), OK
+}
+
+// seek positions the file at off.
+func (s *ioFSStream) seek(off int64) syscall.Errno {
+	if off == s.pos {
+		return OK
+	}
+	if sk, ok := s.file.(io.Seeker); ok {
+		pos, err := sk.Seek(off, io.SeekStart)
+		if err != nil {
+			return ioFSErrno(err)
+		}
+		s.pos = pos
+		return OK
+	}
+	if off < s.pos {
+		// Start over.
+		file, err := s.fsys.Open(s.name)
+		if err != nil {
+			return ioFSErrno(err)
+		}
+		s.file.Close()
+		s.file, s.pos = file, 0
+	}
+	n, err := io.CopyN(ioutil.Discard, s.file, off-s.pos)
+	s.pos += n
+	if err != nil && err != io.EOF {
+		return ioFSErrno(err)
+	}
+	return OK
+}
+
+func (s *ioFSStream) Release(ctx context.Context) syscall.Errno {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.file.Close(); err != nil {
+		return ioFSErrno(err)
+	}
+	return OK
+}
@@ -0,0 +1,128 @@
+// +build go1.16
+
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	iofs "io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+// streamFS hides io.ReaderAt and io.Seeker from the regular files of
+// an FS.
+type streamFS struct {
+	iofs.FS
+}
+
+func (s streamFS) Open(name string) (iofs.File, error) {
+	f, err := s.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(iofs.ReadDirFile); ok {
+		return f, nil
+	}
+	return struct{ iofs.File }{f}, nil
+}
+
+func TestFSRoot(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	big := make([]byte, 300<<10)
+	for i := range big {
+		big[i] = byte(i % 251)
+	}
+	fsys := fstest.MapFS{
+		"top.txt":            {Data: []byte("top"), Mode: 0644, ModTime: mtime},
+		"dir/sub/nested.txt": {Data: []byte("nested"), Mode: 0444, ModTime: mtime},
+		"dir/big":            {Data: big, Mode: 0444},
+	}
+
+	for name, fsys := range map[string]iofs.FS{
+		"readerat": fsys,
+		"stream":   streamFS{fsys},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mntDir, _, clean := testMount(t, NewFSRoot(fsys), nil)
+			defer clean()
+
+			if got, err := ioutil.ReadFile(mntDir + "/dir/sub/nested.txt"); err != nil || string(got) != "nested" {
+				t.Errorf("ReadFile: got %q, %v, want 'nested'", got, err)
+			}
+
+			fi, err := os.Stat(mntDir + "/top.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != 3 || fi.Mode() != 0444 || !fi.ModTime().Equal(mtime) {
+				t.Errorf("Stat: got size %d, mode %v, mtime %v", fi.Size(), fi.Mode(), fi.ModTime())
+			}
+
+			names, err := ioutil.ReadDir(mntDir + "/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range names {
+				got = append(got, e.Name())
+			}
+			if want := []string{"big", "sub"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ReadDir: got %v, want %v", got, want)
+			}
+
+			// Read backwards, so a stream must start over.
+			f, err := os.Open(mntDir + "/dir/big")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, off := range []int64{200 << 10, 0} {
+				buf := make([]byte, 100)
+				if _, err := f.ReadAt(buf, off); err != nil {
+					t.Fatalf("ReadAt(%d): %v", off, err)
+				}
+				if !bytes.Equal(buf, big[off:off+100]) {
+					t.Errorf("ReadAt(%d): got wrong data", off)
+				}
+			}
+
+			if _, err := os.OpenFile(mntDir+"/top.txt", os.O_WRONLY, 0); !errors.Is(err, syscall.EROFS) && !os.IsPermission(err) {
+				t.Errorf("open for writing: got %v, want EROFS", err)
+			}
+		})
+	}
+}
+
+func TestFSRootDirFS(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "a/b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a/b/file"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mntDir, _, clean := testMount(t, NewFSRoot(os.DirFS(dir)), nil)
+	defer clean()
+
+	if got, err := ioutil.ReadFile(mntDir + "/a/b/file"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile: got %q, %v, want 'hello'", got, err)
+	}
+	if _, err := os.Stat(mntDir + "/a/missing"); !os.IsNotExist(err) {
+		t.Errorf("Stat: got %v, want ENOENT", err)
+	}
+}
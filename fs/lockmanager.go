@@ -0,0 +1,159 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// LockManager implements POSIX byte-range locks (fcntl(2) F_GETLK,
+// F_SETLK and F_SETLKW) in memory. Locks are keyed on the lock owner
+// that the kernel passes along, so both process-associated and open
+// file description locks work. Embed a LockManager in a node to make
+// it implement NodeGetlker, NodeSetlker and NodeSetlkwer:
+//
+//	type lockingNode struct {
+//		fs.MemRegularFile
+//		fs.LockManager
+//	}
+//
+// Locks are only honored if MountOptions.EnableLocks is set. The
+// locks of an owner must be dropped when it closes the file; the
+// bridge does so by calling ReleaseOwner (see NodeLockOwnerReleaser)
+// if the LockManager is embedded in the node. A LockManager used
+// otherwise, eg. from a FileHandle, must get ReleaseOwner called from
+// the Flush of the node, or waiting Setlkw calls of other owners
+// block forever once the holder exits.
+type LockManager struct {
+	mu    sync.Mutex
+	locks []heldLock
+
+	// changed is closed and replaced whenever the locks change,
+	// to wake up waiting Setlkw calls.
+	changed chan struct{}
+}
+
+type heldLock struct {
+	owner uint64
+	lk    fuse.FileLock
+}
+
+func lockOverlaps(a, b *fuse.FileLock) bool {
+	return a.Start <= b.End && b.Start <= a.End
+}
+
+// conflict returns a lock held by another owner that prevents owner
+// from taking lk, or nil.
+func (m *LockManager) conflict(owner uint64, lk *fuse.FileLock) *fuse.FileLock {
+	for i := range m.locks {
+		h := &m.locks[i]
+		if h.owner == owner || !lockOverlaps(&h.lk, lk) {
+			continue
+		}
+		if h.lk.Typ == syscall.F_WRLCK || lk.Typ == syscall.F_WRLCK {
+			return &h.lk
+		}
+	}
+	return nil
+}
+
+// apply replaces the locks of owner in the range of lk with lk. An
+// F_UNLCK lk just removes them. It must be called with m.mu held.
+func (m *LockManager) apply(owner uint64, lk *fuse.FileLock) {
+	var result []heldLock
+	for _, h := range m.locks {
+		if h.owner != owner || !lockOverlaps(&h.lk, lk) {
+			result = append(result, h)
+			continue
+		}
+		// Keep the parts sticking out on either side.
+		if h.lk.Start < lk.Start {
+			left := h
+			left.lk.End = lk.Start - 1
+			result = append(result, left)
+		}
+		if h.lk.End > lk.End {
+			right := h
+			right.lk.Start = lk.End + 1
+			result = append(result, right)
+		}
+	}
+	if lk.Typ != syscall.F_UNLCK {
+		result = append(result, heldLock{owner, *lk})
+	}
+	m.locks = result
+
+	if m.changed != nil {
+		close(m.changed)
+		m.changed = nil
+	}
+}
+
+var _ = (NodeGetlker)((*LockManager)(nil))
+var _ = (NodeSetlker)((*LockManager)(nil))
+var _ = (NodeSetlkwer)((*LockManager)(nil))
+var _ = (NodeLockOwnerReleaser)((*LockManager)(nil))
+
+// Getlk returns a lock that conflicts with lk in out, or sets
+// out.Typ to F_UNLCK if there is none.
+func (m *LockManager) Getlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c := m.conflict(owner, lk); c != nil {
+		*out = *c
+		return OK
+	}
+	*out = *lk
+	out.Typ = syscall.F_UNLCK
+	return OK
+}
+
+// Setlk takes or releases a lock, returning EAGAIN if it conflicts
+// with a lock of another owner.
+func (m *LockManager) Setlk(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lk.Typ != syscall.F_UNLCK && m.conflict(owner, lk) != nil {
+		return syscall.EAGAIN
+	}
+	m.apply(owner, lk)
+	return OK
+}
+
+// Setlkw is like Setlk, but waits for conflicting locks to be
+// released. It returns EINTR if the request is interrupted.
+func (m *LockManager) Setlkw(ctx context.Context, f FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	for {
+		m.mu.Lock()
+		if lk.Typ == syscall.F_UNLCK || m.conflict(owner, lk) == nil {
+			m.apply(owner, lk)
+			m.mu.Unlock()
+			return OK
+		}
+		if m.changed == nil {
+			m.changed = make(chan struct{})
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+}
+
+// ReleaseOwner drops all locks of owner, eg. because it closed the
+// file.
+func (m *LockManager) ReleaseOwner(owner uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply(owner, &fuse.FileLock{Start: 0, End: ^uint64(0), Typ: syscall.F_UNLCK})
+}
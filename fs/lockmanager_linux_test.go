@@ -0,0 +1,109 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+func TestLockManagerMount(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnableLocks: true},
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &lockingFile{}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	f1, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f2.Close()
+
+	// Open file description locks have a lock owner per handle.
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Start: 0, Len: 100}
+	if err := unix.FcntlFlock(f1.Fd(), unix.F_OFD_SETLK, &lk); err != nil {
+		t.Fatalf("F_OFD_SETLK: %v", err)
+	}
+	lk = unix.Flock_t{Type: unix.F_RDLCK, Start: 50, Len: 100}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_OFD_SETLK, &lk); err != syscall.EAGAIN {
+		t.Fatalf("F_OFD_SETLK: got %v, want EAGAIN", err)
+	}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_OFD_GETLK, &lk); err != nil {
+		t.Fatalf("F_OFD_GETLK: %v", err)
+	} else if lk.Type != unix.F_WRLCK || lk.Start != 0 || lk.Len != 100 {
+		t.Errorf("F_OFD_GETLK: got %+v", lk)
+	}
+
+	lk = unix.Flock_t{Type: unix.F_UNLCK, Start: 0, Len: 100}
+	if err := unix.FcntlFlock(f1.Fd(), unix.F_OFD_SETLK, &lk); err != nil {
+		t.Fatalf("F_OFD_SETLK: %v", err)
+	}
+	lk = unix.Flock_t{Type: unix.F_RDLCK, Start: 50, Len: 100}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_OFD_SETLK, &lk); err != nil {
+		t.Fatalf("F_OFD_SETLK: %v", err)
+	}
+}
+
+func TestLockManagerFlockClose(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnableLocks: true},
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &lockingFile{}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	f1, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f2, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	defer f2.Close()
+
+	if err := unix.Flock(int(f1.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatalf("Flock: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- unix.Flock(int(f2.Fd()), unix.LOCK_EX)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Flock returned %v while the file was locked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Closing the holder's file drops its lock.
+	f1.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flock: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flock did not return after the holder closed its file")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type lockingFile struct {
+	MemRegularFile
+	LockManager
+}
+
+func TestLockManager(t *testing.T) {
+	var m LockManager
+	ctx := context.Background()
+
+	wr := fuse.FileLock{Start: 0, End: 99, Typ: syscall.F_WRLCK, Pid: 1}
+	if errno := m.Setlk(ctx, nil, 1, &wr, 0); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+
+	rd := fuse.FileLock{Start: 50, End: 149, Typ: syscall.F_RDLCK, Pid: 2}
+	if errno := m.Setlk(ctx, nil, 2, &rd, 0); errno != syscall.EAGAIN {
+		t.Fatalf("Setlk: got %v, want EAGAIN", errno)
+	}
+	var out fuse.FileLock
+	m.Getlk(ctx, nil, 2, &rd, 0, &out)
+	if out != wr {
+		t.Errorf("Getlk: got %v, want %v", out, wr)
+	}
+
+	// Reads do not conflict with reads.
+	rd2 := fuse.FileLock{Start: 100, End: 199, Typ: syscall.F_RDLCK, Pid: 2}
+	if errno := m.Setlk(ctx, nil, 2, &rd2, 0); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+	rd3 := fuse.FileLock{Start: 150, End: 249, Typ: syscall.F_RDLCK, Pid: 3}
+	if errno := m.Setlk(ctx, nil, 3, &rd3, 0); errno != 0 {
+		t.Fatalf("Setlk: %v", errno)
+	}
+
+	done := make(chan syscall.Errno, 1)
+	go func() {
+		done <- m.Setlkw(ctx, nil, 2, &rd, 0)
+	}()
+	select {
+	case errno := <-done:
+		t.Fatalf("Setlkw returned %v while the range was locked", errno)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Unlocking part of the range is not enough.
+	unlk := fuse.FileLock{Start: 0, End: 59, Typ: syscall.F_UNLCK}
+	m.Setlk(ctx, nil, 1, &unlk, 0)
+	select {
+	case errno := <-done:
+		t.Fatalf("Setlkw returned %v while the range was locked", errno)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlk = fuse.FileLock{Start: 0, End: 1000, Typ: syscall.F_UNLCK}
+	m.Setlk(ctx, nil, 1, &unlk, 0)
+	if errno := <-done; errno != 0 {
+		t.Fatalf("Setlkw: %v", errno)
+	}
+
+	// Setlkw gives up when it is interrupted.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		done <- m.Setlkw(cancelCtx, nil, 1, &wr, 0)
+	}()
+	cancel()
+	if errno := <-done; errno != syscall.EINTR {
+		t.Errorf("Setlkw: got %v, want EINTR", errno)
+	}
+}
+
+func TestLockManagerReleaseOwner(t *testing.T) {
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &lockingFile{}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	}).(*rawBridge)
+
+	var out fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &out); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	hdr := fuse.InHeader{NodeId: out.NodeId}
+	lk := fuse.FileLock{Start: 0, End: 99, Typ: syscall.F_WRLCK}
+	if st := rb.SetLk(nil, &fuse.LkIn{InHeader: hdr, Owner: 1, Lk: lk}); !st.Ok() {
+		t.Fatalf("SetLk: %v", st)
+	}
+
+	done := make(chan fuse.Status, 1)
+	go func() {
+		done <- rb.SetLkw(nil, &fuse.LkIn{InHeader: hdr, Owner: 2, Lk: lk})
+	}()
+	select {
+	case st := <-done:
+		t.Fatalf("SetLkw returned %v while the range was locked", st)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Closing a file of another owner keeps the lock.
+	rb.Flush(nil, &fuse.FlushIn{InHeader: hdr, LockOwner: 3})
+	select {
+	case st := <-done:
+		t.Fatalf("SetLkw returned %v while the range was locked", st)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// The holder closes its file.
+	rb.Flush(nil, &fuse.FlushIn{InHeader: hdr, LockOwner: 1})
+	select {
+	case st := <-done:
+		if !st.Ok() {
+			t.Fatalf("SetLkw: %v", st)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SetLkw did not return after the holder closed its file")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"context"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -28,6 +30,149 @@ type LoopbackRoot struct {
 	// to a LOOKUP/CREATE/MKDIR/MKNOD opcode. If not set, use a
 	// LoopbackNode.
 	NewNode func(rootData *LoopbackRoot, parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder
+
+	// FollowSymlinks makes symlinks in the underlying file system
+	// appear as the files or directories they point to, rather
+	// than as symlinks. Dangling symlinks appear not to exist.
+	// This is meant for read-only, flattened views of a tree.
+	//
+	// Symlinks are resolved by the kernel against the namespace
+	// of the server process, so a symlink pointing outside Path
+	// (eg. to "/etc" or "../..") exposes that part of the host
+	// file system through the mount, with the permissions of the
+	// server. Only set this for trees whose symlinks are trusted.
+	FollowSymlinks bool
+
+	// RestrictToRoot makes operations fail with EACCES if the
+	// backing path they resolve lies outside Path, eg. because a
+	// directory in the underlying file system was replaced with
+	// a symlink after it was looked up, or because a symlink
+	// followed with FollowSymlinks points out of the tree. Set it
+	// when exposing the mount to untrusted clients.
+	//
+	// On Linux 5.6 and later this uses openat2(2) with
+	// RESOLVE_BENEATH; elsewhere the symlinks are resolved in the
+	// server. Either way, the check runs just before the
+	// operation itself, so a concurrent change to the underlying
+	// file system can still slip in between them.
+	RestrictToRoot bool
+
+	// MaxOpenFds, if positive, bounds the number of backing fds
+	// kept open for the file handles of the mount. When more files
+	// are open, the least recently used fds are closed, and the
+	// files are reopened by path, with the original access mode,
+	// on their next read or write. This helps when clients keep
+	// many files open on a server with a low RLIMIT_NOFILE.
+	//
+	// The fds of files holding locks, of files used for
+	// passthrough, of O_TMPFILE files, and of files unlinked
+	// while open are never closed, so the bound is exceeded if
+	// there are many of those. They do count towards it, so the
+	// other fds are closed first. A file that is replaced behind
+	// the server's back while its fd is closed fails with ESTALE.
+	MaxOpenFds int
+
+	fdCacheOnce sync.Once
+	fdCache     *fdCache
+}
+
+// fds returns the fd cache, or nil if MaxOpenFds is not set.
+func (r *LoopbackRoot) fds() *fdCache {
+	if r.MaxOpenFds <= 0 {
+		return nil
+	}
+	r.fdCacheOnce.Do(func() {
+		r.fdCache = newFdCache(r.MaxOpenFds)
+	})
+	return r.fdCache
+}
+
+// loopbackFder is implemented by the file handles of the loopback
+// file system, whether or not MaxOpenFds is set. withFd runs fn with
+// the backing fd, which stays open during the call.
+type loopbackFder interface {
+	withFd(fn func(fd int) syscall.Errno) syscall.Errno
+}
+
+// newFile returns a file handle for fd, which was opened on the file
+// of inode with the given flags.
+func (r *LoopbackRoot) newFile(inode *Inode, fd int, flags int) (FileHandle, syscall.Errno) {
+	c := r.fds()
+	if c == nil {
+		return NewLoopbackFile(fd), OK
+	}
+	return c.newFile(r, inode, fd, flags)
+}
+
+// checkBeneath returns EACCES if RestrictToRoot is set and p does
+// not resolve to a file below Path. If follow is set, a symlink as
+// the last component of p is resolved too.
+func (r *LoopbackRoot) checkBeneath(p string, follow bool) syscall.Errno {
+	if !r.RestrictToRoot {
+		return OK
+	}
+	rel, err := filepath.Rel(r.Path, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return syscall.EACCES
+	}
+	errno := resolveBeneath(r.Path, rel, follow)
+	if errno == syscall.ENOSYS {
+		errno = evalBeneath(r.Path, p, follow)
+	}
+	switch errno {
+	case OK, syscall.ENOENT, syscall.ENOTDIR:
+		// ENOENT, eg. for a file that is about to be created,
+		// is left for the operation itself to report.
+		return OK
+	}
+	// This includes ELOOP for magic links, such as those in
+	// /proc, which may lead anywhere.
+	return syscall.EACCES
+}
+
+// evalBeneath is the fallback for resolveBeneath. It resolves the
+// symlinks in p and returns EXDEV if the result is outside root, or
+// if it cannot tell, and ENOENT if p is not there.
+func evalBeneath(root, p string, follow bool) syscall.Errno {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return syscall.EXDEV
+	}
+	if realRoot == "/" {
+		return OK
+	}
+	target := p
+	if !follow {
+		target = filepath.Dir(p)
+	}
+	real, err := filepath.EvalSymlinks(target)
+	if os.IsNotExist(err) && follow {
+		// We cannot tell where a dangling symlink would lead,
+		// so refuse it.
+		var st syscall.Stat_t
+		if syscall.Lstat(p, &st) == nil && st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			return syscall.EXDEV
+		}
+		real, err = filepath.EvalSymlinks(filepath.Dir(p))
+	}
+	if os.IsNotExist(err) {
+		return syscall.ENOENT
+	} else if err != nil {
+		return syscall.EXDEV
+	}
+	if real != realRoot && !strings.HasPrefix(real, realRoot+"/") {
+		return syscall.EXDEV
+	}
+	return OK
+}
+
+// lstat stats p, following a trailing symlink if FollowSymlinks is
+// set.
+func (r *LoopbackRoot) lstat(p string, st *syscall.Stat_t) error {
+	if r.FollowSymlinks {
+		return syscall.Stat(p, st)
+	}
+	return syscall.Lstat(p, st)
 }
 
 func (r *LoopbackRoot) newNode(parent *Inode, name string, st *syscall.Stat_t) InodeEmbedder {
@@ -91,8 +236,17 @@ var _ = (NodeRmdirer)((*LoopbackNode)(nil))
 var _ = (NodeRenamer)((*LoopbackNode)(nil))
 
 func (n *LoopbackNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	if errno := n.RootData.checkBeneath(n.path(), true); errno != 0 {
+		return errno
+	}
+	return StatfsFromBacking(n.path(), out)
+}
+
+// StatfsFromBacking fills `out` with the statistics of the file
+// system holding `path`.
+func StatfsFromBacking(path string, out *fuse.StatfsOut) syscall.Errno {
 	s := syscall.Statfs_t{}
-	err := syscall.Statfs(n.path(), &s)
+	err := syscall.Statfs(path, &s)
 	if err != nil {
 		return ToErrno(err)
 	}
@@ -109,9 +263,12 @@ func (n *LoopbackNode) path() string {
 
 func (n *LoopbackNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	p := filepath.Join(n.path(), name)
+	if errno := n.RootData.checkBeneath(p, n.RootData.FollowSymlinks); errno != 0 {
+		return nil, errno
+	}
 
 	st := syscall.Stat_t{}
-	err := syscall.Lstat(p, &st)
+	err := n.RootData.lstat(p, &st)
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -137,6 +294,10 @@ func (n *LoopbackNode) preserveOwner(ctx context.Context, path string) error {
 
 func (n *LoopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	p := filepath.Join(n.path(), name)
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return nil, errno
+	}
+	mode = applyUmask(ctx, mode)
 	err := syscall.Mknod(p, mode, int(rdev))
 	if err != nil {
 		return nil, ToErrno(err)
@@ -144,10 +305,22 @@ func (n *LoopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32
 	n.preserveOwner(ctx, p)
 	st := syscall.Stat_t{}
 	if err := syscall.Lstat(p, &st); err != nil {
-		syscall.Rmdir(p)
+		syscall.Unlink(p)
 		return nil, ToErrno(err)
 	}
 
+	// The caller's umask was applied to mode; undo the effect of
+	// our own umask.
+	if perm := mode & 07777; uint32(st.Mode)&07777 != perm {
+		if err := syscall.Chmod(p, perm); err == nil {
+			err = syscall.Lstat(p, &st)
+		}
+		if err != nil {
+			syscall.Unlink(p)
+			return nil, ToErrno(err)
+		}
+	}
+
 	out.Attr.FromStat(&st)
 
 	node := n.RootData.newNode(n.EmbeddedInode(), name, &st)
@@ -158,7 +331,10 @@ func (n *LoopbackNode) Mknod(ctx context.Context, name string, mode, rdev uint32
 
 func (n *LoopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	p := filepath.Join(n.path(), name)
-	err := os.Mkdir(p, os.FileMode(mode))
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return nil, errno
+	}
+	err := os.Mkdir(p, os.FileMode(applyUmask(ctx, mode)))
 	if err != nil {
 		return nil, ToErrno(err)
 	}
@@ -179,23 +355,49 @@ func (n *LoopbackNode) Mkdir(ctx context.Context, name string, mode uint32, out
 
 func (n *LoopbackNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 	p := filepath.Join(n.path(), name)
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return errno
+	}
 	err := syscall.Rmdir(p)
 	return ToErrno(err)
 }
 
 func (n *LoopbackNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	p := filepath.Join(n.path(), name)
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return errno
+	}
+	if c := n.RootData.fds(); c != nil {
+		c.pin(n.GetChild(name))
+	}
 	err := syscall.Unlink(p)
 	return ToErrno(err)
 }
 
+// Rename renames a file. The RENAME_EXCHANGE and RENAME_NOREPLACE
+// flags are passed to renameat2(2) on the backing directories; if the
+// underlying file system does not support them, its error (typically
+// EINVAL) is returned. Setting both flags is invalid.
 func (n *LoopbackNode) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
-	if flags&RENAME_EXCHANGE != 0 {
-		return n.renameExchange(name, newParent, newName)
+	if flags&^(RENAME_EXCHANGE|RENAME_NOREPLACE) != 0 ||
+		flags == RENAME_EXCHANGE|RENAME_NOREPLACE {
+		return syscall.EINVAL
 	}
 
 	p1 := filepath.Join(n.path(), name)
 	p2 := filepath.Join(n.RootData.Path, newParent.EmbeddedInode().Path(nil), newName)
+	for _, p := range []string{p1, p2} {
+		if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+			return errno
+		}
+	}
+	if c := n.RootData.fds(); c != nil && flags&RENAME_EXCHANGE == 0 {
+		// The destination may be replaced.
+		c.pin(newParent.EmbeddedInode().GetChild(newName))
+	}
+	if flags != 0 {
+		return n.renameat2(name, newParent, newName, flags)
+	}
 
 	err := syscall.Rename(p1, p2)
 	return ToErrno(err)
@@ -205,8 +407,11 @@ var _ = (NodeCreater)((*LoopbackNode)(nil))
 
 func (n *LoopbackNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	p := filepath.Join(n.path(), name)
+	if errno := n.RootData.checkBeneath(p, true); errno != 0 {
+		return nil, nil, 0, errno
+	}
 	flags = flags &^ syscall.O_APPEND
-	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, mode)
+	fd, err := syscall.Open(p, int(flags)|os.O_CREATE, applyUmask(ctx, mode))
 	if err != nil {
 		return nil, nil, 0, ToErrno(err)
 	}
@@ -219,7 +424,10 @@ func (n *LoopbackNode) Create(ctx context.Context, name string, flags uint32, mo
 
 	node := n.RootData.newNode(n.EmbeddedInode(), name, &st)
 	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
-	lf := NewLoopbackFile(fd)
+	lf, errno := n.RootData.newFile(ch, fd, int(flags))
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
 
 	out.FromStat(&st)
 	return ch, lf, 0, 0
@@ -227,6 +435,9 @@ func (n *LoopbackNode) Create(ctx context.Context, name string, flags uint32, mo
 
 func (n *LoopbackNode) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 	p := filepath.Join(n.path(), name)
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return nil, errno
+	}
 	err := syscall.Symlink(target, p)
 	if err != nil {
 		return nil, ToErrno(err)
@@ -247,9 +458,25 @@ func (n *LoopbackNode) Symlink(ctx context.Context, target, name string, out *fu
 func (n *LoopbackNode) Link(ctx context.Context, target InodeEmbedder, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
 
 	p := filepath.Join(n.path(), name)
-	err := syscall.Link(filepath.Join(n.RootData.Path, target.EmbeddedInode().Path(nil)), p)
-	if err != nil {
-		return nil, ToErrno(err)
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return nil, errno
+	}
+	tn := target.EmbeddedInode()
+	tn.mu.Lock()
+	tmpfile := tn.tmpfile
+	tn.mu.Unlock()
+	var errno syscall.Errno
+	if tmpfile {
+		errno = linkTmpfile(tn, p)
+	} else {
+		old := filepath.Join(n.RootData.Path, tn.Path(nil))
+		if errno := n.RootData.checkBeneath(old, false); errno != 0 {
+			return nil, errno
+		}
+		errno = ToErrno(syscall.Link(old, p))
+	}
+	if errno != 0 {
+		return nil, errno
 	}
 	st := syscall.Stat_t{}
 	if err := syscall.Lstat(p, &st); err != nil {
@@ -264,7 +491,14 @@ func (n *LoopbackNode) Link(ctx context.Context, target InodeEmbedder, name stri
 }
 
 func (n *LoopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if n.RootData.FollowSymlinks {
+		// There are no symlinks in the mount.
+		return nil, syscall.EINVAL
+	}
 	p := n.path()
+	if errno := n.RootData.checkBeneath(p, false); errno != 0 {
+		return nil, errno
+	}
 
 	for l := 256; ; l *= 2 {
 		buf := make([]byte, l)
@@ -282,15 +516,21 @@ func (n *LoopbackNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 func (n *LoopbackNode) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	flags = flags &^ syscall.O_APPEND
 	p := n.path()
+	if errno := n.RootData.checkBeneath(p, true); errno != 0 {
+		return nil, 0, errno
+	}
 	f, err := syscall.Open(p, int(flags), 0)
 	if err != nil {
 		return nil, 0, ToErrno(err)
 	}
-	lf := NewLoopbackFile(f)
-	return lf, 0, 0
+	lf, errno := n.RootData.newFile(n.EmbeddedInode(), f, int(flags))
+	return lf, 0, errno
 }
 
 func (n *LoopbackNode) Opendir(ctx context.Context) syscall.Errno {
+	if errno := n.RootData.checkBeneath(n.path(), true); errno != 0 {
+		return errno
+	}
 	fd, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0755)
 	if err != nil {
 		return ToErrno(err)
@@ -300,7 +540,37 @@ func (n *LoopbackNode) Opendir(ctx context.Context) syscall.Errno {
 }
 
 func (n *LoopbackNode) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
-	return NewLoopbackDirStream(n.path())
+	if errno := n.RootData.checkBeneath(n.path(), true); errno != 0 {
+		return nil, errno
+	}
+	ds, errno := NewLoopbackDirStream(n.path())
+	if errno != 0 || !n.RootData.FollowSymlinks {
+		return ds, errno
+	}
+	defer ds.Close()
+
+	// Report symlinks with the type of their target, as Lookup
+	// does, and leave out dangling ones.
+	var entries []fuse.DirEntry
+	for ds.HasNext() {
+		e, errno := ds.Next()
+		if errno != 0 {
+			return nil, errno
+		}
+		if e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			p := filepath.Join(n.path(), e.Name)
+			if n.RootData.checkBeneath(p, true) != 0 {
+				continue
+			}
+			var st syscall.Stat_t
+			if err := syscall.Stat(p, &st); err != nil {
+				continue
+			}
+			e.Mode = uint32(st.Mode)
+		}
+		entries = append(entries, e)
+	}
+	return NewListDirStream(entries), OK
 }
 
 func (n *LoopbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -309,13 +579,16 @@ func (n *LoopbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.Attr
 	}
 
 	p := n.path()
+	if errno := n.RootData.checkBeneath(p, n.RootData.FollowSymlinks); errno != 0 {
+		return errno
+	}
 
 	var err error
 	st := syscall.Stat_t{}
 	if &n.Inode == n.Root() {
 		err = syscall.Stat(p, &st)
 	} else {
-		err = syscall.Lstat(p, &st)
+		err = n.RootData.lstat(p, &st)
 	}
 
 	if err != nil {
@@ -329,6 +602,9 @@ var _ = (NodeSetattrer)((*LoopbackNode)(nil))
 
 func (n *LoopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	p := n.path()
+	if errno := n.RootData.checkBeneath(p, true); errno != 0 {
+		return errno
+	}
 	fsa, ok := f.(FileSetattrer)
 	if ok && fsa != nil {
 		fsa.Setattr(ctx, in, out)
@@ -389,7 +665,7 @@ func (n *LoopbackNode) Setattr(ctx context.Context, f FileHandle, in *fuse.SetAt
 		fga.Getattr(ctx, out)
 	} else {
 		st := syscall.Stat_t{}
-		err := syscall.Lstat(p, &st)
+		err := n.RootData.lstat(p, &st)
 		if err != nil {
 			return ToErrno(err)
 		}
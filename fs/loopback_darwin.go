@@ -32,7 +32,15 @@ func (n *LoopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, sysc
 	return 0, syscall.ENOSYS
 }
 
-func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
+func linkTmpfile(target *Inode, path string) syscall.Errno {
+	return syscall.ENOENT
+}
+
+func resolveBeneath(dir, rel string, follow bool) syscall.Errno {
+	return syscall.ENOSYS
+}
+
+func (n *LoopbackNode) renameat2(name string, newparent InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	return syscall.ENOSYS
 }
 
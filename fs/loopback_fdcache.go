@@ -0,0 +1,398 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"container/list"
+	"context"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fdCache bounds the number of backing fds held open by the file
+// handles of a loopback file system. See LoopbackRoot.MaxOpenFds.
+type fdCache struct {
+	max int
+
+	mu sync.Mutex
+	// open counts the fds held by cachedFiles, including the
+	// pinned ones and those in use.
+	open int
+	// lru holds the cachedFiles whose fd may be closed, most
+	// recently used first.
+	lru list.List
+	// files holds the open handles by inode, so they can be
+	// pinned before the backing file is unlinked.
+	files map[*Inode]map[*cachedFile]struct{}
+}
+
+func newFdCache(max int) *fdCache {
+	return &fdCache{
+		max:   max,
+		files: map[*Inode]map[*cachedFile]struct{}{},
+	}
+}
+
+// newFile returns a handle for fd, which was opened on the file of
+// inode with the given flags.
+func (c *fdCache) newFile(root *LoopbackRoot, inode *Inode, fd int, flags int) (*cachedFile, syscall.Errno) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, ToErrno(err)
+	}
+	f := &cachedFile{
+		cache: c,
+		root:  root,
+		inode: inode,
+		flags: flags &^ (syscall.O_CREAT | syscall.O_EXCL | syscall.O_TRUNC),
+		dev:   uint64(st.Dev),
+		ino:   st.Ino,
+		fd:    fd,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files[inode] == nil {
+		c.files[inode] = map[*cachedFile]struct{}{}
+	}
+	c.files[inode][f] = struct{}{}
+	c.open++
+	f.elem = c.lru.PushFront(f)
+	c.evict()
+	return f, OK
+}
+
+// evict closes the least recently used fds until at most max are
+// open, or none can be closed. Must be called with c.mu held.
+func (c *fdCache) evict() {
+	for c.open > c.max {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		f := c.lru.Remove(e).(*cachedFile)
+		f.elem = nil
+
+		var st syscall.Stat_t
+		if err := syscall.Fstat(f.fd, &st); err == nil && st.Nlink == 0 {
+			// The file was unlinked behind our back, so it
+			// cannot be reopened.
+			f.pinned = true
+			continue
+		}
+		syscall.Close(f.fd)
+		f.fd = -1
+		c.open--
+	}
+}
+
+// pin reopens the evicted fds of the handles open on inode, and
+// keeps them open until the handles are released. This must be done
+// before the backing file is unlinked.
+func (c *fdCache) pin(inode *Inode) {
+	if inode == nil {
+		return
+	}
+	c.mu.Lock()
+	var files []*cachedFile
+	for f := range c.files[inode] {
+		files = append(files, f)
+	}
+	c.mu.Unlock()
+
+	for _, f := range files {
+		f.mu.Lock()
+		if !f.released {
+			if _, errno := f.get(); errno == 0 {
+				c.mu.Lock()
+				f.pinned = true
+				c.mu.Unlock()
+				f.put()
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+// cachedFile is a loopback file handle whose fd may be closed when
+// too many are open. It is reopened from the inode's path and the
+// original access mode when needed.
+type cachedFile struct {
+	cache *fdCache
+	root  *LoopbackRoot
+	inode *Inode
+	flags int
+
+	// dev and ino identify the backing file, so we do not
+	// reopen a file that replaced it.
+	dev uint64
+	ino uint64
+
+	// mu serializes the operations on the handle.
+	mu       sync.Mutex
+	released bool
+
+	// fd is -1 if the fd was closed. It, elem, pinned and users
+	// are protected by cache.mu. users counts the callers of get
+	// that did not call put yet.
+	fd     int
+	elem   *list.Element
+	pinned bool
+	users  int
+}
+
+var _ = (FileHandle)((*cachedFile)(nil))
+var _ = (FileReleaser)((*cachedFile)(nil))
+var _ = (FileGetattrer)((*cachedFile)(nil))
+var _ = (FileReader)((*cachedFile)(nil))
+var _ = (FileWriter)((*cachedFile)(nil))
+var _ = (FileGetlker)((*cachedFile)(nil))
+var _ = (FileSetlker)((*cachedFile)(nil))
+var _ = (FileSetlkwer)((*cachedFile)(nil))
+var _ = (FileLseeker)((*cachedFile)(nil))
+var _ = (FileFlusher)((*cachedFile)(nil))
+var _ = (FileFsyncer)((*cachedFile)(nil))
+var _ = (FileSetattrer)((*cachedFile)(nil))
+var _ = (FileAllocater)((*cachedFile)(nil))
+var _ = (FilePassthroughFder)((*cachedFile)(nil))
+var _ = (loopbackFder)((*cachedFile)(nil))
+
+// get returns the fd, reopening the file if it was closed. The fd
+// stays open until put is called. Must be called with f.mu held.
+func (f *cachedFile) get() (int, syscall.Errno) {
+	c := f.cache
+	c.mu.Lock()
+	if f.elem != nil {
+		c.lru.Remove(f.elem)
+		f.elem = nil
+	}
+	if f.fd != -1 {
+		fd := f.fd
+		f.users++
+		c.mu.Unlock()
+		return fd, OK
+	}
+	c.open++
+	c.evict()
+	c.mu.Unlock()
+
+	fd, errno := f.reopen()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if errno != 0 {
+		c.open--
+		return -1, errno
+	}
+	f.fd = fd
+	f.users++
+	return fd, OK
+}
+
+// put makes the fd eligible for closing again, once all users are
+// done with it.
+func (f *cachedFile) put() {
+	c := f.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f.users--
+	if f.users == 0 && !f.pinned && f.fd != -1 {
+		f.elem = c.lru.PushFront(f)
+	}
+	c.evict()
+}
+
+func (f *cachedFile) reopen() (int, syscall.Errno) {
+	p := filepath.Join(f.root.Path, f.inode.Path(f.inode.Root()))
+	if errno := f.root.checkBeneath(p, true); errno != 0 {
+		return -1, errno
+	}
+	fd, err := syscall.Open(p, f.flags, 0)
+	if err != nil {
+		return -1, ToErrno(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return -1, ToErrno(err)
+	}
+	if uint64(st.Dev) != f.dev || st.Ino != f.ino {
+		syscall.Close(fd)
+		return -1, syscall.ESTALE
+	}
+	return fd, OK
+}
+
+// do runs fn on a loopbackFile for the fd.
+func (f *cachedFile) do(fn func(lf *loopbackFile) syscall.Errno) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fd, errno := f.get()
+	if errno != 0 {
+		return errno
+	}
+	defer f.put()
+	return fn(&loopbackFile{fd: fd})
+}
+
+// withFd runs fn with the fd, without serializing it against the
+// other operations on the handle, so CopyFileRange can hold the fds
+// of two handles at once.
+func (f *cachedFile) withFd(fn func(fd int) syscall.Errno) syscall.Errno {
+	f.mu.Lock()
+	fd, errno := f.get()
+	f.mu.Unlock()
+	if errno != 0 {
+		return errno
+	}
+	defer f.put()
+	return fn(fd)
+}
+
+func (f *cachedFile) PassthroughFd() (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fd, errno := f.get()
+	if errno != 0 {
+		return -1, false
+	}
+	// The caller uses the fd after we return, so it must not be
+	// closed under it.
+	f.cache.mu.Lock()
+	f.pinned = true
+	f.cache.mu.Unlock()
+	f.put()
+	return fd, true
+}
+
+func (f *cachedFile) Read(ctx context.Context, buf []byte, off int64) (res fuse.ReadResult, errno syscall.Errno) {
+	// Unlike loopbackFile, read the data now: the fd may be
+	// closed before the result is written to the kernel.
+	var n int
+	errno = f.do(func(lf *loopbackFile) syscall.Errno {
+		var err error
+		n, err = syscall.Pread(lf.fd, buf, off)
+		return ToErrno(err)
+	})
+	if errno != 0 {
+		return nil, errno
+	}
+	return fuse.ReadResultData(buf[:n]), OK
+}
+
+func (f *cachedFile) Write(ctx context.Context, data []byte, off int64) (n uint32, errno syscall.Errno) {
+	errno = f.do(func(lf *loopbackFile) syscall.Errno {
+		n, errno = lf.Write(ctx, data, off)
+		return errno
+	})
+	return n, errno
+}
+
+func (f *cachedFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f.released = true
+	delete(c.files[f.inode], f)
+	if len(c.files[f.inode]) == 0 {
+		delete(c.files, f.inode)
+	}
+	if f.elem != nil {
+		c.lru.Remove(f.elem)
+		f.elem = nil
+	}
+	if f.fd == -1 {
+		return OK
+	}
+	err := syscall.Close(f.fd)
+	f.fd = -1
+	c.open--
+	return ToErrno(err)
+}
+
+func (f *cachedFile) Flush(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	f.cache.mu.Lock()
+	closed := f.fd == -1
+	f.cache.mu.Unlock()
+	f.mu.Unlock()
+	if closed {
+		// Closing the fd flushed it already.
+		return OK
+	}
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		return lf.Flush(ctx)
+	})
+}
+
+func (f *cachedFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		return lf.Fsync(ctx, flags)
+	})
+}
+
+func (f *cachedFile) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		return lf.Getlk(ctx, owner, lk, flags, out)
+	})
+}
+
+func (f *cachedFile) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return f.setLock(ctx, owner, lk, flags)
+}
+
+func (f *cachedFile) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	// Don't hold f.mu while waiting, so the file stays usable.
+	return waitLock(ctx, func() syscall.Errno {
+		return f.setLock(ctx, owner, lk, flags)
+	})
+}
+
+func (f *cachedFile) setLock(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		errno := lf.setLock(ctx, owner, lk, flags)
+		if errno == 0 {
+			// Locks belong to the open file, so closing
+			// it would drop them.
+			f.cache.mu.Lock()
+			f.pinned = true
+			f.cache.mu.Unlock()
+		}
+		return errno
+	})
+}
+
+func (f *cachedFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		return lf.Setattr(ctx, in, out)
+	})
+}
+
+func (f *cachedFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		return lf.Getattr(ctx, out)
+	})
+}
+
+func (f *cachedFile) Lseek(ctx context.Context, off uint64, whence uint32) (n uint64, errno syscall.Errno) {
+	errno = f.do(func(lf *loopbackFile) syscall.Errno {
+		n, errno = lf.Lseek(ctx, off, whence)
+		return errno
+	})
+	return n, errno
+}
+
+func (f *cachedFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	return f.do(func(lf *loopbackFile) syscall.Errno {
+		return lf.Allocate(ctx, off, sz, mode)
+	})
+}
@@ -8,33 +8,116 @@ package fs
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"path/filepath"
 	"syscall"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"golang.org/x/sys/unix"
 )
 
 func (n *LoopbackNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := n.RootData.checkBeneath(n.path(), false); errno != 0 {
+		return 0, errno
+	}
 	sz, err := unix.Lgetxattr(n.path(), attr, dest)
 	return uint32(sz), ToErrno(err)
 }
 
 func (n *LoopbackNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if errno := n.RootData.checkBeneath(n.path(), false); errno != 0 {
+		return errno
+	}
 	err := unix.Lsetxattr(n.path(), attr, data, int(flags))
 	return ToErrno(err)
 }
 
 func (n *LoopbackNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if errno := n.RootData.checkBeneath(n.path(), false); errno != 0 {
+		return errno
+	}
 	err := unix.Lremovexattr(n.path(), attr)
 	return ToErrno(err)
 }
 
 func (n *LoopbackNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := n.RootData.checkBeneath(n.path(), false); errno != 0 {
+		return 0, errno
+	}
 	sz, err := unix.Llistxattr(n.path(), dest)
 	return uint32(sz), ToErrno(err)
 }
 
-func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newName string) syscall.Errno {
+var _ = (NodeTmpfiler)((*LoopbackNode)(nil))
+
+// Tmpfile creates an unnamed file using O_TMPFILE on the backing
+// directory. If the backing file system does not support O_TMPFILE,
+// the resulting EOPNOTSUPP is returned to the caller, which
+// typically falls back to creating and unlinking a named file.
+func (n *LoopbackNode) Tmpfile(ctx context.Context, flags uint32, mode uint32, out *fuse.EntryOut) (inode *Inode, fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	p := n.path()
+	if errno := n.RootData.checkBeneath(p, true); errno != 0 {
+		return nil, nil, 0, errno
+	}
+	flags = flags &^ (syscall.O_APPEND | syscall.O_CREAT)
+	fd, err := syscall.Open(p, int(flags)|unix.O_TMPFILE, applyUmask(ctx, mode))
+	if err != nil {
+		return nil, nil, 0, ToErrno(err)
+	}
+	st := syscall.Stat_t{}
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return nil, nil, 0, ToErrno(err)
+	}
+
+	node := n.RootData.newNode(n.EmbeddedInode(), "", &st)
+	ch := n.NewInode(ctx, node, n.RootData.idFromStat(&st))
+	// The file cannot be reopened, so the fd cache keeps the fd
+	// open, but counts it.
+	lf, errno := n.RootData.newFile(ch, fd, int(flags))
+	if errno != 0 {
+		return nil, nil, 0, errno
+	}
+
+	out.FromStat(&st)
+	return ch, lf, 0, 0
+}
+
+// linkTmpfile gives the unnamed file target a name, using one of its
+// open file handles.
+func linkTmpfile(target *Inode, path string) syscall.Errno {
+	b := target.bridge
+	b.mu.Lock()
+	var entry *fileEntry
+	var lf loopbackFder
+	for _, fh := range target.openFiles {
+		if f, ok := b.files[fh].file.(loopbackFder); ok {
+			entry, lf = b.files[fh], f
+			break
+		}
+	}
+	if entry != nil {
+		// Prevent the file from being closed under us.
+		entry.wg.Add(1)
+		defer entry.wg.Done()
+	}
+	b.mu.Unlock()
+	if entry == nil {
+		return syscall.ENOENT
+	}
+
+	return lf.withFd(func(fd int) syscall.Errno {
+		// Linking with AT_EMPTY_PATH needs CAP_DAC_READ_SEARCH;
+		// going through /proc does not.
+		return ToErrno(unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd),
+			unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW))
+	})
+}
+
+// renameat2 runs renameat2(2) with the given flags on the backing
+// directories of n and newparent.
+func (n *LoopbackNode) renameat2(name string, newparent InodeEmbedder, newName string, flags uint32) syscall.Errno {
 	fd1, err := syscall.Open(n.path(), syscall.O_DIRECTORY, 0)
 	if err != nil {
 		return ToErrno(err)
@@ -42,10 +125,10 @@ func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 	defer syscall.Close(fd1)
 	p2 := filepath.Join(n.RootData.Path, newparent.EmbeddedInode().Path(nil))
 	fd2, err := syscall.Open(p2, syscall.O_DIRECTORY, 0)
-	defer syscall.Close(fd2)
 	if err != nil {
 		return ToErrno(err)
 	}
+	defer syscall.Close(fd2)
 
 	var st syscall.Stat_t
 	if err := syscall.Fstat(fd1, &st); err != nil {
@@ -66,23 +149,99 @@ func (n *LoopbackNode) renameExchange(name string, newparent InodeEmbedder, newN
 		return syscall.EBUSY
 	}
 
-	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, unix.RENAME_EXCHANGE))
+	return ToErrno(unix.Renameat2(fd1, name, fd2, newName, uint(flags)))
 }
 
+// CopyFileRange copies between the backing files using
+// copy_file_range(2), so reflinks and server-side copies of the
+// underlying file system can be used. It may copy fewer bytes than
+// requested. If the backing files live on different file systems, it
+// returns EXDEV, so the kernel falls back to copying the data itself.
 func (n *LoopbackNode) CopyFileRange(ctx context.Context, fhIn FileHandle,
 	offIn uint64, out *Inode, fhOut FileHandle, offOut uint64,
 	len uint64, flags uint64) (uint32, syscall.Errno) {
-	lfIn, ok := fhIn.(*loopbackFile)
+	lfIn, ok := fhIn.(loopbackFder)
 	if !ok {
 		return 0, syscall.ENOTSUP
 	}
-	lfOut, ok := fhOut.(*loopbackFile)
+	lfOut, ok := fhOut.(loopbackFder)
 	if !ok {
 		return 0, syscall.ENOTSUP
 	}
 
-	signedOffIn := int64(offIn)
-	signedOffOut := int64(offOut)
-	count, err := unix.CopyFileRange(lfIn.fd, &signedOffIn, lfOut.fd, &signedOffOut, int(len), int(flags))
-	return uint32(count), ToErrno(err)
+	// The result must fit the 32-bit size in the reply.
+	if len > math.MaxUint32 {
+		len = math.MaxUint32
+	}
+
+	var count int
+	errno := lfIn.withFd(func(fdIn int) syscall.Errno {
+		return lfOut.withFd(func(fdOut int) syscall.Errno {
+			if fdIn != fdOut {
+				var stIn, stOut syscall.Stat_t
+				if err := syscall.Fstat(fdIn, &stIn); err != nil {
+					return ToErrno(err)
+				}
+				if err := syscall.Fstat(fdOut, &stOut); err != nil {
+					return ToErrno(err)
+				}
+				if stIn.Dev != stOut.Dev {
+					return syscall.EXDEV
+				}
+			}
+
+			signedOffIn := int64(offIn)
+			signedOffOut := int64(offOut)
+			n, err := unix.CopyFileRange(fdIn, &signedOffIn, fdOut, &signedOffOut, int(len), int(flags))
+			if err != nil {
+				return ToErrno(err)
+			}
+			count = n
+			return OK
+		})
+	})
+	return uint32(count), errno
+}
+
+var _ = (NodeStatxer)((*LoopbackNode)(nil))
+
+func (n *LoopbackNode) Statx(ctx context.Context, f FileHandle, flags uint32, mask uint32, out *fuse.StatxOut) syscall.Errno {
+	st := unix.Statx_t{}
+	atFlags := int(flags&fuse.AT_STATX_SYNC_TYPE) | unix.AT_SYMLINK_NOFOLLOW
+	if &n.Inode == n.Root() || n.RootData.FollowSymlinks {
+		atFlags &^= unix.AT_SYMLINK_NOFOLLOW
+	}
+	if errno := n.RootData.checkBeneath(n.path(), atFlags&unix.AT_SYMLINK_NOFOLLOW == 0); errno != 0 {
+		return errno
+	}
+	if err := unix.Statx(unix.AT_FDCWD, n.path(), atFlags, int(mask), &st); err != nil {
+		return ToErrno(err)
+	}
+	out.Statx.FromStatx(&st)
+	return OK
+}
+
+// resolveBeneath resolves rel relative to dir with openat2(2) and
+// RESOLVE_BENEATH, which fails with EXDEV if rel leaves dir. It
+// returns ENOSYS if the kernel lacks openat2 (before Linux 5.6).
+func resolveBeneath(dir, rel string, follow bool) syscall.Errno {
+	dirfd, err := syscall.Open(dir, unix.O_PATH|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return ToErrno(err)
+	}
+	defer syscall.Close(dirfd)
+
+	how := unix.OpenHow{
+		Flags:   unix.O_PATH | syscall.O_CLOEXEC,
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	if !follow {
+		how.Flags |= syscall.O_NOFOLLOW
+	}
+	fd, err := unix.Openat2(dirfd, rel, &how)
+	if err != nil {
+		return ToErrno(err)
+	}
+	syscall.Close(fd)
+	return OK
 }
@@ -6,9 +6,16 @@ package fs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"testing"
@@ -121,6 +128,347 @@ func TestRenameNoOverwrite(t *testing.T) {
 	}
 }
 
+// TestLoopbackRenameFlags calls the bridge directly, as the kernel
+// already rejects RENAME_NOREPLACE onto an entry it knows about.
+func TestLoopbackRenameFlags(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	for _, nm := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(dir+"/"+nm, []byte(nm), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	rename := func(old, new string, flags uint32) fuse.Status {
+		in := fuse.RenameIn{Newdir: 1, Flags: flags}
+		in.NodeId = 1
+		return rb.Rename(nil, &in, old, new)
+	}
+
+	if got := rename("a", "b", RENAME_EXCHANGE|RENAME_NOREPLACE); got != fuse.EINVAL {
+		t.Errorf("EXCHANGE|NOREPLACE: got %v, want EINVAL", got)
+	}
+	if got := rename("a", "b", RENAME_NOREPLACE); got != fuse.Status(syscall.EEXIST) {
+		t.Errorf("NOREPLACE onto existing: got %v, want EEXIST", got)
+	}
+	if got := rename("a", "c", RENAME_NOREPLACE); !got.Ok() {
+		t.Fatalf("NOREPLACE: %v", got)
+	}
+	if got := rename("c", "b", RENAME_EXCHANGE); !got.Ok() {
+		t.Fatalf("EXCHANGE: %v", got)
+	}
+	for nm, want := range map[string]string{"b": "a", "c": "b"} {
+		if content, err := ioutil.ReadFile(dir + "/" + nm); err != nil {
+			t.Fatal(err)
+		} else if string(content) != want {
+			t.Errorf("%s: got %q, want %q", nm, content, want)
+		}
+	}
+	if got := rename("b", "nonexistent", RENAME_EXCHANGE); got != fuse.ENOENT {
+		t.Errorf("EXCHANGE with missing target: got %v, want ENOENT", got)
+	}
+}
+
+func TestLoopbackFollowSymlinks(t *testing.T) {
+	tc := newTestCase(t, &testOptions{followSymlinks: true})
+	defer tc.Clean()
+
+	if err := os.Mkdir(tc.origDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	tc.writeOrig("dir/file", "hello", 0644)
+	for target, link := range map[string]string{
+		"dir":         "dirlink",
+		"dir/file":    "filelink",
+		"nonexistent": "dangling",
+	} {
+		if err := os.Symlink(target, tc.origDir+"/"+link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/filelink", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Size != 5 {
+		t.Errorf("filelink: got mode %o size %d, want regular file of 5 bytes", st.Mode, st.Size)
+	}
+	if err := syscall.Lstat(tc.mntDir+"/dirlink", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Errorf("dirlink: got mode %o, want directory", st.Mode)
+	}
+	if content, err := ioutil.ReadFile(tc.mntDir + "/dirlink/file"); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+	if err := syscall.Lstat(tc.mntDir+"/dangling", &st); err != syscall.ENOENT {
+		t.Errorf("dangling: got %v, want ENOENT", err)
+	}
+
+	entries, err := ioutil.ReadDir(tc.mntDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]os.FileMode{}
+	for _, e := range entries {
+		got[e.Name()] = e.Mode().Type()
+	}
+	want := map[string]os.FileMode{
+		"dir":      os.ModeDir,
+		"dirlink":  os.ModeDir,
+		"filelink": 0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Readdir: got %v, want %v", got, want)
+	}
+}
+
+func TestLoopbackRestrictToRoot(t *testing.T) {
+	if _, err := os.Stat("/etc/passwd"); err != nil {
+		t.Skip(err)
+	}
+	tc := newTestCase(t, &testOptions{followSymlinks: true, restrictToRoot: true})
+	defer tc.Clean()
+
+	if err := os.Mkdir(tc.origDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	tc.writeOrig("dir/file", "hello", 0644)
+	for target, link := range map[string]string{
+		"/etc":     "etc",
+		"../..":    "up",
+		"dir/file": "inside",
+		// Outside the root, but not somewhere that hurts if
+		// the check fails.
+		tc.dir + "/outside": "dangling",
+	} {
+		if err := os.Symlink(target, tc.origDir+"/"+link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, nm := range []string{"etc", "etc/passwd", "up"} {
+		if _, err := os.Stat(tc.mntDir + "/" + nm); !os.IsPermission(err) {
+			t.Errorf("%s: got %v, want EACCES", nm, err)
+		}
+	}
+	if err := ioutil.WriteFile(tc.mntDir+"/dangling", []byte("x"), 0644); err == nil {
+		t.Errorf("create through dangling symlink succeeded")
+	}
+	if _, err := os.Stat(tc.dir + "/outside"); !os.IsNotExist(err) {
+		t.Errorf("file outside the root: got %v, want ENOENT", err)
+	}
+	if content, err := ioutil.ReadFile(tc.mntDir + "/inside"); err != nil {
+		t.Errorf("inside: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("inside: got %q, want %q", content, "hello")
+	}
+
+	names, err := ioutil.ReadDir(tc.mntDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range names {
+		if e.Name() == "etc" || e.Name() == "up" {
+			t.Errorf("Readdir lists escaping symlink %q", e.Name())
+		}
+	}
+}
+
+func TestEvalBeneath(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	root := dir + "/root"
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for target, link := range map[string]string{
+		dir:              root + "/out",
+		".":              root + "/self",
+		dir + "/missing": root + "/dangling",
+		"loop":           root + "/loop",
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		p      string
+		follow bool
+		want   syscall.Errno
+	}{
+		{"self", true, OK},
+		{"out", false, OK},
+		{"out", true, syscall.EXDEV},
+		{"out/x", false, syscall.EXDEV},
+		{"dangling", false, OK},
+		{"dangling", true, syscall.EXDEV},
+		{"new", true, OK},
+		{"missing/new", false, syscall.ENOENT},
+		// Errors other than ENOENT fail closed.
+		{"loop", true, syscall.EXDEV},
+	} {
+		if got := evalBeneath(root, root+"/"+c.p, c.follow); got != c.want {
+			t.Errorf("evalBeneath(%q, %v): got %v, want %v", c.p, c.follow, got, c.want)
+		}
+	}
+	if got := evalBeneath(dir+"/missing", dir+"/missing/x", false); got != syscall.EXDEV {
+		t.Errorf("evalBeneath with missing root: got %v, want EXDEV", got)
+	}
+}
+
+// TestLoopbackRestrictToRootSwap replaces a directory that the kernel
+// has cached with a symlink out of the tree.
+func TestLoopbackRestrictToRootSwap(t *testing.T) {
+	if _, err := os.Stat("/etc/passwd"); err != nil {
+		t.Skip(err)
+	}
+	tc := newTestCase(t, &testOptions{entryCache: true, attrCache: true, restrictToRoot: true})
+	defer tc.Clean()
+
+	if err := os.Mkdir(tc.origDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tc.mntDir + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tc.origDir + "/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", tc.origDir+"/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ioutil.ReadFile(tc.mntDir + "/dir/passwd"); !os.IsPermission(err) {
+		t.Errorf("got %v, want EACCES", err)
+	}
+	if _, err := ioutil.ReadDir(tc.mntDir + "/dir"); !os.IsPermission(err) {
+		t.Errorf("Readdir: got %v, want EACCES", err)
+	}
+}
+
+// countFds counts the fds of the process for files in dir; the
+// server itself may keep pipes open.
+func countFds(t *testing.T, dir string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, fd := range fds {
+		target, err := os.Readlink("/proc/self/fd/" + fd.Name())
+		if err == nil && strings.HasPrefix(target, dir+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLoopbackReleaseNoFdLeak(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unmounted := make(chan struct{})
+	mntDir, _, clean := testMount(t, root, &Options{
+		// Handle requests in goroutines, which Serve does
+		// not wait for.
+		MountOptions: fuse.MountOptions{MaxConcurrency: 4},
+		OnUnmount:    func() { close(unmounted) },
+	})
+	for i := 0; i < 100; i++ {
+		if _, err := ioutil.ReadFile(mntDir + "/file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadDir(mntDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clean()
+
+	// OnUnmount runs after all handles were released.
+	<-unmounted
+	if n := countFds(t, dir); n != 0 {
+		t.Errorf("got %d open fds in %s after unmount, want 0", n, dir)
+	}
+}
+
+func TestLoopbackMaxOpenFds(t *testing.T) {
+	const max = 4
+	tc := newTestCase(t, &testOptions{maxOpenFds: max})
+	defer tc.Clean()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i := 0; i < 3*max; i++ {
+		name := fmt.Sprintf("file%d", i)
+		tc.writeOrig(name, name, 0644)
+		f, err := os.OpenFile(tc.mntDir+"/"+name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	// This one must survive eviction, as it cannot be reopened.
+	unlinked, err := os.Create(tc.mntDir + "/unlinked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, unlinked)
+	if _, err := unlinked.WriteString("unlinked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(tc.mntDir + "/unlinked"); err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 2; round++ {
+		for i, f := range files {
+			want := fmt.Sprintf("file%d", i)
+			if f == unlinked {
+				want = "unlinked"
+			}
+			buf := make([]byte, 100)
+			n, err := f.ReadAt(buf, 0)
+			if err != io.EOF {
+				t.Fatalf("ReadAt %s: %v", want, err)
+			}
+			if got := string(buf[:n]); got != want {
+				t.Errorf("ReadAt: got %q, want %q", got, want)
+			}
+			if n := countFds(t, tc.origDir); n > max {
+				t.Fatalf("got %d backing fds, want at most %d", n, max)
+			}
+		}
+	}
+
+	if _, err := files[0].WriteAt([]byte("FILE"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(tc.origDir + "/file0"); err != nil || string(got) != "FILE0" {
+		t.Errorf("ReadFile: got %q, %v, want 'FILE0'", got, err)
+	}
+}
+
 func TestXAttr(t *testing.T) {
 	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
 	defer tc.Clean()
@@ -202,7 +550,15 @@ func TestXAttrSymlink(t *testing.T) {
 }
 
 func TestCopyFileRange(t *testing.T) {
-	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	testCopyFileRange(t, &testOptions{attrCache: true, entryCache: true})
+}
+
+func TestCopyFileRangeMaxOpenFds(t *testing.T) {
+	testCopyFileRange(t, &testOptions{attrCache: true, entryCache: true, maxOpenFds: 1})
+}
+
+func testCopyFileRange(t *testing.T, opts *testOptions) {
+	tc := newTestCase(t, opts)
 	defer tc.Clean()
 
 	if !tc.server.KernelSettings().SupportsVersion(7, 28) {
@@ -264,6 +620,135 @@ func TestCopyFileRange(t *testing.T) {
 
 }
 
+func TestCopyFileRangeCrossDevice(t *testing.T) {
+	dirs := []string{os.TempDir(), "/dev/shm"}
+	var fhs []FileHandle
+	var devs []uint64
+	for _, d := range dirs {
+		dir, err := ioutil.TempDir(d, "TestCopyFileRangeCrossDevice")
+		if err != nil {
+			t.Skipf("TempDir(%q): %v", d, err)
+		}
+		defer os.RemoveAll(dir)
+		fd := mustOpen(t, dir+"/file", os.O_RDWR|os.O_CREATE)
+		if _, err := syscall.Write(fd, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			t.Fatal(err)
+		}
+		fh := NewLoopbackFile(fd)
+		defer fh.(FileReleaser).Release(context.Background())
+		fhs = append(fhs, fh)
+		devs = append(devs, uint64(st.Dev))
+	}
+	if devs[0] == devs[1] {
+		t.Skipf("%v are on the same device", dirs)
+	}
+
+	n := &LoopbackNode{}
+	if _, errno := n.CopyFileRange(context.Background(), fhs[0], 0, nil, fhs[1], 0, 5, 0); errno != syscall.EXDEV {
+		t.Errorf("across devices: got %v, want EXDEV", errno)
+	}
+	if count, errno := n.CopyFileRange(context.Background(), fhs[0], 0, nil, fhs[0], 5, 5, 0); errno != 0 || count != 5 {
+		t.Errorf("within a file: got %d, %v, want 5, OK", count, errno)
+	}
+}
+
+func TestCopyFileRangeSparse(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	if !tc.server.KernelSettings().SupportsVersion(7, 28) {
+		t.Skip("need v7.28 for CopyFileRange")
+	}
+
+	const blk = 64 << 10
+	const size = 4 * blk
+	orig, err := os.Create(tc.origDir + "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("x"), blk)
+	if _, err := orig.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orig.WriteAt(data, 2*blk); err != nil {
+		t.Fatal(err)
+	}
+	if err := orig.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	orig.Close()
+
+	if off, err := seekFile(tc.origDir+"/src", blk, _SEEK_DATA); err != nil || off != 2*blk {
+		t.Skipf("backing file system does not support holes: %d, %v", off, err)
+	}
+
+	src := mustOpen(t, tc.mntDir+"/src", os.O_RDONLY)
+	defer syscall.Close(src)
+	dst := mustOpen(t, tc.mntDir+"/dst", os.O_RDWR|os.O_CREATE)
+	defer syscall.Close(dst)
+	if err := syscall.Ftruncate(dst, size); err != nil {
+		t.Fatalf("Ftruncate: %v", err)
+	}
+
+	// Copy the data segments only, like cp --sparse does.
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(src, off, _SEEK_DATA)
+		if err == syscall.ENXIO {
+			break
+		} else if err != nil {
+			t.Fatalf("SEEK_DATA: %v", err)
+		}
+		end, err := unix.Seek(src, start, _SEEK_HOLE)
+		if err != nil {
+			t.Fatalf("SEEK_HOLE: %v", err)
+		}
+		for start < end {
+			inOff, outOff := start, start
+			n, err := unix.CopyFileRange(src, &inOff, dst, &outOff, int(end-start), 0)
+			if err != nil || n == 0 {
+				t.Fatalf("CopyFileRange: %d, %v", n, err)
+			}
+			start += int64(n)
+		}
+		off = end
+	}
+
+	got, err := ioutil.ReadFile(tc.origDir + "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ioutil.ReadFile(tc.origDir + "/src")
+	if !bytes.Equal(got, want) {
+		t.Errorf("content mismatch")
+	}
+
+	if off, err := seekFile(tc.origDir+"/dst", 0, _SEEK_HOLE); err != nil || off != blk {
+		t.Errorf("SEEK_HOLE on copy: got %d, %v, want %d", off, err, blk)
+	}
+}
+
+func seekFile(name string, off int64, whence int) (int64, error) {
+	fd, err := syscall.Open(name, syscall.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	return unix.Seek(fd, off, whence)
+}
+
+func mustOpen(t *testing.T, name string, flags int) int {
+	t.Helper()
+	fd, err := syscall.Open(name, flags, 0644)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	return fd
+}
+
 // Wait for a change in /proc/self/mounts. Efficient through the use of
 // unix.Poll().
 func waitProcMountsChange() error {
@@ -401,3 +886,724 @@ func TestRoMount(t *testing.T) {
 	tc := newTestCase(t, &testOptions{ro: true})
 	defer tc.Clean()
 }
+
+func TestStatx(t *testing.T) {
+	tc := newTestCase(t, &testOptions{statx: true})
+	defer tc.Clean()
+
+	tc.writeOrig("file", "hello", 0644)
+
+	var orig unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, tc.origDir+"/file", 0, unix.STATX_ALL, &orig); err != nil {
+		t.Skipf("Statx: %v", err)
+	}
+
+	var st unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, tc.mntDir+"/file", fuse.AT_STATX_FORCE_SYNC, unix.STATX_ALL, &st); err != nil {
+		t.Fatalf("Statx: %v", err)
+	}
+	if st.Size != 5 {
+		t.Errorf("got size %d, want 5", st.Size)
+	}
+	if orig.Mask&unix.STATX_BTIME != 0 {
+		if st.Mask&unix.STATX_BTIME == 0 {
+			t.Errorf("STATX_BTIME missing from mask %x", st.Mask)
+		} else if st.Btime != orig.Btime {
+			t.Errorf("got btime %v, want %v", st.Btime, orig.Btime)
+		}
+	}
+}
+
+type statxFallbackNode struct {
+	Inode
+}
+
+func (n *statxFallbackNode) Getattr(ctx context.Context, f FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Size = 42
+	out.Mode = 0644
+	return 0
+}
+
+func TestStatxFallback(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnableStatx: true},
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &statxFallbackNode{}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	})
+	defer clean()
+
+	var st unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, mntDir+"/file", fuse.AT_STATX_FORCE_SYNC, unix.STATX_ALL, &st); err != nil {
+		t.Fatalf("Statx: %v", err)
+	}
+	if st.Size != 42 {
+		t.Errorf("got size %d, want 42", st.Size)
+	}
+	if st.Mask&unix.STATX_BTIME != 0 {
+		t.Errorf("fallback reported STATX_BTIME in mask %x", st.Mask)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	tc := newTestCase(t, &testOptions{passthrough: true})
+	defer tc.Clean()
+
+	want := bytes.Repeat([]byte("hello"), 1000)
+	fn := tc.mntDir + "/file"
+	if err := ioutil.WriteFile(fn, want, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if got, err := ioutil.ReadFile(fn); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+	if got, err := ioutil.ReadFile(tc.origDir + "/file"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if !bytes.Equal(got, want) {
+		t.Errorf("backing file: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestTmpfile(t *testing.T) {
+	testTmpfile(t, &testOptions{attrCache: true, entryCache: true})
+}
+
+func TestTmpfileMaxOpenFds(t *testing.T) {
+	testTmpfile(t, &testOptions{attrCache: true, entryCache: true, maxOpenFds: 1})
+}
+
+func testTmpfile(t *testing.T, opts *testOptions) {
+	tc := newTestCase(t, opts)
+	defer tc.Clean()
+
+	fd, err := syscall.Open(tc.mntDir, unix.O_TMPFILE|syscall.O_RDWR, 0644)
+	if err == syscall.EOPNOTSUPP {
+		t.Skip("O_TMPFILE not supported")
+	} else if err != nil {
+		t.Fatalf("Open(O_TMPFILE): %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if names, err := ioutil.ReadDir(tc.origDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	} else if len(names) != 0 {
+		t.Errorf("tmpfile is visible: %v", names)
+	}
+
+	want := []byte("hello")
+	if _, err := syscall.Write(fd, want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd),
+		unix.AT_FDCWD, tc.mntDir+"/file", unix.AT_SYMLINK_FOLLOW); err != nil {
+		t.Fatalf("Linkat: %v", err)
+	}
+
+	for _, fn := range []string{tc.mntDir + "/file", tc.origDir + "/file"} {
+		if got, err := ioutil.ReadFile(fn); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", fn, got, want)
+		}
+	}
+}
+
+// TestTmpfileLinkState checks that only an unlinked node from Tmpfile
+// is linked through its file handle.
+func TestTmpfileLinkState(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := NewNodeFS(root, &Options{}).(*rawBridge)
+
+	in := fuse.CreateIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDWR, Mode: 0644}
+	var out fuse.CreateOut
+	if st := rb.Tmpfile(nil, &in, &out); st == fuse.Status(syscall.EOPNOTSUPP) {
+		t.Skip("O_TMPFILE not supported")
+	} else if !st.Ok() {
+		t.Fatalf("Tmpfile: %v", st)
+	}
+	n, _ := rb.inode(out.NodeId, 0)
+	if !n.tmpfile {
+		t.Fatal("Tmpfile node is not marked")
+	}
+
+	for _, name := range []string{"a", "b"} {
+		link := fuse.LinkIn{InHeader: fuse.InHeader{NodeId: 1}, Oldnodeid: out.NodeId}
+		if st := rb.Link(nil, &link, name, &fuse.EntryOut{}); !st.Ok() {
+			t.Fatalf("Link(%q): %v", name, st)
+		}
+		if n.tmpfile {
+			t.Errorf("after Link(%q): node is still marked", name)
+		}
+		if _, err := os.Stat(dir + "/" + name); err != nil {
+			t.Errorf("Stat(%q): %v", name, err)
+		}
+	}
+
+	// An unlinked named file is not a tmpfile.
+	if st := rb.Unlink(nil, &fuse.InHeader{NodeId: 1}, "a"); !st.Ok() {
+		t.Fatalf("Unlink: %v", st)
+	}
+	if st := rb.Unlink(nil, &fuse.InHeader{NodeId: 1}, "b"); !st.Ok() {
+		t.Fatalf("Unlink: %v", st)
+	}
+	if n.tmpfile {
+		t.Error("unlinked node is marked")
+	}
+	rb.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: out.NodeId}, Fh: out.Fh})
+}
+
+// xattrNode keeps extended attributes in memory.
+type xattrNode struct {
+	MemRegularFile
+
+	mu    sync.Mutex
+	attrs map[string][]byte
+}
+
+func (n *xattrNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	v, ok := n.attrs[attr]
+	if !ok {
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
+	}
+	return uint32(copy(dest, v)), OK
+}
+
+func (n *xattrNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.attrs[attr] = append([]byte{}, data...)
+	return OK
+}
+
+func (n *xattrNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.attrs[attr]; !ok {
+		return syscall.ENODATA
+	}
+	delete(n.attrs, attr)
+	return OK
+}
+
+func (n *xattrNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var names []byte
+	for k := range n.attrs {
+		names = append(names, k...)
+		names = append(names, 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), OK
+}
+
+func TestXAttrNamespaceFilter(t *testing.T) {
+	root := &Inode{}
+	node := &xattrNode{attrs: map[string][]byte{
+		"user.visible":     []byte("yes"),
+		"security.selinux": []byte("system_u:object_r:tmp_t"),
+		"system.hidden":    []byte("no"),
+	}}
+	mntDir, _, clean := testMount(t, root, &Options{
+		XAttrNamespaceFilter: func(name string) bool {
+			return strings.HasPrefix(name, "user.")
+		},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	defer clean()
+	fn := mntDir + "/file"
+
+	sz, err := syscall.Listxattr(fn, nil)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	if want := len("user.visible\x00"); sz != want {
+		t.Errorf("Listxattr size: got %d, want %d", sz, want)
+	}
+	buf := make([]byte, 1024)
+	sz, err = syscall.Listxattr(fn, buf)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+	if got, want := string(buf[:sz]), "user.visible\x00"; got != want {
+		t.Errorf("Listxattr: got %q, want %q", got, want)
+	}
+
+	if _, err := syscall.Getxattr(fn, "security.selinux", buf); err != syscall.ENODATA {
+		t.Errorf("Getxattr(security.selinux): got %v, want ENODATA", err)
+	}
+	if sz, err := syscall.Getxattr(fn, "user.visible", buf); err != nil || string(buf[:sz]) != "yes" {
+		t.Errorf("Getxattr(user.visible): got %q, %v", buf[:sz], err)
+	}
+	if err := syscall.Setxattr(fn, "system.other", []byte("x"), 0); err == nil {
+		t.Errorf("Setxattr(system.other) succeeded")
+	}
+	if err := syscall.Removexattr(fn, "system.hidden"); err != syscall.ENODATA {
+		t.Errorf("Removexattr(system.hidden): got %v, want ENODATA", err)
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if _, ok := node.attrs["system.hidden"]; !ok || len(node.attrs) != 3 {
+		t.Errorf("filtered calls reached the node: %v", node.attrs)
+	}
+}
+
+func TestLoopbackPunchHole(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+
+	content := bytes.Repeat([]byte("x"), 3*4096)
+	tc.writeOrig("file", string(content), 0644)
+	f, err := os.OpenFile(tc.mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := syscall.Fallocate(int(f.Fd()), _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, 4096, 4096); err != nil {
+		if err == syscall.EOPNOTSUPP {
+			t.Skip("backing file system does not support punching holes")
+		}
+		t.Fatalf("punch hole: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(tc.mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(content[4096:], make([]byte, 4096))
+	if !bytes.Equal(got, content) {
+		t.Errorf("content mismatch after punching a hole")
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(tc.origDir+"/file", &st); err != nil {
+		t.Fatal(err)
+	} else if st.Size != 3*4096 {
+		t.Errorf("got size %d, want %d", st.Size, 3*4096)
+	}
+}
+
+func TestLoopbackSeekDataHole(t *testing.T) {
+	tc := newTestCase(t, &testOptions{attrCache: true, entryCache: true})
+	defer tc.Clean()
+
+	const blk = 64 << 10
+	orig, err := os.Create(tc.origDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orig.WriteAt(bytes.Repeat([]byte("x"), blk), 2*blk); err != nil {
+		t.Fatal(err)
+	}
+	if err := orig.Truncate(4 * blk); err != nil {
+		t.Fatal(err)
+	}
+	orig.Close()
+	if off, err := seekFile(tc.origDir+"/file", 0, _SEEK_DATA); err != nil || off != 2*blk {
+		t.Skipf("backing file system does not support holes: %d, %v", off, err)
+	}
+
+	fd := mustOpen(t, tc.mntDir+"/file", os.O_RDONLY)
+	defer syscall.Close(fd)
+	if off, err := unix.Seek(fd, 0, _SEEK_DATA); err != nil || off != 2*blk {
+		t.Errorf("SEEK_DATA: got %d, %v, want %d", off, err, 2*blk)
+	}
+	if off, err := unix.Seek(fd, 2*blk, _SEEK_HOLE); err != nil || off != 3*blk {
+		t.Errorf("SEEK_HOLE: got %d, %v, want %d", off, err, 3*blk)
+	}
+	if off, err := unix.Seek(fd, 3*blk, _SEEK_DATA); err != syscall.ENXIO {
+		t.Errorf("SEEK_DATA in trailing hole: got %d, %v, want ENXIO", off, err)
+	}
+	if off, err := unix.Seek(fd, 5*blk, _SEEK_HOLE); err != syscall.ENXIO {
+		t.Errorf("SEEK_HOLE beyond EOF: got %d, %v, want ENXIO", off, err)
+	}
+}
+
+func TestLoopbackSetlkwInterrupt(t *testing.T) {
+	flock, err := exec.LookPath("flock")
+	if err != nil {
+		t.Skip("flock command not found.")
+	}
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mntDir, _, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnableLocks: true},
+	})
+	defer clean()
+
+	f1, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatalf("Flock: %v", err)
+	}
+
+	f2, err := os.OpenFile(mntDir+"/file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+
+	// flock --wait interrupts its blocking flock(2) with SIGALRM.
+	// The server must answer the interrupted SETLKW with EINTR, or
+	// flock hangs until the lock is released.
+	cmd := exec.Command(flock, "--exclusive", "--wait", "0.2", "3")
+	cmd.ExtraFiles = []*os.File{f2}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Run() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("flock succeeded while the file was locked")
+		}
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("flock was not interrupted")
+	}
+
+	// The abandoned wait must not take the lock later.
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatalf("Flock LOCK_UN: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("Flock after interrupted wait: %v", err)
+	}
+}
+
+func TestLoopbackFileSetlkwCancel(t *testing.T) {
+	fn := testutil.TempDir() + "/file"
+	defer os.RemoveAll(filepath.Dir(fn))
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	open := func() FileHandle {
+		fd, err := syscall.Open(fn, syscall.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewLoopbackFile(fd)
+	}
+	f1 := open()
+	defer f1.(FileReleaser).Release(context.Background())
+	f2 := open()
+	defer f2.(FileReleaser).Release(context.Background())
+
+	for _, flags := range []uint32{0, fuse.FUSE_LK_FLOCK} {
+		lk := fuse.FileLock{Typ: syscall.F_WRLCK, End: 1<<63 - 1}
+		if errno := f1.(FileSetlker).Setlk(context.Background(), 1, &lk, flags); errno != 0 {
+			t.Fatalf("flags %x: Setlk: %v", flags, errno)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		errno := f2.(FileSetlkwer).Setlkw(ctx, 2, &lk, flags)
+		cancel()
+		if errno != syscall.EINTR {
+			t.Errorf("flags %x: Setlkw: got %v, want EINTR", flags, errno)
+		}
+
+		unlk := fuse.FileLock{Typ: syscall.F_UNLCK, End: 1<<63 - 1}
+		if errno := f1.(FileSetlker).Setlk(context.Background(), 1, &unlk, flags); errno != 0 {
+			t.Fatalf("flags %x: unlock: %v", flags, errno)
+		}
+		if errno := f2.(FileSetlkwer).Setlkw(context.Background(), 2, &lk, flags); errno != 0 {
+			t.Errorf("flags %x: Setlkw after unlock: %v", flags, errno)
+		}
+		if errno := f2.(FileSetlker).Setlk(context.Background(), 2, &unlk, flags); errno != 0 {
+			t.Fatalf("flags %x: unlock f2: %v", flags, errno)
+		}
+	}
+}
+
+func TestXAttrLarge(t *testing.T) {
+	root := &Inode{}
+	node := &xattrNode{attrs: map[string][]byte{}}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	defer clean()
+	fn := mntDir + "/file"
+
+	value := bytes.Repeat([]byte("0123456789"), 3000)
+	if err := syscall.Setxattr(fn, "user.large", value, 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+
+	// Probe the size first, as getxattr(3) callers do.
+	sz, err := syscall.Getxattr(fn, "user.large", nil)
+	if err != nil || sz != len(value) {
+		t.Fatalf("Getxattr probe: got %d, %v, want %d", sz, err, len(value))
+	}
+	if _, err := syscall.Getxattr(fn, "user.large", make([]byte, sz-1)); err != syscall.ERANGE {
+		t.Errorf("Getxattr short buffer: got %v, want ERANGE", err)
+	}
+	buf := make([]byte, sz)
+	if n, err := syscall.Getxattr(fn, "user.large", buf); err != nil || !bytes.Equal(buf[:n], value) {
+		t.Errorf("Getxattr: got %d bytes, %v", n, err)
+	}
+
+	sz, err = syscall.Listxattr(fn, nil)
+	if err != nil || sz != len("user.large\x00") {
+		t.Fatalf("Listxattr probe: got %d, %v", sz, err)
+	}
+	if _, err := syscall.Listxattr(fn, make([]byte, sz-1)); err != syscall.ERANGE {
+		t.Errorf("Listxattr short buffer: got %v, want ERANGE", err)
+	}
+}
+
+func TestXAttrNamespaceFilterOverlay(t *testing.T) {
+	node := &xattrNode{attrs: map[string][]byte{
+		"trusted.overlay.origin": []byte("o"),
+		"trusted.other":          []byte("x"),
+	}}
+	opts := &Options{
+		XAttrNamespaceFilter: func(name string) bool { return false },
+	}
+	hdr := fuse.InHeader{NodeId: 1}
+	in := &fuse.SetXAttrIn{InHeader: hdr, Size: 1}
+
+	// The filter applies to overlayfs attributes too, unless
+	// they are asked for.
+	rb := NewNodeFS(node, opts).(*rawBridge)
+	if st := rb.SetXAttr(nil, in, "trusted.overlay.opaque", []byte("y")); st != fuse.ENOTSUP {
+		t.Errorf("SetXAttr without OverlayXAttrs: got %v, want ENOTSUP", st)
+	}
+
+	opts.OverlayXAttrs = true
+	rb = NewNodeFS(node, opts).(*rawBridge)
+	if st := rb.SetXAttr(nil, in, "trusted.overlay.opaque", []byte("y")); !st.Ok() {
+		t.Errorf("SetXAttr: %v", st)
+	}
+	buf := make([]byte, 100)
+	if n, st := rb.GetXAttr(nil, &hdr, "trusted.overlay.opaque", buf); !st.Ok() || string(buf[:n]) != "y" {
+		t.Errorf("GetXAttr: got %q, %v", buf[:n], st)
+	}
+	if _, st := rb.GetXAttr(nil, &hdr, "trusted.other", buf); st.Ok() {
+		t.Errorf("GetXAttr(trusted.other) succeeded")
+	}
+	n, st := rb.ListXAttr(nil, &hdr, buf)
+	if !st.Ok() {
+		t.Fatalf("ListXAttr: %v", st)
+	}
+	names := strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+	sort.Strings(names)
+	if want := []string{"trusted.overlay.opaque", "trusted.overlay.origin"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListXAttr: got %q, want %q", names, want)
+	}
+}
+
+// TestOverlayLower uses the mount as the lower layer of overlayfs,
+// which needs whiteouts and the trusted.overlay.* attributes.
+func TestOverlayLower(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("must run test as root")
+	}
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+
+	if err := syscall.Mknod(tc.mntDir+"/gone", syscall.S_IFCHR, 0); err != nil {
+		t.Fatalf("Mknod whiteout: %v", err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(tc.mntDir+"/gone", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 0 {
+		t.Errorf("whiteout: got mode %o, rdev %d", st.Mode, st.Rdev)
+	}
+	if err := os.Mkdir(tc.mntDir+"/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(tc.mntDir+"/dir", "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	buf := make([]byte, 10)
+	if n, err := syscall.Getxattr(tc.mntDir+"/dir", "trusted.overlay.opaque", buf); err != nil || string(buf[:n]) != "y" {
+		t.Errorf("Getxattr: got %q, %v", buf[:n], err)
+	}
+	tc.writeOrig("file", "hello", 0644)
+
+	merged := tc.dir + "/merged"
+	for _, d := range []string{"upper", "work", "merged"} {
+		if err := os.Mkdir(tc.dir+"/"+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s/upper,workdir=%s/work", tc.mntDir, tc.dir, tc.dir)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		t.Skipf("mount overlay: %v", err)
+	}
+	defer syscall.Unmount(merged, 0)
+
+	if _, err := os.Lstat(merged + "/gone"); !os.IsNotExist(err) {
+		t.Errorf("whiteout is visible in overlay: %v", err)
+	}
+	if err := ioutil.WriteFile(merged+"/new", []byte("x"), 0644); err != nil {
+		t.Errorf("create in overlay: %v", err)
+	}
+	if err := os.Remove(merged + "/file"); err != nil {
+		t.Errorf("remove lower file in overlay: %v", err)
+	}
+	if _, err := os.Lstat(merged + "/file"); !os.IsNotExist(err) {
+		t.Errorf("removed file still visible: %v", err)
+	}
+	if _, err := os.Lstat(tc.mntDir + "/file"); err != nil {
+		t.Errorf("lower file changed: %v", err)
+	}
+}
+
+func TestFstatUnlinked(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+	tc.writeOrig("file", "hello", 0644)
+
+	f, err := os.Open(tc.mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := os.Remove(tc.mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("fstat: %v", err)
+	}
+	if fi.Size() != 5 {
+		t.Errorf("got size %d, want 5", fi.Size())
+	}
+}
+
+// TestLoopbackEdgeErrnos checks that edge cases return the same
+// errors through the mount as on the underlying file system.
+func TestLoopbackEdgeErrnos(t *testing.T) {
+	tc := newTestCase(t, &testOptions{})
+	defer tc.Clean()
+	if err := ioutil.WriteFile(tc.origDir+"/file", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	withFile := func(flags int, f func(fd int) error) func(dir string) error {
+		return func(dir string) error {
+			fd, err := syscall.Open(dir+"/file", flags, 0)
+			if err != nil {
+				return err
+			}
+			defer syscall.Close(fd)
+			return f(fd)
+		}
+	}
+	cases := []struct {
+		name string
+		f    func(dir string) error
+	}{
+		{"read wronly", withFile(syscall.O_WRONLY, func(fd int) error {
+			_, err := syscall.Pread(fd, make([]byte, 10), 0)
+			return err
+		})},
+		{"write rdonly", withFile(syscall.O_RDONLY, func(fd int) error {
+			_, err := syscall.Pwrite(fd, []byte("abc"), 0)
+			return err
+		})},
+		{"write past RLIMIT_FSIZE", withFile(syscall.O_RDWR, func(fd int) error {
+			var old syscall.Rlimit
+			if err := syscall.Getrlimit(unix.RLIMIT_FSIZE, &old); err != nil {
+				return err
+			}
+			lim := syscall.Rlimit{Cur: 1 << 20, Max: old.Max}
+			if err := syscall.Setrlimit(unix.RLIMIT_FSIZE, &lim); err != nil {
+				return err
+			}
+			// The Go runtime ignores SIGXFSZ.
+			_, err := syscall.Pwrite(fd, []byte("abc"), 2<<20)
+			syscall.Setrlimit(unix.RLIMIT_FSIZE, &old)
+			return err
+		})},
+		{"fallocate dir", func(dir string) error {
+			fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+			if err != nil {
+				return err
+			}
+			defer syscall.Close(fd)
+			return syscall.Fallocate(fd, 0, 0, 10)
+		}},
+	}
+	for _, c := range cases {
+		want := c.f(tc.origDir)
+		if want == nil {
+			t.Errorf("%s: succeeded natively", c.name)
+		}
+		if got := c.f(tc.mntDir); got != want {
+			t.Errorf("%s: got %v, want %v", c.name, got, want)
+		}
+	}
+}
+
+func TestCopyFileRangeCachedFile(t *testing.T) {
+	dir := testutil.TempDir()
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(dir+"/src", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/dst", []byte("abcdefghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	root := &LoopbackRoot{Path: dir, MaxOpenFds: 2}
+	var fhs []FileHandle
+	for _, nm := range []string{"src", "dst"} {
+		fd, err := syscall.Open(dir+"/"+nm, syscall.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fh, errno := root.newFile(&Inode{}, fd, syscall.O_RDWR)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		if _, ok := fh.(*cachedFile); !ok {
+			t.Fatalf("got handle %T, want *cachedFile", fh)
+		}
+		defer fh.(FileReleaser).Release(context.Background())
+		fhs = append(fhs, fh)
+	}
+
+	n := &LoopbackNode{RootData: root}
+	if sz, errno := n.CopyFileRange(context.Background(), fhs[0], 2, nil, fhs[1], 4, 3, 0); errno != 0 || sz != 3 {
+		t.Fatalf("CopyFileRange: %d, %v", sz, errno)
+	}
+	if got, err := ioutil.ReadFile(dir + "/dst"); err != nil || string(got) != "abcd234hij" {
+		t.Errorf("got %q, %v, want %q", got, err, "abcd234hij")
+	}
+}
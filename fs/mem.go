@@ -20,6 +20,73 @@ type MemRegularFile struct {
 	mu   sync.Mutex
 	Data []byte
 	Attr fuse.Attr
+
+	// If TrackDirty is set, the byte ranges modified by Write are
+	// recorded, and can be retrieved with DirtyRanges. They are
+	// cleared on Fsync, and on Flush of a file handle that wrote
+	// to the file. Embedders that want to write back changes
+	// should override those and call TakeDirtyRanges, which
+	// returns and clears the ranges in one step, instead of
+	// calling into MemRegularFile.
+	TrackDirty bool
+	dirty      []DirtyRange
+
+	// Snapshot selects whether opens for reading see the live
+	// content, or a snapshot taken at open time. Snapshots are
+	// served with direct I/O (FOPEN_DIRECT_IO), as the kernel
+	// page cache is shared by all opens of the file. As a
+	// consequence, the kernel refuses mmap(2) with MAP_SHARED
+	// of a snapshot handle with ENODEV; MAP_PRIVATE works.
+	// Getattr always reports the live size, as the kernel caches
+	// attributes per inode; readers of a snapshot see its length
+	// through short reads. If Snapshot is set, Data must not be
+	// changed in place by the embedder; assign a new slice
+	// instead.
+	Snapshot SnapshotMode
+	// shared is set if snapshot handles refer to Data.
+	shared bool
+}
+
+// SnapshotMode selects how a MemRegularFile serves opens for reading.
+type SnapshotMode int
+
+const (
+	// SnapshotNone serves the live content to all opens.
+	SnapshotNone SnapshotMode = iota
+
+	// SnapshotCopyOnOpen copies Data on each open for reading.
+	// Each open file holds its own copy, even if the file is
+	// never changed, so memory use grows with the number of
+	// concurrent opens times the file size.
+	SnapshotCopyOnOpen
+
+	// SnapshotCopyOnWrite shares Data with the opens for
+	// reading, and copies it on the first change after an open.
+	// Opens are cheap, and there is one copy per generation of
+	// content that is still open, rather than per open. A change
+	// copies the whole file, though, so many small writes
+	// interleaved with opens are costly.
+	SnapshotCopyOnWrite
+)
+
+// memSnapshot is the handle of an open with a snapshot of the
+// content of a MemRegularFile.
+type memSnapshot struct {
+	data []byte
+}
+
+// memWriter is the handle of an open for writing of a MemRegularFile
+// with TrackDirty set.
+type memWriter struct {
+	// wrote is set by Write. Protected by MemRegularFile.mu.
+	wrote bool
+}
+
+// DirtyRange is a modified byte range [Offset, Offset+Size) of a
+// MemRegularFile.
+type DirtyRange struct {
+	Offset uint64
+	Size   uint64
 }
 
 var _ = (NodeOpener)((*MemRegularFile)(nil))
@@ -27,26 +94,118 @@ var _ = (NodeReader)((*MemRegularFile)(nil))
 var _ = (NodeWriter)((*MemRegularFile)(nil))
 var _ = (NodeSetattrer)((*MemRegularFile)(nil))
 var _ = (NodeFlusher)((*MemRegularFile)(nil))
+var _ = (NodeFsyncer)((*MemRegularFile)(nil))
+var _ = (NodeAllocater)((*MemRegularFile)(nil))
+var _ = (NodeLseeker)((*MemRegularFile)(nil))
 
 func (f *MemRegularFile) Open(ctx context.Context, flags uint32) (fh FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	return nil, fuse.FOPEN_KEEP_CACHE, OK
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		if f.TrackDirty {
+			return &memWriter{}, fuse.FOPEN_KEEP_CACHE, OK
+		}
+		return nil, fuse.FOPEN_KEEP_CACHE, OK
+	}
+	if f.Snapshot == SnapshotNone {
+		return nil, fuse.FOPEN_KEEP_CACHE, OK
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := &memSnapshot{data: f.Data}
+	if f.Snapshot == SnapshotCopyOnOpen {
+		s.data = append([]byte(nil), f.Data...)
+	} else {
+		f.shared = true
+	}
+	return s, fuse.FOPEN_DIRECT_IO, OK
+}
+
+// unshare copies Data if snapshots refer to it, so they keep seeing
+// the old content. Must be called with f.mu held, before changing
+// Data in place.
+func (f *MemRegularFile) unshare() {
+	if !f.shared {
+		return
+	}
+	n := make([]byte, len(f.Data), cap(f.Data))
+	copy(n, f.Data)
+	f.Data = n
+	f.shared = false
+}
+
+// content returns the data that reads through fh see. Must be
+// called with f.mu held.
+func (f *MemRegularFile) content(fh FileHandle) []byte {
+	if s, ok := fh.(*memSnapshot); ok {
+		return s.data
+	}
+	return f.Data
 }
 
 func (f *MemRegularFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	f.unshare()
 	end := int64(len(data)) + off
 	if int64(len(f.Data)) < end {
-		n := make([]byte, end)
-		copy(n, f.Data)
-		f.Data = n
+		f.resize(uint64(end))
 	}
 
 	copy(f.Data[off:off+int64(len(data))], data)
+	if f.TrackDirty && len(data) > 0 {
+		f.markDirty(uint64(off), uint64(len(data)))
+		if w, ok := fh.(*memWriter); ok {
+			w.wrote = true
+		}
+	}
 
 	return uint32(len(data)), 0
 }
 
+// markDirty adds [off, off+sz) to the dirty list, coalescing it
+// with overlapping and adjacent ranges. The list is kept sorted.
+func (f *MemRegularFile) markDirty(off, sz uint64) {
+	start, end := off, off+sz
+	i := 0
+	for i < len(f.dirty) && f.dirty[i].Offset+f.dirty[i].Size < start {
+		i++
+	}
+	j := i
+	for j < len(f.dirty) && f.dirty[j].Offset <= end {
+		if f.dirty[j].Offset < start {
+			start = f.dirty[j].Offset
+		}
+		if e := f.dirty[j].Offset + f.dirty[j].Size; e > end {
+			end = e
+		}
+		j++
+	}
+
+	result := make([]DirtyRange, 0, len(f.dirty)-(j-i)+1)
+	result = append(result, f.dirty[:i]...)
+	result = append(result, DirtyRange{Offset: start, Size: end - start})
+	result = append(result, f.dirty[j:]...)
+	f.dirty = result
+}
+
+// DirtyRanges returns the byte ranges written since they were last
+// cleared, sorted by offset. It returns nil unless TrackDirty is set.
+func (f *MemRegularFile) DirtyRanges() []DirtyRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]DirtyRange(nil), f.dirty...)
+}
+
+// TakeDirtyRanges is like DirtyRanges, but also clears the ranges,
+// atomically with respect to concurrent writes.
+func (f *MemRegularFile) TakeDirtyRanges() []DirtyRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.dirty
+	f.dirty = nil
+	return r
+}
+
 var _ = (NodeGetattrer)((*MemRegularFile)(nil))
 
 func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -57,29 +216,188 @@ func (f *MemRegularFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.A
 	return OK
 }
 
+// Setattr truncates or extends Data to the requested size, zero
+// filling the new bytes, and stores the mode, owner and times in
+// Attr.
 func (f *MemRegularFile) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	if sz, ok := in.GetSize(); ok {
-		f.Data = f.Data[:sz]
+	if sz, ok := in.GetSize(); ok && sz != uint64(len(f.Data)) {
+		f.unshare()
+		f.resize(sz)
+		f.truncateDirty(sz)
+	}
+	if m, ok := in.GetMode(); ok {
+		f.Attr.Mode = m & 07777
+	}
+	if uid, ok := in.GetUID(); ok {
+		f.Attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		f.Attr.Gid = gid
+	}
+	if t, ok := in.GetATime(); ok {
+		f.Attr.SetTimes(&t, nil, nil)
+	}
+	if t, ok := in.GetMTime(); ok {
+		f.Attr.SetTimes(nil, &t, nil)
 	}
+	if t, ok := in.GetCTime(); ok {
+		f.Attr.SetTimes(nil, nil, &t)
+	}
+	f.Attr.Size = uint64(len(f.Data))
 	out.Attr = f.Attr
 	out.Size = uint64(len(f.Data))
 	return OK
 }
 
+// resize grows or shrinks Data to sz bytes. New bytes are zero. The
+// capacity is at least doubled when Data is reallocated, so a series
+// of appends takes amortized constant time.
+func (f *MemRegularFile) resize(sz uint64) {
+	old := uint64(len(f.Data))
+	if sz <= old {
+		f.Data = f.Data[:sz]
+		return
+	}
+	if sz <= uint64(cap(f.Data)) {
+		// The spare capacity may hold data from before a
+		// truncation.
+		f.Data = f.Data[:sz]
+		for i := range f.Data[old:] {
+			f.Data[old+uint64(i)] = 0
+		}
+		return
+	}
+	c := 2 * uint64(cap(f.Data))
+	if c < sz {
+		c = sz
+	}
+	n := make([]byte, sz, c)
+	copy(n, f.Data)
+	f.Data = n
+}
+
+// GrowHint makes room for the file to grow to size bytes without
+// reallocating. It does not change the file size.
+func (f *MemRegularFile) GrowHint(size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= int64(cap(f.Data)) {
+		return
+	}
+	n := make([]byte, len(f.Data), size)
+	copy(n, f.Data)
+	f.Data = n
+	f.shared = false
+}
+
+// Allocate supports plain preallocation, which extends the file
+// unless FALLOC_FL_KEEP_SIZE is given, FALLOC_FL_PUNCH_HOLE and
+// FALLOC_FL_ZERO_RANGE. Holes are not stored sparsely; they read as
+// zeros.
+func (f *MemRegularFile) Allocate(ctx context.Context, fh FileHandle, off uint64, size uint64, mode uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.unshare()
+	keepSize := mode&_FALLOC_FL_KEEP_SIZE != 0
+	end := off + size
+	switch mode &^ _FALLOC_FL_KEEP_SIZE {
+	case 0:
+	case _FALLOC_FL_PUNCH_HOLE:
+		if !keepSize {
+			return syscall.EOPNOTSUPP
+		}
+		f.zero(off, end)
+	case _FALLOC_FL_ZERO_RANGE:
+		f.zero(off, end)
+	default:
+		return syscall.EOPNOTSUPP
+	}
+
+	if !keepSize && end > uint64(len(f.Data)) {
+		f.resize(end)
+	}
+	return OK
+}
+
+// zero clears the bytes of Data in [start, end).
+func (f *MemRegularFile) zero(start, end uint64) {
+	if end > uint64(len(f.Data)) {
+		end = uint64(len(f.Data))
+	}
+	if start >= end {
+		return
+	}
+	for i := range f.Data[start:end] {
+		f.Data[start+uint64(i)] = 0
+	}
+	if f.TrackDirty {
+		f.markDirty(start, end-start)
+	}
+}
+
+// truncateDirty drops dirty ranges beyond sz.
+func (f *MemRegularFile) truncateDirty(sz uint64) {
+	for i := len(f.dirty) - 1; i >= 0; i-- {
+		d := &f.dirty[i]
+		if d.Offset >= sz {
+			f.dirty = f.dirty[:i]
+		} else if d.Offset+d.Size > sz {
+			d.Size = sz - d.Offset
+		}
+	}
+}
+
 func (f *MemRegularFile) Flush(ctx context.Context, fh FileHandle) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if w, ok := fh.(*memWriter); ok && w.wrote {
+		f.dirty = nil
+		w.wrote = false
+	}
+	return 0
+}
+
+func (f *MemRegularFile) Fsync(ctx context.Context, fh FileHandle, flags uint32) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirty = nil
 	return 0
 }
 
 func (f *MemRegularFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	data := f.content(fh)
+	if off >= int64(len(data)) {
+		return fuse.ReadResultData(nil), OK
+	}
 	end := int(off) + len(dest)
-	if end > len(f.Data) {
-		end = len(f.Data)
+	if end > len(data) {
+		end = len(data)
+	}
+	return fuse.ReadResultData(data[off:end]), OK
+}
+
+// Lseek implements SEEK_DATA and SEEK_HOLE. The data is not stored
+// sparsely, so the whole file is data, followed by the implicit hole
+// at EOF. Offsets at or beyond EOF return ENXIO.
+func (f *MemRegularFile) Lseek(ctx context.Context, fh FileHandle, off uint64, whence uint32) (uint64, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sz := uint64(len(f.content(fh)))
+	if off >= sz {
+		return 0, syscall.ENXIO
 	}
-	return fuse.ReadResultData(f.Data[off:end]), OK
+	switch whence {
+	case _SEEK_DATA:
+		return off, OK
+	case _SEEK_HOLE:
+		return sz, OK
+	}
+	return 0, syscall.EINVAL
 }
 
 // MemSymlink is an inode holding a symlink in memory.
@@ -101,3 +419,165 @@ func (l *MemSymlink) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrO
 	out.Attr = l.Attr
 	return OK
 }
+
+// MemDir is a writable directory that keeps its contents in
+// memory. Files, symlinks and subdirectories created in it are
+// MemRegularFile, MemSymlink and MemDir nodes respectively. They are
+// owned by the owner in Attr, rather than by the caller.
+type MemDir struct {
+	Inode
+
+	mu sync.Mutex
+	// Attr holds the permission bits and owner of the directory.
+	Attr fuse.Attr
+}
+
+var _ = (NodeGetattrer)((*MemDir)(nil))
+var _ = (NodeSetattrer)((*MemDir)(nil))
+var _ = (NodeReaddirer)((*MemDir)(nil))
+var _ = (NodeMkdirer)((*MemDir)(nil))
+var _ = (NodeCreater)((*MemDir)(nil))
+var _ = (NodeSymlinker)((*MemDir)(nil))
+var _ = (NodeUnlinker)((*MemDir)(nil))
+var _ = (NodeRmdirer)((*MemDir)(nil))
+var _ = (NodeRenamer)((*MemDir)(nil))
+
+func (d *MemDir) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out.Attr = d.Attr
+	out.Mode = fuse.S_IFDIR | d.Attr.Mode&07777
+	return OK
+}
+
+func (d *MemDir) Setattr(ctx context.Context, fh FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := in.GetMode(); ok {
+		d.Attr.Mode = m & 07777
+	}
+	if uid, ok := in.GetUID(); ok {
+		d.Attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		d.Attr.Gid = gid
+	}
+	out.Attr = d.Attr
+	out.Mode = fuse.S_IFDIR | d.Attr.Mode&07777
+	return OK
+}
+
+// newAttr returns attributes for a new child with the given mode.
+func (d *MemDir) newAttr(mode uint32) fuse.Attr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fuse.Attr{
+		Mode:  mode & 07777,
+		Owner: d.Attr.Owner,
+	}
+}
+
+func (d *MemDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	children := d.ChildrenSorted()
+	r := make([]fuse.DirEntry, 0, len(children))
+	for _, e := range children {
+		r = append(r, fuse.DirEntry{
+			Name: e.Name,
+			Mode: e.Child.Mode(),
+			Ino:  e.Child.StableAttr().Ino,
+		})
+	}
+	return NewListDirStream(r), OK
+}
+
+// addChild adds a new node for ops under name, unless the name is
+// taken. Checking and adding in one step keeps concurrent creates
+// from replacing each other's nodes.
+func (d *MemDir) addChild(ctx context.Context, name string, ops InodeEmbedder, mode uint32) (*Inode, syscall.Errno) {
+	ch, added := d.GetOrAddChild(name, d.NewPersistentInode(ctx, ops, StableAttr{Mode: mode}))
+	if !added {
+		return nil, syscall.EEXIST
+	}
+	return ch, OK
+}
+
+func (d *MemDir) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	dir := &MemDir{Attr: d.newAttr(mode)}
+	out.Attr = dir.Attr
+	out.Mode = fuse.S_IFDIR | dir.Attr.Mode
+	return d.addChild(ctx, name, dir, fuse.S_IFDIR)
+}
+
+func (d *MemDir) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*Inode, FileHandle, uint32, syscall.Errno) {
+	f := &MemRegularFile{Attr: d.newAttr(mode)}
+	out.Attr = f.Attr
+	out.Mode = fuse.S_IFREG | f.Attr.Mode
+	ch, errno := d.addChild(ctx, name, f, fuse.S_IFREG)
+	return ch, nil, 0, errno
+}
+
+func (d *MemDir) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	l := &MemSymlink{
+		Attr: d.newAttr(0777),
+		Data: []byte(target),
+	}
+	l.Attr.Size = uint64(len(target))
+	out.Attr = l.Attr
+	out.Mode = fuse.S_IFLNK | l.Attr.Mode
+	return d.addChild(ctx, name, l, fuse.S_IFLNK)
+}
+
+func (d *MemDir) Unlink(ctx context.Context, name string) syscall.Errno {
+	ch := d.GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	if ch.IsDir() {
+		return syscall.EISDIR
+	}
+	return OK
+}
+
+func (d *MemDir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	ch := d.GetChild(name)
+	if ch == nil {
+		return syscall.ENOENT
+	}
+	if !ch.IsDir() {
+		return syscall.ENOTDIR
+	}
+	if len(ch.Children()) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return OK
+}
+
+func (d *MemDir) Rename(ctx context.Context, name string, newParent InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	src := d.GetChild(name)
+	if src == nil {
+		return syscall.ENOENT
+	}
+	dst := newParent.EmbeddedInode().GetChild(newName)
+	if flags&RENAME_EXCHANGE != 0 {
+		if dst == nil {
+			return syscall.ENOENT
+		}
+		return OK
+	}
+	if dst == nil || dst == src {
+		return OK
+	}
+	if flags&RENAME_NOREPLACE != 0 {
+		return syscall.EEXIST
+	}
+	if src.IsDir() != dst.IsDir() {
+		if dst.IsDir() {
+			return syscall.EISDIR
+		}
+		return syscall.ENOTDIR
+	}
+	if dst.IsDir() && len(dst.Children()) > 0 {
+		return syscall.ENOTEMPTY
+	}
+	return OK
+}
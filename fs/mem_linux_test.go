@@ -0,0 +1,112 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMemRegularFileAllocate(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: bytes.Repeat([]byte("x"), 100)}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	defer clean()
+	fn := mntDir + "/file"
+
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	if err := syscall.Fallocate(fd, _FALLOC_FL_PUNCH_HOLE|_FALLOC_FL_KEEP_SIZE, 10, 20); err != nil {
+		t.Fatalf("punch hole: %v", err)
+	}
+	want := bytes.Repeat([]byte("x"), 100)
+	copy(want[10:30], make([]byte, 20))
+	checkContent := func(what string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", what, got, want)
+		}
+	}
+	checkContent("punch hole")
+
+	if err := syscall.Fallocate(fd, _FALLOC_FL_PUNCH_HOLE, 10, 20); err != syscall.EOPNOTSUPP {
+		t.Errorf("punch hole without KEEP_SIZE: got %v, want EOPNOTSUPP", err)
+	}
+
+	if err := syscall.Fallocate(fd, 0, 50, 100); err != nil {
+		t.Fatalf("fallocate: %v", err)
+	}
+	want = append(want, make([]byte, 50)...)
+	checkContent("preallocate")
+
+	if err := syscall.Fallocate(fd, _FALLOC_FL_KEEP_SIZE, 0, 1000); err != nil {
+		t.Fatalf("fallocate KEEP_SIZE: %v", err)
+	}
+	checkContent("preallocate KEEP_SIZE")
+
+	if err := syscall.Fallocate(fd, _FALLOC_FL_ZERO_RANGE, 90, 70); err != nil {
+		if err == syscall.EOPNOTSUPP {
+			t.Skipf("kernel does not forward FALLOC_FL_ZERO_RANGE")
+		}
+		t.Fatalf("zero range: %v", err)
+	}
+	copy(want[90:], make([]byte, 60))
+	want = append(want, make([]byte, 10)...)
+	checkContent("zero range")
+}
+
+func TestMemRegularFileLseek(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: []byte("hello")}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	f, err := os.Open(mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	for _, tc := range []struct {
+		off    int64
+		whence int
+		want   int64
+		err    error
+	}{
+		{2, _SEEK_DATA, 2, nil},
+		{2, _SEEK_HOLE, 5, nil},
+		{5, _SEEK_DATA, 0, syscall.ENXIO},
+		{10, _SEEK_HOLE, 0, syscall.ENXIO},
+	} {
+		got, err := unix.Seek(fd, tc.off, tc.whence)
+		if err != tc.err || (err == nil && got != tc.want) {
+			t.Errorf("Seek(%d, %d): got %d, %v, want %d, %v", tc.off, tc.whence, got, err, tc.want, tc.err)
+		}
+	}
+}
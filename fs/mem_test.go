@@ -10,14 +10,17 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"reflect"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/internal/testutil"
 )
 
-func testMount(t *testing.T, root InodeEmbedder, opts *Options) (string, *fuse.Server, func()) {
+func testMount(t testing.TB, root InodeEmbedder, opts *Options) (string, *fuse.Server, func()) {
 	t.Helper()
 
 	mntDir := testutil.TempDir()
@@ -197,3 +200,538 @@ func TestDataSymlink(t *testing.T) {
 		t.Errorf("Readlink: got %q want %q", got, want)
 	}
 }
+
+func TestCaseInsensitive(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		CaseInsensitive: true,
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{})
+			root.AddChild("Straße", ch, false)
+
+			dup := root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+			if root.AddChild("straße", dup, false) {
+				t.Errorf("AddChild succeeded for name differing only in case")
+			}
+		},
+	})
+	defer clean()
+
+	content, err := ioutil.ReadFile(mntDir + "/STRAßE")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	names, err := ioutil.ReadDir(mntDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(names) != 1 || names[0].Name() != "Straße" {
+		t.Errorf("got %v, want [Straße]", names)
+	}
+
+	if !root.MvChild("straße", root, "STRAßE", false) {
+		t.Fatalf("MvChild to different case failed")
+	}
+	if chs := root.Children(); len(chs) != 1 || chs["STRAßE"] == nil {
+		t.Errorf("got children %v, want [STRAßE]", chs)
+	}
+}
+
+func TestMemRegularFileDirtyRanges(t *testing.T) {
+	f := &MemRegularFile{TrackDirty: true}
+	ctx := context.Background()
+	for _, w := range []struct {
+		off int64
+		sz  int
+	}{{10, 5}, {0, 2}, {15, 5}, {30, 1}, {1, 3}} {
+		if _, errno := f.Write(ctx, nil, make([]byte, w.sz), w.off); errno != 0 {
+			t.Fatalf("Write: %v", errno)
+		}
+	}
+
+	want := []DirtyRange{{0, 4}, {10, 10}, {30, 1}}
+	if got := f.DirtyRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 12
+	if errno := f.Setattr(ctx, nil, in, &fuse.AttrOut{}); errno != 0 {
+		t.Fatalf("Setattr: %v", errno)
+	}
+	want = []DirtyRange{{0, 4}, {10, 2}}
+	if got := f.DirtyRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after truncate: got %v, want %v", got, want)
+	}
+
+	if errno := f.Fsync(ctx, nil, 0); errno != 0 {
+		t.Fatalf("Fsync: %v", errno)
+	}
+	if got := f.DirtyRanges(); len(got) != 0 {
+		t.Errorf("after Fsync: got %v, want none", got)
+	}
+
+	// Only a handle that wrote clears the ranges on Flush.
+	reader, _, _ := f.Open(ctx, syscall.O_RDONLY)
+	writer, _, _ := f.Open(ctx, syscall.O_WRONLY)
+	if _, errno := f.Write(ctx, writer, []byte("x"), 0); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	f.Flush(ctx, reader)
+	want = []DirtyRange{{0, 1}}
+	if got := f.DirtyRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after Flush of reader: got %v, want %v", got, want)
+	}
+	f.Flush(ctx, writer)
+	if got := f.DirtyRanges(); len(got) != 0 {
+		t.Errorf("after Flush of writer: got %v, want none", got)
+	}
+
+	f.Write(ctx, writer, []byte("x"), 5)
+	want = []DirtyRange{{5, 1}}
+	if got := f.TakeDirtyRanges(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TakeDirtyRanges: got %v, want %v", got, want)
+	}
+	if got := f.DirtyRanges(); len(got) != 0 {
+		t.Errorf("after TakeDirtyRanges: got %v, want none", got)
+	}
+
+	untracked := &MemRegularFile{}
+	untracked.Write(ctx, nil, []byte("x"), 0)
+	if got := untracked.DirtyRanges(); got != nil {
+		t.Errorf("untracked file: got %v", got)
+	}
+}
+
+func TestMemRegularFileGrowth(t *testing.T) {
+	f := &MemRegularFile{}
+	ctx := context.Background()
+	f.GrowHint(64)
+	f.Write(ctx, nil, []byte("hello"), 0)
+	base := &f.Data[:1][0]
+	for i := 0; i < 10; i++ {
+		f.Write(ctx, nil, []byte("abcd"), int64(len(f.Data)))
+	}
+	if &f.Data[0] != base {
+		t.Error("Data was reallocated despite GrowHint")
+	}
+
+	// Shrink and grow again: the bytes beyond the old end must
+	// read as zero.
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_SIZE
+	in.Size = 2
+	f.Setattr(ctx, nil, in, &fuse.AttrOut{})
+	f.Write(ctx, nil, []byte("z"), 6)
+	if want := []byte("he\x00\x00\x00\x00z"); !bytes.Equal(f.Data, want) {
+		t.Errorf("got %q, want %q", f.Data, want)
+	}
+	var out fuse.AttrOut
+	f.Getattr(ctx, nil, &out)
+	if out.Size != 7 {
+		t.Errorf("got size %d, want 7", out.Size)
+	}
+}
+
+func TestMemRegularFileSetattr(t *testing.T) {
+	f := &MemRegularFile{Data: []byte("hello world")}
+	ctx := context.Background()
+	read := func() []byte {
+		t.Helper()
+		res, errno := f.Read(ctx, nil, make([]byte, 100), 0)
+		if errno != 0 {
+			t.Fatalf("Read: %v", errno)
+		}
+		data, _ := res.Bytes(nil)
+		return data
+	}
+	setattr := func(in *fuse.SetAttrIn) fuse.AttrOut {
+		t.Helper()
+		var out fuse.AttrOut
+		if errno := f.Setattr(ctx, nil, in, &out); errno != 0 {
+			t.Fatalf("Setattr: %v", errno)
+		}
+		return out
+	}
+	truncate := func(sz uint64) fuse.AttrOut {
+		in := &fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_SIZE
+		in.Size = sz
+		return setattr(in)
+	}
+
+	if out := truncate(5); out.Size != 5 || f.Attr.Size != 5 {
+		t.Errorf("shrink: got size %d, Attr.Size %d, want 5", out.Size, f.Attr.Size)
+	}
+	if got := read(); string(got) != "hello" {
+		t.Errorf("after shrink: got %q", got)
+	}
+	truncate(8)
+	if got, want := read(), []byte("hello\x00\x00\x00"); !bytes.Equal(got, want) {
+		t.Errorf("after grow: got %q, want %q", got, want)
+	}
+	base := &f.Data[0]
+	truncate(8)
+	if &f.Data[0] != base || len(f.Data) != 8 {
+		t.Error("truncating to the same size changed Data")
+	}
+
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE | fuse.FATTR_UID | fuse.FATTR_GID | fuse.FATTR_MTIME
+	in.Mode = 0640
+	in.Uid = 42
+	in.Gid = 43
+	in.Mtime = 1000
+	out := setattr(in)
+	if out.Mode != 0640 || out.Uid != 42 || out.Gid != 43 || out.Mtime != 1000 {
+		t.Errorf("got attributes %v", &out.Attr)
+	}
+	if out.Size != 8 {
+		t.Errorf("got size %d, want 8", out.Size)
+	}
+}
+
+func TestMemRegularFileSnapshot(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []SnapshotMode{SnapshotCopyOnOpen, SnapshotCopyOnWrite} {
+		f := &MemRegularFile{Data: []byte("hello"), Snapshot: mode}
+		read := func(fh FileHandle) string {
+			t.Helper()
+			res, errno := f.Read(ctx, fh, make([]byte, 100), 0)
+			if errno != 0 {
+				t.Fatalf("Read: %v", errno)
+			}
+			data, _ := res.Bytes(nil)
+			return string(data)
+		}
+		open := func(flags uint32) FileHandle {
+			t.Helper()
+			fh, fuseFlags, errno := f.Open(ctx, flags)
+			if errno != 0 {
+				t.Fatalf("Open: %v", errno)
+			}
+			if fh != nil && fuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
+				t.Errorf("mode %d: snapshot without FOPEN_DIRECT_IO", mode)
+			}
+			return fh
+		}
+
+		snap1 := open(syscall.O_RDONLY)
+		if live := open(syscall.O_RDWR); live != nil {
+			t.Errorf("mode %d: got a snapshot for O_RDWR", mode)
+		}
+		f.Write(ctx, nil, []byte("J"), 0)
+		snap2 := open(syscall.O_RDONLY)
+		in := &fuse.SetAttrIn{}
+		in.Valid = fuse.FATTR_SIZE
+		in.Size = 2
+		f.Setattr(ctx, nil, in, &fuse.AttrOut{})
+		f.Write(ctx, nil, []byte("y"), 3)
+
+		if got := read(snap1); got != "hello" {
+			t.Errorf("mode %d: first snapshot: got %q", mode, got)
+		}
+		if got := read(snap2); got != "Jello" {
+			t.Errorf("mode %d: second snapshot: got %q", mode, got)
+		}
+		if got, want := read(nil), "Je\x00y"; got != want {
+			t.Errorf("mode %d: live: got %q, want %q", mode, got, want)
+		}
+	}
+}
+
+func TestMemRegularFileSnapshotStat(t *testing.T) {
+	root := &Inode{}
+	file := &MemRegularFile{Data: []byte("hello"), Snapshot: SnapshotCopyOnOpen}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	openIn := fuse.OpenIn{Flags: syscall.O_RDONLY}
+	openIn.NodeId = entry.NodeId
+	var openOut fuse.OpenOut
+	if st := rb.Open(nil, &openIn, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+	file.Write(context.Background(), nil, []byte("!"), 5)
+
+	// stat(2) of the path, while the snapshot is open.
+	in := fuse.GetAttrIn{}
+	in.NodeId = entry.NodeId
+	var out fuse.AttrOut
+	if st := rb.GetAttr(nil, &in, &out); !st.Ok() {
+		t.Fatalf("GetAttr: %v", st)
+	}
+	if out.Size != 6 {
+		t.Errorf("got size %d, want 6", out.Size)
+	}
+}
+
+func BenchmarkMemRegularFileAppend(b *testing.B) {
+	ctx := context.Background()
+	data := []byte("abcd")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		f := &MemRegularFile{}
+		for off := int64(0); off < 100000*4; off += 4 {
+			f.Write(ctx, nil, data, off)
+		}
+	}
+}
+
+func TestReplaceChildren(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	newFile := func(content string) *Inode {
+		return root.NewPersistentInode(ctx, &MemRegularFile{Data: []byte(content)}, StableAttr{})
+	}
+	oneHour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout: &oneHour,
+		AttrTimeout:  &oneHour,
+		OnAdd: func(c context.Context) {
+			ctx = c
+			root.AddChild("a", newFile("a"), false)
+			root.AddChild("b", newFile("b"), false)
+		},
+	})
+	defer clean()
+
+	for _, nm := range []string{"a", "b", "c"} {
+		var st syscall.Stat_t
+		syscall.Lstat(mntDir+"/"+nm, &st)
+	}
+
+	keep := root.GetChild("a")
+	root.ReplaceChildren(map[string]*Inode{
+		"a": keep,
+		"b": newFile("new b"),
+		"c": newFile("c"),
+	})
+	if content, err := ioutil.ReadFile(mntDir + "/b"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "new b" {
+		t.Errorf("got %q, want %q", content, "new b")
+	}
+	if _, err := os.Lstat(mntDir + "/c"); err != nil {
+		t.Errorf("Lstat(c): %v", err)
+	}
+
+	root.ReplaceChildren(map[string]*Inode{
+		"c": root.GetChild("c"),
+	})
+	if _, err := os.Lstat(mntDir + "/a"); !os.IsNotExist(err) {
+		t.Errorf("Lstat(a): got %v, want ENOENT", err)
+	}
+	if names, err := ioutil.ReadDir(mntDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	} else if len(names) != 1 || names[0].Name() != "c" {
+		t.Errorf("got %v, want [c]", names)
+	}
+	if nm, p := keep.Parent(); p != nil {
+		t.Errorf("removed child still has parent %q", nm)
+	}
+}
+
+func TestMemDir(t *testing.T) {
+	root := &MemDir{Attr: fuse.Attr{Mode: 0755, Owner: fuse.Owner{Uid: 123, Gid: 456}}}
+	mntDir, _, clean := testMount(t, root, nil)
+	defer clean()
+
+	if err := os.Mkdir(mntDir+"/dir", 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(mntDir+"/dir/file", []byte("hello"), 0640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Symlink("dir/file", mntDir+"/link"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mntDir+"/dir/file", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if st.Mode != syscall.S_IFREG|0640 || st.Uid != 123 || st.Gid != 456 || st.Size != 5 {
+		t.Errorf("got mode %o uid %d gid %d size %d, want %o 123 456 5",
+			st.Mode, st.Uid, st.Gid, st.Size, syscall.S_IFREG|0640)
+	}
+	if err := syscall.Lstat(mntDir+"/dir", &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if st.Mode != syscall.S_IFDIR|0700 {
+		t.Errorf("got mode %o, want %o", st.Mode, syscall.S_IFDIR|0700)
+	}
+	if content, err := ioutil.ReadFile(mntDir + "/link"); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	} else if string(content) != "hello" {
+		t.Errorf("got %q, want %q", content, "hello")
+	}
+
+	if err := syscall.Rmdir(mntDir + "/dir"); err != syscall.ENOTEMPTY {
+		t.Errorf("Rmdir: got %v, want ENOTEMPTY", err)
+	}
+	if err := os.Rename(mntDir+"/dir/file", mntDir+"/file"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := syscall.Rmdir(mntDir + "/dir"); err != nil {
+		t.Fatalf("Rmdir: %v", err)
+	}
+	if err := syscall.Unlink(mntDir + "/link"); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	names, err := ioutil.ReadDir(mntDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(names) != 1 || names[0].Name() != "file" || names[0].Size() != 5 {
+		t.Errorf("got %v, want [file]", names)
+	}
+}
+
+func TestMemDirConcurrentCreate(t *testing.T) {
+	root := &MemDir{}
+	NewNodeFS(root, &Options{})
+
+	const n = 20
+	created := make(chan *Inode, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch, _, _, errno := root.Create(context.Background(), "file", 0, 0644, &fuse.EntryOut{})
+			if errno == 0 {
+				created <- ch
+			} else if errno != syscall.EEXIST {
+				t.Errorf("Create: %v", errno)
+			}
+		}()
+	}
+	wg.Wait()
+	close(created)
+
+	var winners []*Inode
+	for ch := range created {
+		winners = append(winners, ch)
+	}
+	if len(winners) != 1 || root.GetChild("file") != winners[0] {
+		t.Errorf("got %d successful creates, want 1 that is in the tree", len(winners))
+	}
+}
+
+type statfsDir struct {
+	Inode
+}
+
+func (d *statfsDir) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = 512
+	out.Blocks = 42
+	return OK
+}
+
+func TestStatfsDefault(t *testing.T) {
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		FirstAutomaticIno: 1,
+		OnAdd: func(ctx context.Context) {
+			n := root.EmbeddedInode()
+			n.AddChild("file", n.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+			dir := n.NewPersistentInode(ctx, &statfsDir{}, StableAttr{Mode: syscall.S_IFDIR})
+			n.AddChild("dir", dir, false)
+			dir.AddChild("sub", dir.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	for _, p := range []string{"", "/file"} {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mntDir+p, &st); err != nil {
+			t.Fatalf("Statfs(%q): %v", p, err)
+		}
+		if st.Bsize == 0 || st.Bavail == 0 || st.Ffree == 0 {
+			t.Errorf("Statfs(%q): got %#v, want non-zero block size and free space", p, st)
+		}
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mntDir+"/dir/sub", &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+	if st.Blocks != 42 {
+		t.Errorf("got Blocks %d, want 42 from the parent's Statfs", st.Blocks)
+	}
+}
+
+func TestPublishContent(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+	defer clean()
+
+	root.PublishContent(ctx, "file", []byte("old"))
+
+	f, err := os.Open(mntDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	root.PublishContent(ctx, "file", []byte("new content"))
+
+	if got, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "old" {
+		t.Errorf("open file: got %q, want %q", got, "old")
+	}
+	if got, err := ioutil.ReadFile(mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "new content" {
+		t.Errorf("reopened file: got %q, want %q", got, "new content")
+	}
+}
+
+func TestPublishContentUnmounted(t *testing.T) {
+	root := &Inode{}
+	var ctx context.Context
+	NewNodeFS(root, &Options{
+		OnAdd: func(c context.Context) { ctx = c },
+	})
+
+	old := root.PublishContent(ctx, "file", []byte("old"))
+	linked := root.PublishContent(ctx, "link", []byte("linked"))
+	root.AddChild("link2", linked, false)
+
+	ch := root.PublishContent(ctx, "file", []byte("new"))
+	if root.GetChild("file") != ch {
+		t.Fatal("child was not replaced")
+	}
+	if got := string(ch.Operations().(*MemRegularFile).Data); got != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+	if old.persistent {
+		t.Error("replaced child is still persistent")
+	}
+	if got := string(old.Operations().(*MemRegularFile).Data); got != "old" {
+		t.Errorf("replaced child: got %q, want %q", got, "old")
+	}
+
+	// A replaced child that is linked elsewhere is kept.
+	root.PublishContent(ctx, "link", []byte("new"))
+	if !linked.persistent || root.GetChild("link2") != linked {
+		t.Error("replaced child linked elsewhere was dropped")
+	}
+}
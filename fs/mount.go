@@ -5,6 +5,11 @@
 package fs
 
 import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -15,6 +20,44 @@ import (
 // fuse.NewServer.  If nil is given as options, default settings are
 // applied, which are 1 second entry and attribute timeout.
 func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, error) {
+	server, _, err := mount(dir, root, options)
+	return server, err
+}
+
+// MountContext is like Mount, but unmounts the file system once ctx
+// is done, after which Serve returns. This ties the lifetime of the
+// mount to a context, eg. in tests and short-lived tools. Calling
+// Unmount before is fine. If the file system is busy, the unmount is
+// retried lazily (see fuse.Server.UnmountLazy), so the mount point
+// goes away, but Serve only returns once the files that were open in
+// it are closed.
+func MountContext(ctx context.Context, dir string, root InodeEmbedder, options *Options) (*fuse.Server, error) {
+	server, b, err := mount(dir, root, options)
+	if err != nil {
+		return nil, err
+	}
+	served := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(served)
+	}()
+	go func() {
+		select {
+		case <-served:
+			return
+		case <-ctx.Done():
+		}
+		if err := server.Unmount(); err != nil {
+			b.logf("warning: MountContext: Unmount: %v; unmounting lazily", err)
+			if err := server.UnmountLazy(); err != nil {
+				b.logf("warning: MountContext: UnmountLazy: %v", err)
+			}
+		}
+	}()
+	return server, nil
+}
+
+func mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, *rawBridge, error) {
 	if options == nil {
 		oneSec := time.Second
 		options = &Options{
@@ -24,17 +67,88 @@ func Mount(dir string, root InodeEmbedder, options *Options) (*fuse.Server, erro
 	}
 
 	rawFS := NewNodeFS(root, options)
-	server, err := fuse.NewServer(rawFS, dir, &options.MountOptions)
+	b := rawFS.(*rawBridge)
+	served := rawFS
+	if options.WrapRawFileSystem != nil {
+		served = options.WrapRawFileSystem(rawFS)
+	}
+	mountOpts := options.MountOptions
+	if options.ReadOnly {
+		mountOpts.Options = append(append([]string{}, mountOpts.Options...), "ro")
+	}
+	server, err := fuse.NewServer(served, dir, &mountOpts)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	stopDump := func() {}
+	if options.DumpTreeSignal != nil {
+		stopDump = b.dumpTreeOnSignal(options.DumpTreeSignal)
 	}
 
-	go server.Serve()
+	// ready tells the serve goroutine whether the mount came up,
+	// so OnUnmount is only called for successful mounts.
+	ready := make(chan bool, 1)
+	go func() {
+		server.Serve()
+		server.WaitForReleases()
+		stopDump()
+		// Handles that were open when the connection went away
+		// are never released by the kernel.
+		if b.stopMount(nil) {
+			b.releaseOpenFiles()
+		}
+		if <-ready && options.OnUnmount != nil {
+			options.OnUnmount()
+		}
+	}()
 	if err := server.WaitMount(); err != nil {
 		// we don't shutdown the serve loop. If the mount does
 		// not succeed, the loop won't work and exit.
-		return nil, err
+		ready <- false
+		return nil, nil, err
 	}
+	if options.OnReady != nil {
+		options.OnReady(server)
+	}
+	ready <- true
 
-	return server, nil
+	return server, b, nil
+}
+
+// dumpTreeOnSignal dumps the node tree to the log each time sig is
+// received, until the returned function is called.
+func (b *rawBridge) dumpTreeOnSignal(sig os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sig)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch:
+				var w io.Writer = os.Stderr
+				if l := b.options.MountOptions.Logger; l != nil && l.Enabled(fuse.LogWarning) {
+					w = logLineWriter{b}
+				}
+				b.root.DumpTree(w)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// logLineWriter logs each write, which holds one line, with
+// rawBridge.logf.
+type logLineWriter struct {
+	b *rawBridge
+}
+
+func (w logLineWriter) Write(p []byte) (int, error) {
+	w.b.logf("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
 }
@@ -0,0 +1,213 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/internal/testutil"
+)
+
+func TestMountLifecycleCallbacks(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		mntDir := testutil.TempDir()
+		defer syscall.Rmdir(mntDir)
+
+		var readyCount, unmountCount int32
+		unmounted := make(chan struct{})
+		opts := &Options{
+			OnReady: func(server *fuse.Server) {
+				atomic.AddInt32(&readyCount, 1)
+				if atomic.LoadInt32(&unmountCount) != 0 {
+					t.Error("OnUnmount called before OnReady")
+				}
+			},
+			OnUnmount: func() {
+				if atomic.AddInt32(&unmountCount, 1) == 1 {
+					close(unmounted)
+				}
+			},
+		}
+		opts.Debug = testutil.VerboseTest()
+
+		server, err := Mount(mntDir, &Inode{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := atomic.LoadInt32(&readyCount); c != 1 {
+			t.Errorf("lazy=%v: OnReady called %d times after Mount, want 1", lazy, c)
+		}
+
+		if lazy {
+			err = server.UnmountLazy()
+		} else {
+			err = server.Unmount()
+		}
+		if err != nil {
+			t.Fatalf("lazy=%v: unmount: %v", lazy, err)
+		}
+
+		select {
+		case <-unmounted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("lazy=%v: OnUnmount not called", lazy)
+		}
+		// Give a spurious second call a chance to happen.
+		server.Wait()
+		time.Sleep(10 * time.Millisecond)
+		if c := atomic.LoadInt32(&unmountCount); c != 1 {
+			t.Errorf("lazy=%v: OnUnmount called %d times, want 1", lazy, c)
+		}
+	}
+}
+
+func TestAddMount(t *testing.T) {
+	root := &Inode{}
+	var sub *Inode
+	file := &MemRegularFile{Data: []byte("hello")}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			sub = root.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+			root.AddChild("sub", sub, false)
+			sub.AddChild("file", sub.NewPersistentInode(ctx, file, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	subDir := testutil.TempDir()
+	defer syscall.Rmdir(subDir)
+	subServer, err := AddMount(subDir, sub, nil)
+	if err != nil {
+		t.Fatalf("AddMount: %v", err)
+	}
+
+	for _, fn := range []string{mntDir + "/sub/file", subDir + "/file"} {
+		if got, err := ioutil.ReadFile(fn); err != nil || string(got) != "hello" {
+			t.Errorf("ReadFile(%q): got %q, %v", fn, got, err)
+		}
+	}
+	var st1, st2 syscall.Stat_t
+	if err := syscall.Stat(mntDir+"/sub/file", &st1); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(subDir+"/file", &st2); err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino {
+		t.Errorf("got inode numbers %d and %d, want the same", st1.Ino, st2.Ino)
+	}
+
+	// Unmounting the added mount leaves the tree's mount alone.
+	if err := subServer.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	subServer.Wait()
+	if got, err := ioutil.ReadFile(mntDir + "/sub/file"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile after unmounting the added mount: got %q, %v", got, err)
+	}
+}
+
+func TestMountContext(t *testing.T) {
+	for _, busy := range []bool{false, true} {
+		mntDir := testutil.TempDir()
+		defer syscall.Rmdir(mntDir)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		server, err := MountContext(ctx, mntDir, &Inode{}, &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if busy {
+			// An open file makes Unmount fail with EBUSY.
+			f, err := os.Open(mntDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+		}
+
+		cancel()
+		deadline := time.Now().Add(5 * time.Second)
+		for isMounted(t, mntDir) {
+			if time.Now().After(deadline) {
+				t.Fatalf("busy %v: %s still mounted after cancel", busy, mntDir)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !busy {
+			server.Wait()
+		}
+	}
+}
+
+// isMounted reports whether dir is a mount point, ie. whether it is
+// on another device than its parent.
+func isMounted(t *testing.T, dir string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+		t.Fatal(err)
+	}
+	return st.Dev != parent.Dev
+}
+
+// lineChan sends each write on a channel.
+type lineChan chan string
+
+func (c lineChan) Write(p []byte) (int, error) {
+	c <- string(p)
+	return len(p), nil
+}
+
+func TestDumpTreeSignal(t *testing.T) {
+	lines := make(lineChan, 10)
+	root := &Inode{}
+	b := NewNodeFS(root, &Options{Logger: log.New(lines, "", 0)}).(*rawBridge)
+	stop := b.dumpTreeOnSignal(syscall.SIGUSR1)
+	defer stop()
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-lines:
+		if !strings.HasPrefix(l, ".\tn1 ") {
+			t.Errorf("got %q, want the root", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no dump after SIGUSR1")
+	}
+}
+
+func TestOptionsLogger(t *testing.T) {
+	var std, leveled bytes.Buffer
+	opts := &Options{Logger: log.New(&std, "", 0)}
+	opts.MountOptions.Logger = fuse.NewStdLogger(log.New(&leveled, "", 0))
+
+	NewNodeFS(&Inode{}, opts).(*rawBridge).logf("first")
+	if std.String() != "first\n" || leveled.Len() != 0 {
+		t.Errorf("with both loggers: got %q and %q", std.String(), leveled.String())
+	}
+
+	opts.Logger = nil
+	NewNodeFS(&Inode{}, opts).(*rawBridge).logf("second")
+	if leveled.String() != "second\n" {
+		t.Errorf("with MountOptions.Logger: got %q", leveled.String())
+	}
+}
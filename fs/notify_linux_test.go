@@ -0,0 +1,197 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// readInotify waits for an inotify event on fd, and returns the mask
+// and name of the first one.
+func readInotify(t *testing.T, fd int) (uint32, string) {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	if n, err := unix.Poll(fds, 5000); err != nil || n == 0 {
+		t.Fatalf("no inotify event: %v", err)
+	}
+	buf := make([]byte, 4096)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if n < unix.SizeofInotifyEvent {
+		t.Fatalf("short inotify event: %d bytes", n)
+	}
+	ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+	name := buf[unix.SizeofInotifyEvent : unix.SizeofInotifyEvent+int(ev.Len)]
+	return ev.Mask, string(bytes.TrimRight(name, "\x00"))
+}
+
+func TestNotifyDelete(t *testing.T) {
+	root := &Inode{}
+	var file, unseen *Inode
+	oneHour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout: &oneHour,
+		AttrTimeout:  &oneHour,
+		OnAdd: func(ctx context.Context) {
+			file = root.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("file")}, StableAttr{})
+			root.AddChild("file", file, false)
+			unseen = root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{})
+			root.AddChild("unseen", unseen, false)
+		},
+	})
+	defer clean()
+
+	if _, err := os.Lstat(mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if _, err := unix.InotifyAddWatch(fd, mntDir+"/file", unix.IN_DELETE_SELF); err != nil {
+		t.Fatal(err)
+	}
+
+	root.RmChild("file")
+	if errno := root.NotifyDelete("file", file); errno != 0 {
+		t.Fatalf("NotifyDelete: %v", errno)
+	}
+	if mask, _ := readInotify(t, fd); mask&unix.IN_DELETE_SELF == 0 {
+		t.Errorf("got event %x, want IN_DELETE_SELF", mask)
+	}
+	if _, err := os.Lstat(mntDir + "/file"); !os.IsNotExist(err) {
+		t.Errorf("Lstat after NotifyDelete: got %v, want ENOENT", err)
+	}
+
+	// The kernel never looked up "unseen", so there is nothing
+	// to delete.
+	root.RmChild("unseen")
+	if errno := root.NotifyDelete("unseen", unseen); errno != 0 {
+		t.Errorf("NotifyDelete of unseen child: %v", errno)
+	}
+	if errno := root.NotifyDelete("file", nil); errno != 0 {
+		t.Errorf("NotifyDelete without child: %v", errno)
+	}
+}
+
+// cachedListingDir is a directory whose listing the kernel caches,
+// and that counts how often it is listed.
+type cachedListingDir struct {
+	Inode
+
+	mu       sync.Mutex
+	readdirs int
+}
+
+var _ = (NodeOpendirerWithFlags)((*cachedListingDir)(nil))
+var _ = (NodeReaddirer)((*cachedListingDir)(nil))
+
+func (d *cachedListingDir) Opendir(ctx context.Context, flags uint32) (uint32, syscall.Errno) {
+	return fuse.FOPEN_CACHE_DIR, OK
+}
+
+func (d *cachedListingDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	d.mu.Lock()
+	d.readdirs++
+	d.mu.Unlock()
+	var es []fuse.DirEntry
+	for name, ch := range d.Children() {
+		es = append(es, fuse.DirEntry{Name: name, Mode: ch.Mode()})
+	}
+	return NewListDirStream(es), OK
+}
+
+func (d *cachedListingDir) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readdirs
+}
+
+func TestNotifyAddRemoveEntry(t *testing.T) {
+	root := &cachedListingDir{}
+	oneHour := time.Hour
+	mntDir, _, clean := testMount(t, root, &Options{
+		EntryTimeout: &oneHour,
+		AttrTimeout:  &oneHour,
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("a", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	list := func() []string {
+		t.Helper()
+		f, err := os.Open(mntDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	list()
+	if got := list(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("got %v, want [a]", got)
+	}
+	if n := root.count(); n != 1 {
+		t.Skipf("kernel does not cache listings: %d readdirs", n)
+	}
+	// The kernel remembers that "b" does not exist.
+	if _, err := os.Lstat(mntDir + "/b"); !os.IsNotExist(err) {
+		t.Fatalf("Lstat b: %v", err)
+	}
+
+	ctx := context.Background()
+	root.AddChild("b", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+	if errno := root.NotifyAddEntry("b"); errno != 0 {
+		t.Fatalf("NotifyAddEntry: %v", errno)
+	}
+	if got := list(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("after add: got %v, want [a b]", got)
+	}
+	if _, err := os.Lstat(mntDir + "/b"); err != nil {
+		t.Errorf("Lstat b after add: %v", err)
+	}
+
+	// "c" was never looked up, so only the listing is dropped.
+	root.AddChild("c", root.NewPersistentInode(ctx, &MemRegularFile{}, StableAttr{}), false)
+	if errno := root.NotifyAddEntry("c"); errno != 0 {
+		t.Fatalf("NotifyAddEntry c: %v", errno)
+	}
+	if got := list(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("after add c: got %v, want [a b c]", got)
+	}
+
+	root.RmChild("a")
+	if errno := root.NotifyRemoveEntry("a"); errno != 0 {
+		t.Fatalf("NotifyRemoveEntry: %v", errno)
+	}
+	if got := list(); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("after remove: got %v, want [b c]", got)
+	}
+	if _, err := os.Lstat(mntDir + "/a"); !os.IsNotExist(err) {
+		t.Errorf("Lstat a after remove: got %v, want ENOENT", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// panicFile panics on Read.
+type panicFile struct {
+	Inode
+}
+
+var _ = (NodeOpener)((*panicFile)(nil))
+var _ = (NodeReader)((*panicFile)(nil))
+
+func (f *panicFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (f *panicFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	panic("read")
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var panics int32
+	root := &Inode{}
+	opts := &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("panic", root.NewPersistentInode(ctx, &panicFile{}, StableAttr{}), false)
+			root.AddChild("ok", root.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{}), false)
+		},
+	}
+	opts.PanicHandler = func(r interface{}) {
+		atomic.AddInt32(&panics, 1)
+	}
+	mntDir, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	if _, err := ioutil.ReadFile(mntDir + "/panic"); err == nil {
+		t.Fatal("Read of panicking file succeeded")
+	} else if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EIO {
+		t.Errorf("got %v, want EIO", err)
+	}
+	if got := atomic.LoadInt32(&panics); got != 1 {
+		t.Errorf("got %d calls to PanicHandler, want 1", got)
+	}
+
+	// The mount is still alive.
+	if got, err := ioutil.ReadFile(mntDir + "/ok"); err != nil || string(got) != "hello" {
+		t.Errorf("ReadFile after panic: got %q, %v", got, err)
+	}
+	if _, err := os.Stat(mntDir + "/panic"); err != nil {
+		t.Errorf("Stat after panic: %v", err)
+	}
+}
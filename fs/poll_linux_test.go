@@ -0,0 +1,135 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// pollNode is readable once ready is set.
+type pollNode struct {
+	Inode
+
+	mu    sync.Mutex
+	ready bool
+}
+
+var _ = (NodeOpener)((*pollNode)(nil))
+var _ = (NodePoller)((*pollNode)(nil))
+
+type pollFile struct{}
+
+func (n *pollNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return &pollFile{}, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (n *pollNode) Poll(ctx context.Context, f FileHandle, events uint32) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ready {
+		return unix.POLLIN, OK
+	}
+	return 0, OK
+}
+
+func TestPoll(t *testing.T) {
+	node := &pollNode{}
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		MountOptions: fuse.MountOptions{EnablePoll: true},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	defer clean()
+
+	fd, err := syscall.Open(mntDir+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	if n, err := unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}, 0); err != nil || n != 0 {
+		t.Fatalf("Poll before ready: got %d, %v, want 0", n, err)
+	}
+
+	type result struct {
+		fds []unix.PollFd
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 10000)
+		done <- result{fds, n, err}
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatalf("Poll returned early: %d, %v", r.n, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	node.mu.Lock()
+	node.ready = true
+	node.mu.Unlock()
+	if errno := node.NotifyPoll(); errno != 0 {
+		t.Fatalf("NotifyPoll: %v", errno)
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.n != 1 || r.fds[0].Revents&unix.POLLIN == 0 {
+			t.Errorf("Poll: got %d, %v, revents %x, want POLLIN", r.n, r.err, r.fds[0].Revents)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Poll was not woken up")
+	}
+}
+
+func TestPollReleaseForgetsHandle(t *testing.T) {
+	node := &pollNode{}
+	root := &Inode{}
+	rb := NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	}).(*rawBridge)
+
+	var entry fuse.EntryOut
+	if st := rb.Lookup(nil, &fuse.InHeader{NodeId: 1}, "file", &entry); !st.Ok() {
+		t.Fatalf("Lookup: %v", st)
+	}
+	var openOut fuse.OpenOut
+	if st := rb.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}}, &openOut); !st.Ok() {
+		t.Fatalf("Open: %v", st)
+	}
+
+	pollIn := fuse.PollIn{
+		InHeader: fuse.InHeader{NodeId: entry.NodeId},
+		Fh:       openOut.Fh,
+		Kh:       42,
+		Flags:    fuse.FUSE_POLL_SCHEDULE_NOTIFY,
+	}
+	if st := rb.Poll(nil, &pollIn, &fuse.PollOut{}); !st.Ok() {
+		t.Fatalf("Poll: %v", st)
+	}
+	if got := len(node.pollHandles); got != 1 {
+		t.Fatalf("got %d poll handles after Poll, want 1", got)
+	}
+
+	rb.Release(nil, &fuse.ReleaseIn{InHeader: fuse.InHeader{NodeId: entry.NodeId}, Fh: openOut.Fh})
+	if got := len(node.pollHandles); got != 0 {
+		t.Errorf("got %d poll handles after Release, want 0", got)
+	}
+}
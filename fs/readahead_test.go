@@ -0,0 +1,140 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// streamFile is a file of zeros that records the READ sizes.
+type streamFile struct {
+	Inode
+	size      int64
+	openFlags uint32
+
+	mu      sync.Mutex
+	reads   int
+	maxRead int
+}
+
+var _ = (NodeOpener)((*streamFile)(nil))
+var _ = (NodeReader)((*streamFile)(nil))
+var _ = (NodeGetattrer)((*streamFile)(nil))
+
+func (f *streamFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, f.openFlags, OK
+}
+
+func (f *streamFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0444
+	out.Size = uint64(f.size)
+	return OK
+}
+
+func (f *streamFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	f.reads++
+	if len(dest) > f.maxRead {
+		f.maxRead = len(dest)
+	}
+	f.mu.Unlock()
+
+	n := f.size - off
+	if n > int64(len(dest)) {
+		n = int64(len(dest))
+	}
+	if n < 0 {
+		n = 0
+	}
+	return fuse.ReadResultData(dest[:n]), OK
+}
+
+func mountStreamFile(tb testing.TB, node *streamFile, maxReadAhead int) (string, *fuse.Server, func()) {
+	root := &Inode{}
+	mntDir, server, clean := testMount(tb, root, &Options{
+		MountOptions: fuse.MountOptions{MaxReadAhead: maxReadAhead},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	return mntDir, server, clean
+}
+
+// readAll reads the file sequentially in 4 KiB chunks.
+func readAll(tb testing.TB, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	for {
+		if _, err := f.Read(buf); err == io.EOF {
+			return
+		} else if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func TestMaxReadAhead(t *testing.T) {
+	const readAhead = 32 << 10
+	node := &streamFile{size: 1 << 20}
+	mntDir, server, clean := mountStreamFile(t, node, readAhead)
+	defer clean()
+
+	if got := server.NegotiatedSettings().MaxReadAhead; got != readAhead {
+		t.Errorf("negotiated MaxReadAhead %d, want %d", got, readAhead)
+	}
+	readAll(t, mntDir+"/file")
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.maxRead > readAhead {
+		t.Errorf("got READ of %d bytes, want at most %d", node.maxRead, readAhead)
+	}
+}
+
+func benchmarkStream(b *testing.B, maxReadAhead int, openFlags uint32) {
+	const fileSize = 16 << 20
+	node := &streamFile{size: fileSize, openFlags: openFlags}
+	mntDir, server, clean := mountStreamFile(b, node, maxReadAhead)
+	defer clean()
+	server.SetDebug(false)
+
+	b.SetBytes(fileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readAll(b, mntDir+"/file")
+	}
+	b.StopTimer()
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	b.ReportMetric(float64(node.reads)/float64(b.N), "READs/op")
+}
+
+func BenchmarkStreamReadAhead4K(b *testing.B) {
+	benchmarkStream(b, 4<<10, 0)
+}
+
+func BenchmarkStreamReadAhead32K(b *testing.B) {
+	benchmarkStream(b, 32<<10, 0)
+}
+
+func BenchmarkStreamReadAheadDefault(b *testing.B) {
+	benchmarkStream(b, 0, 0)
+}
+
+func BenchmarkStreamDirectIO(b *testing.B) {
+	benchmarkStream(b, 0, fuse.FOPEN_DIRECT_IO)
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NewReaderAtHandle returns a read-only FileHandle that reads from
+// r. A read that hits io.EOF returns the data read so far, which the
+// kernel takes as the end of the file. Other errors are returned as
+// their syscall.Errno if they wrap one, and as EIO otherwise. Reads
+// are not serialized, as io.ReaderAt allows parallel calls. If r is
+// an io.Closer, it is closed on Release.
+func NewReaderAtHandle(r io.ReaderAt) FileHandle {
+	return &readerAtHandle{r: r}
+}
+
+// ReadWriterAt is the interface of the backing store of
+// NewReadWriterAtHandle.
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// NewReadWriterAtHandle returns a FileHandle that reads from and
+// writes to rw. Reads are as for NewReaderAtHandle. A write that
+// fails after writing some bytes reports the short count. Writes are
+// not serialized either, so rw must handle concurrent WriteAt calls
+// on overlapping ranges if the kernel may issue them.
+func NewReadWriterAtHandle(rw ReadWriterAt) FileHandle {
+	return &readWriterAtHandle{readerAtHandle{r: rw}, rw}
+}
+
+type readerAtHandle struct {
+	r io.ReaderAt
+}
+
+var _ = (FileReader)((*readerAtHandle)(nil))
+var _ = (FileReleaser)((*readerAtHandle)(nil))
+
+func (h *readerAtHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.r.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, ioErrno(err)
+	}
+	return fuse.ReadResultData(dest[:n]), OK
+}
+
+func (h *readerAtHandle) Release(ctx context.Context) syscall.Errno {
+	if c, ok := h.r.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			return ioErrno(err)
+		}
+	}
+	return OK
+}
+
+type readWriterAtHandle struct {
+	readerAtHandle
+	w io.WriterAt
+}
+
+var _ = (FileWriter)((*readWriterAtHandle)(nil))
+
+func (h *readWriterAtHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, err := h.w.WriteAt(data, off)
+	if err != nil && n == 0 {
+		return 0, ioErrno(err)
+	}
+	return uint32(n), OK
+}
+
+// ioErrno converts an error from an io interface to an Errno. Errors
+// that do not wrap an Errno are reported as EIO.
+func ioErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return syscall.EIO
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// readerAtNode serves a fixed-size file through handles made by open.
+type readerAtNode struct {
+	Inode
+	size uint64
+	open func() FileHandle
+}
+
+var _ = (NodeOpener)((*readerAtNode)(nil))
+var _ = (NodeGetattrer)((*readerAtNode)(nil))
+
+func (n *readerAtNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return n.open(), fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (n *readerAtNode) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0644
+	out.Size = n.size
+	return OK
+}
+
+type failingReaderAt struct{}
+
+func (failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("backend unavailable")
+}
+
+// bufferAt is a fixed-size ReadWriterAt.
+type bufferAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *bufferAt) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.NewReader(b.data).ReadAt(p, off)
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if off >= int64(len(b.data)) {
+		return 0, syscall.EFBIG
+	}
+	n := copy(b.data[off:], p)
+	if n < len(p) {
+		return n, syscall.EFBIG
+	}
+	return n, nil
+}
+
+func TestReaderAtHandle(t *testing.T) {
+	content := []byte("hello world")
+	buf := &bufferAt{data: make([]byte, 8)}
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		OnAdd: func(ctx context.Context) {
+			add := func(name string, n *readerAtNode) {
+				root.AddChild(name, root.NewPersistentInode(ctx, n, StableAttr{}), false)
+			}
+			add("ro", &readerAtNode{
+				size: uint64(len(content)),
+				open: func() FileHandle { return NewReaderAtHandle(bytes.NewReader(content)) },
+			})
+			add("fail", &readerAtNode{
+				size: 10,
+				open: func() FileHandle { return NewReaderAtHandle(failingReaderAt{}) },
+			})
+			add("rw", &readerAtNode{
+				size: uint64(len(buf.data)),
+				open: func() FileHandle { return NewReadWriterAtHandle(buf) },
+			})
+		},
+	})
+	defer clean()
+
+	if got, err := ioutil.ReadFile(mntDir + "/ro"); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadFile: got %q, %v, want %q", got, err, content)
+	}
+	if _, err := ioutil.ReadFile(mntDir + "/fail"); !errors.Is(err, syscall.EIO) {
+		t.Errorf("ReadFile of failing reader: got %v, want EIO", err)
+	}
+	if err := ioutil.WriteFile(mntDir+"/ro", []byte("x"), 0644); err == nil {
+		t.Error("writing read-only handle succeeded")
+	}
+
+	f, err := os.OpenFile(mntDir+"/rw", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if n, err := f.WriteAt([]byte("abc"), 2); err != nil || n != 3 {
+		t.Fatalf("WriteAt: %d, %v", n, err)
+	}
+	// A write beyond the end of the backing store is short.
+	if n, err := syscall.Pwrite(int(f.Fd()), []byte("xyz"), 6); n != 2 {
+		t.Errorf("short WriteAt: got %d, %v, want 2", n, err)
+	}
+	got := make([]byte, 16)
+	n, err := f.ReadAt(got, 0)
+	if want := []byte("\x00\x00abc\x00xy"); !bytes.Equal(got[:n], want) {
+		t.Errorf("ReadAt: got %q, %v, want %q", got[:n], err, want)
+	}
+}
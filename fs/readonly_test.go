@@ -51,3 +51,58 @@ func TestDefaultPermissions(t *testing.T) {
 		}
 	}
 }
+
+// _ST_RDONLY is ST_RDONLY on Linux and MNT_RDONLY on Darwin.
+const _ST_RDONLY = 0x1
+
+func TestReadOnlyOption(t *testing.T) {
+	root := &MemDir{}
+	opts := &Options{
+		ReadOnly: true,
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &MemRegularFile{Data: []byte("hello")}, StableAttr{})
+			root.AddChild("file", ch, false)
+		},
+	}
+	mntDir, _, clean := testMount(t, root, opts)
+	defer clean()
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(mntDir, &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	} else if st.Flags&_ST_RDONLY == 0 {
+		t.Errorf("mount is not read-only: flags %x", st.Flags)
+	}
+
+	for name, op := range map[string]func() error{
+		"open-rdwr": func() error {
+			fd, err := syscall.Open(mntDir+"/file", syscall.O_RDWR, 0)
+			if err == nil {
+				syscall.Close(fd)
+			}
+			return err
+		},
+		"mkdir":  func() error { return syscall.Mkdir(mntDir+"/dir", 0755) },
+		"unlink": func() error { return syscall.Unlink(mntDir + "/file") },
+		"chmod":  func() error { return syscall.Chmod(mntDir+"/file", 0600) },
+	} {
+		if err := op(); err != syscall.EROFS {
+			t.Errorf("%s: got %v, want EROFS", name, err)
+		}
+	}
+
+	// The kernel rejects most of these by itself on a read-only
+	// mount, so call the bridge directly too.
+	rawFS := NewNodeFS(&MemDir{}, &Options{ReadOnly: true})
+	var out fuse.EntryOut
+	if st := rawFS.Mkdir(nil, &fuse.MkdirIn{InHeader: fuse.InHeader{NodeId: 1}, Mode: 0755}, "dir", &out); st != fuse.EROFS {
+		t.Errorf("Mkdir: got %v, want EROFS", st)
+	}
+	var openOut fuse.OpenOut
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_WRONLY}, &openOut); st != fuse.EROFS {
+		t.Errorf("Open(O_WRONLY): got %v, want EROFS", st)
+	}
+	if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: fuse.InHeader{NodeId: 1}, Flags: syscall.O_RDONLY | syscall.O_TRUNC}, &openOut); st != fuse.EROFS {
+		t.Errorf("Open(O_TRUNC): got %v, want EROFS", st)
+	}
+}
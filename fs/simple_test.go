@@ -61,6 +61,12 @@ type testOptions struct {
 	suppressDebug bool
 	testDir       string
 	ro            bool
+	statx         bool
+	passthrough   bool
+
+	followSymlinks bool
+	restrictToRoot bool
+	maxOpenFds     int
 }
 
 // newTestCase creates the directories `orig` and `mnt` inside a temporary
@@ -90,6 +96,9 @@ func newTestCase(t *testing.T, opts *testOptions) *testCase {
 	if err != nil {
 		t.Fatalf("NewLoopback: %v", err)
 	}
+	tc.loopback.(*LoopbackNode).RootData.FollowSymlinks = opts.followSymlinks
+	tc.loopback.(*LoopbackNode).RootData.RestrictToRoot = opts.restrictToRoot
+	tc.loopback.(*LoopbackNode).RootData.MaxOpenFds = opts.maxOpenFds
 
 	oneSec := time.Second
 
@@ -114,6 +123,8 @@ func newTestCase(t *testing.T, opts *testOptions) *testCase {
 	if opts.ro {
 		mOpts.Options = append(mOpts.Options, "ro")
 	}
+	mOpts.EnableStatx = opts.statx
+	mOpts.EnablePassthrough = opts.passthrough
 	tc.server, err = fuse.NewServer(tc.rawFS, tc.mntDir, mOpts)
 	if err != nil {
 		t.Fatal(err)
@@ -330,21 +341,33 @@ func TestMknod(t *testing.T) {
 		"regular": syscall.S_IFREG,
 		"socket":  syscall.S_IFSOCK,
 		"fifo":    syscall.S_IFIFO,
+		"char":    syscall.S_IFCHR,
+		"block":   syscall.S_IFBLK,
 	}
 
+	oldMask := syscall.Umask(0)
+	defer syscall.Umask(oldMask)
 	for nm, mode := range modes {
 		t.Run(nm, func(t *testing.T) {
 			p := filepath.Join(tc.mntDir, nm)
-			err := syscall.Mknod(p, mode|0755, (8<<8)|0)
-			if err != nil {
+			dev := (8 << 8) | 1
+			err := syscall.Mknod(p, mode|0751, dev)
+			if err == syscall.EPERM && (mode == syscall.S_IFCHR || mode == syscall.S_IFBLK) {
+				t.Skipf("mknod(%s): %v", nm, err)
+			} else if err != nil {
 				t.Fatalf("mknod(%s): %v", nm, err)
 			}
 
 			var st syscall.Stat_t
-			if err := syscall.Stat(p, &st); err != nil {
-				got := st.Mode &^ 07777
-				if want := mode; got != want {
-					t.Fatalf("stat(%s): got %o want %o", nm, got, want)
+			if err := syscall.Lstat(p, &st); err != nil {
+				t.Fatalf("stat(%s): %v", nm, err)
+			}
+			if got, want := uint32(st.Mode), mode|0751; got != want {
+				t.Errorf("stat(%s): got mode %o want %o", nm, got, want)
+			}
+			if mode == syscall.S_IFCHR || mode == syscall.S_IFBLK {
+				if got := int(st.Rdev); got != dev {
+					t.Errorf("stat(%s): got rdev %x want %x", nm, got, dev)
 				}
 			}
 
@@ -0,0 +1,144 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// concurrencyNode records how many reads run at the same time, on
+// the node and in total.
+type concurrencyNode struct {
+	Inode
+
+	// Not protected; relies on SingleThreadedNodes.
+	active, max int
+
+	totalActive, totalMax *int32
+}
+
+var _ = (NodeOpener)((*concurrencyNode)(nil))
+var _ = (NodeReader)((*concurrencyNode)(nil))
+
+func (n *concurrencyNode) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	return nil, fuse.FOPEN_DIRECT_IO, OK
+}
+
+func (n *concurrencyNode) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n.active++
+	if n.active > n.max {
+		n.max = n.active
+	}
+	total := atomic.AddInt32(n.totalActive, 1)
+	for {
+		m := atomic.LoadInt32(n.totalMax)
+		if total <= m || atomic.CompareAndSwapInt32(n.totalMax, m, total) {
+			break
+		}
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	atomic.AddInt32(n.totalActive, -1)
+	n.active--
+	return fuse.ReadResultData(nil), OK
+}
+
+func TestSingleThreadedNodes(t *testing.T) {
+	var totalActive, totalMax int32
+	nodes := []*concurrencyNode{
+		{totalActive: &totalActive, totalMax: &totalMax},
+		{totalActive: &totalActive, totalMax: &totalMax},
+	}
+	root := &Inode{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		SingleThreadedNodes: true,
+		OnAdd: func(ctx context.Context) {
+			for i, n := range nodes {
+				root.AddChild(fmt.Sprintf("file%d", i), root.NewPersistentInode(ctx, n, StableAttr{}), false)
+			}
+		},
+	})
+	defer clean()
+
+	var wg sync.WaitGroup
+	for i := range nodes {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := ioutil.ReadFile(fmt.Sprintf("%s/file%d", mntDir, i)); err != nil {
+					t.Errorf("ReadFile: %v", err)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	for i, n := range nodes {
+		if n.max != 1 {
+			t.Errorf("file%d: got %d concurrent reads, want 1", i, n.max)
+		}
+	}
+	if totalMax < 2 {
+		t.Errorf("got %d concurrent reads in total, want reads on different files to overlap", totalMax)
+	}
+}
+
+func TestSingleThreadedNodesRename(t *testing.T) {
+	root := &MemDir{}
+	mntDir, _, clean := testMount(t, root, &Options{
+		SingleThreadedNodes: true,
+	})
+	defer clean()
+
+	for _, d := range []string{"a", "b"} {
+		if err := os.Mkdir(mntDir+"/"+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(mntDir+"/a/x", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mntDir+"/b/y", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Renames in opposite directions lock the same two
+	// directories in different argument order.
+	rename := func(from, to string) {
+		for i := 0; i < 100; i++ {
+			if err := os.Rename(mntDir+"/"+from, mntDir+"/"+to); err != nil {
+				t.Errorf("Rename: %v", err)
+				return
+			}
+			from, to = to, from
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); rename("a/x", "b/x") }()
+		go func() { defer wg.Done(); rename("b/y", "a/y") }()
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock in rename")
+	}
+}
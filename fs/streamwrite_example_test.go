@@ -0,0 +1,100 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// uploadFile is a write-only file whose content is streamed to a
+// backend as it is written, without buffering it.
+type uploadFile struct {
+	fs.Inode
+}
+
+var _ = (fs.NodeOpener)((*uploadFile)(nil))
+
+func (f *uploadFile) Open(ctx context.Context, openFlags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if openFlags&syscall.O_ACCMODE != syscall.O_WRONLY {
+		return nil, 0, syscall.EACCES
+	}
+	pr, pw := io.Pipe()
+	h := &uploadHandle{pw: pw}
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		// Stand-in for an upload to the backend.
+		n, err := io.Copy(ioutil.Discard, pr)
+		pr.CloseWithError(err)
+		log.Printf("uploaded %d bytes", n)
+	}()
+	// Direct I/O keeps the page cache out of the way, so writes
+	// reach Write in order and as they happen.
+	return h, fuse.FOPEN_DIRECT_IO | fuse.FOPEN_NONSEEKABLE, 0
+}
+
+// uploadHandle streams sequential writes into a pipe.
+type uploadHandle struct {
+	mu  sync.Mutex
+	pw  *io.PipeWriter
+	off int64
+	wg  sync.WaitGroup
+}
+
+var _ = (fs.FileWriter)((*uploadHandle)(nil))
+var _ = (fs.FileReleaser)((*uploadHandle)(nil))
+
+func (h *uploadHandle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if off != h.off {
+		// A stream cannot seek.
+		return 0, syscall.ESPIPE
+	}
+	// data is only valid during this call. PipeWriter.Write
+	// returns once the reader consumed all of it, so the slice is
+	// passed on without a copy.
+	n, err := h.pw.Write(data)
+	h.off += int64(n)
+	if err != nil {
+		return uint32(n), syscall.EIO
+	}
+	return uint32(n), 0
+}
+
+func (h *uploadHandle) Release(ctx context.Context) syscall.Errno {
+	h.pw.Close()
+	h.wg.Wait()
+	return 0
+}
+
+// Example_streamingWrite shows how to stream writes to a backend
+// without buffering them.
+func Example_streamingWrite() {
+	mntDir := "/tmp/x"
+	root := &fs.Inode{}
+
+	server, err := fs.Mount(mntDir, root, &fs.Options{
+		OnAdd: func(ctx context.Context) {
+			ch := root.NewPersistentInode(ctx, &uploadFile{}, fs.StableAttr{Mode: syscall.S_IFREG})
+			root.AddChild("upload", ch, true)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("cat bigfile > %s/upload to stream it\n", mntDir)
+	fmt.Printf("Unmount by calling 'fusermount -u %s'\n", mntDir)
+	server.Wait()
+}
@@ -0,0 +1,192 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"sort"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// NewUnionRoot returns a read-only file system that merges the given
+// trees, the first layer being the topmost. A name resolves to the
+// entry in the topmost layer that has it. If that entry is a
+// directory, it is merged with the directories of the same name in
+// the layers below it, down to the first layer where the name is not
+// a directory.
+//
+// The layers must be static trees of Inodes, ie. their directories
+// must list their contents as children, as is the case for trees
+// built from persistent Inodes in OnAdd. Use NewNodeFS to create the
+// layer roots without mounting them.
+func NewUnionRoot(layers ...*Inode) InodeEmbedder {
+	return &unionDir{layers: layers}
+}
+
+// unionDir is a merged directory. layers has the directories from
+// the different layers, topmost first.
+type unionDir struct {
+	Inode
+
+	layers []*Inode
+}
+
+var _ = (NodeLookuper)((*unionDir)(nil))
+var _ = (NodeReaddirer)((*unionDir)(nil))
+var _ = (NodeGetattrer)((*unionDir)(nil))
+
+func (d *unionDir) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if len(d.layers) > 0 {
+		if errno := layerGetattr(ctx, d.layers[0], nil, out); errno != 0 {
+			return errno
+		}
+	}
+	out.Mode = fuse.S_IFDIR | out.Mode&07777
+	return OK
+}
+
+func (d *unionDir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*Inode, syscall.Errno) {
+	var dirs []*Inode
+	for _, l := range d.layers {
+		ch := l.GetChild(name)
+		if ch == nil {
+			continue
+		}
+		if !ch.IsDir() {
+			if len(dirs) > 0 {
+				// A file below a directory is shadowed.
+				break
+			}
+			var a fuse.AttrOut
+			if errno := layerGetattr(ctx, ch, nil, &a); errno != 0 {
+				return nil, errno
+			}
+			out.Attr = a.Attr
+			return d.NewInode(ctx, &unionLeaf{layer: ch}, StableAttr{Mode: ch.Mode()}), OK
+		}
+		dirs = append(dirs, ch)
+	}
+	if len(dirs) == 0 {
+		return nil, syscall.ENOENT
+	}
+
+	dir := &unionDir{layers: dirs}
+	var a fuse.AttrOut
+	if errno := dir.Getattr(ctx, nil, &a); errno != 0 {
+		return nil, errno
+	}
+	out.Attr = a.Attr
+	return d.NewInode(ctx, dir, StableAttr{Mode: fuse.S_IFDIR}), OK
+}
+
+func (d *unionDir) Readdir(ctx context.Context) (DirStream, syscall.Errno) {
+	modes := map[string]uint32{}
+	// Lower layers only contribute through directories that are
+	// merged, which Lookup determines; mirror its logic here.
+	shadowed := map[string]bool{}
+	for _, l := range d.layers {
+		for name, ch := range l.Children() {
+			if shadowed[name] {
+				continue
+			}
+			mode, seen := modes[name]
+			if !seen {
+				modes[name] = ch.Mode()
+				shadowed[name] = !ch.IsDir()
+			} else if mode&syscall.S_IFMT == syscall.S_IFDIR && !ch.IsDir() {
+				shadowed[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	r := make([]fuse.DirEntry, 0, len(names))
+	for _, name := range names {
+		r = append(r, fuse.DirEntry{Name: name, Mode: modes[name]})
+	}
+	return NewListDirStream(r), OK
+}
+
+// unionLeaf exposes a non-directory from one of the layers.
+type unionLeaf struct {
+	Inode
+
+	layer *Inode
+}
+
+var _ = (NodeGetattrer)((*unionLeaf)(nil))
+var _ = (NodeOpener)((*unionLeaf)(nil))
+var _ = (NodeReader)((*unionLeaf)(nil))
+var _ = (NodeReadlinker)((*unionLeaf)(nil))
+var _ = (NodeFlusher)((*unionLeaf)(nil))
+var _ = (NodeReleaser)((*unionLeaf)(nil))
+
+func (l *unionLeaf) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return layerGetattr(ctx, l.layer, fh, out)
+}
+
+func (l *unionLeaf) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	if o, ok := l.layer.ops.(NodeOpener); ok {
+		return o.Open(ctx, flags)
+	}
+	return nil, 0, OK
+}
+
+func (l *unionLeaf) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if r, ok := l.layer.ops.(NodeReader); ok {
+		return r.Read(ctx, fh, dest, off)
+	}
+	if r, ok := fh.(FileReader); ok {
+		return r.Read(ctx, dest, off)
+	}
+	return nil, syscall.ENOTSUP
+}
+
+func (l *unionLeaf) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if r, ok := l.layer.ops.(NodeReadlinker); ok {
+		return r.Readlink(ctx)
+	}
+	return nil, syscall.EINVAL
+}
+
+func (l *unionLeaf) Flush(ctx context.Context, fh FileHandle) syscall.Errno {
+	if f, ok := l.layer.ops.(NodeFlusher); ok {
+		return f.Flush(ctx, fh)
+	}
+	if f, ok := fh.(FileFlusher); ok {
+		return f.Flush(ctx)
+	}
+	return OK
+}
+
+func (l *unionLeaf) Release(ctx context.Context, fh FileHandle) syscall.Errno {
+	if r, ok := l.layer.ops.(NodeReleaser); ok {
+		return r.Release(ctx, fh)
+	}
+	if r, ok := fh.(FileReleaser); ok {
+		return r.Release(ctx)
+	}
+	return OK
+}
+
+// layerGetattr runs Getattr on a node from one of the layers.
+func layerGetattr(ctx context.Context, n *Inode, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	if ga, ok := fh.(FileGetattrer); ok {
+		return ga.Getattr(ctx, out)
+	}
+	if ga, ok := n.ops.(NodeGetattrer); ok {
+		return ga.Getattr(ctx, fh, out)
+	}
+	return OK
+}
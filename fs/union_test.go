@@ -0,0 +1,114 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// newUnionLayer builds an unmounted in-memory tree with the given
+// files, keyed by slash-separated path.
+func newUnionLayer(files map[string]string) *Inode {
+	root := &Inode{}
+	NewNodeFS(root, &Options{
+		OnAdd: func(ctx context.Context) {
+			for path, content := range files {
+				dir, base := filepath.Split(path)
+				p := root.EmbeddedInode()
+				for _, comp := range strings.Split(filepath.Clean(dir), "/") {
+					if comp == "." {
+						continue
+					}
+					ch := p.GetChild(comp)
+					if ch == nil {
+						ch = p.NewPersistentInode(ctx, &Inode{}, StableAttr{Mode: syscall.S_IFDIR})
+						p.AddChild(comp, ch, false)
+					}
+					p = ch
+				}
+				p.AddChild(base, p.NewPersistentInode(ctx, &MemRegularFile{Data: []byte(content)}, StableAttr{}), false)
+			}
+		},
+	})
+	return root
+}
+
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	es, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", dir, err)
+	}
+	var names []string
+	for _, e := range es {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestUnionRoot(t *testing.T) {
+	upper := newUnionLayer(map[string]string{
+		"a":        "upper a",
+		"dup":      "upper dup",
+		"dir/x":    "upper x",
+		"dir/same": "upper same",
+		"shadow":   "upper shadow",
+	})
+	lower := newUnionLayer(map[string]string{
+		"b":          "lower b",
+		"dup":        "lower dup",
+		"dir/y":      "lower y",
+		"dir/same":   "lower same",
+		"dir/sub/z":  "lower z",
+		"shadow/foo": "lower foo",
+	})
+
+	mntDir, _, clean := testMount(t, NewUnionRoot(upper, lower), nil)
+	defer clean()
+
+	if got, want := readDirNames(t, mntDir), []string{"a", "b", "dir", "dup", "shadow"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("root: got %v, want %v", got, want)
+	}
+	if got, want := readDirNames(t, mntDir+"/dir"), []string{"same", "sub", "x", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dir: got %v, want %v", got, want)
+	}
+
+	for path, want := range map[string]string{
+		"a":         "upper a",
+		"b":         "lower b",
+		"dup":       "upper dup",
+		"dir/x":     "upper x",
+		"dir/y":     "lower y",
+		"dir/same":  "upper same",
+		"dir/sub/z": "lower z",
+		"shadow":    "upper shadow",
+	} {
+		content, err := ioutil.ReadFile(mntDir + "/" + path)
+		if err != nil {
+			t.Errorf("ReadFile(%q): %v", path, err)
+		} else if string(content) != want {
+			t.Errorf("%q: got %q, want %q", path, content, want)
+		}
+	}
+
+	if fi, err := os.Lstat(mntDir + "/shadow"); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	} else if !fi.Mode().IsRegular() {
+		t.Errorf("shadow: got mode %v, want a file", fi.Mode())
+	}
+
+	if err := ioutil.WriteFile(mntDir+"/a", []byte("x"), 0644); err == nil {
+		t.Errorf("write succeeded on a read-only union")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs_test
+
+import (
+	"log"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// loggingFS logs the lookups, opens and reads of the file system it
+// wraps, with the time they took. All other operations go straight
+// to the embedded RawFileSystem.
+type loggingFS struct {
+	fuse.RawFileSystem
+}
+
+func (l *loggingFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	st := l.RawFileSystem.Lookup(cancel, header, name, out)
+	log.Printf("LOOKUP %d %q: %v (%v)", header.NodeId, name, st, time.Since(start))
+	return st
+}
+
+func (l *loggingFS) Open(cancel <-chan struct{}, in *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	st := l.RawFileSystem.Open(cancel, in, out)
+	log.Printf("OPEN %d: %v (%v)", in.NodeId, st, time.Since(start))
+	return st
+}
+
+func (l *loggingFS) Read(cancel <-chan struct{}, in *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	start := time.Now()
+	res, st := l.RawFileSystem.Read(cancel, in, buf)
+	log.Printf("READ %d %d@%d: %v (%v)", in.NodeId, in.Size, in.Offset, st, time.Since(start))
+	return res, st
+}
+
+// InodeCount keeps Server.InodeCount working through the wrapper.
+func (l *loggingFS) InodeCount() int {
+	if c, ok := l.RawFileSystem.(interface{ InodeCount() int }); ok {
+		return c.InodeCount()
+	}
+	return -1
+}
+
+// Example_wrapRawFileSystem shows how to intercept some operations of
+// a node tree, here to log them. To time every operation, without
+// writing a method for each, use fuse.Server.RecordLatencies.
+func Example_wrapRawFileSystem() {
+	mntDir := "/tmp/x"
+	root := &fs.Inode{}
+
+	server, err := fs.Mount(mntDir, root, &fs.Options{
+		WrapRawFileSystem: func(raw fuse.RawFileSystem) fuse.RawFileSystem {
+			return &loggingFS{raw}
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.Wait()
+}
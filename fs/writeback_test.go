@@ -0,0 +1,146 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// writebackFile records the flags it was opened with. It has no
+// Setattr.
+type writebackFile struct {
+	Inode
+
+	mu    sync.Mutex
+	flags uint32
+	data  []byte
+}
+
+var _ = (NodeOpener)((*writebackFile)(nil))
+var _ = (NodeReader)((*writebackFile)(nil))
+var _ = (NodeWriter)((*writebackFile)(nil))
+var _ = (NodeGetattrer)((*writebackFile)(nil))
+
+func (f *writebackFile) Open(ctx context.Context, flags uint32) (FileHandle, uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flags = flags
+	return nil, 0, OK
+}
+
+func (f *writebackFile) Read(ctx context.Context, fh FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := int(off) + len(dest)
+	if end > len(f.data) {
+		end = len(f.data)
+	}
+	return fuse.ReadResultData(append([]byte{}, f.data[off:end]...)), OK
+}
+
+func (f *writebackFile) Write(ctx context.Context, fh FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := int(off) + len(data); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], data)
+	return uint32(len(data)), OK
+}
+
+func (f *writebackFile) Getattr(ctx context.Context, fh FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out.Mode = 0644
+	out.Size = uint64(len(f.data))
+	return OK
+}
+
+func mountWriteback(tb testing.TB, node InodeEmbedder, writeback bool) (string, *fuse.Server, func()) {
+	root := &Inode{}
+	mntDir, server, clean := testMount(tb, root, &Options{
+		MountOptions: fuse.MountOptions{EnableWritebackCache: writeback},
+		OnAdd: func(ctx context.Context) {
+			root.AddChild("file", root.NewPersistentInode(ctx, node, StableAttr{}), false)
+		},
+	})
+	if writeback && server.NegotiatedSettings().Flags&fuse.CAP_WRITEBACK_CACHE == 0 {
+		clean()
+		tb.Skip("kernel does not support the writeback cache")
+	}
+	return mntDir, server, clean
+}
+
+func TestWritebackCache(t *testing.T) {
+	node := &writebackFile{}
+	mntDir, _, clean := mountWriteback(t, node, true)
+	defer clean()
+
+	f, err := os.OpenFile(mntDir+"/file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hello", " ", "world"} {
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close flushes the times, which the node cannot set.
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	node.mu.Lock()
+	flags := node.flags
+	node.mu.Unlock()
+	if flags&syscall.O_ACCMODE != syscall.O_RDWR || flags&syscall.O_APPEND != 0 {
+		t.Errorf("got open flags %x, want O_RDWR without O_APPEND", flags)
+	}
+
+	if content, err := ioutil.ReadFile(mntDir + "/file"); err != nil {
+		t.Fatal(err)
+	} else if string(content) != "hello world" {
+		t.Errorf("got %q, want %q", content, "hello world")
+	}
+}
+
+func benchmarkWrite(b *testing.B, writeback bool) {
+	mntDir, _, clean := mountWriteback(b, &MemRegularFile{}, writeback)
+	defer clean()
+
+	const fileSize = 1 << 20
+	buf := make([]byte, 4096)
+	b.SetBytes(fileSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := os.OpenFile(mntDir+"/file", os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for off := 0; off < fileSize; off += len(buf) {
+			if _, err := f.Write(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := f.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+func BenchmarkWriteWriteback(b *testing.B) {
+	benchmarkWrite(b, true)
+}
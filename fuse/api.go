@@ -117,11 +117,37 @@
 //
 //	$ sudo mount.fuse3 "/usr/local/bin/gocryptfs#/tmp/cipher" /tmp/mnt -o drop_privileges,setuid=$USER
 //
+// 4) If `MountOptions.DeviceFd` is set, the mount was set up by someone
+// else as in 3), but `mountPoint` names the real mountpoint, so
+// WaitMount and Unmount work as usual, provided the mountpoint is
+// visible to this process.
+//
+// Handing over a mount
+//
+// A running server can hand its mount to another process, eg. a newer
+// version of itself, without unmounting, so open files stay valid.
+// On Linux, the old server, started with MountOptions.EnableExport,
+// calls Server.ExportFd, which stops reading requests, waits for the
+// requests it has read to be answered, and returns a duplicate of
+// the /dev/fuse descriptor. It sends the
+// descriptor to the new process over a unix socket (SCM_RIGHTS),
+// together with its KernelSettings and NegotiatedSettings. The new
+// process calls NewServer with MountOptions.DeviceFd set to the
+// received descriptor, and MountOptions.Resume set to the settings.
+// Requests that arrive in between wait in the kernel.
+//
+// The kernel keeps the node IDs and file handles that the old server
+// handed out, so the new server must be able to answer requests for
+// them. This is up to the RawFileSystem: the fs package keeps its
+// inodes in memory, so its file systems cannot be resumed this way.
+//
 // [1] https://github.com/libfuse/libfuse/commit/64e11073b9347fcf9c6d1eea143763ba9e946f70
 //
 // [2] https://sylabs.io/guides/3.7/user-guide/bind_paths_and_mounts.html#fuse-mounts
 package fuse
 
+import "time"
+
 // Types for users to implement.
 
 // The result of Read is an array of bytes, but for performance
@@ -142,10 +168,26 @@ type ReadResult interface {
 	Done()
 }
 
+// ResumeSettings are the INIT settings of a server whose device
+// was handed over with Server.ExportFd. See MountOptions.Resume.
+type ResumeSettings struct {
+	// KernelSettings is the KernelSettings() of the previous
+	// server.
+	KernelSettings InitIn
+
+	// NegotiatedSettings is the NegotiatedSettings() of the
+	// previous server.
+	NegotiatedSettings InitOut
+}
+
 type MountOptions struct {
 	AllowOther bool
 
-	// Options are passed as -o string to fusermount.
+	// Options are passed as -o string to fusermount. The
+	// fsname= and subtype= options set FsName and Name. The
+	// options the library sets itself, fd and rootmode, make
+	// NewServer fail, as do user_id, group_id, suid and dev unless
+	// the process runs as root.
 	Options []string
 
 	// Default is _DEFAULT_BACKGROUND_TASKS, 12.  This numbers
@@ -159,6 +201,14 @@ type MountOptions struct {
 
 	// Max read ahead to use.  If 0, use default. This number is
 	// capped at the kernel maximum.
+	//
+	// The kernel offers the readahead window of the mount, 128 KiB
+	// unless changed through /sys/class/bdi, so this can only
+	// lower it. It applies to all files; FUSE has no per-file
+	// readahead. NegotiatedSettings().MaxReadAhead returns the
+	// value in effect. For a single file, FOPEN_DIRECT_IO disables
+	// caching and readahead, and readers can tune readahead with
+	// posix_fadvise(2).
 	MaxReadAhead int
 
 	// If IgnoreSecurityLabels is set, all security related xattr
@@ -173,15 +223,75 @@ type MountOptions struct {
 	RememberInodes bool
 
 	// Values shown in "df -T" and friends
-	// First column, "Filesystem"
+	// First column, "Filesystem". This is the mount source in
+	// /proc/self/mountinfo. If empty, Name is used.
 	FsName string
 
-	// Second column, "Type", will be shown as "fuse." + Name
+	// Second column, "Type", will be shown as "fuse." + Name. This
+	// is the subtype of the mount. If empty, it is derived from
+	// the String() of the RawFileSystem.
 	Name string
 
+	// VolumeName is the name that Finder shows for the mount on
+	// macOS (the volname option of macFUSE). If empty, macFUSE
+	// picks a generic name. It may not contain commas. It is
+	// ignored, and not checked, on other platforms.
+	VolumeName string
+
 	// If set, wrap the file system in a single-threaded locking wrapper.
 	SingleThreaded bool
 
+	// RequestTimeout, if positive, bounds the time the file
+	// system may take to handle a request. Once it passes, the
+	// request fails with EIO, so a backend that hangs does not
+	// wedge the calling process, and the cancel channel of the
+	// request (the context of fs nodes) is closed. The file
+	// system keeps running the operation, so it should stop work
+	// when it sees the cancellation. Its late result is
+	// discarded: nodes it looked up are forgotten, and handles
+	// it opened are released. The timed out operation still
+	// counts towards MaxConcurrency, and holds up other requests
+	// with SingleThreaded, until it returns.
+	//
+	// Blocking locks (SETLKW), releases and forgets are not
+	// subject to the timeout.
+	RequestTimeout time.Duration
+
+	// PanicHandler is called with the value of a panic in the
+	// file system while it handles a request. The panic is
+	// recovered, and the request fails with EIO, so one buggy
+	// operation does not take down the server and leave a dead
+	// mount ("transport endpoint is not connected") behind. If
+	// unset, the panic and its stack trace are logged. Locks held
+	// by the panicking operation are not released, so later
+	// requests may still hang.
+	PanicHandler func(r interface{})
+
+	// Throttle, if set, is called before each request is passed to
+	// the file system, with the name of the operation, eg. "WRITE"
+	// as in the debug output. It may block to hold the request
+	// back, eg. with a RateLimiter to spare a slow backend, and
+	// should return once cancel is closed. If it returns an error,
+	// the request fails with it. Requests are handled in their own
+	// goroutines, so a blocked request does not hold up others,
+	// unless SingleThreaded is set; it does take up one of the
+	// MaxConcurrency slots. It is not called for requests without
+	// a reply, such as FORGET, nor for INIT, DESTROY and
+	// INTERRUPT.
+	Throttle func(cancel <-chan struct{}, op string) Status
+
+	// MaxConcurrency caps the number of requests that are handled
+	// concurrently. Once the cap is reached, the server stops
+	// reading from the kernel until a request completes, so
+	// further requests queue up in the kernel. If 0, there is no
+	// limit.
+	//
+	// Requests that wait for other requests, such as SETLKW, or
+	// handlers that wait for Server.InodeRetrieveCache, can
+	// deadlock the server if they take up all slots, so the cap
+	// should be set comfortably above their expected number.
+	MaxConcurrency int
+
 	// If set, return ENOSYS for Getxattr calls, so the kernel does not issue any
 	// Xattr operations at all.
 	DisableXAttrs bool
@@ -189,6 +299,12 @@ type MountOptions struct {
 	// If set, print debugging information.
 	Debug bool
 
+	// Logger receives the messages of the server, including the
+	// debugging information if Debug is set. If unset, messages
+	// are printed with the standard logger of the log package.
+	// Use NewStdLogger to send them to a different *log.Logger.
+	Logger Logger
+
 	// If set, ask kernel to forward file locks to FUSE. If using,
 	// you must implement the GetLk/SetLk/SetLkw methods.
 	EnableLocks bool
@@ -219,16 +335,120 @@ type MountOptions struct {
 	// but might be needed if fusermount is not available.
 	DirectMount bool
 
+	// DeviceFd, if positive, is a file descriptor for /dev/fuse
+	// that is already mounted on the mountpoint, eg. by a
+	// privileged helper outside of a container. NewServer then
+	// serves on it instead of mounting, and takes ownership of
+	// the descriptor: it is closed on Unmount, and also if
+	// NewServer fails, eg. because it is not a FUSE device, or
+	// not mounted.
+	DeviceFd int
+
+	// Resume, if set together with DeviceFd, indicates that
+	// DeviceFd was handed over by a server that called
+	// Server.ExportFd. The kernel has already been initialized,
+	// so NewServer skips the INIT handshake, and takes the
+	// settings of the previous server from Resume instead.
+	Resume *ResumeSettings
+
+	// EnableExport allows Server.ExportFd. To let ExportFd
+	// interrupt the reads of the device, the server then puts it
+	// in non-blocking mode, and waits for requests with poll(2),
+	// which costs an extra system call per request when idle.
+	// Linux only.
+	EnableExport bool
+
 	// Options passed to syscall.Mount, the default value used by fusermount
 	// is syscall.MS_NOSUID|syscall.MS_NODEV
 	DirectMountFlags uintptr
 
-	// EnableAcls enables kernel ACL support.
+	// EnableAcls enables kernel ACL support. The kernel then
+	// passes the system.posix_acl_access and
+	// system.posix_acl_default extended attributes to the file
+	// system, and checks permissions itself, taking the ACLs into
+	// account, as if the default_permissions option were given.
+	// The fs package has helpers to decode and encode the ACL
+	// attributes.
 	//
 	// See the comments to FUSE_CAP_POSIX_ACL
 	// in https://github.com/libfuse/libfuse/blob/master/include/fuse_common.h
 	// for details.
 	EnableAcl bool
+
+	// EnableStatx answers STATX requests (protocol 7.39 and up)
+	// through RawFileSystem.Statx. If unset, STATX is answered
+	// with ENOSYS, after which the kernel stops sending it and
+	// uses GETATTR for the remainder of the mount.
+	EnableStatx bool
+
+	// EnablePoll answers POLL requests through RawFileSystem.Poll,
+	// so poll(2), select(2) and epoll(7) can wait for files to
+	// become ready; see Server.NotifyPoll. If unset, POLL is
+	// answered with ENOSYS, after which the kernel reports all
+	// files as always ready.
+	EnablePoll bool
+
+	// EnablePassthrough negotiates FUSE passthrough (Linux 6.9
+	// and up), which lets reads and writes on opened files go
+	// directly to a backing file registered with
+	// Server.RegisterBackingFd. Registering backing files
+	// requires CAP_SYS_ADMIN. If the kernel does not support
+	// passthrough, the option has no effect.
+	EnablePassthrough bool
+
+	// RootNodeId, if set, is the node ID by which the file system
+	// knows the root of this mount. The kernel always refers to
+	// the root as FUSE_ROOT_ID; the server replaces it with
+	// RootNodeId in requests, and RootNodeId with FUSE_ROOT_ID in
+	// notifications. This lets one file system serve a
+	// subdirectory at a second mount point, as fs.AddMount does.
+	RootNodeId uint64
+
+	// DontMask asks the kernel not to apply the umask of the
+	// calling process to the mode of new files, directories and
+	// nodes (CAP_DONT_MASK). The file system then receives the
+	// mode as requested, and must apply the umask, which is sent
+	// along on Linux since protocol 7.12 (PROTO_MINOR_NOTIFY_INVAL),
+	// itself. This is useful for file systems that handle default
+	// ACLs or other mode policies. If the kernel does not support
+	// it, the option has no effect, and the mode is masked as
+	// usual; check Server.NegotiatedSettings to tell.
+	DontMask bool
+
+	// EnableSymlinkCaching negotiates caching of symlink targets
+	// in the kernel (Linux 4.20 and up). The result of READLINK is
+	// then kept in the page cache of the symlink until it is
+	// invalidated with InodeNotify, or the kernel evicts the
+	// inode. If the kernel does not support it, the option has
+	// no effect.
+	EnableSymlinkCaching bool
+
+	// EnableWritebackCache negotiates the writeback cache (Linux
+	// 3.15 and up). Writes then go to the kernel page cache and
+	// are sent to the file system later, in larger batches, which
+	// speeds up workloads doing many small writes.
+	//
+	// While it is active, the kernel keeps its own size, mtime
+	// and ctime for regular files and ignores those returned by
+	// GETATTR, so the file system must not change the size of
+	// files behind the kernel's back. The kernel may also READ
+	// from files opened write-only, to fill partial pages, and it
+	// handles O_APPEND itself; the fs package adjusts the open
+	// flags accordingly. Writes sent from the cache carry no
+	// caller information. If the kernel does not support it, the
+	// option has no effect.
+	EnableWritebackCache bool
+
+	// HandleKillPriv negotiates CAP_HANDLE_KILLPRIV_V2 (Linux 5.11
+	// and up). The kernel then leaves clearing the setuid and
+	// setgid bits to the file system, and asks for it with
+	// WRITE_KILL_SUIDGID on WRITE, FATTR_KILL_SUIDGID on SETATTR
+	// and OPEN_KILL_SUIDGID on OPEN and CREATE with O_TRUNC,
+	// whenever the caller lacks CAP_FSETID. The file system must
+	// also clear the bits on chown. The fs package handles the
+	// flags. If the kernel does not support it, the option has no
+	// effect.
+	HandleKillPriv bool
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -256,6 +476,15 @@ type MountOptions struct {
 // the outstanding request data is not reused, so the API call may
 // return EINTR without ensuring that child contexts have successfully
 // completed.
+//
+// To add cross-cutting behavior, such as tracing, access logging or
+// rate limiting, to a RawFileSystem, wrap it in a struct that embeds
+// it, and override only the methods to intercept; the other methods
+// are forwarded to the embedded file system. Wrappers compose by
+// nesting. Methods outside this interface, such as the InodeCount
+// that Server.InodeCount looks for, are not forwarded, so a wrapper
+// must define them itself to keep them. The fs package applies such
+// wrappers with Options.WrapRawFileSystem.
 type RawFileSystem interface {
 	String() string
 
@@ -280,6 +509,9 @@ type RawFileSystem interface {
 	GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) (code Status)
 	SetAttr(cancel <-chan struct{}, input *SetAttrIn, out *AttrOut) (code Status)
 
+	// Statx is only called if MountOptions.EnableStatx is set.
+	Statx(cancel <-chan struct{}, input *StatxIn, out *StatxOut) (code Status)
+
 	// Modifying structure.
 	Mknod(cancel <-chan struct{}, input *MknodIn, name string, out *EntryOut) (code Status)
 	Mkdir(cancel <-chan struct{}, input *MkdirIn, name string, out *EntryOut) (code Status)
@@ -312,16 +544,41 @@ type RawFileSystem interface {
 
 	// File handling.
 	Create(cancel <-chan struct{}, input *CreateIn, name string, out *CreateOut) (code Status)
+
+	// Tmpfile creates an unnamed file in the given directory, for
+	// open(2) with O_TMPFILE. The file can be given a name later
+	// with Link.
+	Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status)
+
 	Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status)
 	Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status)
 	Lseek(cancel <-chan struct{}, in *LseekIn, out *LseekOut) Status
 
+	// Poll returns the events for which the open file is ready.
+	// It is only called if MountOptions.EnablePoll is set.
+	Poll(cancel <-chan struct{}, input *PollIn, out *PollOut) Status
+
+	// Ioctl implements ioctl(2) on an open file. inbuf holds the
+	// input.InSize bytes the kernel copied from the caller. The
+	// returned data, at most input.OutSize bytes, is copied back
+	// to the caller, and out.Result is the return value of
+	// ioctl(2). For an ioctl with FUSE_IOCTL_UNRESTRICTED set, the
+	// file system may ask the kernel to retry with other buffers by
+	// setting FUSE_IOCTL_RETRY, InIovs and OutIovs in out, and
+	// returning the serialized IoctlIovecs.
+	Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, out *IoctlOut) (data []byte, code Status)
+
 	// File locking
 	GetLk(cancel <-chan struct{}, input *LkIn, out *LkOut) (code Status)
 	SetLk(cancel <-chan struct{}, input *LkIn) (code Status)
 	SetLkw(cancel <-chan struct{}, input *LkIn) (code Status)
 
 	Release(cancel <-chan struct{}, input *ReleaseIn)
+
+	// Write is passed the data in the buffer that the request
+	// was read into, without copying it. The buffer is reused for
+	// other requests once Write returns, so data must not be
+	// retained; copy what is needed after the call.
 	Write(cancel <-chan struct{}, input *WriteIn, data []byte) (written uint32, code Status)
 	CopyFileRange(cancel <-chan struct{}, input *CopyFileRangeIn) (written uint32, code Status)
 
@@ -338,6 +595,11 @@ type RawFileSystem interface {
 
 	StatFs(cancel <-chan struct{}, input *InHeader, out *StatfsOut) (code Status)
 
+	// SyncFs flushes all dirty data of the file system, for
+	// syncfs(2). Not all kernels send SYNCFS; if this returns
+	// ENOSYS, the kernel stops sending it.
+	SyncFs(cancel <-chan struct{}, input *SyncFsIn) (code Status)
+
 	// This is called on processing the first request. The
 	// filesystem implementation can use the server argument to
 	// talk back to the kernel (through notify methods).
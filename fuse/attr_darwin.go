@@ -6,6 +6,7 @@ package fuse
 
 import (
 	"syscall"
+	"time"
 )
 
 func (a *Attr) FromStat(s *syscall.Stat_t) {
@@ -24,3 +25,34 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Gid = uint32(s.Gid)
 	a.Rdev = uint32(s.Rdev)
 }
+
+// SetCrtime sets the creation (birth) time. macOS reports it, eg.
+// in getattrlist(2).
+func (a *Attr) SetCrtime(t time.Time) {
+	a.Crtime_ = uint64(t.Unix())
+	a.Crtimensec_ = uint32(t.Nanosecond())
+}
+
+// Crtime returns the creation (birth) time.
+func (a *Attr) Crtime() time.Time {
+	return time.Unix(int64(a.Crtime_), int64(a.Crtimensec_))
+}
+
+// FromAttr fills the basic statx fields and the birth time from a,
+// and sets Mask accordingly.
+func (s *Statx) FromAttr(a *Attr) {
+	s.Mask = STATX_BASIC_STATS | STATX_BTIME
+	s.Ino = a.Ino
+	s.Size = a.Size
+	s.Blocks = a.Blocks
+	s.Atime = SxTime{Sec: int64(a.Atime), Nsec: a.Atimensec}
+	s.Mtime = SxTime{Sec: int64(a.Mtime), Nsec: a.Mtimensec}
+	s.Ctime = SxTime{Sec: int64(a.Ctime), Nsec: a.Ctimensec}
+	s.Btime = SxTime{Sec: int64(a.Crtime_), Nsec: a.Crtimensec_}
+	s.Mode = uint16(a.Mode)
+	s.Nlink = a.Nlink
+	s.Uid = a.Uid
+	s.Gid = a.Gid
+	s.RdevMajor = uint32(a.Rdev>>24) & 0xff
+	s.RdevMinor = uint32(a.Rdev) & 0xffffff
+}
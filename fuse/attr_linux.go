@@ -6,6 +6,9 @@ package fuse
 
 import (
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func (a *Attr) FromStat(s *syscall.Stat_t) {
@@ -25,3 +28,57 @@ func (a *Attr) FromStat(s *syscall.Stat_t) {
 	a.Rdev = uint32(s.Rdev)
 	a.Blksize = uint32(s.Blksize)
 }
+
+// SetCrtime sets the creation (birth) time where the protocol
+// carries it. The attributes on Linux have none, so this does
+// nothing; the birth time is reported through Statx.Btime instead.
+func (a *Attr) SetCrtime(t time.Time) {
+}
+
+// Crtime returns the creation (birth) time, which is always the zero
+// time on Linux.
+func (a *Attr) Crtime() time.Time {
+	return time.Time{}
+}
+
+// FromAttr fills the basic statx fields from a, and sets Mask to
+// STATX_BASIC_STATS accordingly.
+func (s *Statx) FromAttr(a *Attr) {
+	s.Mask = STATX_BASIC_STATS
+	s.Ino = a.Ino
+	s.Size = a.Size
+	s.Blocks = a.Blocks
+	s.Atime = SxTime{Sec: int64(a.Atime), Nsec: a.Atimensec}
+	s.Mtime = SxTime{Sec: int64(a.Mtime), Nsec: a.Mtimensec}
+	s.Ctime = SxTime{Sec: int64(a.Ctime), Nsec: a.Ctimensec}
+	s.Mode = uint16(a.Mode)
+	s.Nlink = a.Nlink
+	s.Uid = a.Uid
+	s.Gid = a.Gid
+	s.RdevMajor = unix.Major(uint64(a.Rdev))
+	s.RdevMinor = unix.Minor(uint64(a.Rdev))
+	s.Blksize = a.Blksize
+}
+
+// FromStatx copies the result of a statx(2) call.
+func (s *Statx) FromStatx(st *unix.Statx_t) {
+	s.Mask = st.Mask
+	s.Blksize = st.Blksize
+	s.Attributes = st.Attributes
+	s.Nlink = st.Nlink
+	s.Uid = st.Uid
+	s.Gid = st.Gid
+	s.Mode = st.Mode
+	s.Ino = st.Ino
+	s.Size = st.Size
+	s.Blocks = st.Blocks
+	s.AttributesMask = st.Attributes_mask
+	s.Atime = SxTime{Sec: st.Atime.Sec, Nsec: st.Atime.Nsec}
+	s.Btime = SxTime{Sec: st.Btime.Sec, Nsec: st.Btime.Nsec}
+	s.Ctime = SxTime{Sec: st.Ctime.Sec, Nsec: st.Ctime.Nsec}
+	s.Mtime = SxTime{Sec: st.Mtime.Sec, Nsec: st.Mtime.Nsec}
+	s.RdevMajor = st.Rdev_major
+	s.RdevMinor = st.Rdev_minor
+	s.DevMajor = st.Dev_major
+	s.DevMinor = st.Dev_minor
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// slowLookupFS answers LOOKUP with ENOENT after a delay, and records
+// how many lookups run concurrently.
+type slowLookupFS struct {
+	RawFileSystem
+
+	delay   time.Duration
+	current int32
+	peak    int32
+	count   int32
+}
+
+func (fs *slowLookupFS) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) Status {
+	c := atomic.AddInt32(&fs.current, 1)
+	for {
+		p := atomic.LoadInt32(&fs.peak)
+		if c <= p || atomic.CompareAndSwapInt32(&fs.peak, p, c) {
+			break
+		}
+	}
+	time.Sleep(fs.delay)
+	atomic.AddInt32(&fs.current, -1)
+	atomic.AddInt32(&fs.count, 1)
+	return ENOENT
+}
+
+func mountSlowLookupFS(tb testing.TB, delay time.Duration, maxConcurrency int) (string, *slowLookupFS, func()) {
+	mnt, err := ioutil.TempDir("", "concurrency")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fs := &slowLookupFS{RawFileSystem: NewDefaultRawFileSystem(), delay: delay}
+	srv, err := NewServer(fs, mnt, &MountOptions{MaxConcurrency: maxConcurrency})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		tb.Fatal(err)
+	}
+	return mnt, fs, func() {
+		if err := srv.Unmount(); err != nil {
+			tb.Errorf("Unmount: %v", err)
+		}
+		syscall.Rmdir(mnt)
+	}
+}
+
+// statParallel stats n different names from n goroutines.
+func statParallel(mnt string, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var st syscall.Stat_t
+			syscall.Lstat(fmt.Sprintf("%s/file%d", mnt, i), &st)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	const max = 3
+	mnt, fs, clean := mountSlowLookupFS(t, 20*time.Millisecond, max)
+	defer clean()
+
+	statParallel(mnt, 30)
+	if got := atomic.LoadInt32(&fs.count); got != 30 {
+		t.Errorf("got %d lookups, want 30", got)
+	}
+	if got := atomic.LoadInt32(&fs.peak); got > max {
+		t.Errorf("got %d concurrent lookups, want at most %d", got, max)
+	}
+}
+
+func benchmarkMaxConcurrency(b *testing.B, maxConcurrency int) {
+	mnt, fs, clean := mountSlowLookupFS(b, time.Millisecond, maxConcurrency)
+	defer clean()
+
+	b.ResetTimer()
+	statParallel(mnt, b.N)
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt32(&fs.peak)), "peak-concurrency")
+}
+
+func BenchmarkMaxConcurrencyUnlimited(b *testing.B) {
+	benchmarkMaxConcurrency(b, 0)
+}
+
+func BenchmarkMaxConcurrency4(b *testing.B) {
+	benchmarkMaxConcurrency(b, 4)
+}
+
+func BenchmarkMaxConcurrency16(b *testing.B) {
+	benchmarkMaxConcurrency(b, 16)
+}
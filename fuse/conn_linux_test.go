@@ -0,0 +1,495 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type connTestFS struct {
+	RawFileSystem
+
+	// If set, GETATTR and SETLKW of node 7 block until block is
+	// closed.
+	block chan struct{}
+
+	// root is the node ID of the root directory, if not
+	// FUSE_ROOT_ID.
+	root uint64
+}
+
+func (fs *connTestFS) SetLkw(cancel <-chan struct{}, input *LkIn) Status {
+	if input.NodeId == 7 && fs.block != nil {
+		<-fs.block
+	}
+	return OK
+}
+
+func (fs *connTestFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	if input.NodeId == 7 && fs.block != nil {
+		<-fs.block
+	}
+	root := fs.root
+	if root == 0 {
+		root = FUSE_ROOT_ID
+	}
+	if input.NodeId != root {
+		return ENOENT
+	}
+	out.Mode = S_IFDIR | 0755
+	out.Ino = FUSE_ROOT_ID
+	return OK
+}
+
+// connRoundTrip sends the request in, and returns the reply header
+// and the reply data.
+func connRoundTrip(t *testing.T, f *os.File, in unsafe.Pointer, inSize uintptr) (*OutHeader, []byte) {
+	t.Helper()
+	hdr := (*InHeader)(in)
+	hdr.Length = uint32(inSize)
+	if _, err := f.Write((*[1 << 16]byte)(in)[:inSize]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	buf := make([]byte, 1<<16)
+	n, err := f.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	out := (*OutHeader)(unsafe.Pointer(&buf[0]))
+	if int(out.Length) != n {
+		t.Fatalf("got reply length %d, read %d bytes", out.Length, n)
+	}
+	if out.Unique != hdr.Unique {
+		t.Fatalf("got unique %d, want %d", out.Unique, hdr.Unique)
+	}
+	return out, buf[unsafe.Sizeof(OutHeader{}):n]
+}
+
+// newConnServer returns a Server over a socketpair that has
+// answered INIT, and the peer end.
+func newConnServer(t *testing.T) (*Server, *os.File) {
+	return newConnServerFS(t, &connTestFS{RawFileSystem: NewDefaultRawFileSystem()}, &MountOptions{})
+}
+
+// newConnServerFS is like newConnServer, but serves fs with opts.
+func newConnServerFS(t *testing.T, fs RawFileSystem, opts *MountOptions) (*Server, *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := os.NewFile(uintptr(fds[0]), "client")
+	// Non-blocking, so Close interrupts pending reads.
+	if err := syscall.SetNonblock(fds[1], true); err != nil {
+		t.Fatal(err)
+	}
+	serverConn := os.NewFile(uintptr(fds[1]), "server")
+
+	type result struct {
+		srv *Server
+		err error
+	}
+	created := make(chan result, 1)
+	go func() {
+		srv, err := NewServerFromConn(serverConn, fs, opts)
+		created <- result{srv, err}
+	}()
+
+	init := InitIn{
+		InHeader: InHeader{Opcode: _OP_INIT, Unique: 1},
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    _OUR_MINOR_VERSION,
+		Flags:    CAP_ASYNC_READ | CAP_SPLICE_READ | CAP_SPLICE_WRITE,
+	}
+	out, data := connRoundTrip(t, client, unsafe.Pointer(&init), unsafe.Sizeof(init))
+	if out.Status != 0 {
+		t.Fatalf("INIT: got status %d", out.Status)
+	}
+	if initOut := (*InitOut)(unsafe.Pointer(&data[0])); initOut.Major != _FUSE_KERNEL_VERSION {
+		t.Errorf("got major version %d, want %d", initOut.Major, _FUSE_KERNEL_VERSION)
+	}
+
+	r := <-created
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return r.srv, client
+}
+
+// serveConn starts serving, and returns a channel that is closed
+// when Serve returns.
+func serveConn(t *testing.T, srv *Server) chan struct{} {
+	served := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(served)
+	}()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	return served
+}
+
+func TestNewServerFromConn(t *testing.T) {
+	srv, client := newConnServer(t)
+	defer client.Close()
+	if srv.canSplice {
+		t.Error("splicing was enabled for a conn")
+	}
+	served := serveConn(t, srv)
+
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 2, NodeId: FUSE_ROOT_ID}}
+	out, data := connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr))
+	if out.Status != 0 {
+		t.Fatalf("GETATTR: got status %d", out.Status)
+	}
+	if attr := (*AttrOut)(unsafe.Pointer(&data[0])); attr.Mode != S_IFDIR|0755 {
+		t.Errorf("got mode %o, want %o", attr.Mode, S_IFDIR|0755)
+	}
+
+	getattr = GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 3, NodeId: 42}}
+	out, _ = connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr))
+	if out.Status != -int32(ENOENT) {
+		t.Errorf("GETATTR: got status %d, want %d", out.Status, -int32(ENOENT))
+	}
+
+	// Closing the peer ends Serve.
+	client.Close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the peer closed")
+	}
+}
+
+func TestNewServerFromConnUnmount(t *testing.T) {
+	srv, client := newConnServer(t)
+	defer client.Close()
+	served := serveConn(t, srv)
+
+	if err := srv.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Unmount")
+	}
+}
+
+func TestInflightRequests(t *testing.T) {
+	srv, client := newConnServer(t)
+	defer client.Close()
+	fs := srv.fileSystem.(*connTestFS)
+	fs.block = make(chan struct{})
+	serveConn(t, srv)
+	defer srv.Unmount()
+
+	if n := srv.InflightRequests(); n != 0 {
+		t.Errorf("got %d requests in flight before any, want 0", n)
+	}
+	if age := srv.OldestRequestAge(); age != 0 {
+		t.Errorf("got age %v without requests, want 0", age)
+	}
+
+	// A lock wait does not count for the age.
+	setlkw := LkIn{InHeader: InHeader{Opcode: _OP_SETLKW, Unique: 3, NodeId: 7}}
+	setlkw.Length = uint32(unsafe.Sizeof(setlkw))
+	if _, err := client.Write((*[1 << 16]byte)(unsafe.Pointer(&setlkw))[:unsafe.Sizeof(setlkw)]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 2, NodeId: 7}}
+	getattr.Length = uint32(unsafe.Sizeof(getattr))
+	if _, err := client.Write((*[1 << 16]byte)(unsafe.Pointer(&getattr))[:unsafe.Sizeof(getattr)]); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.InflightRequests() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d requests in flight, want 2", srv.InflightRequests())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if age := srv.OldestRequestAge(); age < 10*time.Millisecond || age >= 100*time.Millisecond {
+		t.Errorf("got age %v, want at least 10ms, and less than the SETLKW's", age)
+	}
+
+	close(fs.block)
+	buf := make([]byte, 1<<16)
+	for i := 0; i < 2; i++ {
+		if _, err := client.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for srv.InflightRequests() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d requests in flight after the reply, want 0", srv.InflightRequests())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRootNodeId(t *testing.T) {
+	fs := &connTestFS{RawFileSystem: NewDefaultRawFileSystem(), root: 5}
+	srv, client := newConnServerFS(t, fs, &MountOptions{RootNodeId: 5})
+	defer client.Close()
+	serveConn(t, srv)
+
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 2, NodeId: FUSE_ROOT_ID}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr)); out.Status != 0 {
+		t.Fatalf("GETATTR of the root: got status %d", out.Status)
+	}
+
+	go srv.InodeNotify(5, 0, 0)
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if hdr := (*OutHeader)(unsafe.Pointer(&buf[0])); hdr.Unique != 0 || hdr.Status != -int32(NOTIFY_INVAL_INODE) {
+		t.Fatalf("got header %+v, want INVAL_INODE notification", hdr)
+	}
+	if n < int(unsafe.Sizeof(OutHeader{})+unsafe.Sizeof(NotifyInvalInodeOut{})) {
+		t.Fatalf("short notification: %d bytes", n)
+	}
+	if out := (*NotifyInvalInodeOut)(unsafe.Pointer(&buf[unsafe.Sizeof(OutHeader{})])); out.Ino != FUSE_ROOT_ID {
+		t.Errorf("notification for node %d, want %d", out.Ino, FUSE_ROOT_ID)
+	}
+
+	// The root of the file system is not part of this mount.
+	if st := srv.InodeNotify(FUSE_ROOT_ID, 0, 0); st != ENOENT {
+		t.Errorf("InodeNotify of FUSE_ROOT_ID: got %v, want ENOENT", st)
+	}
+}
+
+// writeTestFS records a copy of the data of the last WRITE, and the
+// capacity of the slice it was passed in.
+type writeTestFS struct {
+	RawFileSystem
+
+	data    []byte
+	dataCap int
+}
+
+func (fs *writeTestFS) Write(cancel <-chan struct{}, input *WriteIn, data []byte) (uint32, Status) {
+	fs.data = append([]byte(nil), data...)
+	fs.dataCap = cap(data)
+	return uint32(len(data)), OK
+}
+
+func TestWriteData(t *testing.T) {
+	fs := &writeTestFS{RawFileSystem: NewDefaultRawFileSystem()}
+	srv, client := newConnServerFS(t, fs, &MountOptions{})
+	defer client.Close()
+	serveConn(t, srv)
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	buf := make([]byte, unsafe.Sizeof(WriteIn{})+uintptr(len(payload)))
+	in := (*WriteIn)(unsafe.Pointer(&buf[0]))
+	*in = WriteIn{
+		InHeader: InHeader{Opcode: _OP_WRITE, Unique: 2, NodeId: FUSE_ROOT_ID},
+		Size:     uint32(len(payload)),
+	}
+	copy(buf[unsafe.Sizeof(WriteIn{}):], payload)
+
+	out, data := connRoundTrip(t, client, unsafe.Pointer(&buf[0]), uintptr(len(buf)))
+	if out.Status != 0 {
+		t.Fatalf("WRITE: got status %d", out.Status)
+	}
+	if wo := (*WriteOut)(unsafe.Pointer(&data[0])); wo.Size != uint32(len(payload)) {
+		t.Errorf("got size %d, want %d", wo.Size, len(payload))
+	}
+	if !bytes.Equal(fs.data, payload) {
+		t.Errorf("got %d bytes of data, want %d", len(fs.data), len(payload))
+	}
+	if fs.dataCap != len(payload) {
+		t.Errorf("got cap %d for %d bytes of data", fs.dataCap, len(payload))
+	}
+}
+
+type syncFsTestFS struct {
+	RawFileSystem
+
+	calls int
+}
+
+func (fs *syncFsTestFS) SyncFs(cancel <-chan struct{}, input *SyncFsIn) Status {
+	fs.calls++
+	return OK
+}
+
+func TestSyncFs(t *testing.T) {
+	fs := &syncFsTestFS{RawFileSystem: NewDefaultRawFileSystem()}
+	srv, client := newConnServerFS(t, fs, &MountOptions{})
+	defer client.Close()
+	serveConn(t, srv)
+
+	in := SyncFsIn{InHeader: InHeader{Opcode: _OP_SYNCFS, Unique: 2, NodeId: FUSE_ROOT_ID}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&in), unsafe.Sizeof(in)); out.Status != 0 {
+		t.Fatalf("SYNCFS: got status %d", out.Status)
+	}
+	if fs.calls != 1 {
+		t.Errorf("got %d SyncFs calls, want 1", fs.calls)
+	}
+}
+
+func TestSyncFsDefault(t *testing.T) {
+	srv, client := newConnServer(t)
+	defer client.Close()
+	serveConn(t, srv)
+
+	in := SyncFsIn{InHeader: InHeader{Opcode: _OP_SYNCFS, Unique: 2, NodeId: FUSE_ROOT_ID}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&in), unsafe.Sizeof(in)); out.Status != -int32(ENOSYS) {
+		t.Errorf("SYNCFS: got status %d, want %d", out.Status, -int32(ENOSYS))
+	}
+}
+
+// panicTestFS panics in GetAttr of node 3.
+type panicTestFS struct {
+	connTestFS
+}
+
+func (fs *panicTestFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	if input.NodeId == 3 {
+		panic("getattr")
+	}
+	return fs.connTestFS.GetAttr(cancel, input, out)
+}
+
+func TestPanicHandler(t *testing.T) {
+	fs := &panicTestFS{connTestFS{RawFileSystem: NewDefaultRawFileSystem()}}
+	var got interface{}
+	srv, client := newConnServerFS(t, fs, &MountOptions{
+		PanicHandler: func(r interface{}) { got = r },
+	})
+	defer client.Close()
+	serveConn(t, srv)
+
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 2, NodeId: 3}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr)); out.Status != -int32(EIO) {
+		t.Errorf("GETATTR: got status %d, want %d", out.Status, -int32(EIO))
+	}
+	if got != "getattr" {
+		t.Errorf("PanicHandler got %v, want %q", got, "getattr")
+	}
+
+	// The server keeps going.
+	getattr = GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 3, NodeId: FUSE_ROOT_ID}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr)); out.Status != 0 {
+		t.Errorf("GETATTR after panic: got status %d", out.Status)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	const perSecond = 10
+	writes := NewRateLimiter(perSecond, 1)
+	fs := &writeTestFS{RawFileSystem: &connTestFS{RawFileSystem: NewDefaultRawFileSystem()}}
+	srv, client := newConnServerFS(t, fs, &MountOptions{
+		Throttle: func(cancel <-chan struct{}, op string) Status {
+			if op == "WRITE" {
+				return writes.Wait(cancel)
+			}
+			return OK
+		},
+	})
+	defer client.Close()
+	serveConn(t, srv)
+
+	payload := []byte("hello")
+	writeReq := func(unique uint64) []byte {
+		buf := make([]byte, unsafe.Sizeof(WriteIn{})+uintptr(len(payload)))
+		in := (*WriteIn)(unsafe.Pointer(&buf[0]))
+		*in = WriteIn{
+			InHeader: InHeader{Opcode: _OP_WRITE, Unique: unique, NodeId: FUSE_ROOT_ID, Length: uint32(len(buf))},
+			Size:     uint32(len(payload)),
+		}
+		copy(buf[unsafe.Sizeof(WriteIn{}):], payload)
+		return buf
+	}
+
+	const n = 5
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		buf := writeReq(uint64(10 + i))
+		if out, _ := connRoundTrip(t, client, unsafe.Pointer(&buf[0]), uintptr(len(buf))); out.Status != 0 {
+			t.Fatalf("WRITE: got status %d", out.Status)
+		}
+	}
+	if dt, min := time.Since(start), (n-1)*time.Second/perSecond; dt < min {
+		t.Errorf("%d writes took %v, want at least %v", n, dt, min)
+	}
+
+	// While a write waits for its turn, other requests are
+	// answered.
+	if _, err := client.Write(writeReq(20)); err != nil {
+		t.Fatal(err)
+	}
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 21, NodeId: FUSE_ROOT_ID}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr)); out.Status != 0 {
+		t.Errorf("GETATTR: got status %d", out.Status)
+	}
+	buf := make([]byte, 1024)
+	if _, err := client.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if hdr := (*OutHeader)(unsafe.Pointer(&buf[0])); hdr.Unique != 20 || hdr.Status != 0 {
+		t.Errorf("got reply %+v, want WRITE 20", hdr)
+	}
+}
+
+func TestRequestTimeoutSingleThreaded(t *testing.T) {
+	fs := &connTestFS{RawFileSystem: NewDefaultRawFileSystem(), block: make(chan struct{})}
+	srv, client := newConnServerFS(t, fs, &MountOptions{
+		SingleThreaded: true,
+		RequestTimeout: 50 * time.Millisecond,
+	})
+	defer client.Close()
+	serveConn(t, srv)
+	defer srv.Unmount()
+
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 2, NodeId: 7}}
+	if out, _ := connRoundTrip(t, client, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr)); out.Status != -int32(EIO) {
+		t.Fatalf("GETATTR: got status %d, want %d", out.Status, -int32(EIO))
+	}
+
+	// The timed out GETATTR still runs, so the next request waits.
+	getattr = GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 3, NodeId: FUSE_ROOT_ID}}
+	getattr.Length = uint32(unsafe.Sizeof(getattr))
+	if _, err := client.Write((*[1 << 16]byte)(unsafe.Pointer(&getattr))[:unsafe.Sizeof(getattr)]); err != nil {
+		t.Fatal(err)
+	}
+	replies := make(chan *OutHeader, 1)
+	go func() {
+		buf := make([]byte, 1<<16)
+		if _, err := client.Read(buf); err != nil {
+			close(replies)
+			return
+		}
+		replies <- (*OutHeader)(unsafe.Pointer(&buf[0]))
+	}()
+	select {
+	case out := <-replies:
+		t.Fatalf("got reply %+v while the timed out request was running", out)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(fs.block)
+	select {
+	case out := <-replies:
+		if out == nil || out.Unique != 3 || out.Status != 0 {
+			t.Errorf("got reply %+v, want GETATTR 3", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply after the timed out request returned")
+	}
+}
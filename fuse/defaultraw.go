@@ -37,6 +37,14 @@ func (fs *defaultRawFileSystem) Lookup(cancel <-chan struct{}, header *InHeader,
 func (fs *defaultRawFileSystem) Forget(nodeID, nlookup uint64) {
 }
 
+func (fs *defaultRawFileSystem) SyncFs(cancel <-chan struct{}, input *SyncFsIn) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) Statx(cancel <-chan struct{}, input *StatxIn, out *StatxOut) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) (code Status) {
 	return ENOSYS
 }
@@ -105,6 +113,10 @@ func (fs *defaultRawFileSystem) Create(cancel <-chan struct{}, input *CreateIn,
 	return ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Tmpfile(cancel <-chan struct{}, input *CreateIn, out *CreateOut) (code Status) {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) OpenDir(cancel <-chan struct{}, input *OpenIn, out *OpenOut) (status Status) {
 	return ENOSYS
 }
@@ -163,6 +175,14 @@ func (fs *defaultRawFileSystem) CopyFileRange(cancel <-chan struct{}, input *Cop
 	return 0, ENOSYS
 }
 
+func (fs *defaultRawFileSystem) Ioctl(cancel <-chan struct{}, input *IoctlIn, inbuf []byte, out *IoctlOut) ([]byte, Status) {
+	return nil, ENOTTY
+}
+
+func (fs *defaultRawFileSystem) Poll(cancel <-chan struct{}, input *PollIn, out *PollOut) Status {
+	return ENOSYS
+}
+
 func (fs *defaultRawFileSystem) Lseek(cancel <-chan struct{}, in *LseekIn, out *LseekOut) Status {
 	return ENOSYS
 }
@@ -27,6 +27,12 @@ type DirEntry struct {
 
 	// Ino is the inode number.
 	Ino uint64
+
+	// Off is the offset of the entry in the directory. The
+	// kernel passes it back to continue the listing after this
+	// entry, eg. after seekdir(3). It must not be 0. If unset,
+	// entries are numbered sequentially.
+	Off uint64
 }
 
 func (d DirEntry) String() string {
@@ -40,8 +46,8 @@ type DirEntryList struct {
 	// capacity of the underlying buffer
 	size int
 	// offset is the requested location in the directory. go-fuse
-	// currently counts in number of directory entries, but this is an
-	// implementation detail and may change in the future.
+	// counts in number of directory entries, unless the entries
+	// carry their own offset in DirEntry.Off.
 	// If `offset` and `fs.fileEntry.dirOffset` disagree, then a
 	// directory seek has taken place.
 	offset uint64
@@ -62,12 +68,21 @@ func NewDirEntryList(data []byte, off uint64) *DirEntryList {
 // AddDirEntry tries to add an entry, and reports whether it
 // succeeded.
 func (l *DirEntryList) AddDirEntry(e DirEntry) bool {
-	return l.Add(0, e.Name, e.Ino, e.Mode)
+	return l.add(0, e.Name, e.Ino, e.Mode, e.Off)
 }
 
 // Add adds a direntry to the DirEntryList, returning whether it
 // succeeded.
 func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) bool {
+	return l.add(prefix, name, inode, mode, 0)
+}
+
+// add adds a direntry. If off is 0, the entry gets the offset
+// following the previous one.
+func (l *DirEntryList) add(prefix int, name string, inode uint64, mode uint32, off uint64) bool {
+	if off == 0 {
+		off = l.offset + 1
+	}
 	if inode == 0 {
 		inode = FUSE_UNKNOWN_INO
 	}
@@ -82,7 +97,7 @@ func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) b
 	l.buf = l.buf[:newLen]
 	oldLen += prefix
 	dirent := (*_Dirent)(unsafe.Pointer(&l.buf[oldLen]))
-	dirent.Off = l.offset + 1
+	dirent.Off = off
 	dirent.Ino = inode
 	dirent.NameLen = uint32(len(name))
 	dirent.Typ = modeToType(mode)
@@ -112,7 +127,7 @@ func (l *DirEntryList) Add(prefix int, name string, inode uint64, mode uint32) b
 func (l *DirEntryList) AddDirLookupEntry(e DirEntry) *EntryOut {
 	const entryOutSize = int(unsafe.Sizeof(EntryOut{}))
 	oldLen := len(l.buf)
-	ok := l.Add(entryOutSize, e.Name, e.Ino, e.Mode)
+	ok := l.add(entryOutSize, e.Name, e.Ino, e.Mode, e.Off)
 	if !ok {
 		return nil
 	}
@@ -139,3 +154,41 @@ func (l *DirEntryList) FixMode(mode uint32) {
 func (l *DirEntryList) bytes() []byte {
 	return l.buf
 }
+
+// Entries decodes the entries added to a READDIR list. This is for
+// tests that call RawFileSystem.ReadDir directly. It does not work
+// for READDIRPLUS lists.
+func (l *DirEntryList) Entries() []DirEntry {
+	var r []DirEntry
+	buf := l.buf
+	for len(buf) >= direntSize {
+		d := (*_Dirent)(unsafe.Pointer(&buf[0]))
+		name := string(buf[direntSize : direntSize+int(d.NameLen)])
+		r = append(r, DirEntry{
+			Name: name,
+			Ino:  d.Ino,
+			Mode: d.Typ << 12,
+			Off:  d.Off,
+		})
+		n := direntSize + int(d.NameLen)
+		buf = buf[n+(8-n&7)&7:]
+	}
+	return r
+}
+
+// dirPlusNodeIds returns the NodeIds of the entries in the data of a
+// READDIRPLUS reply, leaving out the entries without one.
+func dirPlusNodeIds(buf []byte) []uint64 {
+	const entryOutSize = int(unsafe.Sizeof(EntryOut{}))
+	var r []uint64
+	for len(buf) >= entryOutSize+direntSize {
+		e := (*EntryOut)(unsafe.Pointer(&buf[0]))
+		if e.NodeId != 0 {
+			r = append(r, e.NodeId)
+		}
+		d := (*_Dirent)(unsafe.Pointer(&buf[entryOutSize]))
+		n := direntSize + int(d.NameLen)
+		buf = buf[entryOutSize+n+(8-n&7)&7:]
+	}
+	return r
+}
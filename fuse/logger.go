@@ -0,0 +1,122 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	// LogDebug is used for the request/response trace printed
+	// if MountOptions.Debug is set. It is high volume.
+	LogDebug LogLevel = iota
+
+	// LogInfo is used for noteworthy events, such as the mount
+	// commands executed.
+	LogInfo
+
+	// LogWarning is used for unexpected conditions that the
+	// server can recover from, eg. unknown opcodes.
+	LogWarning
+
+	// LogError is used for failures, eg. errors reading from the
+	// FUSE device.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarning:
+		return "WARNING"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger receives the diagnostic messages of the server. It can be
+// used to route them into a structured logging package.
+type Logger interface {
+	// Enabled reports whether messages of the given level
+	// should be logged. It is consulted before a message is
+	// formatted, so dropping messages this way is cheap.
+	Enabled(level LogLevel) bool
+
+	// Log logs a message. The keyvals are alternating keys and
+	// values that give more context to the message.
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// NewStdLogger returns a Logger that prints all messages to l. If l
+// is nil, the standard logger of the log package is used. This is
+// the default if MountOptions.Logger is not set.
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s *stdLogger) Enabled(level LogLevel) bool {
+	return true
+}
+
+func (s *stdLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if len(keyvals) > 0 {
+		var b bytes.Buffer
+		b.WriteString(msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			var v interface{} = "(MISSING)"
+			if i+1 < len(keyvals) {
+				v = keyvals[i+1]
+			}
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], v)
+		}
+		msg = b.String()
+	}
+	if s.l == nil {
+		log.Output(2, msg)
+	} else {
+		s.l.Output(2, msg)
+	}
+}
+
+var defaultLogger Logger = &stdLogger{}
+
+func (o *MountOptions) logger() Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return defaultLogger
+}
+
+// debugEnabled returns whether to produce debug messages. Callers
+// should check it before building expensive debug output.
+func (o *MountOptions) debugEnabled() bool {
+	return o.Debug && o.logger().Enabled(LogDebug)
+}
+
+// logf formats a message and logs it, if the logger wants it. Debug
+// messages are only logged if Debug is set.
+func (o *MountOptions) logf(level LogLevel, format string, args ...interface{}) {
+	if level == LogDebug && !o.Debug {
+		return
+	}
+	l := o.logger()
+	if !l.Enabled(level) {
+		return
+	}
+	l.Log(level, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"testing"
+)
+
+type recordingLogger struct {
+	min  LogLevel
+	msgs []string
+}
+
+func (l *recordingLogger) Enabled(level LogLevel) bool {
+	return level >= l.min
+}
+
+func (l *recordingLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.msgs = append(l.msgs, level.String()+" "+msg)
+}
+
+func TestLoggerLevels(t *testing.T) {
+	rec := &recordingLogger{min: LogWarning}
+	opts := &MountOptions{Debug: true, Logger: rec}
+	opts.logf(LogDebug, "debug %d", 1)
+	opts.logf(LogWarning, "warning %d", 2)
+	opts.logf(LogError, "error %d", 3)
+	if opts.debugEnabled() {
+		t.Errorf("debugEnabled with minimum level %v", rec.min)
+	}
+
+	rec.min = LogDebug
+	opts.Debug = false
+	opts.logf(LogDebug, "debug %d", 4)
+	if opts.debugEnabled() {
+		t.Errorf("debugEnabled without Debug")
+	}
+
+	opts.Debug = true
+	opts.logf(LogDebug, "debug %d", 5)
+
+	want := []string{"WARNING warning 2", "ERROR error 3", "DEBUG debug 5"}
+	if !reflect.DeepEqual(rec.msgs, want) {
+		t.Errorf("got %q, want %q", rec.msgs, want)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0))
+	l.Log(LogInfo, "plain")
+	l.Log(LogError, "mount failed", "dir", "/mnt", "err", EIO)
+	if got, want := buf.String(), "plain\nmount failed dir=/mnt err=5=input/output error\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
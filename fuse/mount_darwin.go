@@ -41,10 +41,14 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 		return 0, err
 	}
 
-	cmd := exec.Command(bin,
+	args := []string{
 		"-o", strings.Join(opts.optionsStrings(), ","),
 		"-o", fmt.Sprintf("iosize=%d", opts.MaxWrite),
-		mountPoint)
+	}
+	if opts.VolumeName != "" {
+		args = append(args, "-o", "volname="+opts.VolumeName)
+	}
+	cmd := exec.Command(bin, append(args, mountPoint)...)
 	cmd.ExtraFiles = []*os.File{remote} // fd would be (index + 3)
 	cmd.Env = append(os.Environ(),
 		"_FUSE_CALL_BY_LIB=",
@@ -86,10 +90,32 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 	return fd, err
 }
 
+// checkDeviceFd checks that fd is open on a character device. The
+// device numbers of the macFUSE devices are not fixed.
+func checkDeviceFd(fd int) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("DeviceFd %d: %v", fd, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR {
+		return fmt.Errorf("DeviceFd %d is not a FUSE device", fd)
+	}
+	return nil
+}
+
 func unmount(dir string, opts *MountOptions) error {
 	return syscall.Unmount(dir, 0)
 }
 
+// _MNT_FORCE is missing from the syscall package on darwin.
+const _MNT_FORCE = 0x80000
+
+// unmountLazy forcibly unmounts dir. macOS has no lazy unmount, so
+// operations on files that are still open will fail.
+func unmountLazy(dir string, opts *MountOptions) error {
+	return syscall.Unmount(dir, _MNT_FORCE)
+}
+
 func getConnection(local *os.File) (int, error) {
 	var data [4]byte
 	control := make([]byte, 4*256)
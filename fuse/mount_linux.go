@@ -7,7 +7,6 @@ package fuse
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path"
@@ -44,7 +43,8 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 	var flags uintptr
 	flags |= syscall.MS_NOSUID | syscall.MS_NODEV
 
-	// some values we need to pass to mount, but override possible since opts.Options comes after
+	// some values we need to pass to mount; user_id and group_id can be
+	// overridden by root, since opts.Options comes after
 	var r = []string{
 		fmt.Sprintf("fd=%d", fd),
 		"rootmode=40000",
@@ -57,7 +57,7 @@ func mountDirect(mountPoint string, opts *MountOptions, ready chan<- error) (fd
 		r = append(r, "allow_other")
 	}
 
-	err = syscall.Mount(opts.FsName, mountPoint, "fuse."+opts.Name, opts.DirectMountFlags, strings.Join(r, ","))
+	err = syscall.Mount(source, mountPoint, "fuse."+opts.Name, opts.DirectMountFlags, strings.Join(r, ","))
 	if err != nil {
 		syscall.Close(fd)
 		return
@@ -92,9 +92,7 @@ func callFusermount(mountPoint string, opts *MountOptions) (fd int, err error) {
 	if s := opts.optionsStrings(); len(s) > 0 {
 		cmd = append(cmd, "-o", strings.Join(s, ","))
 	}
-	if opts.Debug {
-		log.Printf("callFusermount: executing %q", cmd)
-	}
+	opts.logf(LogDebug, "callFusermount: executing %q", cmd)
 	proc, err := os.StartProcess(bin,
 		cmd,
 		&os.ProcAttr{
@@ -129,8 +127,8 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 		fd, err := mountDirect(mountPoint, opts, ready)
 		if err == nil {
 			return fd, nil
-		} else if opts.Debug {
-			log.Printf("mount: failed to do direct mount: %s", err)
+		} else {
+			opts.logf(LogDebug, "mount: failed to do direct mount: %s", err)
 		}
 	}
 
@@ -138,9 +136,7 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 	// works.
 	fd = parseFuseFd(mountPoint)
 	if fd >= 0 {
-		if opts.Debug {
-			log.Printf("mount: magic mountpoint %q, using fd %d", mountPoint, fd)
-		}
+		opts.logf(LogDebug, "mount: magic mountpoint %q, using fd %d", mountPoint, fd)
 	} else {
 		// Usual case: mount via the `fusermount` suid helper
 		fd, err = callFusermount(mountPoint, opts)
@@ -156,6 +152,19 @@ func mount(mountPoint string, opts *MountOptions, ready chan<- error) (fd int, e
 	return fd, err
 }
 
+// checkDeviceFd checks that fd is open on /dev/fuse, which is the
+// misc device 10:229.
+func checkDeviceFd(fd int) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("DeviceFd %d: %v", fd, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFCHR || st.Rdev != 10<<8|229 {
+		return fmt.Errorf("DeviceFd %d is not /dev/fuse", fd)
+	}
+	return nil
+}
+
 func unmount(mountPoint string, opts *MountOptions) (err error) {
 	if opts.DirectMount {
 		// Attempt to directly unmount, if fails fallback to fusermount method
@@ -172,9 +181,33 @@ func unmount(mountPoint string, opts *MountOptions) (err error) {
 	errBuf := bytes.Buffer{}
 	cmd := exec.Command(bin, "-u", mountPoint)
 	cmd.Stderr = &errBuf
-	if opts.Debug {
-		log.Printf("unmount: executing %q", cmd.Args)
+	opts.logf(LogDebug, "unmount: executing %q", cmd.Args)
+	err = cmd.Run()
+	if errBuf.Len() > 0 {
+		return fmt.Errorf("%s (code %v)\n",
+			errBuf.String(), err)
 	}
+	return err
+}
+
+// unmountLazy detaches the mount point, leaving the file system
+// accessible through open files until those are closed.
+func unmountLazy(mountPoint string, opts *MountOptions) (err error) {
+	if opts.DirectMount {
+		err := syscall.Unmount(mountPoint, syscall.MNT_DETACH)
+		if err == nil {
+			return nil
+		}
+	}
+
+	bin, err := fusermountBinary()
+	if err != nil {
+		return err
+	}
+	errBuf := bytes.Buffer{}
+	cmd := exec.Command(bin, "-u", "-z", mountPoint)
+	cmd.Stderr = &errBuf
+	opts.logf(LogDebug, "unmount: executing %q", cmd.Args)
 	err = cmd.Run()
 	if errBuf.Len() > 0 {
 		return fmt.Errorf("%s (code %v)\n",
@@ -3,8 +3,15 @@ package fuse
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // TestMountDevFd tests the special `/dev/fd/N` mountpoint syntax, where a
@@ -98,3 +105,602 @@ func TestMountMaxWrite(t *testing.T) {
 		})
 	}
 }
+
+func TestWaitMountTimeout(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without Serve, the mount never becomes ready.
+	if err := srv.WaitMountTimeout(100 * time.Millisecond); err != ErrMountTimeout {
+		t.Fatalf("got %v, want ErrMountTimeout", err)
+	}
+
+	go srv.Serve()
+	if err := srv.WaitMountTimeout(5 * time.Second); err != nil {
+		t.Fatalf("WaitMountTimeout: %v", err)
+	}
+	if err := srv.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+}
+
+func TestNegotiatedSettings(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	opts := &MountOptions{
+		MaxWrite:     32 * 1024,
+		MaxReadAhead: 16 * 1024,
+	}
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := srv.NegotiatedSettings()
+	if s.Major != _FUSE_KERNEL_VERSION || s.Minor == 0 || s.Minor > srv.KernelSettings().Minor {
+		t.Errorf("got version %d.%d, kernel has %d.%d", s.Major, s.Minor,
+			srv.KernelSettings().Major, srv.KernelSettings().Minor)
+	}
+	if maj, min := srv.ProtocolVersion(); maj != int(s.Major) || min != int(s.Minor) {
+		t.Errorf("ProtocolVersion: got %d.%d, want %d.%d", maj, min, s.Major, s.Minor)
+	}
+	if s.MaxWrite != 32*1024 {
+		t.Errorf("got MaxWrite %d, want %d", s.MaxWrite, 32*1024)
+	}
+	if s.MaxReadAhead > 16*1024 {
+		t.Errorf("got MaxReadAhead %d, want at most %d", s.MaxReadAhead, 16*1024)
+	}
+	if s.Flags != srv.KernelSettings().Flags {
+		t.Errorf("got flags %x, want %x", s.Flags, srv.KernelSettings().Flags)
+	}
+}
+
+func TestServeRetriesEINTR(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail every other read with EINTR.
+	var reads, interrupts int32
+	srv.deviceRead = func(fd int, p []byte) (int, error) {
+		if atomic.AddInt32(&reads, 1)%2 == 1 {
+			atomic.AddInt32(&interrupts, 1)
+			return 0, syscall.EINTR
+		}
+		return syscall.Read(fd, p)
+	}
+
+	served := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(served)
+	}()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	for i := 0; i < 5; i++ {
+		if err := syscall.Stat(mnt+"/file", &st); err != syscall.ENOSYS {
+			t.Fatalf("Stat: got %v, want ENOSYS", err)
+		}
+	}
+	if atomic.LoadInt32(&interrupts) == 0 {
+		t.Error("no EINTR was injected")
+	}
+
+	if err := srv.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after unmount")
+	}
+}
+
+type countingLatencyMap struct {
+	mu     sync.Mutex
+	counts map[string]int
+	total  time.Duration
+}
+
+func (m *countingLatencyMap) Add(name string, dt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[name]++
+	m.total += dt
+}
+
+func TestRecordLatencies(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lat := &countingLatencyMap{counts: map[string]int{}}
+	srv.RecordLatencies(lat)
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	syscall.Lstat(mnt+"/file", &st)
+
+	lat.mu.Lock()
+	defer lat.mu.Unlock()
+	if lat.counts["LOOKUP"] == 0 {
+		t.Errorf("got counts %v, want LOOKUP", lat.counts)
+	}
+	if lat.total <= 0 {
+		t.Errorf("got total latency %v", lat.total)
+	}
+}
+
+func TestUnmountLazy(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the mount busy.
+	fd, err := syscall.Open(mnt, unix.O_PATH|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		srv.Unmount()
+		t.Fatal(err)
+	}
+	if err := srv.UnmountLazy(); err != nil {
+		syscall.Close(fd)
+		srv.Unmount()
+		t.Fatal(err)
+	}
+
+	mounts, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(mounts), " "+mnt+" ") {
+		t.Errorf("%s still in /proc/self/mounts after UnmountLazy", mnt)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	syscall.Close(fd)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the last file was closed")
+	}
+}
+
+func TestMountDeviceFd(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	// Let fusermount do the mount, in place of a privileged helper.
+	fd, err := callFusermount(mnt, &MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &MountOptions{DeviceFd: fd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt+"/file", &st); err != syscall.ENOSYS {
+		t.Errorf("Stat: got %v, want ENOSYS", err)
+	}
+	if err := srv.Unmount(); err != nil {
+		t.Errorf("Unmount: %v", err)
+	}
+}
+
+func TestMountDeviceFdInvalid(t *testing.T) {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[1])
+	if _, err := NewServer(NewDefaultRawFileSystem(), "/mnt", &MountOptions{DeviceFd: p[0]}); err == nil || !strings.Contains(err.Error(), "not /dev/fuse") {
+		t.Errorf("pipe: got %v, want 'not /dev/fuse' error", err)
+	}
+	// NewServer owns the descriptor, also when it fails.
+	if _, err := unix.FcntlInt(uintptr(p[0]), unix.F_GETFD, 0); err != syscall.EBADF {
+		t.Errorf("DeviceFd after failure: got %v, want EBADF", err)
+		syscall.Close(p[0])
+	}
+
+	// An unmounted /dev/fuse.
+	fd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("cannot open /dev/fuse: %v", err)
+	}
+	if _, err := NewServer(NewDefaultRawFileSystem(), "/mnt", &MountOptions{DeviceFd: fd}); err == nil || !strings.Contains(err.Error(), "not mounted") {
+		t.Errorf("unmounted device: got %v, want 'not mounted' error", err)
+	}
+}
+
+// handoverFS serves a root directory with a single file, whose
+// contents name the generation of the server.
+type handoverFS struct {
+	RawFileSystem
+	gen int
+}
+
+func (fs *handoverFS) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) Status {
+	if header.NodeId != FUSE_ROOT_ID || name != "file" {
+		return ENOENT
+	}
+	out.NodeId = 2
+	out.Mode = S_IFREG | 0644
+	out.Size = 64
+	return OK
+}
+
+func (fs *handoverFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	out.Mode = S_IFDIR | 0755
+	out.Size = uint64(fs.gen)
+	return OK
+}
+
+func (fs *handoverFS) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	out.Fh = 42
+	out.OpenFlags = FOPEN_DIRECT_IO
+	return OK
+}
+
+func (fs *handoverFS) Read(cancel <-chan struct{}, input *ReadIn, buf []byte) (ReadResult, Status) {
+	if input.Fh != 42 {
+		return nil, EBADF
+	}
+	return ReadResultData([]byte(fmt.Sprintf("gen %d", fs.gen))), OK
+}
+
+func TestExportFd(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	old, err := NewServer(&handoverFS{NewDefaultRawFileSystem(), 1}, mnt, &MountOptions{EnableExport: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		old.Serve()
+		close(served)
+	}()
+	if err := old.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := syscall.Open(mnt+"/file", syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if n, err := syscall.Pread(fd, buf, 0); err != nil || string(buf[:n]) != "gen 1" {
+		t.Fatalf("Pread: got %q, %v, want 'gen 1'", buf[:n], err)
+	}
+
+	devFd, err := old.ExportFd()
+	if err != nil {
+		t.Fatalf("ExportFd: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after ExportFd")
+	}
+	if err := old.Unmount(); err != nil {
+		t.Errorf("Unmount after ExportFd: %v", err)
+	}
+
+	// Requests wait in the kernel until the new server reads them.
+	statDone := make(chan error, 1)
+	go func() {
+		var st syscall.Stat_t
+		err := syscall.Stat(mnt, &st)
+		if err == nil && st.Size != 2 {
+			err = fmt.Errorf("got size %d, want 2", st.Size)
+		}
+		statDone <- err
+	}()
+	select {
+	case err := <-statDone:
+		t.Fatalf("Stat returned without a server: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	srv, err := NewServer(&handoverFS{NewDefaultRawFileSystem(), 2}, mnt, &MountOptions{
+		DeviceFd: devFd,
+		Resume: &ResumeSettings{
+			KernelSettings:     *old.KernelSettings(),
+			NegotiatedSettings: *old.NegotiatedSettings(),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer func() {
+		syscall.Close(fd)
+		if err := srv.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+	}()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+	if s := srv.NegotiatedSettings(); *s != *old.NegotiatedSettings() {
+		t.Errorf("got settings %v, want %v", s, old.NegotiatedSettings())
+	}
+
+	select {
+	case err := <-statDone:
+		if err != nil {
+			t.Errorf("Stat: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stat was not answered by the new server")
+	}
+	// The file opened through the old server stays valid.
+	if n, err := syscall.Pread(fd, buf, 0); err != nil || string(buf[:n]) != "gen 2" {
+		t.Errorf("Pread: got %q, %v, want 'gen 2'", buf[:n], err)
+	}
+}
+
+// mountInfo returns the file system type and the source of the
+// mount at mnt from /proc/self/mountinfo.
+func mountInfo(t *testing.T, mnt string) (fstype, source string) {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The optional fields end with "-", followed by the
+		// type, the source and the super block options.
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != mnt {
+			continue
+		}
+		for i, f := range fields {
+			if f == "-" && i+2 < len(fields) {
+				return fields[i+1], fields[i+2]
+			}
+		}
+	}
+	t.Fatalf("%s not found in /proc/self/mountinfo", mnt)
+	return "", ""
+}
+
+func TestMountFsNameSubtype(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		opts       MountOptions
+		wantSource string
+	}{
+		{"fields", MountOptions{FsName: "my-source", Name: "mytype"}, "my-source"},
+		{"options", MountOptions{Options: []string{"fsname=my-source", "subtype=mytype"}}, "my-source"},
+		{"both", MountOptions{FsName: "my-source", Name: "mytype", Options: []string{"fsname=my-source"}}, "my-source"},
+		{"direct", MountOptions{FsName: "my-source", Name: "mytype", DirectMount: true}, "my-source"},
+		// Without FsName, the source is the subtype.
+		{"nofsname", MountOptions{Name: "mytype"}, "mytype"},
+		{"nofsnamedirect", MountOptions{Name: "mytype", DirectMount: true}, "mytype"},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			mnt, err := ioutil.TempDir("", "TestMountFsNameSubtype")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Rmdir(mnt)
+
+			srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go srv.Serve()
+			defer srv.Unmount()
+			if err := srv.WaitMount(); err != nil {
+				t.Fatal(err)
+			}
+
+			fstype, source := mountInfo(t, mnt)
+			if fstype != "fuse.mytype" || source != tc.wantSource {
+				t.Errorf("got type %q, source %q, want fuse.mytype, %s", fstype, source, tc.wantSource)
+			}
+		})
+	}
+}
+
+func TestCheckOptionsPrivileged(t *testing.T) {
+	root := os.Geteuid() == 0
+	for _, o := range []string{"suid", "dev", "user_id=0", "group_id=0"} {
+		opts := MountOptions{Options: []string{o}}
+		if err := opts.checkOptions(); (err == nil) != root {
+			t.Errorf("%q as root=%v: got %v", o, root, err)
+		}
+	}
+}
+
+func TestCheckOptionsVolumeName(t *testing.T) {
+	// Commas only matter for macFUSE.
+	opts := MountOptions{VolumeName: "a,b"}
+	if err := opts.checkOptions(); err != nil {
+		t.Errorf("checkOptions: %v", err)
+	}
+}
+
+func TestMountOptionsRejected(t *testing.T) {
+	for _, opts := range []MountOptions{
+		{Options: []string{"fd=3"}},
+		{Options: []string{"rootmode=40000"}},
+		{FsName: "a", Options: []string{"fsname=b"}},
+		{Name: "a", Options: []string{"subtype=b"}},
+		{VolumeName: "a", Options: []string{"volname=b"}},
+	} {
+		mnt, err := ioutil.TempDir("", "TestMountOptionsRejected")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Rmdir(mnt)
+
+		if srv, err := NewServer(NewDefaultRawFileSystem(), mnt, &opts); err == nil {
+			go srv.Serve()
+			srv.Unmount()
+			t.Errorf("NewServer(%v) succeeded", opts.Options)
+		}
+	}
+}
+
+// timeoutFS serves a file "slow", whose LOOKUP hangs, and a file
+// "file", whose OPEN hangs, until unblock is closed. It ignores
+// cancellation.
+type timeoutFS struct {
+	RawFileSystem
+	unblock  chan struct{}
+	forgets  chan uint64
+	releases chan uint64
+}
+
+func (fs *timeoutFS) Lookup(cancel <-chan struct{}, header *InHeader, name string, out *EntryOut) Status {
+	switch name {
+	case "slow":
+		<-fs.unblock
+		out.NodeId = 2
+	case "file":
+		out.NodeId = 3
+	default:
+		return ENOENT
+	}
+	out.Mode = S_IFREG | 0644
+	return OK
+}
+
+func (fs *timeoutFS) Forget(nodeid, nlookup uint64) {
+	fs.forgets <- nodeid
+}
+
+func (fs *timeoutFS) GetAttr(cancel <-chan struct{}, input *GetAttrIn, out *AttrOut) Status {
+	out.Mode = S_IFDIR | 0755
+	return OK
+}
+
+func (fs *timeoutFS) Open(cancel <-chan struct{}, input *OpenIn, out *OpenOut) Status {
+	<-fs.unblock
+	out.Fh = 42
+	return OK
+}
+
+func (fs *timeoutFS) Release(cancel <-chan struct{}, input *ReleaseIn) {
+	fs.releases <- input.Fh
+}
+
+func TestRequestTimeout(t *testing.T) {
+	mnt, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Rmdir(mnt)
+
+	fs := &timeoutFS{
+		RawFileSystem: NewDefaultRawFileSystem(),
+		unblock:       make(chan struct{}),
+		forgets:       make(chan uint64, 10),
+		releases:      make(chan uint64, 10),
+	}
+	srv, err := NewServer(fs, mnt, &MountOptions{
+		RequestTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Unmount()
+	if err := srv.WaitMount(); err != nil {
+		t.Fatal(err)
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/slow", &st); err != syscall.EIO {
+		t.Errorf("Lstat: got %v, want EIO", err)
+	}
+	if _, err := syscall.Open(mnt+"/file", syscall.O_RDONLY, 0); err != syscall.EIO {
+		t.Errorf("Open: got %v, want EIO", err)
+	}
+
+	// The late replies are discarded, and what they gave out is
+	// taken back.
+	close(fs.unblock)
+	want := map[string]bool{"forget 2": true, "release 42": true}
+	for len(want) > 0 {
+		select {
+		case id := <-fs.forgets:
+			delete(want, fmt.Sprintf("forget %d", id))
+		case fh := <-fs.releases:
+			delete(want, fmt.Sprintf("release %d", fh))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing %v", want)
+		}
+	}
+
+	// The server still works.
+	if err := syscall.Lstat(mnt+"/slow", &st); err != nil {
+		t.Errorf("Lstat after timeout: %v", err)
+	}
+}
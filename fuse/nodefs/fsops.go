@@ -500,6 +500,26 @@ func (c *rawBridge) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRa
 	return 0, fuse.ENOSYS
 }
 
+func (c *rawBridge) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, out *fuse.IoctlOut) ([]byte, fuse.Status) {
+	return nil, fuse.ENOTTY
+}
+
+func (c *rawBridge) Poll(cancel <-chan struct{}, input *fuse.PollIn, out *fuse.PollOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
 func (fs *rawBridge) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
 	return fuse.ENOSYS
 }
+
+func (c *rawBridge) Statx(cancel <-chan struct{}, input *fuse.StatxIn, out *fuse.StatxOut) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (c *rawBridge) SyncFs(cancel <-chan struct{}, input *fuse.SyncFsIn) fuse.Status {
+	return fuse.ENOSYS
+}
+
+func (c *rawBridge) Tmpfile(cancel <-chan struct{}, input *fuse.CreateIn, out *fuse.CreateOut) fuse.Status {
+	return fuse.ENOSYS
+}
@@ -10,7 +10,6 @@ import (
 	"log"
 	"reflect"
 	"runtime"
-	"syscall"
 	"time"
 	"unsafe"
 )
@@ -61,6 +60,9 @@ const (
 	_OP_RENAME2         = uint32(45) // protocol version 23.
 	_OP_LSEEK           = uint32(46) // protocol version 24
 	_OP_COPY_FILE_RANGE = uint32(47) // protocol version 28.
+	_OP_SYNCFS          = uint32(50) // protocol version 34.
+	_OP_TMPFILE         = uint32(51) // protocol version 37.
+	_OP_STATX           = uint32(52) // protocol version 39.
 
 	// The following entries don't have to be compatible across Go-FUSE versions.
 	_OP_NOTIFY_INVAL_ENTRY    = uint32(100)
@@ -68,8 +70,9 @@ const (
 	_OP_NOTIFY_STORE_CACHE    = uint32(102)
 	_OP_NOTIFY_RETRIEVE_CACHE = uint32(103)
 	_OP_NOTIFY_DELETE         = uint32(104) // protocol version 18
+	_OP_NOTIFY_POLL           = uint32(105)
 
-	_OPCODE_COUNT = uint32(105)
+	_OPCODE_COUNT = uint32(106)
 )
 
 ////////////////////////////////////////////////////////////////
@@ -77,20 +80,30 @@ const (
 func doInit(server *Server, req *request) {
 	input := (*InitIn)(req.inData)
 	if input.Major != _FUSE_KERNEL_VERSION {
-		log.Printf("Major versions does not match. Given %d, want %d\n", input.Major, _FUSE_KERNEL_VERSION)
+		server.opts.logf(LogError, "Major versions does not match. Given %d, want %d", input.Major, _FUSE_KERNEL_VERSION)
 		req.status = EIO
 		return
 	}
 	if input.Minor < _MINIMUM_MINOR_VERSION {
-		log.Printf("Minor version is less than we support. Given %d, want at least %d\n", input.Minor, _MINIMUM_MINOR_VERSION)
+		server.opts.logf(LogError, "Minor version is less than we support. Given %d, want at least %d", input.Minor, _MINIMUM_MINOR_VERSION)
 		req.status = EIO
 		return
 	}
 
+	kernelFlags := input.Flags64()
+
 	server.reqMu.Lock()
 	server.kernelSettings = *input
 	server.kernelSettings.Flags = input.Flags & (CAP_ASYNC_READ | CAP_BIG_WRITES | CAP_FILE_OPS |
 		CAP_READDIRPLUS | CAP_NO_OPEN_SUPPORT | CAP_PARALLEL_DIROPS)
+	// Flags2 and the rest are not valid for older kernels.
+	server.kernelSettings.Flags2 = 0
+	server.kernelSettings.Unused = [11]uint32{}
+
+	if server.opts.EnablePassthrough && server.conn == nil && kernelFlags&CAP_PASSTHROUGH != 0 {
+		server.kernelSettings.Flags |= CAP_INIT_EXT
+		server.kernelSettings.Flags2 |= uint32(CAP_PASSTHROUGH >> 32)
+	}
 
 	if server.opts.EnableLocks {
 		server.kernelSettings.Flags |= CAP_FLOCK_LOCKS | CAP_POSIX_LOCKS
@@ -99,6 +112,18 @@ func doInit(server *Server, req *request) {
 	if server.opts.EnableAcl {
 		server.kernelSettings.Flags |= CAP_POSIX_ACL
 	}
+	if server.opts.EnableSymlinkCaching {
+		server.kernelSettings.Flags |= input.Flags & CAP_CACHE_SYMLINKS
+	}
+	if server.opts.DontMask {
+		server.kernelSettings.Flags |= input.Flags & CAP_DONT_MASK
+	}
+	if server.opts.EnableWritebackCache {
+		server.kernelSettings.Flags |= input.Flags & CAP_WRITEBACK_CACHE
+	}
+	if server.opts.HandleKillPriv {
+		server.kernelSettings.Flags |= input.Flags & CAP_HANDLE_KILLPRIV_V2
+	}
 	if server.opts.SyncRead {
 		// Clear CAP_ASYNC_READ
 		server.kernelSettings.Flags &= ^uint32(CAP_ASYNC_READ)
@@ -116,7 +141,7 @@ func doInit(server *Server, req *request) {
 	}
 	server.kernelSettings.Flags |= dataCacheMode
 
-	if input.Minor >= 13 {
+	if input.Minor >= 13 && server.conn == nil {
 		server.setSplice()
 	}
 	server.reqMu.Unlock()
@@ -130,6 +155,12 @@ func doInit(server *Server, req *request) {
 		MaxWrite:            uint32(server.opts.MaxWrite),
 		CongestionThreshold: uint16(server.opts.MaxBackground * 3 / 4),
 		MaxBackground:       uint16(server.opts.MaxBackground),
+		Flags2:              server.kernelSettings.Flags2,
+	}
+	if out.Flags2&uint32(CAP_PASSTHROUGH>>32) != 0 {
+		// Backing files may not themselves be on a stacked
+		// file system.
+		out.MaxStackDepth = 1
 	}
 
 	if server.opts.MaxReadAhead != 0 && uint32(server.opts.MaxReadAhead) < out.MaxReadAhead {
@@ -147,6 +178,10 @@ func doInit(server *Server, req *request) {
 		req.handler = &tweaked
 	}
 
+	server.reqMu.Lock()
+	server.initOut = *out
+	server.reqMu.Unlock()
+
 	req.status = OK
 }
 
@@ -165,6 +200,16 @@ func doCreate(server *Server, req *request) {
 	req.status = status
 }
 
+// doTmpfile ignores the name argument, which is a placeholder.
+func doTmpfile(server *Server, req *request) {
+	out := (*CreateOut)(req.outData())
+	req.status = server.fileSystem.Tmpfile(req.cancel, (*CreateIn)(req.inData), out)
+}
+
+func doSyncFs(server *Server, req *request) {
+	req.status = server.fileSystem.SyncFs(req.cancel, (*SyncFsIn)(req.inData))
+}
+
 func doReadDir(server *Server, req *request) {
 	in := (*ReadIn)(req.inData)
 	buf := server.allocOut(req, in.Size)
@@ -197,7 +242,15 @@ func doSetattr(server *Server, req *request) {
 }
 
 func doWrite(server *Server, req *request) {
-	n, status := server.fileSystem.Write(req.cancel, (*WriteIn)(req.inData), req.arg)
+	input := (*WriteIn)(req.inData)
+	data := req.arg
+	if int(input.Size) < len(data) {
+		data = data[:input.Size]
+	}
+	// Cap the slice, so appending to it cannot overwrite the
+	// rest of the read buffer.
+	data = data[:len(data):len(data)]
+	n, status := server.fileSystem.Write(req.cancel, input, data)
 	o := (*WriteOut)(req.outData())
 	o.Size = n
 	req.status = status
@@ -211,7 +264,7 @@ func doNotifyReply(server *Server, req *request) {
 	server.retrieveMu.Unlock()
 
 	badf := func(format string, argv ...interface{}) {
-		log.Printf("notify reply: "+format, argv...)
+		server.opts.logf(LogWarning, "notify reply: "+format, argv...)
 	}
 
 	if reading == nil {
@@ -279,6 +332,10 @@ func doGetXAttr(server *Server, req *request) {
 		// For input.size==0, returning ERANGE is an error.
 		req.status = OK
 		out.Size = n
+	} else if req.status.Ok() && input.Size > 0 && n > input.Size {
+		// The data did not fit, and must not be sent truncated.
+		req.status = ERANGE
+		req.flatData = req.flatData[:0]
 	} else if req.status.Ok() {
 		// ListXAttr called with an empty buffer returns the current size of
 		// the list but does not touch the buffer (see man 2 listxattr).
@@ -297,6 +354,17 @@ func doGetAttr(server *Server, req *request) {
 	req.status = s
 }
 
+func doStatx(server *Server, req *request) {
+	if !server.opts.EnableStatx {
+		// The kernel remembers ENOSYS, and falls back to GETATTR
+		// for the rest of the mount.
+		req.status = ENOSYS
+		return
+	}
+	out := (*StatxOut)(req.outData())
+	req.status = server.fileSystem.Statx(req.cancel, (*StatxIn)(req.inData), out)
+}
+
 // doForget - forget one NodeId
 func doForget(server *Server, req *request) {
 	if !server.opts.RememberInodes {
@@ -310,7 +378,7 @@ func doBatchForget(server *Server, req *request) {
 	wantBytes := uintptr(in.Count) * unsafe.Sizeof(_ForgetOne{})
 	if uintptr(len(req.arg)) < wantBytes {
 		// We have no return value to complain, so log an error.
-		log.Printf("Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
+		server.opts.logf(LogError, "Too few bytes for batch forget. Got %d bytes, want %d (%d entries)",
 			len(req.arg), wantBytes, in.Count)
 	}
 
@@ -322,10 +390,8 @@ func doBatchForget(server *Server, req *request) {
 
 	forgets := *(*[]_ForgetOne)(unsafe.Pointer(h))
 	for i, f := range forgets {
-		if server.opts.Debug {
-			log.Printf("doBatchForget: rx %d %d/%d: FORGET n%d {Nlookup=%d}",
-				req.inHeader.Unique, i+1, len(forgets), f.NodeId, f.Nlookup)
-		}
+		server.opts.logf(LogDebug, "doBatchForget: rx %d %d/%d: FORGET n%d {Nlookup=%d}",
+			req.inHeader.Unique, i+1, len(forgets), f.NodeId, f.Nlookup)
 		if f.NodeId == pollHackInode {
 			continue
 		}
@@ -443,7 +509,30 @@ func doStatFs(server *Server, req *request) {
 }
 
 func doIoctl(server *Server, req *request) {
-	req.status = Status(syscall.ENOTTY)
+	in := (*IoctlIn)(req.inData)
+	out := (*IoctlOut)(req.outData())
+	data, status := server.fileSystem.Ioctl(req.cancel, in, req.arg, out)
+	if !status.Ok() {
+		req.status = status
+		return
+	}
+	if out.Flags&FUSE_IOCTL_RETRY == 0 && len(data) > int(in.OutSize) {
+		server.opts.logf(LogWarning, "ioctl %x: reply of %d bytes exceeds %d", in.Cmd, len(data), in.OutSize)
+		req.status = EIO
+		return
+	}
+	req.flatData = data
+	req.status = OK
+}
+
+func doPoll(server *Server, req *request) {
+	if !server.opts.EnablePoll {
+		// The kernel stops sending POLL, and reports files
+		// as always ready.
+		req.status = ENOSYS
+		return
+	}
+	req.status = server.fileSystem.Poll(req.cancel, (*PollIn)(req.inData), (*PollOut)(req.outData()))
 }
 
 func doDestroy(server *Server, req *request) {
@@ -564,7 +653,7 @@ func init() {
 		_OP_GETXATTR:        unsafe.Sizeof(GetXAttrIn{}),
 		_OP_LISTXATTR:       unsafe.Sizeof(GetXAttrIn{}),
 		_OP_FLUSH:           unsafe.Sizeof(FlushIn{}),
-		_OP_INIT:            unsafe.Sizeof(InitIn{}),
+		_OP_INIT:            unsafe.Offsetof(InitIn{}.Flags2),
 		_OP_OPENDIR:         unsafe.Sizeof(OpenIn{}),
 		_OP_READDIR:         unsafe.Sizeof(ReadIn{}),
 		_OP_RELEASEDIR:      unsafe.Sizeof(ReleaseIn{}),
@@ -576,14 +665,17 @@ func init() {
 		_OP_CREATE:          unsafe.Sizeof(CreateIn{}),
 		_OP_INTERRUPT:       unsafe.Sizeof(InterruptIn{}),
 		_OP_BMAP:            unsafe.Sizeof(_BmapIn{}),
-		_OP_IOCTL:           unsafe.Sizeof(_IoctlIn{}),
-		_OP_POLL:            unsafe.Sizeof(_PollIn{}),
+		_OP_IOCTL:           unsafe.Sizeof(IoctlIn{}),
+		_OP_POLL:            unsafe.Sizeof(PollIn{}),
 		_OP_NOTIFY_REPLY:    unsafe.Sizeof(NotifyRetrieveIn{}),
 		_OP_FALLOCATE:       unsafe.Sizeof(FallocateIn{}),
 		_OP_READDIRPLUS:     unsafe.Sizeof(ReadIn{}),
 		_OP_RENAME2:         unsafe.Sizeof(RenameIn{}),
 		_OP_LSEEK:           unsafe.Sizeof(LseekIn{}),
 		_OP_COPY_FILE_RANGE: unsafe.Sizeof(CopyFileRangeIn{}),
+		_OP_SYNCFS:          unsafe.Sizeof(SyncFsIn{}),
+		_OP_TMPFILE:         unsafe.Sizeof(CreateIn{}),
+		_OP_STATX:           unsafe.Sizeof(StatxIn{}),
 	} {
 		operationHandlers[op].InputSize = sz
 		if sz > maxInputSize {
@@ -609,15 +701,18 @@ func init() {
 		_OP_GETLK:                 unsafe.Sizeof(LkOut{}),
 		_OP_CREATE:                unsafe.Sizeof(CreateOut{}),
 		_OP_BMAP:                  unsafe.Sizeof(_BmapOut{}),
-		_OP_IOCTL:                 unsafe.Sizeof(_IoctlOut{}),
-		_OP_POLL:                  unsafe.Sizeof(_PollOut{}),
+		_OP_IOCTL:                 unsafe.Sizeof(IoctlOut{}),
+		_OP_POLL:                  unsafe.Sizeof(PollOut{}),
 		_OP_NOTIFY_INVAL_ENTRY:    unsafe.Sizeof(NotifyInvalEntryOut{}),
 		_OP_NOTIFY_INVAL_INODE:    unsafe.Sizeof(NotifyInvalInodeOut{}),
 		_OP_NOTIFY_STORE_CACHE:    unsafe.Sizeof(NotifyStoreOut{}),
 		_OP_NOTIFY_RETRIEVE_CACHE: unsafe.Sizeof(NotifyRetrieveOut{}),
 		_OP_NOTIFY_DELETE:         unsafe.Sizeof(NotifyInvalDeleteOut{}),
+		_OP_NOTIFY_POLL:           unsafe.Sizeof(NotifyPollWakeupOut{}),
 		_OP_LSEEK:                 unsafe.Sizeof(LseekOut{}),
 		_OP_COPY_FILE_RANGE:       unsafe.Sizeof(WriteOut{}),
+		_OP_TMPFILE:               unsafe.Sizeof(CreateOut{}),
+		_OP_STATX:                 unsafe.Sizeof(StatxOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
@@ -668,11 +763,15 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    "NOTIFY_STORE",
 		_OP_NOTIFY_RETRIEVE_CACHE: "NOTIFY_RETRIEVE",
 		_OP_NOTIFY_DELETE:         "NOTIFY_DELETE",
+		_OP_NOTIFY_POLL:           "NOTIFY_POLL",
 		_OP_FALLOCATE:             "FALLOCATE",
 		_OP_READDIRPLUS:           "READDIRPLUS",
 		_OP_RENAME2:               "RENAME2",
 		_OP_LSEEK:                 "LSEEK",
 		_OP_COPY_FILE_RANGE:       "COPY_FILE_RANGE",
+		_OP_SYNCFS:                "SYNCFS",
+		_OP_TMPFILE:               "TMPFILE",
+		_OP_STATX:                 "STATX",
 	} {
 		operationHandlers[op].Name = v
 	}
@@ -713,6 +812,7 @@ func init() {
 		_OP_RENAME:          doRename,
 		_OP_STATFS:          doStatFs,
 		_OP_IOCTL:           doIoctl,
+		_OP_POLL:            doPoll,
 		_OP_DESTROY:         doDestroy,
 		_OP_NOTIFY_REPLY:    doNotifyReply,
 		_OP_FALLOCATE:       doFallocate,
@@ -721,6 +821,9 @@ func init() {
 		_OP_INTERRUPT:       doInterrupt,
 		_OP_COPY_FILE_RANGE: doCopyFileRange,
 		_OP_LSEEK:           doLseek,
+		_OP_SYNCFS:          doSyncFs,
+		_OP_TMPFILE:         doTmpfile,
+		_OP_STATX:           doStatx,
 	} {
 		operationHandlers[op].Func = v
 	}
@@ -742,11 +845,16 @@ func init() {
 		_OP_NOTIFY_STORE_CACHE:    func(ptr unsafe.Pointer) interface{} { return (*NotifyStoreOut)(ptr) },
 		_OP_NOTIFY_RETRIEVE_CACHE: func(ptr unsafe.Pointer) interface{} { return (*NotifyRetrieveOut)(ptr) },
 		_OP_NOTIFY_DELETE:         func(ptr unsafe.Pointer) interface{} { return (*NotifyInvalDeleteOut)(ptr) },
+		_OP_NOTIFY_POLL:           func(ptr unsafe.Pointer) interface{} { return (*NotifyPollWakeupOut)(ptr) },
+		_OP_POLL:                  func(ptr unsafe.Pointer) interface{} { return (*PollOut)(ptr) },
 		_OP_STATFS:                func(ptr unsafe.Pointer) interface{} { return (*StatfsOut)(ptr) },
 		_OP_SYMLINK:               func(ptr unsafe.Pointer) interface{} { return (*EntryOut)(ptr) },
 		_OP_GETLK:                 func(ptr unsafe.Pointer) interface{} { return (*LkOut)(ptr) },
 		_OP_LSEEK:                 func(ptr unsafe.Pointer) interface{} { return (*LseekOut)(ptr) },
+		_OP_IOCTL:                 func(ptr unsafe.Pointer) interface{} { return (*IoctlOut)(ptr) },
 		_OP_COPY_FILE_RANGE:       func(ptr unsafe.Pointer) interface{} { return (*WriteOut)(ptr) },
+		_OP_TMPFILE:               func(ptr unsafe.Pointer) interface{} { return (*CreateOut)(ptr) },
+		_OP_STATX:                 func(ptr unsafe.Pointer) interface{} { return (*StatxOut)(ptr) },
 	} {
 		operationHandlers[op].DecodeOut = f
 	}
@@ -760,7 +868,7 @@ func init() {
 		_OP_LISTXATTR:       func(ptr unsafe.Pointer) interface{} { return (*GetXAttrIn)(ptr) },
 		_OP_SETATTR:         func(ptr unsafe.Pointer) interface{} { return (*SetAttrIn)(ptr) },
 		_OP_INIT:            func(ptr unsafe.Pointer) interface{} { return (*InitIn)(ptr) },
-		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*_IoctlIn)(ptr) },
+		_OP_IOCTL:           func(ptr unsafe.Pointer) interface{} { return (*IoctlIn)(ptr) },
 		_OP_OPEN:            func(ptr unsafe.Pointer) interface{} { return (*OpenIn)(ptr) },
 		_OP_MKNOD:           func(ptr unsafe.Pointer) interface{} { return (*MknodIn)(ptr) },
 		_OP_CREATE:          func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
@@ -775,6 +883,7 @@ func init() {
 		_OP_RELEASE:         func(ptr unsafe.Pointer) interface{} { return (*ReleaseIn)(ptr) },
 		_OP_RELEASEDIR:      func(ptr unsafe.Pointer) interface{} { return (*ReleaseIn)(ptr) },
 		_OP_FALLOCATE:       func(ptr unsafe.Pointer) interface{} { return (*FallocateIn)(ptr) },
+		_OP_POLL:            func(ptr unsafe.Pointer) interface{} { return (*PollIn)(ptr) },
 		_OP_NOTIFY_REPLY:    func(ptr unsafe.Pointer) interface{} { return (*NotifyRetrieveIn)(ptr) },
 		_OP_READDIRPLUS:     func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
 		_OP_RENAME:          func(ptr unsafe.Pointer) interface{} { return (*Rename1In)(ptr) },
@@ -785,6 +894,9 @@ func init() {
 		_OP_INTERRUPT:       func(ptr unsafe.Pointer) interface{} { return (*InterruptIn)(ptr) },
 		_OP_LSEEK:           func(ptr unsafe.Pointer) interface{} { return (*LseekIn)(ptr) },
 		_OP_COPY_FILE_RANGE: func(ptr unsafe.Pointer) interface{} { return (*CopyFileRangeIn)(ptr) },
+		_OP_SYNCFS:          func(ptr unsafe.Pointer) interface{} { return (*SyncFsIn)(ptr) },
+		_OP_TMPFILE:         func(ptr unsafe.Pointer) interface{} { return (*CreateIn)(ptr) },
+		_OP_STATX:           func(ptr unsafe.Pointer) interface{} { return (*StatxIn)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
@@ -803,6 +915,7 @@ func init() {
 		_OP_RENAME2:     2,
 		_OP_RMDIR:       1,
 		_OP_SYMLINK:     2,
+		_OP_TMPFILE:     1,
 		_OP_UNLINK:      1,
 	} {
 		operationHandlers[op].FileNames = count
@@ -0,0 +1,32 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+// Opcodes that only macFUSE sends.
+const (
+	_OP_SETVOLNAME = uint32(61)
+	_OP_GETXTIMES  = uint32(62)
+	_OP_EXCHANGE   = uint32(63)
+)
+
+func init() {
+	for op, v := range map[uint32]string{
+		_OP_SETVOLNAME: "SETVOLNAME",
+		_OP_GETXTIMES:  "GETXTIMES",
+		_OP_EXCHANGE:   "EXCHANGE",
+	} {
+		operationHandlers[op].Name = v
+		operationHandlers[op].Func = doUnsupported
+	}
+}
+
+// doUnsupported answers the macFUSE specific requests, which the
+// RawFileSystem API has no methods for. Unlike for unknown opcodes,
+// no warning is logged, as macFUSE sends them in normal use; ENOSYS
+// makes it fall back to the generic operations, or report that the
+// operation is not supported.
+func doUnsupported(server *Server, req *request) {
+	req.status = ENOSYS
+}
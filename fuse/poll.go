@@ -36,7 +36,15 @@ func doPollHackLookup(ms *Server, req *request) {
 		// Kernel will try to read acl xattrs. Pretend we don't have any.
 		req.status = ENODATA
 	case _OP_POLL:
-		req.status = ENOSYS
+		if ms.opts.EnablePoll {
+			// ENOSYS would disable polling for the
+			// whole mount.
+			out := (*PollOut)(req.outData())
+			out.Revents = DEFAULT_POLLMASK
+			req.status = OK
+		} else {
+			req.status = ENOSYS
+		}
 
 	case _OP_ACCESS, _OP_FLUSH, _OP_RELEASE:
 		// Avoid upsetting the OSX mount process.
@@ -13,8 +13,9 @@ import (
 
 var (
 	writeFlagNames = map[int64]string{
-		WRITE_CACHE:     "CACHE",
-		WRITE_LOCKOWNER: "LOCKOWNER",
+		WRITE_CACHE:        "CACHE",
+		WRITE_LOCKOWNER:    "LOCKOWNER",
+		WRITE_KILL_SUIDGID: "KILL_SUIDGID",
 	}
 	readFlagNames = map[int64]string{
 		READ_LOCKOWNER: "LOCKOWNER",
@@ -46,9 +47,13 @@ var (
 		CAP_CACHE_SYMLINKS:      "CACHE_SYMLINKS",
 		CAP_NO_OPENDIR_SUPPORT:  "NO_OPENDIR_SUPPORT",
 		CAP_EXPLICIT_INVAL_DATA: "EXPLICIT_INVAL_DATA",
+		CAP_HANDLE_KILLPRIV_V2:  "HANDLE_KILLPRIV_V2",
+		CAP_INIT_EXT:            "INIT_EXT",
+		CAP_PASSTHROUGH:         "PASSTHROUGH",
 	}
 	releaseFlagNames = map[int64]string{
-		RELEASE_FLUSH: "FLUSH",
+		RELEASE_FLUSH:        "FLUSH",
+		RELEASE_FLOCK_UNLOCK: "FLOCK_UNLOCK",
 	}
 	openFlagNames = map[int64]string{
 		int64(os.O_WRONLY):        "WRONLY",
@@ -71,6 +76,10 @@ var (
 		FOPEN_NONSEEKABLE: "NONSEEK",
 		FOPEN_CACHE_DIR:   "CACHE_DIR",
 		FOPEN_STREAM:      "STREAM",
+
+		FOPEN_NOFLUSH:                "NOFLUSH",
+		FOPEN_PARALLEL_DIRECT_WRITES: "PARALLEL_DIRECT_WRITES",
+		FOPEN_PASSTHROUGH:            "PASSTHROUGH",
 	}
 	accessFlagName = map[int64]string{
 		X_OK: "x",
@@ -140,6 +149,9 @@ func (in *SetAttrIn) string() string {
 	if in.Valid&FATTR_FH != 0 {
 		s = append(s, fmt.Sprintf("fh %d", in.Fh))
 	}
+	if in.Valid&FATTR_KILL_SUIDGID != 0 {
+		s = append(s, "kill_suidgid")
+	}
 	// TODO - FATTR_ATIME_NOW = (1 << 7), FATTR_MTIME_NOW = (1 << 8), FATTR_LOCKOWNER = (1 << 9)
 	return fmt.Sprintf("{%s}", strings.Join(s, ", "))
 }
@@ -163,13 +175,17 @@ func (in *OpenOut) string() string {
 func (in *InitIn) string() string {
 	return fmt.Sprintf("{%d.%d Ra %d %s}",
 		in.Major, in.Minor, in.MaxReadAhead,
-		flagString(initFlagNames, int64(in.Flags), ""))
+		flagString(initFlagNames, int64(in.Flags64()), ""))
 }
 
 func (o *InitOut) string() string {
+	flags := uint64(o.Flags)
+	if flags&CAP_INIT_EXT != 0 {
+		flags |= uint64(o.Flags2) << 32
+	}
 	return fmt.Sprintf("{%d.%d Ra %d %s %d/%d Wr %d Tg %d MaxPages %d}",
 		o.Major, o.Minor, o.MaxReadAhead,
-		flagString(initFlagNames, int64(o.Flags), ""),
+		flagString(initFlagNames, int64(flags), ""),
 		o.CongestionThreshold, o.MaxBackground, o.MaxWrite,
 		o.TimeGran, o.MaxPages)
 }
@@ -207,6 +223,17 @@ func (o *AttrOut) string() string {
 		ft(o.AttrValid, o.AttrValidNsec), &o.Attr)
 }
 
+func (in *StatxIn) string() string {
+	return fmt.Sprintf("{Fh %d flags 0x%x mask 0x%x}", in.Fh(), in.SxFlags, in.SxMask)
+}
+
+func (o *StatxOut) string() string {
+	return fmt.Sprintf(
+		"{tA=%gs mask 0x%x M0%o SZ=%d L=%d %d:%d i%d}",
+		ft(o.AttrValid, o.AttrValidNsec), o.Mask, o.Mode, o.Size, o.Nlink,
+		o.Uid, o.Gid, o.Ino)
+}
+
 // ft converts (seconds , nanoseconds) -> float(seconds)
 func ft(tsec uint64, tnsec uint32) float64 {
 	return float64(tsec) + float64(tnsec)*1E-9
@@ -293,6 +320,28 @@ func (o *LseekOut) string() string {
 	return fmt.Sprintf("{%d}", o.Offset)
 }
 
+func (in *PollIn) string() string {
+	return fmt.Sprintf("{Fh %d kh %d flags 0x%x events 0x%x}", in.Fh, in.Kh, in.Flags, in.Events)
+}
+
+func (o *PollOut) string() string {
+	return fmt.Sprintf("{revents 0x%x}", o.Revents)
+}
+
+func (o *NotifyPollWakeupOut) string() string {
+	return fmt.Sprintf("{kh %d}", o.Kh)
+}
+
+func (in *IoctlIn) string() string {
+	return fmt.Sprintf("{Fh %d cmd 0x%x arg 0x%x in %d out %d flags 0x%x}",
+		in.Fh, in.Cmd, in.Arg, in.InSize, in.OutSize, in.Flags)
+}
+
+func (o *IoctlOut) string() string {
+	return fmt.Sprintf("{result %d flags 0x%x iovs %d/%d}",
+		o.Result, o.Flags, o.InIovs, o.OutIovs)
+}
+
 // Print pretty prints FUSE data types for kernel communication
 func Print(obj interface{}) string {
 	t, ok := obj.(interface {
@@ -0,0 +1,80 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+// FUSE_KERNEL_VERSION is the major version of the FUSE protocol. It
+// has not changed since Linux 2.6.
+const FUSE_KERNEL_VERSION = _FUSE_KERNEL_VERSION
+
+// Minor versions of the FUSE protocol that introduced features that
+// file systems may want to gate on. Compare them against the minor
+// version returned by Server.ProtocolVersion, which is the version
+// both sides agreed on, and which determines the layout of the
+// messages. The kernel may speak a newer version; see
+// Server.KernelSettings for that.
+const (
+	// NOTIFY_INVAL_ENTRY and NOTIFY_INVAL_INODE notifications,
+	// and the umask in CREATE, MKNOD and MKDIR (CAP_DONT_MASK).
+	PROTO_MINOR_NOTIFY_INVAL = 12
+
+	// MaxBackground and CongestionThreshold in the INIT reply.
+	PROTO_MINOR_MAX_BACKGROUND = 13
+
+	// Splicing request and reply data (CAP_SPLICE_*).
+	PROTO_MINOR_SPLICE = 14
+
+	// NOTIFY_STORE_CACHE and NOTIFY_RETRIEVE_CACHE.
+	PROTO_MINOR_STORE_RETRIEVE = 15
+
+	// BATCH_FORGET.
+	PROTO_MINOR_BATCH_FORGET = 16
+
+	// flock(2) locks (CAP_FLOCK_LOCKS).
+	PROTO_MINOR_FLOCK = 17
+
+	// NOTIFY_DELETE.
+	PROTO_MINOR_NOTIFY_DELETE = 18
+
+	// FALLOCATE.
+	PROTO_MINOR_FALLOCATE = 19
+
+	// CAP_AUTO_INVAL_DATA.
+	PROTO_MINOR_AUTO_INVAL_DATA = 20
+
+	// READDIRPLUS (CAP_READDIRPLUS).
+	PROTO_MINOR_READDIRPLUS = 21
+
+	// Asynchronous direct I/O (CAP_ASYNC_DIO).
+	PROTO_MINOR_ASYNC_DIO = 22
+
+	// CAP_WRITEBACK_CACHE, TimeGran in the INIT reply, RENAME2
+	// with rename flags, and ctime in SETATTR.
+	PROTO_MINOR_WRITEBACK_CACHE = 23
+
+	// LSEEK.
+	PROTO_MINOR_LSEEK = 24
+
+	// CAP_PARALLEL_DIROPS.
+	PROTO_MINOR_PARALLEL_DIROPS = 25
+
+	// CAP_HANDLE_KILLPRIV and CAP_POSIX_ACL.
+	PROTO_MINOR_POSIX_ACL = 26
+
+	// CAP_ABORT_ERROR.
+	PROTO_MINOR_ABORT_ERROR = 27
+
+	// COPY_FILE_RANGE, MaxPages in the INIT reply,
+	// CAP_CACHE_SYMLINKS and FOPEN_CACHE_DIR.
+	PROTO_MINOR_COPY_FILE_RANGE = 28
+)
+
+// ProtocolVersion returns the FUSE protocol version negotiated with
+// the kernel: the lower of the version the kernel offered and the
+// one this package implements. It returns 0, 0 if the INIT request
+// has not been answered yet.
+func (ms *Server) ProtocolVersion() (major, minor int) {
+	s := ms.NegotiatedSettings()
+	return int(s.Major), int(s.Minor)
+}
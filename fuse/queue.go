@@ -0,0 +1,132 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"io"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// RequestQueue supplies FUSE requests that are each answered on
+// their own, rather than over a byte stream as with the FUSE device.
+// This is how a virtio-fs device works: the guest kernel puts a
+// request in a descriptor chain on a virtqueue, and the device writes
+// the reply to the same chain. A vhost-user backend for virtio-fs
+// implements RequestQueue over its virtqueues, and serves it with
+// NewServerFromQueue.
+//
+// Threading: the Server calls Next from several goroutines at once.
+// A goroutine that got a request handles it and sends the reply
+// before it calls Next again; while all of them are busy, the Server
+// starts another one, up to MountOptions.MaxConcurrency if that is
+// set. With MaxConcurrency 1, requests are thus handled one at a
+// time, in the order Next returns them. Otherwise, replies are sent
+// in any order, and reply functions may be called concurrently,
+// with each other and with Next. An implementation serving several
+// virtqueues can feed the chains of all of them through a single
+// channel that Next receives from.
+type RequestQueue interface {
+	// Next waits for the next request, copies it to dest, and
+	// returns its size, together with the function that sends
+	// the reply for it, eg. by writing to the descriptor chain
+	// and putting it on the used ring. The reply function is
+	// called exactly once. For requests that are not answered,
+	// such as FORGET, it is called with a nil message right
+	// away, so the chain can be returned. The message passed to
+	// it is only valid during the call.
+	//
+	// Next returns io.EOF when the device is stopped, after
+	// which the Server stops serving.
+	Next(dest []byte) (n int, reply func(msg []byte) error, err error)
+
+	// Close is called by Unmount, and when Serve returns, so it
+	// may be called twice. It must make pending and future calls
+	// to Next fail.
+	Close() error
+}
+
+// NewServerFromQueue creates a FUSE server that reads requests from
+// q, eg. as the backend of a virtio-fs device, and serves them from
+// fs. The file system logic, including that of the fs package, is
+// the same as for a mounted file system. Nothing is mounted, and as
+// with NewServerFromConn, data is never spliced, and passthrough is
+// not negotiated. The DAX window of virtio-fs is not supported.
+//
+// Notifications, such as EntryNotify, return ENOSYS, as virtio-fs
+// has no queue for them that Linux uses. This reads and answers the
+// INIT request, so it blocks until the guest sends it.
+func NewServerFromQueue(q RequestQueue, fs RawFileSystem, opts *MountOptions) (*Server, error) {
+	return NewServerFromConn(newQueueConn(q), fs, opts)
+}
+
+// queueConn adapts a RequestQueue to the io.ReadWriteCloser of
+// NewServerFromConn, by routing each reply to the request with the
+// same unique ID.
+type queueConn struct {
+	q RequestQueue
+
+	mu      sync.Mutex
+	replies map[uint64]func([]byte) error
+}
+
+func newQueueConn(q RequestQueue) *queueConn {
+	return &queueConn{
+		q:       q,
+		replies: make(map[uint64]func([]byte) error),
+	}
+}
+
+var _ = (io.ReadWriteCloser)((*queueConn)(nil))
+
+func (c *queueConn) Read(dest []byte) (int, error) {
+	n, reply, err := c.q.Next(dest)
+	if err != nil {
+		return n, err
+	}
+	if uintptr(n) < unsafe.Sizeof(InHeader{}) {
+		// Let the server report the short request.
+		reply(nil)
+		return n, nil
+	}
+	hdr := (*InHeader)(unsafe.Pointer(&dest[0]))
+	switch hdr.Opcode {
+	case _OP_FORGET, _OP_BATCH_FORGET, _OP_NOTIFY_REPLY, _OP_INTERRUPT:
+		// No reply, except for an INTERRUPT that is not
+		// understood, which is dropped.
+		reply(nil)
+	default:
+		c.mu.Lock()
+		c.replies[hdr.Unique] = reply
+		c.mu.Unlock()
+	}
+	return n, nil
+}
+
+func (c *queueConn) Write(msg []byte) (int, error) {
+	if uintptr(len(msg)) < unsafe.Sizeof(OutHeader{}) {
+		return 0, syscall.EINVAL
+	}
+	unique := (*OutHeader)(unsafe.Pointer(&msg[0])).Unique
+	if unique == 0 {
+		return 0, syscall.ENOSYS
+	}
+	c.mu.Lock()
+	reply, ok := c.replies[unique]
+	delete(c.replies, unique)
+	c.mu.Unlock()
+	if !ok {
+		return len(msg), nil
+	}
+	if err := reply(msg); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+func (c *queueConn) Close() error {
+	return c.q.Close()
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// chanQueue is a RequestQueue fed from a channel, like the
+// virtqueues of a virtio-fs device.
+type chanQueue struct {
+	reqs chan []byte
+
+	// replies receives one reply per request, nil if the request
+	// is not answered.
+	replies chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newChanQueue() *chanQueue {
+	return &chanQueue{
+		reqs:    make(chan []byte),
+		replies: make(chan []byte, 10),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (q *chanQueue) Next(dest []byte) (int, func([]byte) error, error) {
+	select {
+	case req := <-q.reqs:
+		reply := func(msg []byte) error {
+			if msg != nil {
+				msg = append([]byte(nil), msg...)
+			}
+			q.replies <- msg
+			return nil
+		}
+		return copy(dest, req), reply, nil
+	case <-q.closed:
+		return 0, nil, io.EOF
+	}
+}
+
+func (q *chanQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.closed) })
+	return nil
+}
+
+// roundTrip queues the request in, and returns its reply.
+func (q *chanQueue) roundTrip(t *testing.T, in unsafe.Pointer, inSize uintptr) []byte {
+	t.Helper()
+	(*InHeader)(in).Length = uint32(inSize)
+	q.reqs <- append([]byte(nil), (*[1 << 16]byte)(in)[:inSize]...)
+	select {
+	case msg := <-q.replies:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reply")
+		return nil
+	}
+}
+
+func TestNewServerFromQueue(t *testing.T) {
+	q := newChanQueue()
+	type result struct {
+		srv *Server
+		err error
+	}
+	created := make(chan result, 1)
+	go func() {
+		srv, err := NewServerFromQueue(q, &connTestFS{RawFileSystem: NewDefaultRawFileSystem()}, &MountOptions{})
+		created <- result{srv, err}
+	}()
+
+	init := InitIn{
+		InHeader: InHeader{Opcode: _OP_INIT, Unique: 1},
+		Major:    _FUSE_KERNEL_VERSION,
+		Minor:    _OUR_MINOR_VERSION,
+	}
+	msg := q.roundTrip(t, unsafe.Pointer(&init), unsafe.Sizeof(init))
+	if out := (*OutHeader)(unsafe.Pointer(&msg[0])); out.Status != 0 || out.Unique != 1 {
+		t.Fatalf("INIT: got status %d, unique %d", out.Status, out.Unique)
+	}
+	r := <-created
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	srv := r.srv
+	served := serveConn(t, srv)
+
+	getattr := GetAttrIn{InHeader: InHeader{Opcode: _OP_GETATTR, Unique: 2, NodeId: FUSE_ROOT_ID}}
+	msg = q.roundTrip(t, unsafe.Pointer(&getattr), unsafe.Sizeof(getattr))
+	out := (*OutHeader)(unsafe.Pointer(&msg[0]))
+	if out.Status != 0 || out.Unique != 2 {
+		t.Fatalf("GETATTR: got status %d, unique %d", out.Status, out.Unique)
+	}
+	if attr := (*AttrOut)(unsafe.Pointer(&msg[unsafe.Sizeof(OutHeader{})])); attr.Mode != S_IFDIR|0755 {
+		t.Errorf("got mode %o, want %o", attr.Mode, S_IFDIR|0755)
+	}
+
+	// FORGET is not answered, but its chain is returned.
+	forget := ForgetIn{InHeader: InHeader{Opcode: _OP_FORGET, Unique: 3, NodeId: FUSE_ROOT_ID}, Nlookup: 1}
+	if msg := q.roundTrip(t, unsafe.Pointer(&forget), unsafe.Sizeof(forget)); msg != nil {
+		t.Errorf("FORGET: got reply %v, want nil", msg)
+	}
+
+	if code := srv.EntryNotify(FUSE_ROOT_ID, "name"); code != ENOSYS {
+		t.Errorf("EntryNotify: got %v, want ENOSYS", code)
+	}
+
+	if err := srv.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Unmount")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket, for use in MountOptions.Throttle. It
+// lets through perSecond operations per second on average, and bursts
+// of up to burst operations.
+type RateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mu sync.Mutex
+	// next is the time at which the next token is available,
+	// minus the burst.
+	next time.Time
+}
+
+// NewRateLimiter returns a RateLimiter for perSecond operations per
+// second, with bursts of up to burst operations. It panics if
+// perSecond is not positive.
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+	if !(perSecond > 0) {
+		log.Panicf("NewRateLimiter: perSecond must be positive, got %v", perSecond)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		interval: time.Duration(float64(time.Second) / perSecond),
+		burst:    burst,
+	}
+}
+
+// Wait blocks until the operation may proceed. It returns EINTR if
+// cancel is closed first, and then gives the token back.
+func (l *RateLimiter) Wait(cancel <-chan struct{}) Status {
+	now := time.Now()
+	l.mu.Lock()
+	if earliest := now.Add(-time.Duration(l.burst) * l.interval); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(l.interval)
+	wait := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return OK
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return OK
+	case <-cancel:
+		l.mu.Lock()
+		l.next = l.next.Add(-l.interval)
+		l.mu.Unlock()
+		return EINTR
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 the Go-FUSE Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := NewRateLimiter(10, 1)
+	start := time.Now()
+	if st := l.Wait(nil); !st.Ok() {
+		t.Fatalf("Wait: %v", st)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	for i := 0; i < 5; i++ {
+		if st := l.Wait(cancel); st != EINTR {
+			t.Fatalf("Wait with cancel: got %v, want EINTR", st)
+		}
+	}
+
+	// The canceled waits gave their tokens back, so this only
+	// waits for the first interval.
+	if st := l.Wait(nil); !st.Ok() {
+		t.Fatalf("Wait: %v", st)
+	}
+	if dt := time.Since(start); dt > 300*time.Millisecond {
+		t.Errorf("Wait took %v, want about 100ms", dt)
+	}
+}
+
+func TestNewRateLimiterInvalid(t *testing.T) {
+	for _, perSecond := range []float64{0, -1} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewRateLimiter(%v) did not panic", perSecond)
+				}
+			}()
+			NewRateLimiter(perSecond, 1)
+		}()
+	}
+}
@@ -7,7 +7,6 @@ package fuse
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 	"unsafe"
@@ -162,9 +161,9 @@ func (r *request) setInput(input []byte) bool {
 	return true
 }
 
-func (r *request) parseHeader() Status {
+func (r *request) parseHeader(opts *MountOptions) Status {
 	if len(r.inputBuf) < int(unsafe.Sizeof(InHeader{})) {
-		log.Printf("Short read for input header: %v", r.inputBuf)
+		opts.logf(LogError, "Short read for input header: %v", r.inputBuf)
 		return EINVAL
 	}
 
@@ -172,17 +171,17 @@ func (r *request) parseHeader() Status {
 	return OK
 }
 
-func (r *request) parse() {
+func (r *request) parse(opts *MountOptions) {
 	r.arg = r.inputBuf[:]
 	r.handler = getHandler(r.inHeader.Opcode)
 	if r.handler == nil {
-		log.Printf("Unknown opcode %d", r.inHeader.Opcode)
+		opts.logf(LogWarning, "Unknown opcode %d", r.inHeader.Opcode)
 		r.status = ENOSYS
 		return
 	}
 
 	if len(r.arg) < int(r.handler.InputSize) {
-		log.Printf("Short read for %v: %v", operationName(r.inHeader.Opcode), r.arg)
+		opts.logf(LogError, "Short read for %v: %v", operationName(r.inHeader.Opcode), r.arg)
 		r.status = EIO
 		return
 	}
@@ -210,7 +209,7 @@ func (r *request) parse() {
 				r.filenames[i] = string(n)
 			}
 			if len(names) != count {
-				log.Println("filename argument mismatch", names, count)
+				opts.logf(LogError, "filename argument mismatch %v %d", names, count)
 				r.status = EIO
 			}
 		}
@@ -5,16 +5,19 @@
 package fuse
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -45,6 +48,11 @@ type Server struct {
 	// I/O with kernel and daemon.
 	mountFd int
 
+	// conn replaces mountFd for servers created with
+	// NewServerFromConn. connClosed is set by Unmount.
+	conn       io.ReadWriteCloser
+	connClosed int32
+
 	latencies LatencyMap
 
 	opts *MountOptions
@@ -64,6 +72,15 @@ type Server struct {
 	reqReaders     int
 	reqInflight    []*request
 	kernelSettings InitIn
+	initOut        InitOut
+
+	// inflightCount is len(reqInflight), for reading without
+	// reqMu.
+	inflightCount int32
+
+	// timeRequests is set once OldestRequestAge was called, so
+	// requests get a startTime without RecordLatencies too.
+	timeRequests int32
 
 	// in-flight notify-retrieve queries
 	retrieveMu   sync.Mutex
@@ -74,8 +91,35 @@ type Server struct {
 	canSplice    bool
 	loops        sync.WaitGroup
 
+	// releases counts the RELEASE and RELEASEDIR requests being
+	// handled.
+	releases sync.WaitGroup
+
+	// handling counts the requests read by the loops that are
+	// being handled.
+	handling sync.WaitGroup
+
+	// exported is set by ExportFd. The loops stop reading once it
+	// is set, and are woken up through a write to wakeupFds.
+	exported  int32
+	wakeupFds [2]int
+
+	// loopCount is the number of running loop goroutines, each
+	// of which reads or handles a single request at a time. It
+	// is protected by reqMu.
+	loopCount int
+
+	// handlerSlots limits the number of handler goroutines if
+	// MaxConcurrency is set and requests are read by a single
+	// reader.
+	handlerSlots chan struct{}
+
 	ready chan error
 
+	// deviceRead reads from the FUSE device. If nil, syscall.Read
+	// is used. Tests replace it to inject errors.
+	deviceRead func(fd int, p []byte) (int, error)
+
 	// for implementing single threaded processing.
 	requestProcessingMu sync.Mutex
 }
@@ -97,16 +141,86 @@ func (ms *Server) KernelSettings() *InitIn {
 	return &s
 }
 
+// InodeCount returns the number of inodes the kernel holds
+// references to, if the file system keeps track of this (as the
+// file systems from the fs package do), or -1 otherwise.
+func (ms *Server) InodeCount() int {
+	if c, ok := ms.fileSystem.(interface{ InodeCount() int }); ok {
+		return c.InodeCount()
+	}
+	return -1
+}
+
+// NegotiatedSettings returns the Init reply sent to the kernel,
+// describing the protocol version, flags and limits (eg. MaxWrite,
+// MaxReadAhead, MaxBackground) that are in effect for this mount. It
+// is only valid after WaitMount returns. The message should not be
+// altered.
+func (ms *Server) NegotiatedSettings() *InitOut {
+	ms.reqMu.Lock()
+	s := ms.initOut
+	ms.reqMu.Unlock()
+
+	return &s
+}
+
+// InflightRequests returns the number of requests that were read
+// from the kernel and are not answered yet. It is cheap to call, so
+// health checks can poll it to detect requests piling up. Requests
+// that failed with MountOptions.RequestTimeout count until the file
+// system returns from them, as do SETLKW requests waiting for a lock.
+func (ms *Server) InflightRequests() int {
+	return int(atomic.LoadInt32(&ms.inflightCount))
+}
+
+// OldestRequestAge returns the time since the oldest request counted
+// by InflightRequests was read from the kernel, or 0 if there are
+// none. A large age points to a file system that hangs. SETLKW
+// requests are left out, as they legitimately wait for as long as
+// the lock is held.
+//
+// Requests are only timed once this was called, or with
+// RecordLatencies, so the first call does not see the requests that
+// were in flight already.
+func (ms *Server) OldestRequestAge() time.Duration {
+	atomic.StoreInt32(&ms.timeRequests, 1)
+
+	var oldest time.Time
+	ms.reqMu.Lock()
+	for _, req := range ms.reqInflight {
+		if req.startTime.IsZero() || req.inHeader.Opcode == _OP_SETLKW {
+			continue
+		}
+		if oldest.IsZero() || req.startTime.Before(oldest) {
+			oldest = req.startTime
+		}
+	}
+	ms.reqMu.Unlock()
+
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
 const _MAX_NAME_LEN = 20
 
 // This type may be provided for recording latencies of each FUSE
-// operation.
+// operation. It can be used to export per-operation counts and
+// latency histograms to a monitoring system.
 type LatencyMap interface {
+	// Add is called after each request has been answered, with
+	// the name of the operation (eg. "LOOKUP", "READ") and the
+	// time since the request was read from the kernel. It is
+	// called concurrently from the goroutines serving requests.
 	Add(name string, dt time.Duration)
 }
 
 // RecordLatencies switches on collection of timing for each request
-// coming from the kernel.P assing a nil argument switches off the
+// coming from the kernel. Passing a nil argument switches off the
+// collection; no timing is done in that case, so there is no overhead
+// if latencies are not recorded, unless OldestRequestAge is used. It
+// should be called before Serve.
 func (ms *Server) RecordLatencies(l LatencyMap) {
 	ms.latencies = l
 }
@@ -122,6 +236,13 @@ func (ms *Server) RecordLatencies(l LatencyMap) {
 //
 /// in this case.
 func (ms *Server) Unmount() (err error) {
+	if ms.conn != nil {
+		// Make pending reads fail, which stops the loops.
+		atomic.StoreInt32(&ms.connClosed, 1)
+		ms.conn.Close()
+		ms.loops.Wait()
+		return nil
+	}
 	if ms.mountPoint == "" {
 		return nil
 	}
@@ -150,12 +271,34 @@ func (ms *Server) Unmount() (err error) {
 	return err
 }
 
-// NewServer creates a FUSE server and attaches ("mounts") it to the
-// `mountPoint` directory.
+// UnmountLazy unmounts the file system even if it is still in use.
+// Unmount fails with EBUSY if processes have files open or their
+// working directory inside the mount; UnmountLazy does not.
 //
-// See the "Mount styles" section in the package documentation if you want to
-// know about the inner workings of the mount process. Usually you do not.
-func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+// On Linux, the mount is detached from the file system hierarchy
+// immediately (umount -l), but the server keeps answering requests
+// for files that remain open. Serve returns once the last of those
+// is closed; use Wait to block until then. On macOS, the unmount is
+// forced, and operations on open files fail.
+//
+// Like Unmount, this does not work for the magic /dev/fd/N mountpoint.
+func (ms *Server) UnmountLazy() error {
+	if ms.mountPoint == "" {
+		return nil
+	}
+	if parseFuseFd(ms.mountPoint) >= 0 {
+		return fmt.Errorf("Cannot unmount magic mountpoint %q. Please use `fusermount -u -z REALMOUNTPOINT` instead.", ms.mountPoint)
+	}
+	if err := unmountLazy(ms.mountPoint, ms.opts); err != nil {
+		return err
+	}
+	ms.mountPoint = ""
+	return nil
+}
+
+// newServer creates a Server with the options normalized, which is
+// not connected to the kernel yet.
+func newServer(fs RawFileSystem, opts *MountOptions) (*Server, error) {
 	if opts == nil {
 		opts = &MountOptions{
 			MaxBackground: _DEFAULT_BACKGROUND_TASKS,
@@ -172,6 +315,9 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 	if o.MaxWrite > MAX_KERNEL_WRITE {
 		o.MaxWrite = MAX_KERNEL_WRITE
 	}
+	if err := o.checkOptions(); err != nil {
+		return nil, err
+	}
 	if o.Name == "" {
 		name := fs.String()
 		l := len(name)
@@ -204,6 +350,10 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		// error-out, meaning that unmount will hang.
 		singleReader: runtime.GOOS == "darwin",
 		ready:        make(chan error, 1),
+		wakeupFds:    [2]int{-1, -1},
+	}
+	if o.MaxConcurrency > 0 && ms.singleReader {
+		ms.handlerSlots = make(chan struct{}, o.MaxConcurrency)
 	}
 	ms.reqPool.New = func() interface{} {
 		return &request{
@@ -219,34 +369,173 @@ func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server
 		buf = alignSlice(buf, unsafe.Sizeof(WriteIn{}), logicalBlockSize, uintptr(targetSize))
 		return buf
 	}
+	return ms, nil
+}
+
+// NewServer creates a FUSE server and attaches ("mounts") it to the
+// `mountPoint` directory.
+//
+// See the "Mount styles" section in the package documentation if you want to
+// know about the inner workings of the mount process. Usually you do not.
+func NewServer(fs RawFileSystem, mountPoint string, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		if opts != nil && opts.DeviceFd > 0 {
+			syscall.Close(opts.DeviceFd)
+		}
+		return nil, err
+	}
+	o := ms.opts
+
 	mountPoint = filepath.Clean(mountPoint)
 	if !filepath.IsAbs(mountPoint) {
 		cwd, err := os.Getwd()
 		if err != nil {
+			if o.DeviceFd > 0 {
+				syscall.Close(o.DeviceFd)
+			}
 			return nil, err
 		}
 		mountPoint = filepath.Clean(filepath.Join(cwd, mountPoint))
 	}
-	fd, err := mount(mountPoint, &o, ms.ready)
-	if err != nil {
-		return nil, err
+	var fd int
+	if o.DeviceFd > 0 {
+		if err := checkDeviceFd(o.DeviceFd); err != nil {
+			syscall.Close(o.DeviceFd)
+			return nil, err
+		}
+		fd = o.DeviceFd
+		syscall.CloseOnExec(fd)
+		close(ms.ready)
+	} else {
+		var err error
+		fd, err = mount(mountPoint, o, ms.ready)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ms.mountPoint = mountPoint
 	ms.mountFd = fd
 
-	if code := ms.handleInit(); !code.Ok() {
+	if o.DeviceFd > 0 && o.Resume != nil {
+		ms.resume(o.Resume)
+	} else if code := ms.handleInit(); !code.Ok() {
 		syscall.Close(fd)
+		if o.DeviceFd > 0 && code == EPERM {
+			// The kernel refuses reads from a device that
+			// is not mounted.
+			return nil, fmt.Errorf("init: DeviceFd %d is not mounted: %s", o.DeviceFd, code)
+		}
 		// TODO - unmount as well?
 		return nil, fmt.Errorf("init: %s", code)
 	}
+	if o.EnableExport {
+		if err := ms.setupWakeup(); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
 
 	// This prepares for Serve being called somewhere, either
 	// synchronously or asynchronously.
 	ms.loops.Add(1)
+	ms.loopCount = 1
 	return ms, nil
 }
 
+// NewServerFromConn creates a FUSE server that speaks the protocol
+// over conn instead of the FUSE device, eg. to proxy FUSE traffic or
+// to test a file system without mounting it. Nothing is mounted.
+//
+// Each Read from conn must return exactly one request, and each
+// reply is sent with a single Write, so conn must preserve message
+// boundaries, like a SOCK_SEQPACKET socket. Data is never spliced,
+// and passthrough is not negotiated.
+// Like NewServer, this reads and answers the INIT request, so it
+// blocks until the peer sends it. Serve returns when a Read returns
+// io.EOF or ENODEV, and then closes conn. Unmount closes conn; this
+// only stops Serve if Close makes pending Reads fail, as it does for
+// a net.Conn, or an *os.File for a non-blocking file descriptor.
+func NewServerFromConn(conn io.ReadWriteCloser, fs RawFileSystem, opts *MountOptions) (*Server, error) {
+	ms, err := newServer(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	ms.conn = conn
+	ms.mountFd = -1
+	close(ms.ready)
+
+	if code := ms.handleInit(); !code.Ok() {
+		conn.Close()
+		return nil, fmt.Errorf("init: %s", code)
+	}
+
+	ms.loops.Add(1)
+	ms.loopCount = 1
+	return ms, nil
+}
+
+// reservedOptions may not be passed in MountOptions.Options, as the
+// library sets them itself.
+var reservedOptions = map[string]bool{
+	"fd":       true,
+	"rootmode": true,
+}
+
+// privilegedOptions may only be passed in MountOptions.Options when
+// running as root. user_id and group_id override the ones the library
+// sets for DirectMount, and suid and dev let the file system serve
+// setuid binaries and device nodes.
+var privilegedOptions = map[string]bool{
+	"user_id":  true,
+	"group_id": true,
+	"suid":     true,
+	"dev":      true,
+}
+
+// checkOptions moves fsname=, subtype= and volname= from Options to
+// FsName, Name and VolumeName, so they are passed once, and rejects
+// reserved options, and privileged ones unless running as root.
+func (o *MountOptions) checkOptions() error {
+	var opts []string
+	for _, s := range o.Options {
+		key, val := s, ""
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			key, val = s[:i], s[i+1:]
+		}
+		switch {
+		case reservedOptions[key]:
+			return fmt.Errorf("mount option %q is not allowed", s)
+		case privilegedOptions[key] && os.Geteuid() != 0:
+			return fmt.Errorf("mount option %q is only allowed for root", s)
+		case key == "fsname":
+			if o.FsName != "" && o.FsName != val {
+				return fmt.Errorf("option %q conflicts with FsName %q", s, o.FsName)
+			}
+			o.FsName = val
+		case key == "subtype":
+			if o.Name != "" && o.Name != val {
+				return fmt.Errorf("option %q conflicts with Name %q", s, o.Name)
+			}
+			o.Name = val
+		case key == "volname":
+			if o.VolumeName != "" && o.VolumeName != val {
+				return fmt.Errorf("option %q conflicts with VolumeName %q", s, o.VolumeName)
+			}
+			o.VolumeName = val
+		default:
+			opts = append(opts, s)
+		}
+	}
+	o.Options = opts
+	// macFUSE takes it as a mount option; elsewhere it is unused.
+	if runtime.GOOS == "darwin" && strings.Contains(o.VolumeName, ",") {
+		return fmt.Errorf("VolumeName %q may not contain a comma", o.VolumeName)
+	}
+	return nil
+}
+
 func (o *MountOptions) optionsStrings() []string {
 	var r []string
 	r = append(r, o.Options...)
@@ -255,8 +544,11 @@ func (o *MountOptions) optionsStrings() []string {
 		r = append(r, "allow_other")
 	}
 
+	// Use the same source as mountDirect.
 	if o.FsName != "" {
 		r = append(r, "fsname="+o.FsName)
+	} else if o.Name != "" {
+		r = append(r, "fsname="+o.Name)
 	}
 	if o.Name != "" {
 		r = append(r, "subtype="+o.Name)
@@ -309,12 +601,7 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	ms.reqReaders++
 	ms.reqMu.Unlock()
 
-	var n int
-	err := handleEINTR(func() error {
-		var err error
-		n, err = syscall.Read(ms.mountFd, dest)
-		return err
-	})
+	n, err := ms.readDevice(dest)
 	if err != nil {
 		code = ToStatus(err)
 		ms.reqPool.Put(req)
@@ -324,7 +611,7 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 		return nil, code
 	}
 
-	if ms.latencies != nil {
+	if ms.latencies != nil || atomic.LoadInt32(&ms.timeRequests) != 0 {
 		req.startTime = time.Now()
 	}
 	gobbled := req.setInput(dest[:n])
@@ -332,17 +619,20 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	ms.reqMu.Lock()
 	defer ms.reqMu.Unlock()
 	// Must parse request.Unique under lock
-	if status := req.parseHeader(); !status.Ok() {
+	if status := req.parseHeader(ms.opts); !status.Ok() {
 		return nil, status
 	}
 	req.inflightIndex = len(ms.reqInflight)
 	ms.reqInflight = append(ms.reqInflight, req)
+	atomic.AddInt32(&ms.inflightCount, 1)
 	if !gobbled {
 		ms.readPool.Put(dest)
 		dest = nil
 	}
 	ms.reqReaders--
-	if !ms.singleReader && ms.reqReaders <= 0 {
+	if !ms.singleReader && ms.reqReaders <= 0 &&
+		(ms.opts.MaxConcurrency <= 0 || ms.loopCount < ms.opts.MaxConcurrency) {
+		ms.loopCount++
 		ms.loops.Add(1)
 		go ms.loop(true)
 	}
@@ -350,6 +640,41 @@ func (ms *Server) readRequest(exitIdle bool) (req *request, code Status) {
 	return req, OK
 }
 
+// readDevice reads a single request from the FUSE device, retrying
+// on EINTR.
+func (ms *Server) readDevice(dest []byte) (n int, err error) {
+	if ms.conn != nil {
+		n, err = ms.conn.Read(dest)
+		if err == io.EOF || (err != nil && atomic.LoadInt32(&ms.connClosed) != 0) {
+			// The peer went away, or Unmount closed the conn.
+			err = syscall.ENODEV
+		}
+		return n, err
+	}
+	read := ms.deviceRead
+	if read == nil {
+		read = syscall.Read
+	}
+	for {
+		if atomic.LoadInt32(&ms.exported) != 0 {
+			return 0, syscall.ENODEV
+		}
+		err = handleEINTR(func() error {
+			var err error
+			n, err = read(ms.mountFd, dest)
+			return err
+		})
+		if err != syscall.EAGAIN {
+			return n, err
+		}
+		// With EnableExport, the device is non-blocking, so
+		// ExportFd can interrupt the wait.
+		if err = ms.waitDevice(); err != nil {
+			return 0, err
+		}
+	}
+}
+
 // returnRequest returns a request to the pool of unused requests.
 func (ms *Server) returnRequest(req *request) {
 	ms.reqMu.Lock()
@@ -361,6 +686,7 @@ func (ms *Server) returnRequest(req *request) {
 		ms.reqInflight[this].inflightIndex = this
 	}
 	ms.reqInflight = ms.reqInflight[:last]
+	atomic.AddInt32(&ms.inflightCount, -1)
 	interrupted := req.interrupted
 	ms.reqMu.Unlock()
 
@@ -398,12 +724,20 @@ func (ms *Server) recordStats(req *request) {
 // goroutine.
 //
 // Each filesystem operation executes in a separate goroutine.
+//
+// Serve returns once the file system is unmounted; the ENODEV that
+// the kernel then returns from the device is not an error.
 func (ms *Server) Serve() {
 	ms.loop(false)
 	ms.loops.Wait()
 
 	ms.writeMu.Lock()
-	syscall.Close(ms.mountFd)
+	if ms.conn != nil {
+		ms.conn.Close()
+	} else {
+		syscall.Close(ms.mountFd)
+		ms.closeWakeup()
+	}
 	ms.writeMu.Unlock()
 
 	// shutdown in-flight cache retrieves.
@@ -430,6 +764,31 @@ func (ms *Server) Wait() {
 	ms.loops.Wait()
 }
 
+// WaitForReleases waits for the RELEASE and RELEASEDIR requests
+// that were read from the kernel to be handled. Serve may return
+// while they are still running, eg. if MountOptions.MaxConcurrency is
+// set. Call this after Serve returns to be sure that the file system
+// has seen all the releases the kernel sent, eg. before closing
+// backing files. File handles that are still open when the
+// connection is aborted are never released.
+func (ms *Server) WaitForReleases() {
+	ms.releases.Wait()
+}
+
+// resume takes over the INIT settings of the server that exported
+// the device, instead of reading INIT from the kernel.
+func (ms *Server) resume(s *ResumeSettings) {
+	ms.reqMu.Lock()
+	ms.kernelSettings = s.KernelSettings
+	ms.initOut = s.NegotiatedSettings
+	if s.KernelSettings.Minor >= 13 {
+		ms.setSplice()
+	}
+	ms.reqMu.Unlock()
+
+	ms.fileSystem.Init(ms)
+}
+
 func (ms *Server) handleInit() Status {
 	// The first request should be INIT; read it synchronously,
 	// and don't spawn new readers.
@@ -453,6 +812,11 @@ func (ms *Server) handleInit() Status {
 
 func (ms *Server) loop(exitIdle bool) {
 	defer ms.loops.Done()
+	defer func() {
+		ms.reqMu.Lock()
+		ms.loopCount--
+		ms.reqMu.Unlock()
+	}()
 exit:
 	for {
 		req, errNo := ms.readRequest(exitIdle)
@@ -465,46 +829,76 @@ exit:
 			continue
 		case ENODEV:
 			// unmount
-			if ms.opts.Debug {
-				log.Printf("received ENODEV (unmount request), thread exiting")
-			}
+			ms.opts.logf(LogDebug, "received ENODEV (unmount request), thread exiting")
 			break exit
 		default: // some other error?
-			log.Printf("Failed to read from fuse conn: %v", errNo)
+			ms.opts.logf(LogError, "Failed to read from fuse conn: %v", errNo)
 			break exit
 		}
 
+		if op := req.inHeader.Opcode; op == _OP_RELEASE || op == _OP_RELEASEDIR {
+			ms.releases.Add(1)
+		}
+		ms.handling.Add(1)
 		if ms.singleReader {
-			go ms.handleRequest(req)
+			if ms.handlerSlots != nil {
+				ms.handlerSlots <- struct{}{}
+				go func() {
+					ms.handleRequest(req)
+					<-ms.handlerSlots
+					ms.handling.Done()
+				}()
+			} else {
+				go func() {
+					ms.handleRequest(req)
+					ms.handling.Done()
+				}()
+			}
 		} else {
 			ms.handleRequest(req)
+			ms.handling.Done()
 		}
 	}
 }
 
 func (ms *Server) handleRequest(req *request) Status {
+	if op := req.inHeader.Opcode; op == _OP_RELEASE || op == _OP_RELEASEDIR {
+		defer ms.releases.Done()
+	}
 	if ms.opts.SingleThreaded {
 		ms.requestProcessingMu.Lock()
 		defer ms.requestProcessingMu.Unlock()
 	}
 
-	req.parse()
+	req.parse(ms.opts)
 	if req.handler == nil {
 		req.status = ENOSYS
 	}
 
-	if req.status.Ok() && ms.opts.Debug {
-		log.Println(req.InputDebug())
+	if req.status.Ok() && ms.opts.debugEnabled() {
+		ms.opts.logger().Log(LogDebug, req.InputDebug())
 	}
 
 	if req.inHeader.NodeId == pollHackInode ||
 		req.inHeader.NodeId == FUSE_ROOT_ID && len(req.filenames) > 0 && req.filenames[0] == pollHackName {
 		doPollHackLookup(ms, req)
 	} else if req.status.Ok() && req.handler.Func == nil {
-		log.Printf("Unimplemented opcode %v", operationName(req.inHeader.Opcode))
+		ms.opts.logf(LogWarning, "Unimplemented opcode %v", operationName(req.inHeader.Opcode))
 		req.status = ENOSYS
 	} else if req.status.Ok() {
-		req.handler.Func(ms, req)
+		if ms.opts.RootNodeId != 0 {
+			ms.translateRootId(req)
+		}
+		if ms.opts.Throttle != nil && !noThrottle[req.inHeader.Opcode] {
+			req.status = ms.opts.Throttle(req.cancel, req.handler.Name)
+		}
+		if req.status.Ok() && ms.opts.RequestTimeout > 0 && !noTimeout[req.inHeader.Opcode] {
+			if !ms.handleWithTimeout(req) {
+				return EIO
+			}
+		} else if req.status.Ok() {
+			ms.callHandler(req)
+		}
 	}
 
 	errNo := ms.write(req)
@@ -512,9 +906,10 @@ func (ms *Server) handleRequest(req *request) Status {
 		// Unless debugging is enabled, ignore ENOENT for INTERRUPT responses
 		// which indicates that the referred request is no longer known by the
 		// kernel. This is a normal if the referred request already has
-		// completed.
-		if ms.opts.Debug || !(req.inHeader.Opcode == _OP_INTERRUPT && errNo == ENOENT) {
-			log.Printf("writer: Write/Writev failed, err: %v. opcode: %v",
+		// completed. Similarly, ENODEV means the file system
+		// was unmounted while the request was being handled.
+		if ms.opts.Debug || !((req.inHeader.Opcode == _OP_INTERRUPT && errNo == ENOENT) || errNo == ENODEV) {
+			ms.opts.logf(LogError, "writer: Write/Writev failed, err: %v. opcode: %v",
 				errNo, operationName(req.inHeader.Opcode))
 		}
 
@@ -523,6 +918,148 @@ func (ms *Server) handleRequest(req *request) Status {
 	return Status(errNo)
 }
 
+// callHandler runs the handler of req. If it panics, the panic is
+// passed to MountOptions.PanicHandler, and the request fails with
+// EIO.
+func (ms *Server) callHandler(req *request) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if ms.opts.PanicHandler != nil {
+			ms.opts.PanicHandler(r)
+		} else {
+			ms.opts.logf(LogError, "panic in %v: %v\n%s",
+				operationName(req.inHeader.Opcode), r, debug.Stack())
+		}
+		if req.readResult != nil {
+			req.readResult.Done()
+			req.readResult = nil
+		}
+		req.flatData = nil
+		req.fdData = nil
+		req.status = EIO
+	}()
+	req.handler.Func(ms, req)
+}
+
+// noThrottle holds the opcodes that MountOptions.Throttle is not
+// called for.
+var noThrottle = map[uint32]bool{
+	_OP_INIT:         true,
+	_OP_DESTROY:      true,
+	_OP_FORGET:       true,
+	_OP_BATCH_FORGET: true,
+	_OP_INTERRUPT:    true,
+	_OP_NOTIFY_REPLY: true,
+}
+
+// noTimeout holds the opcodes that MountOptions.RequestTimeout does
+// not apply to: those without a reply, the ones that must reach the
+// file system in order, and blocking locks.
+var noTimeout = map[uint32]bool{
+	_OP_INIT:         true,
+	_OP_DESTROY:      true,
+	_OP_FORGET:       true,
+	_OP_BATCH_FORGET: true,
+	_OP_INTERRUPT:    true,
+	_OP_NOTIFY_REPLY: true,
+	_OP_RELEASE:      true,
+	_OP_RELEASEDIR:   true,
+	_OP_SETLKW:       true,
+}
+
+// handleWithTimeout runs the handler of req, and returns false if it
+// did not finish within RequestTimeout. In that case, EIO was sent to
+// the kernel, req is cancelled, and its late reply was discarded.
+// Only the reply is sent early: this waits for the handler to return,
+// so the caller keeps holding the SingleThreaded lock and its
+// MaxConcurrency slot meanwhile.
+func (ms *Server) handleWithTimeout(req *request) bool {
+	done := make(chan struct{})
+	go func() {
+		ms.callHandler(req)
+		close(done)
+	}()
+
+	t := time.NewTimer(ms.opts.RequestTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+	}
+
+	// Mark the request as interrupted, so its buffers are not
+	// reused while the handler writes to them.
+	ms.reqMu.Lock()
+	if !req.interrupted {
+		close(req.cancel)
+		req.interrupted = true
+	}
+	ms.reqMu.Unlock()
+
+	ms.opts.logf(LogWarning, "%v timed out after %v",
+		operationName(req.inHeader.Opcode), ms.opts.RequestTimeout)
+	reply := &request{
+		inHeader: req.inHeader,
+		inData:   req.inData,
+		handler:  req.handler,
+		status:   EIO,
+	}
+	if errNo := ms.write(reply); errNo != OK && errNo != ENOENT && errNo != ENODEV {
+		ms.opts.logf(LogError, "writer: Write/Writev failed, err: %v. opcode: %v",
+			errNo, operationName(req.inHeader.Opcode))
+	}
+
+	<-done
+	ms.discardReply(req)
+	ms.returnRequest(req)
+	return false
+}
+
+// discardReply undoes a reply that is not sent to the kernel,
+// because the request timed out: the kernel does not know about the
+// nodes it looked up and the handles it opened.
+func (ms *Server) discardReply(req *request) {
+	if req.readResult != nil {
+		req.readResult.Done()
+	}
+	if !req.status.Ok() {
+		return
+	}
+	fs := ms.fileSystem
+	forget := func(out *EntryOut) {
+		if out.NodeId != 0 {
+			fs.Forget(out.NodeId, 1)
+		}
+	}
+	release := func(nodeId uint64, out *OpenOut) {
+		in := &ReleaseIn{InHeader: *req.inHeader, Fh: out.Fh}
+		in.NodeId = nodeId
+		fs.Release(nil, in)
+	}
+
+	switch req.inHeader.Opcode {
+	case _OP_LOOKUP, _OP_MKNOD, _OP_MKDIR, _OP_SYMLINK, _OP_LINK:
+		forget((*EntryOut)(req.outData()))
+	case _OP_CREATE, _OP_TMPFILE:
+		out := (*CreateOut)(req.outData())
+		release(out.NodeId, &out.OpenOut)
+		forget(&out.EntryOut)
+	case _OP_OPEN:
+		release(req.inHeader.NodeId, (*OpenOut)(req.outData()))
+	case _OP_OPENDIR:
+		out := (*OpenOut)(req.outData())
+		fs.ReleaseDir(&ReleaseIn{InHeader: *req.inHeader, Fh: out.Fh})
+	case _OP_READDIRPLUS:
+		for _, id := range dirPlusNodeIds(req.flatData) {
+			fs.Forget(id, 1)
+		}
+	}
+}
+
 // alignSlice ensures that the byte at alignedByte is aligned with the
 // given logical block size.  The input slice should be at least (size
 // + blockSize)
@@ -559,24 +1096,85 @@ func (ms *Server) write(req *request) Status {
 	}
 
 	header := req.serializeHeader(req.flatDataSize())
-	if ms.opts.Debug {
-		log.Println(req.OutputDebug())
+	if ms.opts.debugEnabled() {
+		ms.opts.logger().Log(LogDebug, req.OutputDebug())
 	}
 
 	if header == nil {
 		return OK
 	}
 
+	if ms.conn != nil {
+		return ms.connWrite(req, header)
+	}
 	s := ms.systemWrite(req, header)
 	return s
 }
 
+// connWrite sends a reply over the conn given to NewServerFromConn
+// in a single Write.
+func (ms *Server) connWrite(req *request, header []byte) Status {
+	if req.fdData != nil {
+		sz := req.flatDataSize()
+		buf := ms.allocOut(req, uint32(sz))
+		req.flatData, req.status = req.fdData.Bytes(buf)
+		header = req.serializeHeader(len(req.flatData))
+	}
+	msg := header
+	if len(req.flatData) > 0 {
+		msg = make([]byte, 0, len(header)+len(req.flatData))
+		msg = append(append(msg, header...), req.flatData...)
+	}
+	_, err := ms.conn.Write(msg)
+	if req.readResult != nil {
+		req.readResult.Done()
+	}
+	return ToStatus(err)
+}
+
+// translateRootId replaces FUSE_ROOT_ID in the input of req with
+// MountOptions.RootNodeId.
+func (ms *Server) translateRootId(req *request) {
+	if req.inHeader.NodeId == FUSE_ROOT_ID {
+		req.inHeader.NodeId = ms.opts.RootNodeId
+	}
+	var newDir *uint64
+	switch req.inHeader.Opcode {
+	case _OP_RENAME:
+		newDir = &(*Rename1In)(req.inData).Newdir
+	case _OP_RENAME2:
+		newDir = &(*RenameIn)(req.inData).Newdir
+	}
+	if newDir != nil && *newDir == FUSE_ROOT_ID {
+		*newDir = ms.opts.RootNodeId
+	}
+}
+
+// kernelNodeId returns the ID by which the kernel knows the node
+// that the file system calls node, or 0 if the kernel cannot know
+// it, because it is the root of the file system and this mount
+// serves a subdirectory.
+func (ms *Server) kernelNodeId(node uint64) uint64 {
+	switch root := ms.opts.RootNodeId; {
+	case root == 0:
+		return node
+	case node == root:
+		return FUSE_ROOT_ID
+	case node == FUSE_ROOT_ID:
+		return 0
+	}
+	return node
+}
+
 // InodeNotify invalidates the information associated with the inode
 // (ie. data cache, attributes, etc.)
 func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
 	if !ms.kernelSettings.SupportsNotify(NOTIFY_INVAL_INODE) {
 		return ENOSYS
 	}
+	if node = ms.kernelNodeId(node); node == 0 {
+		return ENOENT
+	}
 
 	req := request{
 		inHeader: &InHeader{
@@ -596,9 +1194,7 @@ func (ms *Server) InodeNotify(node uint64, off int64, length int64) Status {
 	result := ms.write(&req)
 	ms.writeMu.Unlock()
 
-	if ms.opts.Debug {
-		log.Println("Response: INODE_NOTIFY", result)
-	}
+	ms.opts.logf(LogDebug, "Response: INODE_NOTIFY %v", result)
 	return result
 }
 
@@ -635,6 +1231,9 @@ func (ms *Server) InodeNotifyStoreCache(node uint64, offset int64, data []byte)
 // inodeNotifyStoreCache32 is internal worker for InodeNotifyStoreCache which
 // handles data chunks not larger than 2GB.
 func (ms *Server) inodeNotifyStoreCache32(node uint64, offset int64, data []byte) Status {
+	if node = ms.kernelNodeId(node); node == 0 {
+		return ENOENT
+	}
 	req := request{
 		inHeader: &InHeader{
 			Opcode: _OP_NOTIFY_STORE_CACHE,
@@ -655,9 +1254,7 @@ func (ms *Server) inodeNotifyStoreCache32(node uint64, offset int64, data []byte
 	result := ms.write(&req)
 	ms.writeMu.Unlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: INODE_NOTIFY_STORE_CACHE: %v", result)
-	}
+	ms.opts.logf(LogDebug, "Response: INODE_NOTIFY_STORE_CACHE: %v", result)
 	return result
 }
 
@@ -674,6 +1271,9 @@ func (ms *Server) InodeRetrieveCache(node uint64, offset int64, dest []byte) (n
 	// the kernel won't send us in one go more then what we negotiated as MaxWrite.
 	// retrieve the data in chunks.
 	// TODO spawn some number of readahead retrievers in parallel.
+	if node = ms.kernelNodeId(node); node == 0 {
+		return 0, ENOENT
+	}
 	ntotal := 0
 	for {
 		chunkSize := len(dest)
@@ -747,9 +1347,7 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 	result := ms.write(&req)
 	ms.writeMu.Unlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: NOTIFY_RETRIEVE_CACHE: %v", result)
-	}
+	ms.opts.logf(LogDebug, "Response: NOTIFY_RETRIEVE_CACHE: %v", result)
 	if result != OK {
 		ms.retrieveMu.Lock()
 		r := ms.retrieveTab[q.NotifyUnique]
@@ -762,7 +1360,7 @@ func (ms *Server) inodeRetrieveCache1(node uint64, offset int64, dest []byte) (n
 			// unexpected NotifyReply with our notifyUnique, then
 			// retrieveNext wraps, makes full cycle, and another
 			// retrieve request is made with the same notifyUnique.
-			log.Printf("W: INODE_RETRIEVE_CACHE: request with notifyUnique=%d mutated", q.NotifyUnique)
+			ms.opts.logf(LogWarning, "INODE_RETRIEVE_CACHE: request with notifyUnique=%d mutated", q.NotifyUnique)
 		}
 		ms.retrieveMu.Unlock()
 		return 0, result
@@ -793,6 +1391,9 @@ type retrieveCacheRequest struct {
 // some process. You should not hold any FUSE filesystem locks, as that
 // can lead to deadlock.
 func (ms *Server) DeleteNotify(parent uint64, child uint64, name string) Status {
+	if parent = ms.kernelNodeId(parent); parent == 0 {
+		return ENOENT
+	}
 	if ms.kernelSettings.Minor < 18 {
 		return ms.EntryNotify(parent, name)
 	}
@@ -822,9 +1423,34 @@ func (ms *Server) DeleteNotify(parent uint64, child uint64, name string) Status
 	result := ms.write(&req)
 	ms.writeMu.Unlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: DELETE_NOTIFY: %v", result)
+	ms.opts.logf(LogDebug, "Response: DELETE_NOTIFY: %v", result)
+	return result
+}
+
+// NotifyPoll wakes up the poll(2) calls waiting on the file with
+// kernel handle kh, which was passed in a PollIn with
+// FUSE_POLL_SCHEDULE_NOTIFY set. The kernel then polls the file
+// again.
+func (ms *Server) NotifyPoll(kh uint64) Status {
+	if !ms.kernelSettings.SupportsNotify(NOTIFY_POLL) {
+		return ENOSYS
+	}
+	req := request{
+		inHeader: &InHeader{
+			Opcode: _OP_NOTIFY_POLL,
+		},
+		handler: operationHandlers[_OP_NOTIFY_POLL],
+		status:  NOTIFY_POLL,
 	}
+	out := (*NotifyPollWakeupOut)(req.outData())
+	out.Kh = kh
+
+	// Protect against concurrent close.
+	ms.writeMu.Lock()
+	result := ms.write(&req)
+	ms.writeMu.Unlock()
+
+	ms.opts.logf(LogDebug, "Response: POLL_NOTIFY: %v", result)
 	return result
 }
 
@@ -835,6 +1461,9 @@ func (ms *Server) EntryNotify(parent uint64, name string) Status {
 	if !ms.kernelSettings.SupportsNotify(NOTIFY_INVAL_ENTRY) {
 		return ENOSYS
 	}
+	if parent = ms.kernelNodeId(parent); parent == 0 {
+		return ENOENT
+	}
 	req := request{
 		inHeader: &InHeader{
 			Opcode: _OP_NOTIFY_INVAL_ENTRY,
@@ -858,9 +1487,7 @@ func (ms *Server) EntryNotify(parent uint64, name string) Status {
 	result := ms.write(&req)
 	ms.writeMu.Unlock()
 
-	if ms.opts.Debug {
-		log.Printf("Response: ENTRY_NOTIFY: %v", result)
-	}
+	ms.opts.logf(LogDebug, "Response: ENTRY_NOTIFY: %v", result)
 	return result
 }
 
@@ -882,6 +1509,8 @@ func (in *InitIn) SupportsNotify(notifyType int) bool {
 		return in.SupportsVersion(7, 15)
 	case NOTIFY_DELETE:
 		return in.SupportsVersion(7, 18)
+	case NOTIFY_POLL:
+		return in.SupportsVersion(7, 11)
 	}
 	return false
 }
@@ -894,6 +1523,9 @@ func (ms *Server) WaitMount() error {
 	if err != nil {
 		return err
 	}
+	if ms.conn != nil {
+		return nil
+	}
 	if parseFuseFd(ms.mountPoint) >= 0 {
 		// Magic `/dev/fd/N` mountpoint. We don't know the real mountpoint, so
 		// we cannot run the poll hack.
@@ -902,6 +1534,30 @@ func (ms *Server) WaitMount() error {
 	return pollHack(ms.mountPoint)
 }
 
+// ErrMountTimeout is returned by WaitMountTimeout if the mount did
+// not complete in time.
+var ErrMountTimeout = errors.New("fuse: timed out waiting for mount")
+
+// WaitMountTimeout is like WaitMount, but gives up after d, returning
+// ErrMountTimeout. The caller can then call Unmount to tear down the
+// half-finished mount; this also ends the goroutine that is still
+// waiting for the mount.
+func (ms *Server) WaitMountTimeout(d time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- ms.WaitMount()
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrMountTimeout
+	}
+}
+
 // parseFuseFd checks if `mountPoint` is the special form /dev/fd/N (with N >= 0),
 // and returns N in this case. Returns -1 otherwise.
 func parseFuseFd(mountPoint string) (fd int) {
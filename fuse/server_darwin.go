@@ -30,3 +30,30 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 	}
 	return ToStatus(err)
 }
+
+// RegisterBackingFd is not supported on Darwin.
+func (ms *Server) RegisterBackingFd(m *BackingMap) (int32, syscall.Errno) {
+	return 0, syscall.ENOSYS
+}
+
+// UnregisterBackingFd is not supported on Darwin.
+func (ms *Server) UnregisterBackingFd(id int32) syscall.Errno {
+	return syscall.ENOSYS
+}
+
+func (ms *Server) setupWakeup() error {
+	return nil
+}
+
+func (ms *Server) closeWakeup() {
+}
+
+// waitDevice is never called on Darwin, as the device is blocking.
+func (ms *Server) waitDevice() error {
+	return syscall.EAGAIN
+}
+
+// ExportFd is not supported on Darwin.
+func (ms *Server) ExportFd() (int, error) {
+	return -1, syscall.ENOSYS
+}
@@ -5,8 +5,12 @@
 package fuse
 
 import (
-	"log"
+	"errors"
+	"sync/atomic"
 	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 func (ms *Server) systemWrite(req *request, header []byte) Status {
@@ -25,7 +29,7 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 				req.readResult.Done()
 				return OK
 			}
-			log.Println("trySplice:", err)
+			ms.opts.logf(LogWarning, "trySplice: %v", err)
 		}
 
 		sz := req.flatDataSize()
@@ -40,3 +44,119 @@ func (ms *Server) systemWrite(req *request, header []byte) Status {
 	}
 	return ToStatus(err)
 }
+
+const (
+	// _IOW(229, 1, struct fuse_backing_map)
+	_FUSE_DEV_IOC_BACKING_OPEN = 0x4010e501
+	// _IOW(229, 2, uint32_t)
+	_FUSE_DEV_IOC_BACKING_CLOSE = 0x4004e502
+)
+
+// RegisterBackingFd registers a file descriptor as backing file for
+// FUSE passthrough. The returned ID can be used in
+// OpenOut.BackingId together with FOPEN_PASSTHROUGH. It returns
+// ENOSYS if passthrough was not negotiated with the kernel.
+func (ms *Server) RegisterBackingFd(m *BackingMap) (int32, syscall.Errno) {
+	if ms.KernelSettings().Flags64()&CAP_PASSTHROUGH == 0 {
+		return 0, syscall.ENOSYS
+	}
+	id, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(ms.mountFd),
+		_FUSE_DEV_IOC_BACKING_OPEN, uintptr(unsafe.Pointer(m)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int32(id), 0
+}
+
+// UnregisterBackingFd releases a backing ID obtained from
+// RegisterBackingFd. Files opened with it keep working.
+func (ms *Server) UnregisterBackingFd(id int32) syscall.Errno {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(ms.mountFd),
+		_FUSE_DEV_IOC_BACKING_CLOSE, uintptr(unsafe.Pointer(&id)))
+	return errno
+}
+
+// setupWakeup puts the device in non-blocking mode, and creates the
+// pipe that ExportFd uses to wake up readers waiting in waitDevice.
+// It is only called for MountOptions.EnableExport.
+func (ms *Server) setupWakeup() error {
+	if err := syscall.Pipe2(ms.wakeupFds[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(ms.mountFd, true); err != nil {
+		ms.closeWakeup()
+		return err
+	}
+	return nil
+}
+
+func (ms *Server) closeWakeup() {
+	for i, fd := range ms.wakeupFds {
+		if fd >= 0 {
+			syscall.Close(fd)
+			ms.wakeupFds[i] = -1
+		}
+	}
+}
+
+// waitDevice waits until the device can be read, or ExportFd was
+// called, in which case it returns ENODEV.
+func (ms *Server) waitDevice() error {
+	fds := []unix.PollFd{
+		{Fd: int32(ms.mountFd), Events: unix.POLLIN},
+		{Fd: int32(ms.wakeupFds[0]), Events: unix.POLLIN},
+	}
+	err := handleEINTR(func() error {
+		_, err := unix.Poll(fds, -1)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if fds[1].Revents != 0 {
+		return syscall.ENODEV
+	}
+	return nil
+}
+
+// ExportFd stops the server, and returns a duplicate of the FUSE
+// device descriptor, so the mount can be handed over to another
+// process without unmounting it. See "Handing over a mount" in the
+// package documentation.
+//
+// ExportFd requires MountOptions.EnableExport, and must be called
+// while Serve runs. It waits for the requests that were already read
+// to be answered; requests that arrive later stay queued in the
+// kernel until the next server reads them. Serve then returns, but
+// the mount is left intact, and Unmount does nothing. The returned
+// descriptor is in blocking mode, and close-on-exec.
+func (ms *Server) ExportFd() (int, error) {
+	if ms.conn != nil {
+		return -1, errors.New("ExportFd: server has no FUSE device")
+	}
+	if !ms.opts.EnableExport {
+		return -1, errors.New("ExportFd: MountOptions.EnableExport is not set")
+	}
+	if !atomic.CompareAndSwapInt32(&ms.exported, 0, 1) {
+		return -1, errors.New("ExportFd: already exported")
+	}
+	fd, err := syscall.Dup(ms.mountFd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(fd)
+
+	if _, err := syscall.Write(ms.wakeupFds[1], []byte{0}); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	ms.loops.Wait()
+	ms.handling.Wait()
+
+	if err := syscall.SetNonblock(fd, false); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	ms.mountPoint = ""
+	return fd, nil
+}
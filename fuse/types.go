@@ -73,6 +73,9 @@ const (
 
 	// EROFS Read-only file system
 	EROFS = Status(syscall.EROFS)
+
+	// ENOTTY Inappropriate ioctl for device
+	ENOTTY = Status(syscall.ENOTTY)
 )
 
 type ForgetIn struct {
@@ -137,6 +140,10 @@ const ( // SetAttrIn.Valid
 	FATTR_MTIME_NOW = (1 << 8)
 	FATTR_LOCKOWNER = (1 << 9)
 	FATTR_CTIME     = (1 << 10)
+
+	// FATTR_KILL_SUIDGID is set on truncates by a caller that
+	// lacks CAP_FSETID, if CAP_HANDLE_KILLPRIV_V2 was negotiated.
+	FATTR_KILL_SUIDGID = (1 << 11)
 )
 
 type SetAttrInCommon struct {
@@ -233,7 +240,13 @@ func (s *SetAttrInCommon) GetCTime() (time.Time, bool) {
 	return t, false
 }
 
-const RELEASE_FLUSH = (1 << 0)
+const (
+	RELEASE_FLUSH = (1 << 0)
+
+	// RELEASE_FLOCK_UNLOCK asks to drop the flock(2) locks of
+	// ReleaseIn.LockOwner.
+	RELEASE_FLOCK_UNLOCK = (1 << 1)
+)
 
 type ReleaseIn struct {
 	InHeader
@@ -246,22 +259,69 @@ type ReleaseIn struct {
 type OpenIn struct {
 	InHeader
 	Flags uint32
-	Mode  uint32
+
+	// Mode holds the OPEN_* flags of the kernel's open_flags.
+	Mode uint32
 }
 
 const (
-	// OpenOut.Flags
-	FOPEN_DIRECT_IO   = (1 << 0)
-	FOPEN_KEEP_CACHE  = (1 << 1)
+	// OPEN_KILL_SUIDGID is set in OpenIn.Mode and
+	// CreateIn.OpenFlags for O_TRUNC opens by a caller that lacks
+	// CAP_FSETID, if CAP_HANDLE_KILLPRIV_V2 was negotiated.
+	OPEN_KILL_SUIDGID = (1 << 0)
+)
+
+// OpenOut.Flags. These are the only caching controls for a single
+// open file; the FUSE protocol has no per-file readahead setting (see
+// MountOptions.MaxReadAhead).
+const (
+	// FOPEN_DIRECT_IO bypasses the page cache: reads and writes
+	// are passed on with the size the application used, without
+	// readahead. Useful for random access, or for files whose
+	// size is not known up front.
+	FOPEN_DIRECT_IO = (1 << 0)
+
+	// FOPEN_KEEP_CACHE keeps the cached data of the file. If
+	// unset, the cache is dropped when the file is opened.
+	FOPEN_KEEP_CACHE = (1 << 1)
+
+	// FOPEN_NONSEEKABLE makes lseek(2) fail with ESPIPE.
 	FOPEN_NONSEEKABLE = (1 << 2)
-	FOPEN_CACHE_DIR   = (1 << 3)
-	FOPEN_STREAM      = (1 << 4)
+
+	// FOPEN_CACHE_DIR allows caching the directory listing
+	// (protocol 7.28 and up).
+	FOPEN_CACHE_DIR = (1 << 3)
+
+	// FOPEN_STREAM marks the file as a stream without file
+	// position, like a pipe or socket (protocol 7.31 and up).
+	FOPEN_STREAM = (1 << 4)
+
+	// FOPEN_NOFLUSH suppresses FLUSH when the file is closed
+	// (protocol 7.35 and up).
+	FOPEN_NOFLUSH = (1 << 5)
+
+	// FOPEN_PARALLEL_DIRECT_WRITES allows concurrent direct writes
+	// to the file (protocol 7.36 and up).
+	FOPEN_PARALLEL_DIRECT_WRITES = (1 << 6)
+
+	FOPEN_PASSTHROUGH = (1 << 7)
 )
 
 type OpenOut struct {
 	Fh        uint64
 	OpenFlags uint32
-	Padding   uint32
+
+	// BackingId is the ID returned by Server.RegisterBackingFd,
+	// and is used if OpenFlags has FOPEN_PASSTHROUGH set.
+	BackingId int32
+}
+
+// BackingMap is the argument for registering a backing file
+// descriptor for FUSE passthrough.
+type BackingMap struct {
+	Fd      int32
+	Flags   uint32
+	Padding uint64
 }
 
 // To be set in InitIn/InitOut.Flags.
@@ -299,6 +359,12 @@ const (
 	CAP_CACHE_SYMLINKS      = (1 << 23)
 	CAP_NO_OPENDIR_SUPPORT  = (1 << 24)
 	CAP_EXPLICIT_INVAL_DATA = (1 << 25)
+	CAP_HANDLE_KILLPRIV_V2  = (1 << 28)
+	CAP_INIT_EXT            = (1 << 30)
+
+	// The following are in InitIn.Flags2/InitOut.Flags2, and
+	// given here as bits of InitIn.Flags64().
+	CAP_PASSTHROUGH = (1 << 37)
 )
 
 type InitIn struct {
@@ -308,6 +374,19 @@ type InitIn struct {
 	Minor        uint32
 	MaxReadAhead uint32
 	Flags        uint32
+
+	// The following fields are only sent if Flags has
+	// CAP_INIT_EXT set (protocol 7.36 and up).
+	Flags2 uint32
+	Unused [11]uint32
+}
+
+// Flags64 returns Flags combined with Flags2 as the upper 32 bits.
+func (in *InitIn) Flags64() uint64 {
+	if in.Flags&CAP_INIT_EXT == 0 {
+		return uint64(in.Flags)
+	}
+	return uint64(in.Flags) | uint64(in.Flags2)<<32
 }
 
 type InitOut struct {
@@ -321,7 +400,9 @@ type InitOut struct {
 	TimeGran            uint32
 	MaxPages            uint16
 	Padding             uint16
-	Unused              [8]uint32
+	Flags2              uint32
+	MaxStackDepth       uint32
+	Unused              [6]uint32
 }
 
 type _CuseInitIn struct {
@@ -366,7 +447,7 @@ const (
 	FUSE_IOCTL_RETRY        = (1 << 2)
 )
 
-type _IoctlIn struct {
+type IoctlIn struct {
 	InHeader
 	Fh      uint64
 	Flags   uint32
@@ -376,27 +457,42 @@ type _IoctlIn struct {
 	OutSize uint32
 }
 
-type _IoctlOut struct {
+type IoctlOut struct {
 	Result  int32
 	Flags   uint32
 	InIovs  uint32
 	OutIovs uint32
 }
 
-type _PollIn struct {
+// IoctlIovec describes a buffer in the address space of the process
+// calling ioctl(2). A reply with FUSE_IOCTL_RETRY carries the
+// IoctlIovecs for the input followed by those for the output.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// DEFAULT_POLLMASK is POLLIN|POLLOUT|POLLRDNORM|POLLWRNORM, the
+// events the kernel reports for files that don't support polling.
+const DEFAULT_POLLMASK = 0x1 | 0x4 | 0x40 | 0x100
+
+type PollIn struct {
 	InHeader
-	Fh      uint64
-	Kh      uint64
-	Flags   uint32
-	Padding uint32
+	Fh    uint64
+	Kh    uint64
+	Flags uint32
+
+	// Events holds the requested poll events (protocol 7.21 and
+	// up).
+	Events uint32
 }
 
-type _PollOut struct {
+type PollOut struct {
 	Revents uint32
 	Padding uint32
 }
 
-type _NotifyPollWakeupOut struct {
+type NotifyPollWakeupOut struct {
 	Kh uint64
 }
 
@@ -502,7 +598,7 @@ type NotifyRetrieveIn struct {
 }
 
 const (
-	//	NOTIFY_POLL         = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
+	NOTIFY_POLL           = -1 // notify kernel that a poll waiting for IO on a file handle should wake up
 	NOTIFY_INVAL_INODE    = -2 // notify kernel that an inode should be invalidated
 	NOTIFY_INVAL_ENTRY    = -3 // notify kernel that a directory entry should be invalidated
 	NOTIFY_STORE_CACHE    = -4 // store data into kernel cache of an inode
@@ -543,6 +639,108 @@ type CopyFileRangeIn struct {
 	Flags     uint64
 }
 
+// SyncFsIn is the input for the SYNCFS operation (protocol version
+// 34), sent for syncfs(2).
+type SyncFsIn struct {
+	InHeader
+	Padding uint64
+}
+
+// StatxIn is the input for the STATX operation (protocol version
+// 39). SxFlags carries the AT_STATX_* synchronization flags and
+// SxMask the STATX_* fields requested by the caller.
+type StatxIn struct {
+	InHeader
+	GetattrFlags uint32
+	Reserved     uint32
+	Fh_          uint64
+	SxFlags      uint32
+	SxMask       uint32
+}
+
+// Fh returns the file handle if the kernel supplied one.
+func (in *StatxIn) Fh() uint64 {
+	if in.GetattrFlags&FUSE_GETATTR_FH == 0 {
+		return 0
+	}
+	return in.Fh_
+}
+
+// Masks for Statx.Mask, mirroring STATX_* from <linux/stat.h>.
+const (
+	STATX_TYPE        = 0x1
+	STATX_MODE        = 0x2
+	STATX_NLINK       = 0x4
+	STATX_UID         = 0x8
+	STATX_GID         = 0x10
+	STATX_ATIME       = 0x20
+	STATX_MTIME       = 0x40
+	STATX_CTIME       = 0x80
+	STATX_INO         = 0x100
+	STATX_SIZE        = 0x200
+	STATX_BLOCKS      = 0x400
+	STATX_BASIC_STATS = 0x7ff
+	STATX_BTIME       = 0x800
+)
+
+// Synchronization flags for StatxIn.SxFlags.
+const (
+	AT_STATX_SYNC_TYPE    = 0x6000
+	AT_STATX_SYNC_AS_STAT = 0x0
+	AT_STATX_FORCE_SYNC   = 0x2000
+	AT_STATX_DONT_SYNC    = 0x4000
+)
+
+type SxTime struct {
+	Sec      int64
+	Nsec     uint32
+	Reserved int32
+}
+
+// Statx is the FUSE wire version of struct statx. Mask should only
+// contain the STATX_* bits for fields that were actually filled in.
+type Statx struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	Uid            uint32
+	Gid            uint32
+	Mode           uint16
+	Spare0         uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          SxTime
+	Btime          SxTime
+	Ctime          SxTime
+	Mtime          SxTime
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	Spare2         [14]uint64
+}
+
+type StatxOut struct {
+	AttrValid     uint64
+	AttrValidNsec uint32
+	Flags         uint32
+	Spare         [2]uint64
+	Statx
+}
+
+func (o *StatxOut) Timeout() time.Duration {
+	return time.Duration(uint64(o.AttrValidNsec) + o.AttrValid*1e9)
+}
+
+func (o *StatxOut) SetTimeout(dt time.Duration) {
+	ns := int64(dt)
+	o.AttrValidNsec = uint32(ns % 1e9)
+	o.AttrValid = uint64(ns / 1e9)
+}
+
 // EntryOut holds the result of a (directory,name) lookup.  It has two
 // TTLs, one for the (directory, name) lookup itself, and one for the
 // attributes (eg. size, mode). The entry TTL also applies if the
@@ -647,6 +845,12 @@ const (
 const (
 	WRITE_CACHE     = (1 << 0)
 	WRITE_LOCKOWNER = (1 << 1)
+
+	// WRITE_KILL_SUIDGID is set by the kernel if the writer lacks
+	// CAP_FSETID and CAP_HANDLE_KILLPRIV_V2 was negotiated, so
+	// the file system should clear the setuid and setgid bits of
+	// the file.
+	WRITE_KILL_SUIDGID = (1 << 2)
 )
 
 type FallocateIn struct {
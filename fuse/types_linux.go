@@ -74,8 +74,10 @@ type CreateIn struct {
 	Mode uint32
 
 	// Umask used for this create call.
-	Umask   uint32
-	Padding uint32
+	Umask uint32
+
+	// OpenFlags holds the OPEN_* flags.
+	OpenFlags uint32
 }
 
 type MknodIn struct {
@@ -3,7 +3,7 @@ module github.com/hanwen/go-fuse/v2
 require (
 	github.com/kylelemons/godebug v0.0.0-20170820004349-d65d576e9348
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
-	golang.org/x/sys v0.0.0-20180830151530-49385e6e1522
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 )
 
 go 1.13